@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+
+	"weka-deployment/common"
+	"weka-deployment/functions/debug"
+	"weka-deployment/functions/reset"
+	"weka-deployment/functions/resize"
+	"weka-deployment/functions/status"
+	"weka-deployment/functions/upgrade"
+	"weka-deployment/functions/vmss"
+)
+
+// ErrorResponse is the error returned by a function, the functions reply errors as {"error": "..."}
+type ErrorResponse struct {
+	Function   string
+	StatusCode int
+	Message    string
+}
+
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("%s failed (%d): %s", e.Function, e.StatusCode, e.Message)
+}
+
+// Client calls the function app endpoints, either through the functions host or on a local server (see --local)
+type Client struct {
+	// BaseUrl is the url the function names are appended to, e.g. https://<function app>.azurewebsites.net/api/
+	BaseUrl     string
+	FunctionKey string
+	HttpClient  *http.Client
+}
+
+func New(baseUrl, functionKey string) *Client {
+	if !strings.HasSuffix(baseUrl, "/") {
+		baseUrl += "/"
+	}
+	return &Client{
+		BaseUrl:     baseUrl,
+		FunctionKey: functionKey,
+		HttpClient:  &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// FunctionAppUrl returns the base url of the functions of a function app
+func FunctionAppUrl(functionAppName string) string {
+	return fmt.Sprintf("https://%s.azurewebsites.net/api/", functionAppName)
+}
+
+// endpoint binds a function to the request struct decoded by its handler and to its response type
+type endpoint[Req, Resp any] struct {
+	function string
+}
+
+func (e endpoint[Req, Resp]) call(ctx context.Context, c *Client, req Req) (resp Resp, err error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	functionUrl := c.BaseUrl + e.function
+	if c.FunctionKey != "" {
+		functionUrl += "?code=" + url.QueryEscape(c.FunctionKey)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, functionUrl, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.HttpClient.Do(httpReq)
+	if err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return
+	}
+
+	if errResp := decodeError(data); errResp != "" || httpResp.StatusCode >= http.StatusBadRequest {
+		if errResp == "" {
+			errResp = strings.TrimSpace(string(data))
+		}
+		err = &ErrorResponse{Function: e.function, StatusCode: httpResp.StatusCode, Message: errResp}
+		return
+	}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		err = fmt.Errorf("cannot decode %s response: %v", e.function, err)
+	}
+	return
+}
+
+// decodeError returns the message of an error response, empty for other responses
+func decodeError(data []byte) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || len(fields) != 1 {
+		return ""
+	}
+	var message string
+	if err := json.Unmarshal(fields["error"], &message); err != nil {
+		return ""
+	}
+	return message
+}
+
+var (
+	statusEndpoint         = endpoint[status.StatusRequest, protocol.ClusterStatus]{"status"}
+	progressEndpoint       = endpoint[status.StatusRequest, protocol.Reports]{"status"}
+	vmssEndpoint           = endpoint[status.StatusRequest, common.VMSSStateVerbose]{"status"}
+	operationsEndpoint     = endpoint[status.StatusRequest, common.Operations]{"status"}
+	upgradeStatusEndpoint  = endpoint[status.StatusRequest, common.RollingUpgrade]{"status"}
+	migrationEndpoint      = endpoint[status.StatusRequest, common.SkuMigration]{"status"}
+	clusterizationEndpoint = endpoint[status.StatusRequest, common.ClusterizationWatch]{"status"}
+	auditEndpoint          = endpoint[status.StatusRequest, []common.AuditEntry]{"status"}
+	resizeEndpoint         = endpoint[resize.ResizeRequest, string]{"resize"}
+	upgradeEndpoint        = endpoint[upgrade.UpgradeRequest, common.RollingUpgrade]{"upgrade"}
+	vmssPlansEndpoint      = endpoint[vmss.VmssRequest, common.VmssPlans]{"vmss"}
+	vmssPlanEndpoint       = endpoint[vmss.VmssRequest, common.VmssPlan]{"vmss"}
+	resetEndpoint          = endpoint[reset.ResetRequest, reset.ResetResponse]{"reset"}
+	debugEndpoint          = endpoint[debug.DebugRequest, json.RawMessage]{"debug"}
+	fetchEndpoint          = endpoint[protocol.FetchRequest, protocol.HostGroupInfoResponse]{"fetch"}
+)
+
+// Status returns the cluster status, protocolName is empty for the backends cluster
+func (c *Client) Status(ctx context.Context, protocolName string) (protocol.ClusterStatus, error) {
+	return statusEndpoint.call(ctx, c, status.StatusRequest{Type: "status", Protocol: protocolName})
+}
+
+// Progress returns the clusterization progress and the reports of the hosts
+func (c *Client) Progress(ctx context.Context, protocolName string) (protocol.Reports, error) {
+	return progressEndpoint.call(ctx, c, status.StatusRequest{Type: "progress", Protocol: protocolName})
+}
+
+// Vmss returns the target and current scale set configs, extended includes the current config
+func (c *Client) Vmss(ctx context.Context, protocolName string, extended bool) (common.VMSSStateVerbose, error) {
+	statusType := "vmss"
+	if extended {
+		statusType = "vmss-extended"
+	}
+	return vmssEndpoint.call(ctx, c, status.StatusRequest{Type: statusType, Protocol: protocolName})
+}
+
+// Operations returns the pending and failed long-running Azure operations
+func (c *Client) Operations(ctx context.Context, protocolName string) (common.Operations, error) {
+	return operationsEndpoint.call(ctx, c, status.StatusRequest{Type: "operations", Protocol: protocolName})
+}
+
+// RollingUpgrade returns the progress of the rolling upgrade of the backends
+func (c *Client) RollingUpgrade(ctx context.Context) (common.RollingUpgrade, error) {
+	return upgradeStatusEndpoint.call(ctx, c, status.StatusRequest{Type: "upgrade"})
+}
+
+// PauseUpgrade pauses the rolling upgrade, the instance being replaced is not affected
+func (c *Client) PauseUpgrade(ctx context.Context) (common.RollingUpgrade, error) {
+	return upgradeEndpoint.call(ctx, c, upgrade.UpgradeRequest{Action: "pause"})
+}
+
+// ResumeUpgrade resumes a rolling upgrade paused by PauseUpgrade or by itself
+func (c *Client) ResumeUpgrade(ctx context.Context) (common.RollingUpgrade, error) {
+	return upgradeEndpoint.call(ctx, c, upgrade.UpgradeRequest{Action: "resume"})
+}
+
+// SkuMigration returns the last sku migration of the backends
+func (c *Client) SkuMigration(ctx context.Context) (common.SkuMigration, error) {
+	return migrationEndpoint.call(ctx, c, status.StatusRequest{Type: "migration"})
+}
+
+// VmssPlans returns the vmss config change plans, oldest first
+func (c *Client) VmssPlans(ctx context.Context) (common.VmssPlans, error) {
+	return vmssPlansEndpoint.call(ctx, c, vmss.VmssRequest{Action: "list"})
+}
+
+// ApproveVmssPlan approves the pending vmss plan, scale_up applies it on its next run
+func (c *Client) ApproveVmssPlan(ctx context.Context, id string) (common.VmssPlan, error) {
+	return vmssPlanEndpoint.call(ctx, c, vmss.VmssRequest{Action: "approve", Id: id})
+}
+
+// RejectVmssPlan rejects the pending vmss plan, the config change is not applied
+func (c *Client) RejectVmssPlan(ctx context.Context, id, reason string) (common.VmssPlan, error) {
+	return vmssPlanEndpoint.call(ctx, c, vmss.VmssRequest{Action: "reject", Id: id, Reason: reason})
+}
+
+// Clusterization returns the clusterization instance followed by the scale up watchdog and the ones it replaced
+func (c *Client) Clusterization(ctx context.Context) (common.ClusterizationWatch, error) {
+	return clusterizationEndpoint.call(ctx, c, status.StatusRequest{Type: "clusterization"})
+}
+
+// Audit returns the audit log of the administrative actions, newest first
+func (c *Client) Audit(ctx context.Context) ([]common.AuditEntry, error) {
+	return auditEndpoint.call(ctx, c, status.StatusRequest{Type: "audit"})
+}
+
+// Reset clears the state of a failed initial deployment, mode is soft or hard (the scale set is deleted too),
+// force is required once the cluster is clusterized
+func (c *Client) Reset(ctx context.Context, mode string, force bool, reason string) (reset.ResetResponse, error) {
+	return resetEndpoint.call(ctx, c, reset.ResetRequest{Mode: mode, Force: force, Reason: reason})
+}
+
+// Resize sets the desired size of the cluster
+func (c *Client) Resize(ctx context.Context, size int, protocolName string) (string, error) {
+	req := resize.ResizeRequest{Value: &size}
+	if protocolName != "" {
+		req.Protocol = &protocolName
+	}
+	return resizeEndpoint.call(ctx, c, req)
+}
+
+// Debug calls a /debug function, the result depends on the function
+func (c *Client) Debug(ctx context.Context, function string) (json.RawMessage, error) {
+	result, err := debugEndpoint.call(ctx, c, debug.DebugRequest{Function: &function})
+	if err == nil && isUnsupported(result) {
+		err = errors.New("unsupported debug function " + function)
+	}
+	return result, err
+}
+
+func isUnsupported(result json.RawMessage) bool {
+	var message string
+	return json.Unmarshal(result, &message) == nil && message == "unsupported function"
+}
+
+// Fetch returns the cluster hosts, as fetched by the scale down
+func (c *Client) Fetch(ctx context.Context, showAdminPassword bool) (protocol.HostGroupInfoResponse, error) {
+	return fetchEndpoint.call(ctx, c, protocol.FetchRequest{ShowAdminPassword: showAdminPassword})
+}
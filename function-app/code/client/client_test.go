@@ -0,0 +1,49 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"weka-deployment/functions/status"
+)
+
+func TestCall(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" || r.URL.Query().Get("code") != "key" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req status.StatusRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch req.Protocol {
+		case "":
+			_, _ = w.Write([]byte(`{"initial_size":6,"desired_size":8,"clusterized":true,"weka_status":{"io_status":"STARTED"}}`))
+		case "nfs":
+			_, _ = w.Write([]byte(`{"error":"no nfs state"}`))
+		}
+	}))
+	defer server.Close()
+
+	c := New(server.URL, "key")
+	clusterStatus, err := c.Status(t.Context(), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if clusterStatus.DesiredSize != 8 || !clusterStatus.Clusterized || clusterStatus.WekaStatus.IoStatus != "STARTED" {
+		t.Fatalf("unexpected status %+v", clusterStatus)
+	}
+
+	_, err = c.Status(t.Context(), "nfs")
+	var errResp *ErrorResponse
+	if !errors.As(err, &errResp) || errResp.Message != "no nfs state" {
+		t.Fatalf("expected the function error, got %v", err)
+	}
+
+	_, err = New(server.URL, "wrong").Status(t.Context(), "")
+	if !errors.As(err, &errResp) || errResp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+// weka-azure is an operator cli for the weka function app
+//
+//	weka-azure [global flags] status
+//	weka-azure [global flags] progress [--watch] [--interval 10s]
+//	weka-azure [global flags] resize --size N
+//	weka-azure [global flags] reset --mode soft|hard [--force] [--reason TEXT]
+//	weka-azure [global flags] vmss [diff]
+//	weka-azure [global flags] vmss plans
+//	weka-azure [global flags] vmss approve|reject <id> [reason]
+//	weka-azure [global flags] operations
+//	weka-azure [global flags] upgrade [pause|resume]
+//	weka-azure [global flags] migration
+//	weka-azure [global flags] debug <function>
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"weka-deployment/client"
+	"weka-deployment/common"
+)
+
+const usage = `usage: weka-azure [global flags] <command> [command flags]
+
+commands:
+  status                  show the cluster status
+  progress                show the clusterization progress, --watch to follow it
+  resize --size N         set the desired cluster size
+  reset --mode soft|hard  restart a failed initial deployment, hard deletes the scale set, --force once clusterized
+  vmss [diff]             show the scale set config, diff shows the pending changes
+  vmss plans              show the config change plans, see VMSS_UPDATE_APPROVAL_REQUIRED
+  vmss approve|reject ID  approve or reject the pending config change plan, reject takes a reason
+  operations              show the pending and failed Azure operations
+  upgrade [pause|resume]  show the rolling upgrade of the backends, pause or resume it
+  migration               show the sku migration of the backends
+  debug <function>        call a debug function, e.g. instances, interfaces, lock, config
+
+global flags:
+`
+
+type globalOptions struct {
+	url          string
+	functionApp  string
+	functionKey  string
+	output       string
+	protocolName string
+}
+
+func main() {
+	opts := globalOptions{}
+	flags := flag.NewFlagSet("weka-azure", flag.ExitOnError)
+	flags.StringVar(&opts.url, "url", os.Getenv("WEKA_FUNCTION_APP_URL"), "base url of the functions, e.g. http://localhost:8080/ (env WEKA_FUNCTION_APP_URL)")
+	flags.StringVar(&opts.functionApp, "function-app", "", "function app name, used when --url is not set")
+	flags.StringVar(&opts.functionKey, "function-key", os.Getenv("WEKA_FUNCTION_KEY"), "function app key (env WEKA_FUNCTION_KEY)")
+	flags.StringVar(&opts.output, "output", "table", "output format: table or json")
+	flags.StringVar(&opts.output, "o", "table", "shorthand for --output")
+	flags.StringVar(&opts.protocolName, "protocol", "", "protocol gateways cluster, e.g. nfs (default: the backends cluster)")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(os.Args[1:])
+
+	if err := run(opts, flags.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		if errors.Is(err, errUsage) {
+			flags.Usage()
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid usage")
+
+func run(opts globalOptions, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	if opts.output != "table" && opts.output != "json" {
+		return fmt.Errorf("%w: unsupported output format %s", errUsage, opts.output)
+	}
+
+	baseUrl := opts.url
+	if baseUrl == "" {
+		if opts.functionApp == "" {
+			return fmt.Errorf("%w: either --url or --function-app is required", errUsage)
+		}
+		baseUrl = client.FunctionAppUrl(opts.functionApp)
+	}
+	c := client.New(baseUrl, opts.functionKey)
+	out := newPrinter(os.Stdout, opts.output)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "status":
+		return runStatus(ctx, c, out, opts)
+	case "progress":
+		return runProgress(ctx, c, out, opts, args)
+	case "resize":
+		return runResize(ctx, c, out, opts, args)
+	case "reset":
+		return runReset(ctx, c, out, args)
+	case "vmss":
+		return runVmss(ctx, c, out, opts, args)
+	case "operations":
+		return runOperations(ctx, c, out, opts)
+	case "upgrade":
+		return runUpgrade(ctx, c, out, args)
+	case "migration":
+		return runMigration(ctx, c, out)
+	case "debug":
+		return runDebug(ctx, c, out, args)
+	default:
+		return fmt.Errorf("%w: unknown command %s", errUsage, command)
+	}
+}
+
+func runStatus(ctx context.Context, c *client.Client, out *printer, opts globalOptions) error {
+	status, err := c.Status(ctx, opts.protocolName)
+	if err != nil {
+		return err
+	}
+	if out.json() {
+		return out.printJson(status)
+	}
+	out.table([]string{"INITIAL SIZE", "DESIRED SIZE", "CLUSTERIZED", "IO STATUS"}, [][]string{{
+		strconv.Itoa(status.InitialSize),
+		strconv.Itoa(status.DesiredSize),
+		strconv.FormatBool(status.Clusterized),
+		status.WekaStatus.IoStatus,
+	}})
+	return nil
+}
+
+func runProgress(ctx context.Context, c *client.Client, out *printer, opts globalOptions, args []string) error {
+	flags := flag.NewFlagSet("progress", flag.ContinueOnError)
+	watch := flags.Bool("watch", false, "refresh the progress until the cluster is clusterized")
+	interval := flags.Duration("interval", 10*time.Second, "refresh interval of --watch")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	for {
+		reports, err := c.Progress(ctx, opts.protocolName)
+		if err != nil {
+			return err
+		}
+		if out.json() {
+			if err = out.printJson(reports); err != nil {
+				return err
+			}
+		} else {
+			if *watch {
+				out.clear()
+			}
+			printProgress(out, reports)
+		}
+		if !*watch || reports.Summary.Clusterized {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+func runResize(ctx context.Context, c *client.Client, out *printer, opts globalOptions, args []string) error {
+	flags := flag.NewFlagSet("resize", flag.ContinueOnError)
+	size := flags.Int("size", -1, "desired cluster size")
+	flags.StringVar(&opts.protocolName, "protocol", opts.protocolName, "protocol gateways cluster, e.g. nfs")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if *size < 0 {
+		return fmt.Errorf("%w: resize requires --size", errUsage)
+	}
+
+	result, err := c.Resize(ctx, *size, opts.protocolName)
+	if err != nil {
+		return err
+	}
+	if out.json() {
+		return out.printJson(map[string]string{"result": result})
+	}
+	out.println(result)
+	return nil
+}
+
+func runReset(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	flags := flag.NewFlagSet("reset", flag.ContinueOnError)
+	mode := flags.String("mode", "", "soft keeps the scale set, hard deletes it")
+	force := flags.Bool("force", false, "reset a clusterized cluster")
+	reason := flags.String("reason", "", "reason recorded in the audit log")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if *mode != "soft" && *mode != "hard" {
+		return fmt.Errorf("%w: reset requires --mode soft or hard", errUsage)
+	}
+
+	result, err := c.Reset(ctx, *mode, *force, *reason)
+	if err != nil {
+		return err
+	}
+	if out.json() {
+		return out.printJson(result)
+	}
+	out.println(result.Message)
+	return nil
+}
+
+func runVmss(ctx context.Context, c *client.Client, out *printer, opts globalOptions, args []string) error {
+	if len(args) > 0 && args[0] != "diff" {
+		return runVmssPlans(ctx, c, out, args)
+	}
+	diff := len(args) > 0
+
+	vmssState, err := c.Vmss(ctx, opts.protocolName, true)
+	if err != nil {
+		return err
+	}
+	if diff {
+		return printVmssDiff(out, vmssState)
+	}
+	if out.json() {
+		return out.printJson(vmssState)
+	}
+	out.table([]string{"VMSS", "TARGET CONFIG HASH", "CURRENT CONFIG HASH", "NEED UPDATE"}, [][]string{{
+		vmssState.VmssName,
+		vmssState.TargetConfigHash,
+		vmssState.CurrentConfigHash,
+		strconv.FormatBool(vmssState.NeedUpdate),
+	}})
+	if plan := vmssState.PendingPlan; plan != nil {
+		out.println()
+		out.println(fmt.Sprintf("plan %s waits for approval (risk: %s), see vmss plans", plan.Id, plan.Risk))
+	}
+	return nil
+}
+
+func runVmssPlans(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	switch args[0] {
+	case "plans":
+		plans, err := c.VmssPlans(ctx)
+		if err != nil {
+			return err
+		}
+		if out.json() {
+			return out.printJson(plans)
+		}
+		printVmssPlans(out, plans)
+		return nil
+	case "approve", "reject":
+	default:
+		return fmt.Errorf("%w: unknown vmss command %s", errUsage, args[0])
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("%w: vmss %s requires a plan id", errUsage, args[0])
+	}
+	var plan common.VmssPlan
+	var err error
+	if args[0] == "approve" {
+		plan, err = c.ApproveVmssPlan(ctx, args[1])
+	} else {
+		plan, err = c.RejectVmssPlan(ctx, args[1], strings.Join(args[2:], " "))
+	}
+	if err != nil {
+		return err
+	}
+	if out.json() {
+		return out.printJson(plan)
+	}
+	out.println(fmt.Sprintf("vmss plan %s is %s", plan.Id, plan.Status))
+	return nil
+}
+
+func runOperations(ctx context.Context, c *client.Client, out *printer, opts globalOptions) error {
+	operations, err := c.Operations(ctx, opts.protocolName)
+	if err != nil {
+		return err
+	}
+	if out.json() {
+		return out.printJson(operations)
+	}
+	printOperations(out, operations)
+	return nil
+}
+
+func runUpgrade(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	var upgrade common.RollingUpgrade
+	var err error
+	switch {
+	case len(args) == 0:
+		upgrade, err = c.RollingUpgrade(ctx)
+	case args[0] == "pause":
+		upgrade, err = c.PauseUpgrade(ctx)
+	case args[0] == "resume":
+		upgrade, err = c.ResumeUpgrade(ctx)
+	default:
+		return fmt.Errorf("%w: unknown upgrade command %s", errUsage, args[0])
+	}
+	if err != nil {
+		return err
+	}
+	if out.json() {
+		return out.printJson(upgrade)
+	}
+	printRollingUpgrade(out, upgrade)
+	return nil
+}
+
+func runMigration(ctx context.Context, c *client.Client, out *printer) error {
+	migration, err := c.SkuMigration(ctx)
+	if err != nil {
+		return err
+	}
+	if out.json() {
+		return out.printJson(migration)
+	}
+	printSkuMigration(out, migration)
+	return nil
+}
+
+func runDebug(ctx context.Context, c *client.Client, out *printer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: debug requires a function name", errUsage)
+	}
+	result, err := c.Debug(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	// debug results have no fixed shape, they are always printed as json
+	return out.printJson(result)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+
+	"weka-deployment/common"
+)
+
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+func newPrinter(w io.Writer, format string) *printer {
+	return &printer{w: w, format: format}
+}
+
+func (p *printer) json() bool {
+	return p.format == "json"
+}
+
+func (p *printer) printJson(v any) error {
+	encoder := json.NewEncoder(p.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func (p *printer) println(a ...any) {
+	fmt.Fprintln(p.w, a...)
+}
+
+// clear clears the terminal before a refresh of a watched table
+func (p *printer) clear() {
+	fmt.Fprint(p.w, "\033[H\033[2J")
+}
+
+func (p *printer) table(header []string, rows [][]string) {
+	tw := tabwriter.NewWriter(p.w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	tw.Flush()
+}
+
+func lastMessage(messages []string) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	return messages[len(messages)-1]
+}
+
+func printProgress(p *printer, reports protocol.Reports) {
+	hosts := make(map[string]bool)
+	for host := range reports.Progress {
+		hosts[host] = true
+	}
+	for host := range reports.Errors {
+		hosts[host] = true
+	}
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	rows := make([][]string, 0, len(names))
+	for _, host := range names {
+		rows = append(rows, []string{host, lastMessage(reports.Progress[host]), strconv.Itoa(len(reports.Errors[host]))})
+	}
+	p.table([]string{"HOST", "LAST PROGRESS", "ERRORS"}, rows)
+
+	summary := reports.Summary
+	p.println()
+	p.println(fmt.Sprintf("ready for clusterization: %d/%d, in progress: %d, stopped: %d, clusterized: %t",
+		summary.ReadyForClusterization, summary.ClusterizationTarget, summary.InProgress, summary.Stopped, summary.Clusterized))
+	if summary.ClusterizationInstance != "" {
+		p.println("clusterization instance:", summary.ClusterizationInstance)
+	}
+}
+
+func printVmssDiff(p *printer, vmssState common.VMSSStateVerbose) error {
+	diff := ""
+	if vmssState.CurrentConfig != nil {
+		current, target := *vmssState.CurrentConfig, vmssState.TargetConfig
+		// VmssConfigsDiff resets the hash tags in place
+		current.Tags, target.Tags = copyTags(current.Tags), copyTags(target.Tags)
+		diff = common.VmssConfigsDiff(current, target)
+	}
+
+	if p.json() {
+		return p.printJson(map[string]any{
+			"vmss_name":   vmssState.VmssName,
+			"exists":      vmssState.CurrentConfig != nil,
+			"need_update": vmssState.NeedUpdate,
+			"diff":        diff,
+		})
+	}
+	switch {
+	case vmssState.CurrentConfig == nil:
+		p.println(fmt.Sprintf("vmss %s does not exist yet", vmssState.VmssName))
+	case diff == "":
+		p.println(fmt.Sprintf("vmss %s is up to date", vmssState.VmssName))
+	default:
+		p.println(fmt.Sprintf("vmss %s config changes (-current +target):", vmssState.VmssName))
+		p.println(diff)
+	}
+	return nil
+}
+
+func printVmssPlans(p *printer, plans common.VmssPlans) {
+	rows := make([][]string, 0, len(plans.Plans))
+	for _, plan := range plans.Plans {
+		rows = append(rows, []string{
+			plan.Id,
+			plan.From,
+			string(plan.Status),
+			string(plan.Risk),
+			strings.Join(plan.ReplacementFields, ","),
+			plan.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	p.table([]string{"ID", "FROM", "STATUS", "RISK", "REPLACEMENT FIELDS", "CREATED AT"}, rows)
+
+	if pending := plans.Pending(); pending != nil {
+		p.println()
+		p.println(fmt.Sprintf("pending plan %s:", pending.Id))
+		for _, summary := range pending.RiskSummary {
+			p.println("  - " + summary)
+		}
+		p.println(pending.Diff)
+	}
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	return copied
+}
+
+func printOperations(p *printer, operations common.Operations) {
+	all := make([]common.Operation, 0, len(operations.Pending)+len(operations.Failed))
+	all = append(append(all, operations.Pending...), operations.Failed...)
+	rows := make([][]string, 0, len(all))
+	for _, operation := range all {
+		rows = append(rows, []string{
+			operation.Id,
+			string(operation.Kind),
+			operation.Resource,
+			string(operation.Status),
+			operation.StartedAt.Format(time.RFC3339),
+			operation.Error,
+		})
+	}
+	p.table([]string{"ID", "KIND", "RESOURCE", "STATUS", "STARTED AT", "ERROR"}, rows)
+}
+
+func printRollingUpgrade(p *printer, upgrade common.RollingUpgrade) {
+	if upgrade.To == "" {
+		p.println("no rolling upgrade")
+		return
+	}
+	phase := string(upgrade.Phase)
+	if upgrade.Paused {
+		phase += " (paused)"
+	}
+	p.table([]string{"TO CONFIG HASH", "PHASE", "INSTANCE", "REPLACED", "REMAINING", "STARTED AT"}, [][]string{{
+		upgrade.To,
+		phase,
+		upgrade.Instance,
+		strconv.Itoa(len(upgrade.Replaced)),
+		strconv.Itoa(upgrade.Remaining),
+		upgrade.StartedAt.Format(time.RFC3339),
+	}})
+	if upgrade.PauseReason != "" {
+		p.println("paused: " + upgrade.PauseReason)
+	}
+}
+
+func printSkuMigration(p *printer, migration common.SkuMigration) {
+	if migration.Target == "" {
+		p.println("no sku migration")
+		return
+	}
+	p.table([]string{"SOURCE", "TARGET", "SKU", "PHASE", "REMOVED", "STARTED AT"}, [][]string{{
+		migration.Source,
+		migration.Target,
+		migration.FromSku + " -> " + migration.ToSku,
+		string(migration.Phase),
+		strconv.Itoa(len(migration.Removed)),
+		migration.StartedAt.Format(time.RFC3339),
+	}})
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const auditPrefix = "audit"
+
+// AuditEntry records an administrative action on the deployment, including the refused ones
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"`
+	InvocationId string    `json:"invocation_id,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	// Details are the parameters and the outcome of the action
+	Details map[string]any `json:"details,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// the audit log is an append-only json lines object next to the state, it is not affected by state resets
+func auditParams(stateParams BlobObjParams) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      path.Join(auditPrefix, stateParams.BlobName+".jsonl"),
+	}
+}
+
+// AppendAuditEntry adds the entry to the audit log, the time and invocation id are set from ctx when missing
+func AppendAuditEntry(ctx context.Context, store StateStore, stateParams BlobObjParams, entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	if entry.InvocationId == "" {
+		entry.InvocationId = InvocationFromCtx(ctx).InvocationId
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return store.Append(ctx, auditParams(stateParams), append(data, '\n'))
+}
+
+// GetAuditEntries returns the audit log, newest entries first
+func GetAuditEntries(ctx context.Context, store StateStore, stateParams BlobObjParams) (entries []AuditEntry, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	entries = []AuditEntry{}
+
+	data, _, err := store.Read(ctx, auditParams(stateParams))
+	if errors.Is(err, ErrStateObjectNotFound) {
+		return entries, nil
+	}
+	if err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err2 := json.Unmarshal(scanner.Bytes(), &entry); err2 != nil {
+			logger.Warn().Err(err2).Msg("skipping malformed audit entry")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	slices.Reverse(entries)
+	err = scanner.Err()
+	return
+}
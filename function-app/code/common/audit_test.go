@@ -0,0 +1,33 @@
+package common
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAuditEntries(t *testing.T) {
+	ctx := ContextWithInvocation(context.TODO(), InvocationInfo{FunctionName: "reset", InvocationId: "invocation-1"})
+	store := NewMemoryStateStore()
+	stateParams := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+
+	entries, err := GetAuditEntries(ctx, store, stateParams)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected an empty audit log, got %v, %v", entries, err)
+	}
+
+	for _, reason := range []string{"first", "second"} {
+		if err := AppendAuditEntry(ctx, store, stateParams, AuditEntry{Action: "reset", Reason: reason}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err = GetAuditEntries(ctx, store, stateParams)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %v, %v", entries, err)
+	}
+	if entries[0].Reason != "second" || entries[1].Reason != "first" {
+		t.Errorf("expected the newest entry first, got %s, %s", entries[0].Reason, entries[1].Reason)
+	}
+	if entries[0].InvocationId != "invocation-1" || entries[0].Time.IsZero() {
+		t.Errorf("expected the invocation id and time to be set, got %+v", entries[0])
+	}
+}
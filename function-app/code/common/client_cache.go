@@ -0,0 +1,149 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/appendblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// ClientCacheStats are the process-wide client cache counters, as shown by the debug function
+type ClientCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Clients int   `json:"clients"`
+}
+
+type clientCacheKey struct {
+	kind string
+	// subscription id, key vault uri or storage url the client is bound to
+	scope string
+}
+
+// clientCache keeps the managed identity credential and the SDK clients for the lifetime of the process.
+// The clients share the credential, so its token cache is used across helpers and invocations instead of
+// requesting a token for every new client. SDK clients are safe for concurrent use.
+type clientCache struct {
+	mu         sync.Mutex
+	credential *azidentity.ManagedIdentityCredential
+	options    azcore.ClientOptions
+	clients    map[clientCacheKey]any
+	hits       atomic.Int64
+	misses     atomic.Int64
+}
+
+var sdkClients = &clientCache{
+	options: NewClientOptions(DefaultRetryPolicy),
+	clients: make(map[clientCacheKey]any),
+}
+
+// SetClientOptions sets the options of the SDK clients, it is called at startup before any client is created
+func SetClientOptions(options azcore.ClientOptions) {
+	sdkClients.mu.Lock()
+	defer sdkClients.mu.Unlock()
+	sdkClients.options = options
+}
+
+func (c *clientCache) clientOptions() azcore.ClientOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.options
+}
+
+func (c *clientCache) getCredential(ctx context.Context) (*azidentity.ManagedIdentityCredential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credential != nil {
+		c.hits.Add(1)
+		return c.credential, nil
+	}
+	c.misses.Add(1)
+
+	credOpt := &azidentity.ManagedIdentityCredentialOptions{
+		ID: azidentity.ClientID(userAssignedClientId),
+	}
+	credential, err := azidentity.NewManagedIdentityCredential(credOpt)
+	if err != nil {
+		logging.LoggerFromCtx(ctx).Error().CallerSkipFrame(2).Err(err).Msg("failed to get credential")
+		return nil, err
+	}
+	c.credential = credential
+	return credential, nil
+}
+
+// getCachedClient returns the client of the given kind bound to scope, creating it on first use.
+// Failed creations are not cached.
+func getCachedClient[T any](ctx context.Context, kind, scope string, newClient func(credential azcore.TokenCredential, options azcore.ClientOptions) (T, error)) (client T, err error) {
+	credential, err := sdkClients.getCredential(ctx)
+	if err != nil {
+		return
+	}
+
+	key := clientCacheKey{kind: kind, scope: scope}
+	sdkClients.mu.Lock()
+	defer sdkClients.mu.Unlock()
+
+	if cached, ok := sdkClients.clients[key]; ok {
+		sdkClients.hits.Add(1)
+		return cached.(T), nil
+	}
+	sdkClients.misses.Add(1)
+
+	client, err = newClient(credential, sdkClients.options)
+	if err != nil {
+		return
+	}
+	sdkClients.clients[key] = client
+	return
+}
+
+func GetClientCacheStats() ClientCacheStats {
+	sdkClients.mu.Lock()
+	clients := len(sdkClients.clients)
+	sdkClients.mu.Unlock()
+
+	return ClientCacheStats{
+		Hits:    sdkClients.hits.Load(),
+		Misses:  sdkClients.misses.Load(),
+		Clients: clients,
+	}
+}
+
+func getBlobServiceClient(ctx context.Context, storageName string) (*azblob.Client, error) {
+	url := getBlobUrl(storageName)
+	return getCachedClient(ctx, "azblob", url, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*azblob.Client, error) {
+		return azblob.NewClient(url, credential, &azblob.ClientOptions{ClientOptions: options})
+	})
+}
+
+func getContainerClient(ctx context.Context, storageName, containerName string) (*container.Client, error) {
+	url := getContainerUrl(storageName, containerName)
+	return getCachedClient(ctx, "container", url, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*container.Client, error) {
+		return container.NewClient(url, credential, &container.ClientOptions{ClientOptions: options})
+	})
+}
+
+// blob clients are derived from the cached container client, so that the cache doesn't grow with the blobs
+func getBlobClient(ctx context.Context, p BlobObjParams) (*blob.Client, error) {
+	containerClient, err := getContainerClient(ctx, p.StorageName, p.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+	return containerClient.NewBlobClient(p.BlobName), nil
+}
+
+func getAppendBlobClient(ctx context.Context, p BlobObjParams) (*appendblob.Client, error) {
+	containerClient, err := getContainerClient(ctx, p.StorageName, p.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+	return containerClient.NewAppendBlobClient(p.BlobName), nil
+}
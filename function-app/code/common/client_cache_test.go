@@ -0,0 +1,50 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+func TestCachedClientIsCreatedOnce(t *testing.T) {
+	ctx := context.TODO()
+	type testClient struct{ scope string }
+
+	var created atomic.Int32
+	newClient := func(scope string) func(azcore.TokenCredential, azcore.ClientOptions) (*testClient, error) {
+		return func(credential azcore.TokenCredential, options azcore.ClientOptions) (*testClient, error) {
+			created.Add(1)
+			return &testClient{scope: scope}, nil
+		}
+	}
+
+	before := GetClientCacheStats()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := getCachedClient(ctx, "test", "sub-1", newClient("sub-1"))
+			if err != nil || client.scope != "sub-1" {
+				t.Errorf("unexpected client %+v, %v", client, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := getCachedClient(ctx, "test", "sub-2", newClient("sub-2")); err != nil {
+		t.Fatalf("failed getting client: %s", err)
+	}
+	if created.Load() != 2 {
+		t.Fatalf("expected a client per subscription, %d were created", created.Load())
+	}
+
+	after := GetClientCacheStats()
+	// each call also looks up the cached credential
+	if after.Hits-before.Hits < 19 || after.Clients-before.Clients != 2 {
+		t.Fatalf("unexpected cache stats, before: %+v, after: %+v", before, after)
+	}
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+)
+
+// CloudProvider wraps the compute, network, storage account and key vault calls made by the functions.
+// The Azure implementation is used by the function app, the fake implementation simulates scale sets
+// in memory for unit tests and local runs.
+// Errors follow the Azure SDK: a missing resource is reported as *azcore.ResponseError with the Azure error code.
+// Methods which don't wait for their long-running operation return its resume token, empty when it already completed.
+type CloudProvider interface {
+	GetScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (*armcompute.VirtualMachineScaleSet, error)
+	// CreateOrUpdateScaleSet waits until the scale set is created or updated
+	CreateOrUpdateScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, scaleSet armcompute.VirtualMachineScaleSet) (*armcompute.VirtualMachineScaleSet, error)
+	// SetScaleSetCapacity starts the capacity update without waiting for it
+	SetScaleSetCapacity(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, capacity int64) (resumeToken string, err error)
+	// DeleteScaleSet force deletes a scale set with its VMs, without waiting for the deletion
+	DeleteScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (resumeToken string, err error)
+	// ListScaleSetVms lists the scale set VMs through the VMSS VMs API (both Uniform and Flexible)
+	ListScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *string) ([]*armcompute.VirtualMachineScaleSetVM, error)
+	// ListFlexibleScaleSetVms lists the VMs of a Flexible scale set through the VMs API
+	ListFlexibleScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *armcompute.ExpandTypeForListVMs) ([]*armcompute.VirtualMachine, error)
+	SetScaleSetVmProtection(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string, protect bool) (resumeToken string, err error)
+	// DeleteScaleSetVm force deletes a Uniform scale set VM, without waiting for the deletion
+	DeleteScaleSetVm(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string) (resumeToken string, err error)
+	// DeleteScaleSetVms force deletes Uniform scale set VMs with a single call, without waiting for the deletion.
+	// The call fails as a whole when any of the VMs can't be deleted.
+	DeleteScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, instanceIds []string) (resumeToken string, err error)
+
+	// DeleteVm force deletes a VM (Flexible scale set VMs are regular VMs), without waiting for the deletion
+	DeleteVm(ctx context.Context, subscriptionId, resourceGroupName, vmName string) (resumeToken string, err error)
+	// UpdateVmTags merges the tags into the VM tags, without waiting for the update
+	UpdateVmTags(ctx context.Context, subscriptionId, resourceGroupName, vmName string, tags map[string]string) (resumeToken string, err error)
+	// PollOperation polls a long-running operation once, given the resume token returned when it was started.
+	// When done, the error is the operation failure; otherwise it is the failure to get the operation status.
+	PollOperation(ctx context.Context, subscriptionId string, kind OperationKind, resumeToken string) (done bool, err error)
+
+	// ListScaleSetNetworkInterfaces lists the network interfaces of a Uniform scale set
+	ListScaleSetNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) ([]*armnetwork.Interface, error)
+	GetNetworkInterface(ctx context.Context, subscriptionId, resourceGroupName, nicName string) (*armnetwork.Interface, error)
+	// GetScaleSetVmPublicIp returns the public ip of a Uniform scale set VM ip configuration, empty when there is none
+	GetScaleSetVmPublicIp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceIndex, nicName, ipConfigName string) (string, error)
+
+	// CreateStorageAccount starts the storage account creation without waiting for it
+	CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName, accountName string, params armstorage.AccountCreateParameters) (resumeToken string, err error)
+	GetStorageAccountKey(ctx context.Context, subscriptionId, resourceGroupName, accountName string) (string, error)
+
+	GetSecret(ctx context.Context, keyVaultUri, secretName string) (string, error)
+	SetSecret(ctx context.Context, keyVaultUri, secretName, secretValue string) error
+
+	// CheckIdentity acquires an ARM token with the function app identity
+	CheckIdentity(ctx context.Context) error
+}
+
+type cloudProviderCtxKey struct{}
+
+func ContextWithCloudProvider(ctx context.Context, provider CloudProvider) context.Context {
+	return context.WithValue(ctx, cloudProviderCtxKey{}, provider)
+}
+
+// CloudProviderFromCtx returns the cloud provider injected into the context (Azure by default)
+func CloudProviderFromCtx(ctx context.Context) CloudProvider {
+	if provider, ok := ctx.Value(cloudProviderCtxKey{}).(CloudProvider); ok {
+		return provider
+	}
+	return NewAzureCloudProvider()
+}
+
+// CloudProviderMiddleware injects the cloud provider into the request context
+func CloudProviderMiddleware(provider CloudProvider, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ContextWithCloudProvider(r.Context(), provider)
+		next(w, r.WithContext(ctx))
+	}
+}
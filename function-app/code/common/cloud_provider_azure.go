@@ -0,0 +1,455 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azsecrets"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+)
+
+// AzureCloudProvider calls the Azure APIs using the function app managed identity, its SDK clients are
+// shared by all the invocations of the process
+type AzureCloudProvider struct{}
+
+func NewAzureCloudProvider() *AzureCloudProvider {
+	return &AzureCloudProvider{}
+}
+
+func (p *AzureCloudProvider) scaleSetsClient(ctx context.Context, subscriptionId string) (*armcompute.VirtualMachineScaleSetsClient, error) {
+	return getCachedClient(ctx, "scale_sets", subscriptionId, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*armcompute.VirtualMachineScaleSetsClient, error) {
+		return armcompute.NewVirtualMachineScaleSetsClient(subscriptionId, credential, &arm.ClientOptions{ClientOptions: options})
+	})
+}
+
+func (p *AzureCloudProvider) scaleSetVmsClient(ctx context.Context, subscriptionId string) (*armcompute.VirtualMachineScaleSetVMsClient, error) {
+	return getCachedClient(ctx, "scale_set_vms", subscriptionId, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*armcompute.VirtualMachineScaleSetVMsClient, error) {
+		return armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, &arm.ClientOptions{ClientOptions: options})
+	})
+}
+
+func (p *AzureCloudProvider) vmsClient(ctx context.Context, subscriptionId string) (*armcompute.VirtualMachinesClient, error) {
+	return getCachedClient(ctx, "vms", subscriptionId, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*armcompute.VirtualMachinesClient, error) {
+		return armcompute.NewVirtualMachinesClient(subscriptionId, credential, &arm.ClientOptions{ClientOptions: options})
+	})
+}
+
+func (p *AzureCloudProvider) interfacesClient(ctx context.Context, subscriptionId string) (*armnetwork.InterfacesClient, error) {
+	return getCachedClient(ctx, "interfaces", subscriptionId, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*armnetwork.InterfacesClient, error) {
+		return armnetwork.NewInterfacesClient(subscriptionId, credential, &arm.ClientOptions{ClientOptions: options})
+	})
+}
+
+func (p *AzureCloudProvider) publicIpsClient(ctx context.Context, subscriptionId string) (*armnetwork.PublicIPAddressesClient, error) {
+	return getCachedClient(ctx, "public_ips", subscriptionId, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*armnetwork.PublicIPAddressesClient, error) {
+		return armnetwork.NewPublicIPAddressesClient(subscriptionId, credential, &arm.ClientOptions{ClientOptions: options})
+	})
+}
+
+func (p *AzureCloudProvider) storageAccountsClient(ctx context.Context, subscriptionId string) (*armstorage.AccountsClient, error) {
+	return getCachedClient(ctx, "storage_accounts", subscriptionId, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*armstorage.AccountsClient, error) {
+		return armstorage.NewAccountsClient(subscriptionId, credential, &arm.ClientOptions{ClientOptions: options})
+	})
+}
+
+func (p *AzureCloudProvider) secretsClient(ctx context.Context, keyVaultUri string) (*azsecrets.Client, error) {
+	return getCachedClient(ctx, "secrets", keyVaultUri, func(credential azcore.TokenCredential, options azcore.ClientOptions) (*azsecrets.Client, error) {
+		return azsecrets.NewClient(keyVaultUri, credential, &azsecrets.ClientOptions{ClientOptions: options})
+	})
+}
+
+// see https://learn.microsoft.com/en-us/rest/api/compute/virtual-machine-scale-sets/get
+func (p *AzureCloudProvider) GetScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (*armcompute.VirtualMachineScaleSet, error) {
+	client, err := p.scaleSetsClient(ctx, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	// the user data is only returned when expanded, see GetVmssConfig
+	expand := armcompute.ExpandTypesForGetVMScaleSetsUserData
+	scaleSet, err := client.Get(ctx, resourceGroupName, vmScaleSetName, &armcompute.VirtualMachineScaleSetsClientGetOptions{Expand: &expand})
+	if err != nil {
+		return nil, err
+	}
+	return &scaleSet.VirtualMachineScaleSet, nil
+}
+
+func (p *AzureCloudProvider) CreateOrUpdateScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, scaleSet armcompute.VirtualMachineScaleSet) (*armcompute.VirtualMachineScaleSet, error) {
+	client, err := p.scaleSetsClient(ctx, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	poller, err := client.BeginCreateOrUpdate(ctx, resourceGroupName, vmScaleSetName, scaleSet, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.VirtualMachineScaleSet, nil
+}
+
+func (p *AzureCloudProvider) SetScaleSetCapacity(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, capacity int64) (string, error) {
+	client, err := p.scaleSetsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	poller, err := client.BeginUpdate(ctx, resourceGroupName, vmScaleSetName, armcompute.VirtualMachineScaleSetUpdate{
+		SKU: &armcompute.SKU{
+			Capacity: &capacity,
+		},
+	}, nil)
+	return resumeToken(poller, err)
+}
+
+// see https://learn.microsoft.com/en-us/rest/api/compute/virtual-machine-scale-set-vms/list
+func (p *AzureCloudProvider) ListScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *string) (vms []*armcompute.VirtualMachineScaleSetVM, err error) {
+	client, err := p.scaleSetVmsClient(ctx, subscriptionId)
+	if err != nil {
+		return
+	}
+	pager := client.NewListPager(resourceGroupName, vmScaleSetName, &armcompute.VirtualMachineScaleSetVMsClientListOptions{
+		Expand: expand,
+	})
+	for pager.More() {
+		nextResult, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, nextResult.Value...)
+	}
+	return
+}
+
+func (p *AzureCloudProvider) ListFlexibleScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *armcompute.ExpandTypeForListVMs) (vms []*armcompute.VirtualMachine, err error) {
+	client, err := p.vmsClient(ctx, subscriptionId)
+	if err != nil {
+		return
+	}
+	filter := fmt.Sprintf("'virtualMachineScaleSet/id' eq '/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s'", subscriptionId, resourceGroupName, vmScaleSetName)
+	pager := client.NewListPager(resourceGroupName, &armcompute.VirtualMachinesClientListOptions{
+		Filter: &filter,
+		Expand: expand,
+	})
+	for pager.More() {
+		nextResult, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, nextResult.Value...)
+	}
+	return
+}
+
+func (p *AzureCloudProvider) DeleteScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (string, error) {
+	client, err := p.scaleSetsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	force := true
+	poller, err := client.BeginDelete(ctx, resourceGroupName, vmScaleSetName, &armcompute.VirtualMachineScaleSetsClientBeginDeleteOptions{
+		ForceDeletion: &force,
+	})
+	return resumeToken(poller, err)
+}
+
+// NOTE: works both for Uniform and Flexible scale sets
+func (p *AzureCloudProvider) SetScaleSetVmProtection(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string, protect bool) (string, error) {
+	client, err := p.scaleSetVmsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	poller, err := client.BeginUpdate(
+		ctx,
+		resourceGroupName,
+		vmScaleSetName,
+		instanceId,
+		armcompute.VirtualMachineScaleSetVM{
+			Properties: &armcompute.VirtualMachineScaleSetVMProperties{
+				ProtectionPolicy: &armcompute.VirtualMachineScaleSetVMProtectionPolicy{
+					ProtectFromScaleSetActions: &protect,
+				},
+			},
+		},
+		nil)
+	return resumeToken(poller, err)
+}
+
+func (p *AzureCloudProvider) DeleteScaleSetVm(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string) (string, error) {
+	client, err := p.scaleSetVmsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	force := true
+	poller, err := client.BeginDelete(ctx, resourceGroupName, vmScaleSetName, instanceId, &armcompute.VirtualMachineScaleSetVMsClientBeginDeleteOptions{
+		ForceDeletion: &force,
+	})
+	return resumeToken(poller, err)
+}
+
+func (p *AzureCloudProvider) DeleteScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, instanceIds []string) (string, error) {
+	client, err := p.scaleSetsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	force := true
+	poller, err := client.BeginDeleteInstances(ctx, resourceGroupName, vmScaleSetName, armcompute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+		InstanceIDs: StrArrToPtrArray(instanceIds),
+	}, &armcompute.VirtualMachineScaleSetsClientBeginDeleteInstancesOptions{
+		ForceDeletion: &force,
+	})
+	return resumeToken(poller, err)
+}
+
+func (p *AzureCloudProvider) DeleteVm(ctx context.Context, subscriptionId, resourceGroupName, vmName string) (string, error) {
+	client, err := p.vmsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	force := true
+	poller, err := client.BeginDelete(ctx, resourceGroupName, vmName, &armcompute.VirtualMachinesClientBeginDeleteOptions{
+		ForceDeletion: &force,
+	})
+	return resumeToken(poller, err)
+}
+
+func (p *AzureCloudProvider) UpdateVmTags(ctx context.Context, subscriptionId, resourceGroupName, vmName string, tags map[string]string) (string, error) {
+	client, err := p.vmsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+
+	// get current tags
+	vm, err := client.Get(ctx, resourceGroupName, vmName, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot get vm %s: %v", vmName, err)
+	}
+
+	vmTags := PtrMapToStrMap(vm.Tags)
+	// merge current tags with new tags
+	for k, v := range tags {
+		vmTags[k] = v
+	}
+
+	params := armcompute.VirtualMachineUpdate{
+		Tags: StrMapToPtrMap(vmTags),
+	}
+	poller, err := client.BeginUpdate(ctx, resourceGroupName, vmName, params, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot update tags on vm %s: %v", vmName, err)
+	}
+	return resumeToken(poller, nil)
+}
+
+// resumeToken returns the token to resume the poller with, empty when the operation already completed
+func resumeToken[T any](poller *runtime.Poller[T], err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if poller.Done() {
+		_, err = poller.Result(context.Background())
+		return "", err
+	}
+	return poller.ResumeToken()
+}
+
+// pollOnce polls the resumed poller, the error of a done poller is the operation failure
+func pollOnce[T any](ctx context.Context, poller *runtime.Poller[T], err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	if !poller.Done() {
+		if _, err = poller.Poll(ctx); err != nil {
+			return false, err
+		}
+		if !poller.Done() {
+			return false, nil
+		}
+	}
+	_, err = poller.Result(ctx)
+	return true, err
+}
+
+// PollOperation resumes the poller of the operation from its token, the operation parameters are taken from the token
+func (p *AzureCloudProvider) PollOperation(ctx context.Context, subscriptionId string, kind OperationKind, resumeToken string) (bool, error) {
+	switch kind {
+	case OperationScaleSetCapacity:
+		client, err := p.scaleSetsClient(ctx, subscriptionId)
+		if err != nil {
+			return false, err
+		}
+		poller, err := client.BeginUpdate(ctx, "", "", armcompute.VirtualMachineScaleSetUpdate{}, &armcompute.VirtualMachineScaleSetsClientBeginUpdateOptions{
+			ResumeToken: resumeToken,
+		})
+		return pollOnce(ctx, poller, err)
+	case OperationScaleSetDelete:
+		client, err := p.scaleSetsClient(ctx, subscriptionId)
+		if err != nil {
+			return false, err
+		}
+		poller, err := client.BeginDelete(ctx, "", "", &armcompute.VirtualMachineScaleSetsClientBeginDeleteOptions{
+			ResumeToken: resumeToken,
+		})
+		return pollOnce(ctx, poller, err)
+	case OperationScaleSetVmProtection:
+		client, err := p.scaleSetVmsClient(ctx, subscriptionId)
+		if err != nil {
+			return false, err
+		}
+		poller, err := client.BeginUpdate(ctx, "", "", "", armcompute.VirtualMachineScaleSetVM{}, &armcompute.VirtualMachineScaleSetVMsClientBeginUpdateOptions{
+			ResumeToken: resumeToken,
+		})
+		return pollOnce(ctx, poller, err)
+	case OperationScaleSetVmDelete:
+		client, err := p.scaleSetVmsClient(ctx, subscriptionId)
+		if err != nil {
+			return false, err
+		}
+		poller, err := client.BeginDelete(ctx, "", "", "", &armcompute.VirtualMachineScaleSetVMsClientBeginDeleteOptions{
+			ResumeToken: resumeToken,
+		})
+		return pollOnce(ctx, poller, err)
+	case OperationScaleSetVmsDelete:
+		client, err := p.scaleSetsClient(ctx, subscriptionId)
+		if err != nil {
+			return false, err
+		}
+		poller, err := client.BeginDeleteInstances(ctx, "", "", armcompute.VirtualMachineScaleSetVMInstanceRequiredIDs{}, &armcompute.VirtualMachineScaleSetsClientBeginDeleteInstancesOptions{
+			ResumeToken: resumeToken,
+		})
+		return pollOnce(ctx, poller, err)
+	case OperationVmDelete:
+		client, err := p.vmsClient(ctx, subscriptionId)
+		if err != nil {
+			return false, err
+		}
+		poller, err := client.BeginDelete(ctx, "", "", &armcompute.VirtualMachinesClientBeginDeleteOptions{
+			ResumeToken: resumeToken,
+		})
+		return pollOnce(ctx, poller, err)
+	case OperationVmTags:
+		client, err := p.vmsClient(ctx, subscriptionId)
+		if err != nil {
+			return false, err
+		}
+		poller, err := client.BeginUpdate(ctx, "", "", armcompute.VirtualMachineUpdate{}, &armcompute.VirtualMachinesClientBeginUpdateOptions{
+			ResumeToken: resumeToken,
+		})
+		return pollOnce(ctx, poller, err)
+	case OperationStorageAccountCreate:
+		client, err := p.storageAccountsClient(ctx, subscriptionId)
+		if err != nil {
+			return false, err
+		}
+		poller, err := client.BeginCreate(ctx, "", "", armstorage.AccountCreateParameters{}, &armstorage.AccountsClientBeginCreateOptions{
+			ResumeToken: resumeToken,
+		})
+		return pollOnce(ctx, poller, err)
+	default:
+		return true, fmt.Errorf("unknown operation kind %q", kind)
+	}
+}
+
+// see https://learn.microsoft.com/en-us/rest/api/virtualnetwork/network-interface-in-vm-ss/list-virtual-machine-scale-set-network-interfaces
+func (p *AzureCloudProvider) ListScaleSetNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (networkInterfaces []*armnetwork.Interface, err error) {
+	client, err := p.interfacesClient(ctx, subscriptionId)
+	if err != nil {
+		return
+	}
+	pager := client.NewListVirtualMachineScaleSetNetworkInterfacesPager(resourceGroupName, vmScaleSetName, nil)
+	for pager.More() {
+		nextResult, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		networkInterfaces = append(networkInterfaces, nextResult.Value...)
+	}
+	return
+}
+
+func (p *AzureCloudProvider) GetNetworkInterface(ctx context.Context, subscriptionId, resourceGroupName, nicName string) (*armnetwork.Interface, error) {
+	client, err := p.interfacesClient(ctx, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(ctx, resourceGroupName, nicName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Interface, nil
+}
+
+func (p *AzureCloudProvider) GetScaleSetVmPublicIp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceIndex, nicName, ipConfigName string) (string, error) {
+	client, err := p.publicIpsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	pager := client.NewListVirtualMachineScaleSetVMPublicIPAddressesPager(resourceGroupName, vmScaleSetName, instanceIndex, nicName, ipConfigName, nil)
+	for pager.More() {
+		nextResult, err := pager.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		if len(nextResult.Value) > 0 {
+			return *nextResult.Value[0].Properties.IPAddress, nil
+		}
+	}
+	return "", nil
+}
+
+func (p *AzureCloudProvider) CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName, accountName string, params armstorage.AccountCreateParameters) (string, error) {
+	client, err := p.storageAccountsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	return resumeToken(client.BeginCreate(ctx, resourceGroupName, accountName, params, nil))
+}
+
+func (p *AzureCloudProvider) GetStorageAccountKey(ctx context.Context, subscriptionId, resourceGroupName, accountName string) (string, error) {
+	client, err := p.storageAccountsClient(ctx, subscriptionId)
+	if err != nil {
+		return "", err
+	}
+	keys, err := client.ListKeys(ctx, resourceGroupName, accountName, nil)
+	if err != nil {
+		return "", err
+	}
+	return *keys.Keys[0].Value, nil
+}
+
+func (p *AzureCloudProvider) GetSecret(ctx context.Context, keyVaultUri, secretName string) (string, error) {
+	client, err := p.secretsClient(ctx, keyVaultUri)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.GetSecret(ctx, secretName, "", nil)
+	if err != nil {
+		return "", err
+	}
+	return *resp.Value, nil
+}
+
+func (p *AzureCloudProvider) SetSecret(ctx context.Context, keyVaultUri, secretName, secretValue string) error {
+	client, err := p.secretsClient(ctx, keyVaultUri)
+	if err != nil {
+		return err
+	}
+	_, err = client.SetSecret(ctx, secretName, azsecrets.SetSecretParameters{Value: &secretValue}, nil)
+	return err
+}
+
+func (p *AzureCloudProvider) CheckIdentity(ctx context.Context) error {
+	credential, err := getCredential(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://management.azure.com/.default"}})
+	return err
+}
@@ -0,0 +1,674 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/storage/armstorage"
+)
+
+// FakeInstance is a simulated scale set instance
+type FakeInstance struct {
+	InstanceId   string
+	Name         string
+	ComputerName string
+	// running, starting, stopped, deallocated
+	PowerState string
+	// healthy, unhealthy, or empty when the instance has no health extension
+	HealthState string
+	// Succeeded, Creating, Failed
+	ProvisioningState string
+	Protected         bool
+	PrivateIp         string
+	SecondaryIps      []string
+	PublicIp          string
+	CreatedAt         time.Time
+	Tags              map[string]string
+}
+
+type fakeScaleSet struct {
+	subscriptionId    string
+	resourceGroupName string
+	scaleSet          armcompute.VirtualMachineScaleSet
+	flexible          bool
+	instances         []*FakeInstance
+	nextIndex         int
+}
+
+// FakeCloudProvider simulates scale sets, their instances, secrets and storage accounts in memory.
+// New instances are created running and healthy when the capacity grows, and deleting an instance
+// decreases the capacity, like Azure does.
+// Long-running operations complete synchronously, unless SetAsyncOperations is used.
+type FakeCloudProvider struct {
+	mu              sync.Mutex
+	scaleSets       map[string]*fakeScaleSet
+	secrets         map[string]string
+	storageAccounts map[string]string
+	nextIp          int
+
+	asyncOperations   bool
+	operationFailures map[OperationKind]error
+	// results of the started operations by resume token
+	operations    map[string]error
+	nextOperation int
+}
+
+func NewFakeCloudProvider() *FakeCloudProvider {
+	return &FakeCloudProvider{
+		scaleSets:         make(map[string]*fakeScaleSet),
+		secrets:           make(map[string]string),
+		storageAccounts:   make(map[string]string),
+		operationFailures: make(map[OperationKind]error),
+		operations:        make(map[string]error),
+	}
+}
+
+// SetAsyncOperations makes the long-running operations return a resume token, their changes are
+// still applied immediately and they are reported as done on the first poll
+func (p *FakeCloudProvider) SetAsyncOperations(async bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.asyncOperations = async
+}
+
+// FailOperations makes the operations of the given kind fail with err without applying their changes,
+// a nil err clears the failure
+func (p *FakeCloudProvider) FailOperations(kind OperationKind, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		delete(p.operationFailures, kind)
+		return
+	}
+	p.operationFailures[kind] = err
+}
+
+// startOperation applies the operation changes, must be called without holding the lock
+func (p *FakeCloudProvider) startOperation(kind OperationKind, apply func() error) (string, error) {
+	p.mu.Lock()
+	failure, fail := p.operationFailures[kind]
+	async := p.asyncOperations
+	p.mu.Unlock()
+
+	if !fail {
+		if err := apply(); err != nil {
+			return "", err
+		}
+	}
+	if !async {
+		return "", failure
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextOperation++
+	token := fmt.Sprintf("fake-operation-%d", p.nextOperation)
+	p.operations[token] = failure
+	return token, nil
+}
+
+func (p *FakeCloudProvider) PollOperation(ctx context.Context, subscriptionId string, kind OperationKind, resumeToken string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	failure, ok := p.operations[resumeToken]
+	if !ok {
+		return false, fmt.Errorf("unknown resume token %q", resumeToken)
+	}
+	return true, failure
+}
+
+func fakeResourceKey(parts ...string) string {
+	return strings.ToLower(strings.Join(parts, "/"))
+}
+
+func fakeNotFound() error {
+	return &azcore.ResponseError{ErrorCode: "ResourceNotFound", StatusCode: http.StatusNotFound}
+}
+
+func (p *FakeCloudProvider) getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName string) (*fakeScaleSet, error) {
+	ss, ok := p.scaleSets[fakeResourceKey(subscriptionId, resourceGroupName, vmScaleSetName)]
+	if !ok {
+		return nil, fakeNotFound()
+	}
+	return ss, nil
+}
+
+func (p *FakeCloudProvider) addInstance(ss *fakeScaleSet) *FakeInstance {
+	index := ss.nextIndex
+	ss.nextIndex++
+	p.nextIp++
+
+	vmssName := *ss.scaleSet.Name
+	instance := &FakeInstance{
+		InstanceId:        fmt.Sprintf("%d", index),
+		Name:              fmt.Sprintf("%s_%d", vmssName, index),
+		ComputerName:      fmt.Sprintf("%s%06x", vmssName, index),
+		PowerState:        "running",
+		HealthState:       "healthy",
+		ProvisioningState: "Succeeded",
+		PrivateIp:         fmt.Sprintf("10.0.%d.%d", p.nextIp/250, p.nextIp%250+4),
+		CreatedAt:         time.Now(),
+		// the instances are tagged like their scale set was at their creation
+		Tags: PtrMapToStrMap(ss.scaleSet.Tags),
+	}
+	if ss.flexible {
+		// flexible scale set vms are regular vms, their instance id is the vm name
+		instance.Name = fmt.Sprintf("%s_%08x", vmssName, index)
+		instance.InstanceId = instance.Name
+	}
+	ss.instances = append(ss.instances, instance)
+	return instance
+}
+
+// resize adds instances or removes the newest unprotected ones to match the capacity
+func (p *FakeCloudProvider) resize(ss *fakeScaleSet, capacity int64) {
+	ss.scaleSet.SKU.Capacity = &capacity
+	for int64(len(ss.instances)) < capacity {
+		p.addInstance(ss)
+	}
+	for i := len(ss.instances) - 1; i >= 0 && int64(len(ss.instances)) > capacity; i-- {
+		if !ss.instances[i].Protected {
+			ss.instances = append(ss.instances[:i], ss.instances[i+1:]...)
+		}
+	}
+}
+
+// AddScaleSet creates a scale set with capacity running instances
+func (p *FakeCloudProvider) AddScaleSet(subscriptionId, resourceGroupName, vmScaleSetName string, flexible bool, capacity int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	orchestrationMode := armcompute.OrchestrationModeUniform
+	if flexible {
+		orchestrationMode = armcompute.OrchestrationModeFlexible
+	}
+	p.createScaleSet(subscriptionId, resourceGroupName, vmScaleSetName, armcompute.VirtualMachineScaleSet{
+		SKU:        &armcompute.SKU{},
+		Properties: &armcompute.VirtualMachineScaleSetProperties{OrchestrationMode: &orchestrationMode},
+	}, int64(capacity))
+}
+
+func (p *FakeCloudProvider) createScaleSet(subscriptionId, resourceGroupName, vmScaleSetName string, scaleSet armcompute.VirtualMachineScaleSet, capacity int64) *fakeScaleSet {
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s", subscriptionId, resourceGroupName, vmScaleSetName)
+	scaleSet.ID = &id
+	scaleSet.Name = &vmScaleSetName
+	if scaleSet.SKU == nil {
+		scaleSet.SKU = &armcompute.SKU{}
+	}
+
+	ss := &fakeScaleSet{
+		subscriptionId:    subscriptionId,
+		resourceGroupName: resourceGroupName,
+		scaleSet:          scaleSet,
+		flexible: scaleSet.Properties != nil && scaleSet.Properties.OrchestrationMode != nil &&
+			*scaleSet.Properties.OrchestrationMode == armcompute.OrchestrationModeFlexible,
+	}
+	p.scaleSets[fakeResourceKey(subscriptionId, resourceGroupName, vmScaleSetName)] = ss
+	p.resize(ss, capacity)
+	return ss
+}
+
+// GetInstances returns a copy of the scale set instances
+func (p *FakeCloudProvider) GetInstances(subscriptionId, resourceGroupName, vmScaleSetName string) ([]FakeInstance, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]FakeInstance, len(ss.instances))
+	for i, instance := range ss.instances {
+		instances[i] = *instance
+	}
+	return instances, nil
+}
+
+// UpdateInstance changes a simulated instance, e.g. its power state or health
+func (p *FakeCloudProvider) UpdateInstance(subscriptionId, resourceGroupName, vmScaleSetName, instanceId string, update func(instance *FakeInstance)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return err
+	}
+	instance, _ := ss.findInstance(instanceId)
+	if instance == nil {
+		return fakeNotFound()
+	}
+	update(instance)
+	return nil
+}
+
+func (ss *fakeScaleSet) findInstance(instanceId string) (*FakeInstance, int) {
+	for i, instance := range ss.instances {
+		if instance.InstanceId == instanceId || instance.Name == instanceId {
+			return instance, i
+		}
+	}
+	return nil, -1
+}
+
+func (ss *fakeScaleSet) vmId(instance *FakeInstance) string {
+	if ss.flexible {
+		return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s", ss.subscriptionId, ss.resourceGroupName, instance.Name)
+	}
+	return fmt.Sprintf("%s/virtualMachines/%s", *ss.scaleSet.ID, instance.InstanceId)
+}
+
+func (ss *fakeScaleSet) nicName(instance *FakeInstance) string {
+	return fmt.Sprintf("%s-nic-0", instance.Name)
+}
+
+func (ss *fakeScaleSet) nicId(instance *FakeInstance) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/networkInterfaces/%s", ss.subscriptionId, ss.resourceGroupName, ss.nicName(instance))
+}
+
+func (ss *fakeScaleSet) networkProfile(instance *FakeInstance) *armcompute.NetworkProfile {
+	nicId := ss.nicId(instance)
+	primary := true
+	return &armcompute.NetworkProfile{
+		NetworkInterfaces: []*armcompute.NetworkInterfaceReference{
+			{ID: &nicId, Properties: &armcompute.NetworkInterfaceReferenceProperties{Primary: &primary}},
+		},
+	}
+}
+
+func (ss *fakeScaleSet) instanceView(instance *FakeInstance) (computerName *string, health *armcompute.VirtualMachineHealthStatus, statuses []*armcompute.InstanceViewStatus) {
+	computerName = &instance.ComputerName
+	if instance.HealthState != "" {
+		healthCode := "HealthState/" + instance.HealthState
+		health = &armcompute.VirtualMachineHealthStatus{Status: &armcompute.InstanceViewStatus{Code: &healthCode}}
+	}
+	provisioningCode := "ProvisioningState/" + strings.ToLower(instance.ProvisioningState)
+	createdAt := instance.CreatedAt
+	powerCode := "PowerState/" + instance.PowerState
+	statuses = []*armcompute.InstanceViewStatus{
+		{Code: &provisioningCode, Time: &createdAt},
+		{Code: &powerCode},
+	}
+	return
+}
+
+func (ss *fakeScaleSet) toScaleSetVm(instance *FakeInstance, expandInstanceView bool) *armcompute.VirtualMachineScaleSetVM {
+	id := ss.vmId(instance)
+	instanceId, name, computerName := instance.InstanceId, instance.Name, instance.ComputerName
+	provisioningState := instance.ProvisioningState
+	protect := instance.Protected
+
+	vm := &armcompute.VirtualMachineScaleSetVM{
+		ID:         &id,
+		InstanceID: &instanceId,
+		Name:       &name,
+		Tags:       StrMapToPtrMap(instance.Tags),
+		Properties: &armcompute.VirtualMachineScaleSetVMProperties{
+			ProvisioningState: &provisioningState,
+			OSProfile:         &armcompute.OSProfile{ComputerName: &computerName},
+			NetworkProfile:    ss.networkProfile(instance),
+			ProtectionPolicy:  &armcompute.VirtualMachineScaleSetVMProtectionPolicy{ProtectFromScaleSetActions: &protect},
+		},
+	}
+	if expandInstanceView {
+		computerName, health, statuses := ss.instanceView(instance)
+		vm.Properties.InstanceView = &armcompute.VirtualMachineScaleSetVMInstanceView{
+			ComputerName: computerName,
+			VMHealth:     health,
+			Statuses:     statuses,
+		}
+	}
+	return vm
+}
+
+func (ss *fakeScaleSet) toVm(instance *FakeInstance, expandInstanceView bool) *armcompute.VirtualMachine {
+	id := ss.vmId(instance)
+	name := instance.Name
+	provisioningState := instance.ProvisioningState
+
+	vm := &armcompute.VirtualMachine{
+		ID:   &id,
+		Name: &name,
+		Tags: StrMapToPtrMap(instance.Tags),
+		Properties: &armcompute.VirtualMachineProperties{
+			ProvisioningState: &provisioningState,
+			NetworkProfile:    ss.networkProfile(instance),
+		},
+	}
+	if expandInstanceView {
+		computerName, health, statuses := ss.instanceView(instance)
+		vm.Properties.InstanceView = &armcompute.VirtualMachineInstanceView{
+			ComputerName: computerName,
+			VMHealth:     health,
+			Statuses:     statuses,
+		}
+	}
+	return vm
+}
+
+func (ss *fakeScaleSet) toNetworkInterface(instance *FakeInstance) *armnetwork.Interface {
+	id, name, vmId := ss.nicId(instance), ss.nicName(instance), ss.vmId(instance)
+	primary, secondary := true, false
+	privateIp := instance.PrivateIp
+
+	ipConfigs := []*armnetwork.InterfaceIPConfiguration{
+		{Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{Primary: &primary, PrivateIPAddress: &privateIp}},
+	}
+	for i := range instance.SecondaryIps {
+		ipConfigs = append(ipConfigs, &armnetwork.InterfaceIPConfiguration{
+			Properties: &armnetwork.InterfaceIPConfigurationPropertiesFormat{Primary: &secondary, PrivateIPAddress: &instance.SecondaryIps[i]},
+		})
+	}
+	return &armnetwork.Interface{
+		ID:   &id,
+		Name: &name,
+		Properties: &armnetwork.InterfacePropertiesFormat{
+			Primary:          &primary,
+			VirtualMachine:   &armnetwork.SubResource{ID: &vmId},
+			IPConfigurations: ipConfigs,
+		},
+	}
+}
+
+func (p *FakeCloudProvider) GetScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (*armcompute.VirtualMachineScaleSet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return nil, err
+	}
+	scaleSet := ss.scaleSet
+	capacity := *ss.scaleSet.SKU.Capacity
+	sku := *ss.scaleSet.SKU
+	sku.Capacity = &capacity
+	scaleSet.SKU = &sku
+	return &scaleSet, nil
+}
+
+func (p *FakeCloudProvider) CreateOrUpdateScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, scaleSet armcompute.VirtualMachineScaleSet) (*armcompute.VirtualMachineScaleSet, error) {
+	var capacity int64
+	if scaleSet.SKU != nil && scaleSet.SKU.Capacity != nil {
+		capacity = *scaleSet.SKU.Capacity
+	}
+
+	p.mu.Lock()
+	ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		p.createScaleSet(subscriptionId, resourceGroupName, vmScaleSetName, scaleSet, capacity)
+	} else {
+		// the model is replaced, existing instances are kept
+		scaleSet.ID, scaleSet.Name = ss.scaleSet.ID, ss.scaleSet.Name
+		if scaleSet.SKU == nil {
+			scaleSet.SKU = &armcompute.SKU{}
+		}
+		ss.scaleSet = scaleSet
+		p.resize(ss, capacity)
+	}
+	p.mu.Unlock()
+
+	return p.GetScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+}
+
+func (p *FakeCloudProvider) SetScaleSetCapacity(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, capacity int64) (string, error) {
+	return p.startOperation(OperationScaleSetCapacity, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+		if err != nil {
+			return err
+		}
+		p.resize(ss, capacity)
+		return nil
+	})
+}
+
+func (p *FakeCloudProvider) DeleteScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (string, error) {
+	return p.startOperation(OperationScaleSetDelete, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if _, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName); err != nil {
+			return err
+		}
+		delete(p.scaleSets, fakeResourceKey(subscriptionId, resourceGroupName, vmScaleSetName))
+		return nil
+	})
+}
+
+func (p *FakeCloudProvider) ListScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *string) ([]*armcompute.VirtualMachineScaleSetVM, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return nil, err
+	}
+	expandInstanceView := expand != nil && *expand == string(armcompute.ExpandTypeForListVMsInstanceView)
+	vms := make([]*armcompute.VirtualMachineScaleSetVM, 0, len(ss.instances))
+	for _, instance := range ss.instances {
+		vms = append(vms, ss.toScaleSetVm(instance, expandInstanceView))
+	}
+	return vms, nil
+}
+
+func (p *FakeCloudProvider) ListFlexibleScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *armcompute.ExpandTypeForListVMs) ([]*armcompute.VirtualMachine, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		// listing vms with a filter on a missing scale set returns an empty list
+		return nil, nil
+	}
+	expandInstanceView := expand != nil && *expand == armcompute.ExpandTypeForListVMsInstanceView
+	vms := make([]*armcompute.VirtualMachine, 0, len(ss.instances))
+	for _, instance := range ss.instances {
+		vms = append(vms, ss.toVm(instance, expandInstanceView))
+	}
+	return vms, nil
+}
+
+func (p *FakeCloudProvider) SetScaleSetVmProtection(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string, protect bool) (string, error) {
+	return p.startOperation(OperationScaleSetVmProtection, func() error {
+		return p.UpdateInstance(subscriptionId, resourceGroupName, vmScaleSetName, instanceId, func(instance *FakeInstance) {
+			instance.Protected = protect
+		})
+	})
+}
+
+func (p *FakeCloudProvider) deleteInstance(ss *fakeScaleSet, instanceId string) error {
+	instance, i := ss.findInstance(instanceId)
+	if instance == nil {
+		return fakeNotFound()
+	}
+	if instance.Protected {
+		return &azcore.ResponseError{ErrorCode: "OperationNotAllowed", StatusCode: http.StatusConflict}
+	}
+	ss.instances = append(ss.instances[:i], ss.instances[i+1:]...)
+	capacity := *ss.scaleSet.SKU.Capacity - 1
+	ss.scaleSet.SKU.Capacity = &capacity
+	return nil
+}
+
+func (p *FakeCloudProvider) DeleteScaleSetVm(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string) (string, error) {
+	return p.startOperation(OperationScaleSetVmDelete, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+		if err != nil {
+			return err
+		}
+		return p.deleteInstance(ss, instanceId)
+	})
+}
+
+func (p *FakeCloudProvider) DeleteScaleSetVms(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, instanceIds []string) (string, error) {
+	return p.startOperation(OperationScaleSetVmsDelete, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+		if err != nil {
+			return err
+		}
+		// like Azure, nothing is deleted when one of the instances can't be
+		for _, instanceId := range instanceIds {
+			instance, _ := ss.findInstance(instanceId)
+			if instance == nil {
+				return fakeNotFound()
+			}
+			if instance.Protected {
+				return &azcore.ResponseError{ErrorCode: "OperationNotAllowed", StatusCode: http.StatusConflict}
+			}
+		}
+		for _, instanceId := range instanceIds {
+			if err := p.deleteInstance(ss, instanceId); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// findVm looks up a VM by name in all scale sets of the resource group
+func (p *FakeCloudProvider) findVm(subscriptionId, resourceGroupName, vmName string) (*fakeScaleSet, *FakeInstance) {
+	for _, ss := range p.scaleSets {
+		if !strings.EqualFold(ss.subscriptionId, subscriptionId) || !strings.EqualFold(ss.resourceGroupName, resourceGroupName) {
+			continue
+		}
+		for _, instance := range ss.instances {
+			if instance.Name == vmName || ss.nicName(instance) == vmName {
+				return ss, instance
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (p *FakeCloudProvider) DeleteVm(ctx context.Context, subscriptionId, resourceGroupName, vmName string) (string, error) {
+	return p.startOperation(OperationVmDelete, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		ss, instance := p.findVm(subscriptionId, resourceGroupName, vmName)
+		if instance == nil {
+			return fakeNotFound()
+		}
+		return p.deleteInstance(ss, instance.InstanceId)
+	})
+}
+
+func (p *FakeCloudProvider) UpdateVmTags(ctx context.Context, subscriptionId, resourceGroupName, vmName string, tags map[string]string) (string, error) {
+	return p.startOperation(OperationVmTags, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		_, instance := p.findVm(subscriptionId, resourceGroupName, vmName)
+		if instance == nil {
+			return fmt.Errorf("cannot get vm %s: %v", vmName, fakeNotFound())
+		}
+		for k, v := range tags {
+			instance.Tags[k] = v
+		}
+		return nil
+	})
+}
+
+func (p *FakeCloudProvider) ListScaleSetNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) ([]*armnetwork.Interface, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return nil, err
+	}
+	nics := make([]*armnetwork.Interface, 0, len(ss.instances))
+	for _, instance := range ss.instances {
+		nics = append(nics, ss.toNetworkInterface(instance))
+	}
+	return nics, nil
+}
+
+func (p *FakeCloudProvider) GetNetworkInterface(ctx context.Context, subscriptionId, resourceGroupName, nicName string) (*armnetwork.Interface, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, instance := p.findVm(subscriptionId, resourceGroupName, nicName)
+	if instance == nil {
+		return nil, fakeNotFound()
+	}
+	return ss.toNetworkInterface(instance), nil
+}
+
+func (p *FakeCloudProvider) GetScaleSetVmPublicIp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceIndex, nicName, ipConfigName string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ss, err := p.getScaleSet(subscriptionId, resourceGroupName, vmScaleSetName)
+	if err != nil {
+		return "", err
+	}
+	instance, _ := ss.findInstance(instanceIndex)
+	if instance == nil {
+		return "", fakeNotFound()
+	}
+	return instance.PublicIp, nil
+}
+
+func (p *FakeCloudProvider) CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName, accountName string, params armstorage.AccountCreateParameters) (string, error) {
+	return p.startOperation(OperationStorageAccountCreate, func() error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		key := fakeResourceKey(subscriptionId, resourceGroupName, accountName)
+		if _, ok := p.storageAccounts[key]; ok {
+			return &azcore.ResponseError{ErrorCode: "StorageAccountAlreadyExists", StatusCode: http.StatusConflict}
+		}
+		p.storageAccounts[key] = fmt.Sprintf("%s-key", accountName)
+		return nil
+	})
+}
+
+func (p *FakeCloudProvider) GetStorageAccountKey(ctx context.Context, subscriptionId, resourceGroupName, accountName string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.storageAccounts[fakeResourceKey(subscriptionId, resourceGroupName, accountName)]
+	if !ok {
+		return "", fakeNotFound()
+	}
+	return key, nil
+}
+
+func (p *FakeCloudProvider) GetSecret(ctx context.Context, keyVaultUri, secretName string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	secret, ok := p.secrets[fakeResourceKey(keyVaultUri, secretName)]
+	if !ok {
+		return "", &azcore.ResponseError{ErrorCode: "SecretNotFound", StatusCode: http.StatusNotFound}
+	}
+	return secret, nil
+}
+
+func (p *FakeCloudProvider) SetSecret(ctx context.Context, keyVaultUri, secretName, secretValue string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.secrets[fakeResourceKey(keyVaultUri, secretName)] = secretValue
+	return nil
+}
+
+func (p *FakeCloudProvider) CheckIdentity(ctx context.Context) error {
+	return nil
+}
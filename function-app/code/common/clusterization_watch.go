@@ -0,0 +1,96 @@
+package common
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const clusterizationWatchPrefix = "clusterization"
+
+// ClusterizationReelection is the removal of a clusterization instance which stalled
+type ClusterizationReelection struct {
+	Instance string `json:"instance"`
+	Reason   string `json:"reason"`
+	// Removed are the instances removed from the state, the clusterization instance and the ones which
+	// were told to join the cluster it was creating
+	Removed []string  `json:"removed"`
+	Time    time.Time `json:"time"`
+}
+
+// ClusterizationWatch follows the instance elected to clusterize, the instance which reaches the clusterization
+// target in the state. The progress of the clusterization is detected by changes of its reports.
+type ClusterizationWatch struct {
+	Instance  string    `json:"instance,omitempty"`
+	ElectedAt time.Time `json:"elected_at"`
+	// LastReport is the last progress and error reports of the instance, they include the report time
+	LastReport     string                     `json:"last_report,omitempty"`
+	LastProgressAt time.Time                  `json:"last_progress_at"`
+	Reelections    []ClusterizationReelection `json:"reelections"`
+}
+
+// GetClusterizationInstance returns the instance elected to clusterize, empty when not enough instances are ready
+func GetClusterizationInstance(state protocol.ClusterState) string {
+	if state.Clusterized || state.ClusterizationTarget <= 0 || len(state.Instances) < state.ClusterizationTarget {
+		return ""
+	}
+	return state.Instances[state.ClusterizationTarget-1].Name
+}
+
+// Observe follows the clusterization instance of the state, the progress time is moved forward when its reports change
+func (w *ClusterizationWatch) Observe(state protocol.ClusterState, now time.Time) {
+	instance := GetClusterizationInstance(state)
+	if instance == "" {
+		w.Instance, w.LastReport = "", ""
+		return
+	}
+
+	hostname := instance
+	if parts := strings.Split(instance, ":"); len(parts) > 1 {
+		hostname = parts[1]
+	}
+	lastReport := ""
+	for _, reports := range [][]string{state.Progress[hostname], state.Errors[hostname]} {
+		if len(reports) > 0 {
+			lastReport += reports[len(reports)-1]
+		}
+		lastReport += "\n"
+	}
+
+	if w.Instance != instance {
+		w.Instance, w.ElectedAt = instance, now
+		w.LastReport, w.LastProgressAt = lastReport, now
+	} else if w.LastReport != lastReport {
+		w.LastReport, w.LastProgressAt = lastReport, now
+	}
+}
+
+// Stalled tells whether the clusterization instance didn't report for longer than the timeout
+func (w *ClusterizationWatch) Stalled(now time.Time, timeout time.Duration) bool {
+	return w.Instance != "" && now.Sub(w.LastProgressAt) > timeout
+}
+
+// the clusterization watch is kept next to the state it belongs to, like the operations
+func clusterizationWatchParams(stateParams BlobObjParams) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      path.Join(clusterizationWatchPrefix, stateParams.BlobName+".json"),
+	}
+}
+
+func newClusterizationWatch() ClusterizationWatch {
+	return ClusterizationWatch{Reelections: []ClusterizationReelection{}}
+}
+
+func GetClusterizationWatch(ctx context.Context, store StateStore, stateParams BlobObjParams) (watch ClusterizationWatch, err error) {
+	watch, _, err = readJsonObject(ctx, store, clusterizationWatchParams(stateParams), newClusterizationWatch)
+	return
+}
+
+func UpdateClusterizationWatch(ctx context.Context, store StateStore, stateParams BlobObjParams, updateFn func(watch *ClusterizationWatch) error) (ClusterizationWatch, error) {
+	return updateJsonObject(ctx, store, clusterizationWatchParams(stateParams), newClusterizationWatch, updateFn)
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestClusterizationWatch(t *testing.T) {
+	state := protocol.ClusterState{
+		ClusterizationTarget: 2,
+		Instances:            []protocol.Vm{{Name: "vmss_0:backend0"}},
+		Progress:             map[string][]string{},
+	}
+	start := time.Now()
+	timeout := 30 * time.Minute
+
+	watch := ClusterizationWatch{}
+	watch.Observe(state, start)
+	if watch.Instance != "" || watch.Stalled(start.Add(time.Hour), timeout) {
+		t.Fatalf("expected no clusterization instance before the target is reached, got %s", watch.Instance)
+	}
+
+	state.Instances = append(state.Instances, protocol.Vm{Name: "vmss_1:backend1"})
+	watch.Observe(state, start)
+	if watch.Instance != "vmss_1:backend1" || watch.ElectedAt != start {
+		t.Fatalf("expected vmss_1:backend1 elected, got %q", watch.Instance)
+	}
+
+	// the reports of the other instances are not progress of the clusterization
+	state.Progress["backend0"] = []string{"10:00:00 UTC: joined"}
+	watch.Observe(state, start.Add(20*time.Minute))
+	if !watch.Stalled(start.Add(40*time.Minute), timeout) {
+		t.Error("expected the clusterization to be stalled")
+	}
+
+	state.Progress["backend1"] = []string{"10:20:00 UTC: creating cluster"}
+	watch.Observe(state, start.Add(20*time.Minute))
+	if watch.Stalled(start.Add(40*time.Minute), timeout) || !watch.Stalled(start.Add(51*time.Minute), timeout) {
+		t.Errorf("expected the progress at %s, got %s", start.Add(20*time.Minute), watch.LastProgressAt)
+	}
+
+	state.Clusterized = true
+	watch.Observe(state, start.Add(time.Hour))
+	if watch.Instance != "" || watch.Stalled(start.Add(2*time.Hour), timeout) {
+		t.Error("expected no clusterization instance once clusterized")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha256"
 	_ "embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,12 +12,11 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
-	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
-	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azsecrets"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v4"
@@ -46,6 +46,12 @@ const (
 	// NFS VMs tag
 	NfsInterfaceGroupPortKey   = "nfs_interface_group_port"
 	NfsInterfaceGroupPortValue = "ready"
+	// parallel per instance calls made when terminating instances
+	instanceCallsParallelism = 10
+	// time to wait for the deletion protection removal before deleting an instance
+	protectionRemovalTimeout = 2 * time.Minute
+	// time to wait for the storage account creation during clusterization
+	storageAccountCreateTimeout = 10 * time.Minute
 )
 
 var (
@@ -88,17 +94,7 @@ for d in json.load(sys.stdin)['disks']:
 `
 
 func getCredential(ctx context.Context) (*azidentity.ManagedIdentityCredential, error) {
-	logger := logging.LoggerFromCtx(ctx)
-
-	credOpt := &azidentity.ManagedIdentityCredentialOptions{
-		ID: azidentity.ClientID(userAssignedClientId),
-	}
-	credential, err := azidentity.NewManagedIdentityCredential(credOpt)
-	if err != nil {
-		logger.Error().CallerSkipFrame(1).Err(err).Msg("failed to get credential")
-		return nil, err
-	}
-	return credential, nil
+	return sdkClients.getCredential(ctx)
 }
 
 func WriteResponse(w http.ResponseWriter, resData map[string]any, statusCode *int) {
@@ -133,15 +129,9 @@ func WriteSuccessResponse(w http.ResponseWriter, data any) {
 func leaseContainerAcquire(ctx context.Context, storageAccountName, containerName string, leaseIdIn *string) (leaseIdOut *string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
+	containerClient, err := getContainerClient(ctx, storageAccountName, containerName)
 	if err != nil {
-		return
-	}
-
-	containerUrl := getContainerUrl(storageAccountName, containerName)
-	containerClient, err := container.NewClient(containerUrl, credential, nil)
-	if err != nil {
-		logger.Error().Msgf("container.NewClient: %s", err)
+		logger.Error().Msgf("cannot get container client: %s", err)
 		return
 	}
 
@@ -153,7 +143,7 @@ func leaseContainerAcquire(ctx context.Context, storageAccountName, containerNam
 		logger.Error().Msgf("lease.NewContainerClient: %s", err)
 		return
 	}
-	duration := int32(60)
+	duration := int32(LockLeaseDuration.Seconds())
 	for i := 1; i < 1000; i++ {
 		lease, err2 := leaseContainerClient.AcquireLease(ctx, duration, nil)
 		err = err2
@@ -177,15 +167,9 @@ func leaseContainerAcquire(ctx context.Context, storageAccountName, containerNam
 func leaseContainerRelease(ctx context.Context, storageAccountName, containerName string, leaseId *string) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
+	containerClient, err := getContainerClient(ctx, storageAccountName, containerName)
 	if err != nil {
-		return
-	}
-
-	containerUrl := getContainerUrl(storageAccountName, containerName)
-	containerClient, err := container.NewClient(containerUrl, credential, nil)
-	if err != nil {
-		logger.Error().Msgf("container.NewClient: %s", err)
+		logger.Error().Msgf("cannot get container client: %s", err)
 		return
 	}
 
@@ -207,33 +191,32 @@ func leaseContainerRelease(ctx context.Context, storageAccountName, containerNam
 	return
 }
 
-func LockContainer(ctx context.Context, storageAccountName, containerName string) (*string, error) {
-	logger := logging.LoggerFromCtx(ctx)
-	logger.Debug().Msgf("locking %s", containerName)
-	return leaseContainerAcquire(ctx, storageAccountName, containerName, nil)
-}
+func leaseContainerRenew(ctx context.Context, storageAccountName, containerName string, leaseId *string) (err error) {
+	containerClient, err := getContainerClient(ctx, storageAccountName, containerName)
+	if err != nil {
+		return
+	}
 
-func UnlockContainer(ctx context.Context, storageAccountName, containerName string, leaseId *string) error {
-	logger := logging.LoggerFromCtx(ctx)
-	logger.Debug().Msgf("unlocking %s", containerName)
-	err := leaseContainerRelease(ctx, storageAccountName, containerName, leaseId)
+	leaseContainerClient, err := lease.NewContainerClient(containerClient, &lease.ContainerClientOptions{LeaseID: leaseId})
 	if err != nil {
-		logger.Error().Msgf("Failed leaseContainerRelease: %s", err)
+		return
 	}
-	return err
+
+	_, err = leaseContainerClient.RenewLease(ctx, nil)
+	return
 }
 
 func ReadBlobObject(ctx context.Context, bl BlobObjParams) (state []byte, err error) {
-	logger := logging.LoggerFromCtx(ctx)
+	state, _, err = readBlobObjectWithETag(ctx, bl)
+	return
+}
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
+func readBlobObjectWithETag(ctx context.Context, bl BlobObjParams) (state []byte, etag string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
 
-	blobClient, err := azblob.NewClient(getBlobUrl(bl.StorageName), credential, nil)
+	blobClient, err := getBlobServiceClient(ctx, bl.StorageName)
 	if err != nil {
-		logger.Error().Msgf("azblob.NewClient: %s", err)
+		logger.Error().Msgf("cannot get blob client: %s", err)
 		return
 	}
 
@@ -242,6 +225,11 @@ func ReadBlobObject(ctx context.Context, bl BlobObjParams) (state []byte, err er
 		logger.Error().Msgf("blobClient.DownloadStream: %s", err)
 		return
 	}
+	defer downloadResponse.Body.Close()
+
+	if downloadResponse.ETag != nil {
+		etag = string(*downloadResponse.ETag)
+	}
 
 	state, err = io.ReadAll(downloadResponse.Body)
 	if err != nil {
@@ -268,13 +256,7 @@ func containerExists(ctx context.Context, containerClient *container.Client, sto
 func ensureStorageContainer(ctx context.Context, storageAccountName, containerName string) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	containerUrl := getContainerUrl(storageAccountName, containerName)
-	containerClient, err := container.NewClient(containerUrl, credential, nil)
+	containerClient, err := getContainerClient(ctx, storageAccountName, containerName)
 	if err != nil {
 		err = fmt.Errorf("failed to create container client: %v", err)
 		return err
@@ -314,27 +296,15 @@ func blobExists(ctx context.Context, blobClient *blob.Client) (bool, error) {
 	return true, nil
 }
 
-func EnsureStateIsCreated(ctx context.Context, p BlobObjParams, initialState protocol.ClusterState) (exists bool, err error) {
+func EnsureStateIsCreated(ctx context.Context, store StateStore, p BlobObjParams, initialState protocol.ClusterState) (exists bool, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	err = ensureStorageContainer(ctx, p.StorageName, p.ContainerName)
-	if err != nil {
-		return
-	}
-
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	url := getBlobFileUrl(p.StorageName, p.ContainerName, p.BlobName)
-	blobClient, err := blob.NewClient(url, credential, nil)
+	err = store.EnsureContainer(ctx, p)
 	if err != nil {
-		logger.Error().Err(err).Msg("failed to create blob client")
 		return
 	}
 
-	exists, err = blobExists(ctx, blobClient)
+	exists, err = store.Exists(ctx, p)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
@@ -347,33 +317,33 @@ func EnsureStateIsCreated(ctx context.Context, p BlobObjParams, initialState pro
 
 	logger.Info().Msg("state does not exist, creating new state")
 
-	err = WriteState(ctx, p, initialState)
+	err = WriteState(ctx, store, p, initialState)
 	if err != nil {
 		logger.Error().Err(err).Msg("failed to write initial state")
 	}
 	return
 }
 
-func ReadStateOrCreateNew(ctx context.Context, p BlobObjParams, initialState protocol.ClusterState) (state protocol.ClusterState, err error) {
-	exists, err := EnsureStateIsCreated(ctx, p, initialState)
+func ReadStateOrCreateNew(ctx context.Context, store StateStore, p BlobObjParams, initialState protocol.ClusterState) (state protocol.ClusterState, err error) {
+	exists, err := EnsureStateIsCreated(ctx, store, p, initialState)
 	if err != nil {
 		return
 	}
 
 	if exists {
-		return ReadState(ctx, p)
+		return ReadState(ctx, store, p)
 	}
 	return initialState, nil
 }
 
-func ReadState(ctx context.Context, stateParams BlobObjParams) (state protocol.ClusterState, err error) {
+func ReadState(ctx context.Context, store StateStore, stateParams BlobObjParams) (state protocol.ClusterState, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	stateAsByteArray, err := ReadBlobObject(ctx, stateParams)
+	stateAsByteArray, _, err := store.Read(ctx, stateParams)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(stateAsByteArray, &state)
+	state, err = decodeState(stateAsByteArray)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
@@ -383,35 +353,62 @@ func ReadState(ctx context.Context, stateParams BlobObjParams) (state protocol.C
 }
 
 func WriteBlobObject(ctx context.Context, bl BlobObjParams, state []byte) (err error) {
+	_, err = writeBlobObjectIfMatch(ctx, bl, state, "")
+	return
+}
+
+// writeBlobObjectIfMatch uploads the blob, when ifMatch is not empty the upload is conditioned on the blob ETag,
+// or on the blob not existing for IfNotExists
+func writeBlobObjectIfMatch(ctx context.Context, bl BlobObjParams, state []byte, ifMatch string) (etag string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
+	blobClient, err := getBlobServiceClient(ctx, bl.StorageName)
 	if err != nil {
+		logger.Error().Err(err).Send()
 		return
 	}
 
-	blobClient, err := azblob.NewClient(getBlobUrl(bl.StorageName), credential, nil)
+	options := &azblob.UploadBufferOptions{}
+	switch ifMatch {
+	case "":
+	case IfNotExists:
+		anyETag := azcore.ETagAny
+		options.AccessConditions = &azblob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &anyETag},
+		}
+	default:
+		azEtag := azcore.ETag(ifMatch)
+		options.AccessConditions = &azblob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: &azEtag},
+		}
+	}
+
+	resp, err := blobClient.UploadBuffer(ctx, bl.ContainerName, bl.BlobName, state, options)
 	if err != nil {
-		logger.Error().Err(err).Send()
 		return
 	}
-
-	_, err = blobClient.UploadBuffer(ctx, bl.ContainerName, bl.BlobName, state, &azblob.UploadBufferOptions{})
-
+	if resp.ETag != nil {
+		etag = string(*resp.ETag)
+	}
 	return
 
 }
 
-func WriteState(ctx context.Context, stateParams BlobObjParams, state protocol.ClusterState) (err error) {
+func WriteState(ctx context.Context, store StateStore, stateParams BlobObjParams, state protocol.ClusterState) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	stateAsByteArray, err := json.Marshal(state)
+	stateAsByteArray, err := encodeState(state)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
 
-	err = WriteBlobObject(ctx, stateParams, stateAsByteArray)
+	_, err = store.Write(ctx, stateParams, stateAsByteArray, "")
+	if err != nil {
+		return
+	}
+
+	saveStateVersion(ctx, store, stateParams, stateAsByteArray)
 	return
 }
 
@@ -435,34 +432,24 @@ func (e *ShutdownRequired) Error() string {
 	return e.Message
 }
 
-func AddInstanceToState(ctx context.Context, subscriptionId, resourceGroupName string, stateParams BlobObjParams, newInstance protocol.Vm) (state protocol.ClusterState, err error) {
+func AddInstanceToState(ctx context.Context, store StateStore, subscriptionId, resourceGroupName string, stateParams BlobObjParams, newInstance protocol.Vm) (state protocol.ClusterState, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	leaseId, err := LockContainer(ctx, stateParams.StorageName, stateParams.ContainerName)
-	if err != nil {
-		return
-	}
-	defer UnlockContainer(ctx, stateParams.StorageName, stateParams.ContainerName, leaseId)
-
-	state, err = ReadState(ctx, stateParams)
-	if err != nil {
-		return
-	}
-
-	if len(state.Instances) >= state.InitialSize {
-		message := "cluster size is already satisfied"
-		err = &ShutdownRequired{
-			Message: message,
-		}
-		logger.Error().Err(err).Send()
-	} else if state.Clusterized {
-		err = &ShutdownRequired{
-			Message: "cluster is already clusterized",
+	state, err = UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		if len(state.Instances) >= state.InitialSize {
+			return &ShutdownRequired{
+				Message: "cluster size is already satisfied",
+			}
+		} else if state.Clusterized {
+			return &ShutdownRequired{
+				Message: "cluster is already clusterized",
+			}
 		}
-		logger.Error().Err(err).Send()
-	} else {
 		state.Instances = append(state.Instances, newInstance)
-		err = WriteState(ctx, stateParams, state)
+		return nil
+	})
+	if _, ok := err.(*ShutdownRequired); ok {
+		logger.Error().Err(err).Send()
 	}
 	return
 }
@@ -474,25 +461,18 @@ func GetStateInstancesNames(vms []protocol.Vm) (instanceNames []string) {
 	return
 }
 
-func UpdateClusterized(ctx context.Context, subscriptionId, resourceGroupName string, stateParams BlobObjParams) (state protocol.ClusterState, err error) {
+func UpdateClusterized(ctx context.Context, store StateStore, subscriptionId, resourceGroupName string, stateParams BlobObjParams) (state protocol.ClusterState, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	leaseId, err := LockContainer(ctx, stateParams.StorageName, stateParams.ContainerName)
-	if err != nil {
-		return
-	}
-	defer UnlockContainer(ctx, stateParams.StorageName, stateParams.ContainerName, leaseId)
-
-	state, err = ReadState(ctx, stateParams)
+	state, err = UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		state.Instances = []protocol.Vm{}
+		state.Clusterized = true
+		return nil
+	})
 	if err != nil {
 		return
 	}
 
-	state.Instances = []protocol.Vm{}
-	state.Clusterized = true
-
-	err = WriteState(ctx, stateParams, state)
-
 	logger.Info().Msg("State updated to 'clusterized'")
 	return
 }
@@ -521,7 +501,7 @@ func CreatePrivateDnsZoneGroup(ctx context.Context, subscriptionId, resourceGrou
 		},
 	}
 
-	client, err := armnetwork.NewPrivateDNSZoneGroupsClient(subscriptionId, credential, nil)
+	client, err := armnetwork.NewPrivateDNSZoneGroupsClient(subscriptionId, credential, armClientOptions())
 	if err != nil {
 		err = fmt.Errorf("failed to create PrivateDNSZoneGroupsClient: %w", err)
 		return
@@ -551,7 +531,7 @@ func CreateStorageAccountBlobPrivateEndpoint(ctx context.Context, subscriptionId
 		return
 	}
 
-	client, err := armnetwork.NewPrivateEndpointsClient(subscriptionId, credential, nil)
+	client, err := armnetwork.NewPrivateEndpointsClient(subscriptionId, credential, armClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
@@ -610,16 +590,6 @@ func CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msgf("creating storage account: %v", obsParams)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := armstorage.NewAccountsClient(subscriptionId, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
 	skuName := armstorage.SKUNameStandardZRS
 	kind := armstorage.KindStorageV2
 	publicAccess := armstorage.PublicNetworkAccessEnabled
@@ -645,7 +615,7 @@ func CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName
 		}
 	}
 
-	_, err = client.BeginCreate(ctx, resourceGroupName, obsParams.Name, armstorage.AccountCreateParameters{
+	resumeToken, err := CloudProviderFromCtx(ctx).CreateStorageAccount(ctx, subscriptionId, resourceGroupName, obsParams.Name, armstorage.AccountCreateParameters{
 		Kind:     &kind,
 		Location: &location,
 		SKU: &armstorage.SKU{
@@ -655,7 +625,7 @@ func CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName
 			PublicNetworkAccess: &publicAccess,
 			NetworkRuleSet:      networkRuleSet,
 		},
-	}, nil)
+	})
 
 	if err != nil {
 		if azerr, ok := err.(*azcore.ResponseError); ok {
@@ -671,6 +641,16 @@ func CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName
 			return
 		}
 	}
+	err = waitOperation(ctx, Operation{
+		Kind:           OperationStorageAccountCreate,
+		SubscriptionId: subscriptionId,
+		Resource:       obsParams.Name,
+		Description:    fmt.Sprintf("create storage account %s", obsParams.Name),
+	}, resumeToken, storageAccountCreateTimeout)
+	if err != nil {
+		logger.Error().Msgf("storage creation failed: %s", err)
+		return
+	}
 
 	for i := 0; i < 10; i++ {
 		accessKey, err = getStorageAccountAccessKey(ctx, subscriptionId, resourceGroupName, obsParams.Name)
@@ -700,22 +680,10 @@ func CreateStorageAccount(ctx context.Context, subscriptionId, resourceGroupName
 func getStorageAccountAccessKey(ctx context.Context, subscriptionId, resourceGroupName, obsName string) (accessKey string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := armstorage.NewAccountsClient(subscriptionId, credential, nil)
+	accessKey, err = CloudProviderFromCtx(ctx).GetStorageAccountKey(ctx, subscriptionId, resourceGroupName, obsName)
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return
-	}
-	keys, err := client.ListKeys(ctx, resourceGroupName, obsName, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
 	}
-	accessKey = *keys.Keys[0].Value
 	return
 }
 
@@ -723,12 +691,7 @@ func CreateContainer(ctx context.Context, storageAccountName, containerName stri
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msgf("creating obs container %s in storage account %s", containerName, storageAccountName)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	blobClient, err := azblob.NewClient(getBlobUrl(storageAccountName), credential, nil)
+	blobClient, err := getBlobServiceClient(ctx, storageAccountName)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
@@ -752,24 +715,10 @@ func GetKeyVaultValue(ctx context.Context, keyVaultUri, secretName string) (secr
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msgf("fetching key vault secret: %s", secretName)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := azsecrets.NewClient(keyVaultUri, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
-	resp, err := client.GetSecret(ctx, secretName, "", nil)
+	secret, err = CloudProviderFromCtx(ctx).GetSecret(ctx, keyVaultUri, secretName)
 	if err != nil {
 		logger.Info().Err(err).Send()
-		return
 	}
-
-	secret = *resp.Value
-
 	return
 }
 
@@ -777,22 +726,7 @@ func SetKeyVaultValue(ctx context.Context, keyVaultUri, secretName, secretValue
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msgf("setting key vault secret: %s", secretName)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := azsecrets.NewClient(keyVaultUri, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
-
-	params := azsecrets.SetSecretParameters{
-		Value: &secretValue,
-	}
-
-	_, err = client.SetSecret(ctx, secretName, params, nil)
+	err = CloudProviderFromCtx(ctx).SetSecret(ctx, keyVaultUri, secretName, secretValue)
 	if err != nil {
 		logger.Error().Err(err).Send()
 	}
@@ -804,26 +738,9 @@ func SetKeyVaultValue(ctx context.Context, keyVaultUri, secretName, secretValue
 func getUniformScaleSetVmsNetworkInterfaces(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (networkInterfaces []*armnetwork.Interface, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := armnetwork.NewInterfacesClient(subscriptionId, credential, nil)
+	networkInterfaces, err = CloudProviderFromCtx(ctx).ListScaleSetNetworkInterfaces(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return
-	}
-
-	pager := client.NewListVirtualMachineScaleSetNetworkInterfacesPager(resourceGroupName, vmScaleSetName, nil)
-
-	for pager.More() {
-		nextResult, err := pager.NextPage(ctx)
-		if err != nil {
-			logger.Error().Err(err).Send()
-			return nil, err
-		}
-		networkInterfaces = append(networkInterfaces, nextResult.Value...)
 	}
 	return
 }
@@ -853,27 +770,16 @@ func getFlexibleScaleSetVmsNetworkInterfaces(ctx context.Context, subscriptionId
 		}
 	}
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return nil, err
-	}
-
-	client, err := armnetwork.NewInterfacesClient(subscriptionId, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return nil, err
-	}
-
+	cloud := CloudProviderFromCtx(ctx)
 	for _, nicId := range nicIds {
 		nicIdParts := strings.Split(nicId, "/")
 		nicName := nicIdParts[len(nicIdParts)-1]
-		resp, err := client.Get(ctx, resourceGroupName, nicName, nil)
+		nic, err := cloud.GetNetworkInterface(ctx, subscriptionId, resourceGroupName, nicName)
 		if err != nil {
 			logger.Error().Err(err).Send()
 			return nil, err
 		}
-		networkInterfaces = append(networkInterfaces, &resp.Interface)
+		networkInterfaces = append(networkInterfaces, nic)
 	}
 	return
 }
@@ -937,31 +843,11 @@ func GetPublicIp(ctx context.Context, vmssParams *ScaleSetParams, prefix, cluste
 		return
 	}
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := armnetwork.NewPublicIPAddressesClient(vmssParams.SubscriptionId, credential, nil)
+	interfaceName := fmt.Sprintf("%s-%s-backend-nic-0", prefix, clusterName)
+	publicIp, err = CloudProviderFromCtx(ctx).GetScaleSetVmPublicIp(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceIndex, interfaceName, "ipconfig0")
 	if err != nil {
 		logger.Error().Err(err).Send()
-		return
 	}
-	interfaceName := fmt.Sprintf("%s-%s-backend-nic-0", prefix, clusterName)
-	pager := client.NewListVirtualMachineScaleSetVMPublicIPAddressesPager(vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceIndex, interfaceName, "ipconfig0", nil)
-
-	for pager.More() {
-		nextResult, err1 := pager.NextPage(ctx)
-		if err1 != nil {
-			logger.Error().Err(err1).Send()
-			return "", err1
-		}
-		if len(nextResult.Value) > 0 {
-			publicIp = *nextResult.Value[0].Properties.IPAddress
-			return
-		}
-	}
-
 	return
 }
 
@@ -992,38 +878,50 @@ func ScaleUp(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetN
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msg("updating scale set vms num")
 
-	credential, err := getCredential(ctx)
+	cloud := CloudProviderFromCtx(ctx)
+	scaleSet, err := cloud.GetScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
 	if err != nil {
+		logger.Error().Err(err).Send()
 		return
 	}
 
-	client, err := armcompute.NewVirtualMachineScaleSetsClient(subscriptionId, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
+	scaleSetCapacity := *scaleSet.SKU.Capacity
+	if scaleSetCapacity >= newSize {
+		logger.Info().Msgf(
+			"scale set %s capacity:%d desired capacity:%d, skipping scale up", vmScaleSetName, scaleSetCapacity, newSize)
 		return
 	}
 
-	response, err := client.Get(ctx, resourceGroupName, vmScaleSetName, nil)
+	resumeToken, err := cloud.SetScaleSetCapacity(ctx, subscriptionId, resourceGroupName, vmScaleSetName, newSize)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
+	TrackOperation(ctx, Operation{
+		Kind:           OperationScaleSetCapacity,
+		SubscriptionId: subscriptionId,
+		Resource:       vmScaleSetName,
+		Description:    fmt.Sprintf("set capacity of %s to %d", vmScaleSetName, newSize),
+	}, resumeToken)
+	return
+}
 
-	scaleSetCapacity := *response.SKU.Capacity
-	if scaleSetCapacity >= newSize {
-		logger.Info().Msgf(
-			"scale set %s capacity:%d desired capacity:%d, skipping scale up", vmScaleSetName, scaleSetCapacity, newSize)
-		return
-	}
+// DeleteScaleSet starts the deletion of the scale set and its VMs, the operation is tracked in the state of ctx
+func DeleteScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("deleting scale set %s", vmScaleSetName)
 
-	_, err = client.BeginUpdate(ctx, resourceGroupName, vmScaleSetName, armcompute.VirtualMachineScaleSetUpdate{
-		SKU: &armcompute.SKU{
-			Capacity: &newSize,
-		},
-	}, nil)
+	resumeToken, err := CloudProviderFromCtx(ctx).DeleteScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
 	if err != nil {
 		logger.Error().Err(err).Send()
+		return
 	}
+	TrackOperation(ctx, Operation{
+		Kind:           OperationScaleSetDelete,
+		SubscriptionId: subscriptionId,
+		Resource:       vmScaleSetName,
+		Description:    fmt.Sprintf("delete scale set %s", vmScaleSetName),
+	}, resumeToken)
 	return
 }
 
@@ -1035,7 +933,7 @@ func GetRoleDefinitionByRoleName(ctx context.Context, roleName, scope string) (*
 		return nil, err
 	}
 
-	client, err := armauthorization.NewRoleDefinitionsClient(credential, nil)
+	client, err := armauthorization.NewRoleDefinitionsClient(credential, armClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return nil, err
@@ -1085,7 +983,7 @@ func AssignStorageBlobDataContributorRoleToScaleSet(
 		return nil, err
 	}
 
-	client, err := armauthorization.NewRoleAssignmentsClient(subscriptionId, credential, nil)
+	client, err := armauthorization.NewRoleAssignmentsClient(subscriptionId, credential, armClientOptions())
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return nil, err
@@ -1162,23 +1060,12 @@ func getScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScale
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msgf("Getting scale set %s info", vmScaleSetName)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	client, err := armcompute.NewVirtualMachineScaleSetsClient(subscriptionId, credential, nil)
+	scaleSet, err := CloudProviderFromCtx(ctx).GetScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return nil, err
 	}
-
-	scaleSet, err := client.Get(ctx, resourceGroupName, vmScaleSetName, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return nil, err
-	}
-	return &scaleSet.VirtualMachineScaleSet, nil
+	return scaleSet, nil
 }
 
 func GetScaleSetOrNil(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (*armcompute.VirtualMachineScaleSet, error) {
@@ -1210,37 +1097,18 @@ func GetScaleSetInstances(ctx context.Context, vmssParams *ScaleSetParams) (vms
 func GetUniformScaleSetInstances(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string, expand *armcompute.ExpandTypeForListVMs) (vms []*VMInfoSummary, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
-
 	var expandStr *string
 	if expand != nil {
 		expandStr = (*string)(expand)
 	}
 
-	pager := client.NewListPager(
-		resourceGroupName, vmScaleSetName, &armcompute.VirtualMachineScaleSetVMsClientListOptions{
-			Expand: expandStr,
-		})
-
-	for pager.More() {
-		nextResult, err := pager.NextPage(ctx)
-		if err != nil {
-			err = fmt.Errorf("failed to advance page getting images list: %v", err)
-			logger.Error().Err(err).Send()
-			return nil, err
-		}
-		vmsSummary := UniformVmssVMsToVmInfoSummary(nextResult.Value)
-		vms = append(vms, vmsSummary...)
+	vmssVms, err := CloudProviderFromCtx(ctx).ListScaleSetVms(ctx, subscriptionId, resourceGroupName, vmScaleSetName, expandStr)
+	if err != nil {
+		err = fmt.Errorf("failed to advance page getting images list: %v", err)
+		logger.Error().Err(err).Send()
+		return nil, err
 	}
+	vms = UniformVmssVMsToVmInfoSummary(vmssVms)
 	return
 }
 
@@ -1259,39 +1127,24 @@ func GetFlexibleScaleSetInstances(ctx context.Context, subscriptionId, resourceG
 	}
 
 	// fetch vms ids along with protection policy info (can only be fethced via VMSS VMs client)
-	credential, err := getCredential(ctx)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
-
-	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, nil)
+	vmssVms, err := CloudProviderFromCtx(ctx).ListScaleSetVms(ctx, subscriptionId, resourceGroupName, vmScaleSetName, nil)
 	if err != nil {
+		err = fmt.Errorf("cannot get scale set %s vms: %v", vmScaleSetName, err)
 		logger.Error().Err(err).Send()
-		return
+		return nil, err
 	}
-
-	vmssVmPager := client.NewListPager(resourceGroupName, vmScaleSetName, nil)
-	for vmssVmPager.More() {
-		nextResult, err := vmssVmPager.NextPage(ctx)
-		if err != nil {
-			err = fmt.Errorf("cannot get scale set %s vms: %v", vmScaleSetName, err)
+	for _, vmssVm := range vmssVms {
+		vmName := *vmssVm.Name
+		vm, ok := vmNamesToVms[vmName]
+		if ok {
+			if vmssVm.Properties != nil && vmssVm.Properties.ProtectionPolicy != nil {
+				vm.ProtectionPolicy = vmssVm.Properties.ProtectionPolicy
+			}
+		} else {
+			err = fmt.Errorf("cannot find vm %s from the flexible scale set %s", vmName, vmScaleSetName)
 			logger.Error().Err(err).Send()
 			return nil, err
 		}
-		for _, vmssVm := range nextResult.Value {
-			vmName := *vmssVm.Name
-			vm, ok := vmNamesToVms[vmName]
-			if ok {
-				if vmssVm.Properties != nil && vmssVm.Properties.ProtectionPolicy != nil {
-					vm.ProtectionPolicy = vmssVm.Properties.ProtectionPolicy
-				}
-			} else {
-				err = fmt.Errorf("cannot find vm %s from the flexible scale set %s", vmName, vmScaleSetName)
-				logger.Error().Err(err).Send()
-				return nil, err
-			}
-		}
 	}
 	return
 }
@@ -1300,33 +1153,10 @@ func getFlexibleScaleSetVms(ctx context.Context, subscriptionId, resourceGroupNa
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msg("fetching flexible scale set vms")
 
-	credential, err := getCredential(ctx)
+	vms, err = CloudProviderFromCtx(ctx).ListFlexibleScaleSetVms(ctx, subscriptionId, resourceGroupName, vmScaleSetName, expand)
 	if err != nil {
+		err = fmt.Errorf("cannot get flexible scale set %s vms: %v", vmScaleSetName, err)
 		logger.Error().Err(err).Send()
-		return
-	}
-
-	client, err := armcompute.NewVirtualMachinesClient(subscriptionId, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
-
-	filter := fmt.Sprintf("'virtualMachineScaleSet/id' eq '/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s'", subscriptionId, resourceGroupName, vmScaleSetName)
-	options := &armcompute.VirtualMachinesClientListOptions{
-		Filter: &filter,
-		Expand: expand,
-	}
-
-	pager := client.NewListPager(resourceGroupName, options)
-	for pager.More() {
-		nextResult, err := pager.NextPage(ctx)
-		if err != nil {
-			err = fmt.Errorf("cannot get flexible scale set %s vms: %v", vmScaleSetName, err)
-			logger.Error().Err(err).Send()
-			return nil, err
-		}
-		vms = append(vms, nextResult.Value...)
 	}
 	return
 }
@@ -1398,38 +1228,24 @@ func SetDeletionProtection(ctx context.Context, vmssParams *ScaleSetParams, inst
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msgf("Setting deletion protection: %t on instanceId %s", protect, instanceId)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(vmssParams.SubscriptionId, credential, nil)
+	resumeToken, err := CloudProviderFromCtx(ctx).SetScaleSetVmProtection(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceId, protect)
 	if err != nil {
-		logger.Error().Err(err).Send()
 		return
 	}
-
-	_, err = client.BeginUpdate(
-		ctx,
-		vmssParams.ResourceGroupName,
-		vmssParams.ScaleSetName,
-		instanceId,
-		armcompute.VirtualMachineScaleSetVM{
-			Properties: &armcompute.VirtualMachineScaleSetVMProperties{
-				ProtectionPolicy: &armcompute.VirtualMachineScaleSetVMProtectionPolicy{
-					ProtectFromScaleSetActions: &protect,
-				},
-			},
-		},
-		nil)
-
+	TrackOperation(ctx, Operation{
+		Kind:           OperationScaleSetVmProtection,
+		SubscriptionId: vmssParams.SubscriptionId,
+		Resource:       instanceId,
+		Description:    fmt.Sprintf("set deletion protection %t on %s instance %s", protect, vmssParams.ScaleSetName, instanceId),
+	}, resumeToken)
 	return
 }
 
 func RetrySetDeletionProtectionAndReport(
-	ctx context.Context, vmssParams *ScaleSetParams, stateParams BlobObjParams, instanceId, hostName string,
+	ctx context.Context, store StateStore, vmssParams *ScaleSetParams, stateParams BlobObjParams, instanceId, hostName string,
 	maxAttempts int, sleepInterval time.Duration,
 ) (err error) {
+	ctx = ContextWithOperationsState(ctx, stateParams)
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msgf("Setting deletion protection on %s", hostName)
 	counter := 0
@@ -1438,16 +1254,17 @@ func RetrySetDeletionProtectionAndReport(
 		if err == nil {
 			msg := "Deletion protection was set successfully"
 			logger.Info().Msg(msg)
-			ReportMsg(ctx, hostName, stateParams, "progress", msg)
+			ReportMsg(ctx, store, hostName, stateParams, "progress", msg)
 			break
 		}
 
-		if protectionErr, ok := err.(*azcore.ResponseError); ok && protectionErr.ErrorCode == "AuthorizationFailed" {
+		// the role assignments of a new deployment take a while to propagate
+		if IsAuthorizationError(err) {
 			counter++
 			// deletion protection invoked by terminate function
 			if maxAttempts == 0 {
 				msg := "Deletion protection set authorization isn't ready, will retry on next scale down workflow"
-				ReportMsg(ctx, hostName, stateParams, "debug", msg)
+				ReportMsg(ctx, store, hostName, stateParams, "debug", msg)
 				return
 			}
 
@@ -1456,7 +1273,7 @@ func RetrySetDeletionProtectionAndReport(
 			}
 			msg := fmt.Sprintf("Deletion protection set authorization isn't ready, going to sleep for %s", sleepInterval)
 			logger.Info().Msg(msg)
-			ReportMsg(ctx, hostName, stateParams, "debug", msg)
+			ReportMsg(ctx, store, hostName, stateParams, "debug", msg)
 			time.Sleep(sleepInterval)
 		} else {
 			break
@@ -1464,14 +1281,14 @@ func RetrySetDeletionProtectionAndReport(
 	}
 	if err != nil {
 		logger.Error().Err(err).Send()
-		ReportMsg(ctx, hostName, stateParams, "error", err.Error())
+		ReportMsg(ctx, store, hostName, stateParams, "error", err.Error())
 	}
 	return
 }
 
-func ReportMsg(ctx context.Context, hostName string, stateParams BlobObjParams, reportType, message string) {
+func ReportMsg(ctx context.Context, store StateStore, hostName string, stateParams BlobObjParams, reportType, message string) {
 	reportObj := protocol.Report{Type: reportType, Hostname: hostName, Message: message}
-	_ = UpdateStateReporting(ctx, stateParams, reportObj)
+	_ = UpdateStateReporting(ctx, store, stateParams, reportObj)
 }
 
 func GetWekaAdminPassword(ctx context.Context, keyVaultUri string) (password string, err error) {
@@ -1537,138 +1354,184 @@ func FilterSpecificScaleSetInstances(ctx context.Context, allVms []*VMInfoSummar
 	return
 }
 
+// TerminateScaleSetInstances removes the deletion protection of the instances and deletes them, Uniform scale set
+// instances are deleted with a single call. The returned errors name the instance they relate to.
 func TerminateScaleSetInstances(ctx context.Context, vmssParams *ScaleSetParams, terminateInstanceIds []string) (terminatedInstances []string, errs []error) {
 	logger := logging.LoggerFromCtx(ctx)
 
 	if len(terminateInstanceIds) == 0 {
 		return
 	}
+
+	instanceErrs := removeDeletionProtection(ctx, vmssParams, terminateInstanceIds)
+	var toDelete []string
 	for _, instanceId := range terminateInstanceIds {
-		err := SetDeletionProtection(ctx, vmssParams, instanceId, false)
-		if err != nil {
-			errs = append(errs, err)
-			continue
+		if instanceErrs[instanceId] == nil {
+			toDelete = append(toDelete, instanceId)
 		}
-		logger.Info().Msgf("Deleting instanceId %s", instanceId)
+	}
+
+	if len(toDelete) > 0 {
+		logger.Info().Msgf("Deleting instances %v", toDelete)
+		var deleteErrs map[string]error
 		if vmssParams.Flexible {
-			err = deleteFlexibleScaleSetVM(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceId)
+			deleteErrs = forEachInstance(toDelete, func(instanceId string) error {
+				return deleteFlexibleScaleSetVM(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceId)
+			})
 		} else {
-			err = deleteUniformScaleSetVM(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceId)
+			deleteErrs = deleteUniformScaleSetVMs(ctx, vmssParams, toDelete)
 		}
-		if err != nil {
+		for instanceId, err := range deleteErrs {
+			instanceErrs[instanceId] = err
+		}
+	}
+
+	for _, instanceId := range terminateInstanceIds {
+		if err := instanceErrs[instanceId]; err != nil {
+			err = fmt.Errorf("cannot terminate instance %s: %w", instanceId, err)
 			logger.Error().Err(err).Send()
 			errs = append(errs, err)
 			continue
 		}
 		terminatedInstances = append(terminatedInstances, instanceId)
 	}
-
 	return
 }
 
-func deleteFlexibleScaleSetVM(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string) (err error) {
-	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msgf("Deleting instanceId %s from Flexible VMSS %s", instanceId, vmScaleSetName)
+// forEachInstance calls fn for each instance with bounded parallelism and returns the errors by instance id
+func forEachInstance(instanceIds []string, fn func(instanceId string) error) map[string]error {
+	errs := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, instanceCallsParallelism)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
+	for _, instanceId := range instanceIds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(instanceId string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(instanceId); err != nil {
+				mu.Lock()
+				errs[instanceId] = err
+				mu.Unlock()
+			}
+		}(instanceId)
 	}
+	wg.Wait()
+	return errs
+}
 
-	client, err := armcompute.NewVirtualMachinesClient(subscriptionId, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
+// removeDeletionProtection removes the protection of the instances in parallel and waits for it to apply,
+// so that the instances can be deleted right after
+func removeDeletionProtection(ctx context.Context, vmssParams *ScaleSetParams, instanceIds []string) map[string]error {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Removing deletion protection from instances %v", instanceIds)
 
-	force := true
-	_, err = client.BeginDelete(ctx, resourceGroupName, instanceId, &armcompute.VirtualMachinesClientBeginDeleteOptions{
-		ForceDeletion: &force,
+	cloud := CloudProviderFromCtx(ctx)
+	return forEachInstance(instanceIds, func(instanceId string) error {
+		resumeToken, err := cloud.SetScaleSetVmProtection(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceId, false)
+		if err != nil {
+			return err
+		}
+		return waitOperation(ctx, Operation{
+			Kind:           OperationScaleSetVmProtection,
+			SubscriptionId: vmssParams.SubscriptionId,
+			Resource:       instanceId,
+			Description:    fmt.Sprintf("remove deletion protection from %s instance %s", vmssParams.ScaleSetName, instanceId),
+		}, resumeToken, protectionRemovalTimeout)
 	})
-	if err != nil {
-		logger.Error().Err(err).Send()
-	}
-	return
 }
 
-func deleteUniformScaleSetVM(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string) (err error) {
+// deleteUniformScaleSetVMs deletes the instances with a single DeleteInstances call. When it fails, the instances
+// are deleted one by one, so that the instances which can be deleted are and the failures are known per instance.
+func deleteUniformScaleSetVMs(ctx context.Context, vmssParams *ScaleSetParams, instanceIds []string) map[string]error {
 	logger := logging.LoggerFromCtx(ctx)
-	logger.Info().Msgf("Deleting instanceId %s from Uniform VMSS %s", instanceId, vmScaleSetName)
+	logger.Info().Msgf("Deleting instances %v from Uniform VMSS %s", instanceIds, vmssParams.ScaleSetName)
+
+	resumeToken, err := CloudProviderFromCtx(ctx).DeleteScaleSetVms(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceIds)
+	if err == nil {
+		TrackOperation(ctx, Operation{
+			Kind:           OperationScaleSetVmsDelete,
+			SubscriptionId: vmssParams.SubscriptionId,
+			Resource:       vmssParams.ScaleSetName,
+			Description:    fmt.Sprintf("delete instances %s from %s", strings.Join(instanceIds, ","), vmssParams.ScaleSetName),
+		}, resumeToken)
+		return nil
+	}
+
+	logger.Warn().Err(err).Msg("bulk instances deletion failed, deleting instances one by one")
+	return forEachInstance(instanceIds, func(instanceId string) error {
+		return deleteUniformScaleSetVM(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName, instanceId)
+	})
+}
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
+func deleteFlexibleScaleSetVM(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Deleting instanceId %s from Flexible VMSS %s", instanceId, vmScaleSetName)
 
-	client, err := armcompute.NewVirtualMachineScaleSetVMsClient(subscriptionId, credential, nil)
+	resumeToken, err := CloudProviderFromCtx(ctx).DeleteVm(ctx, subscriptionId, resourceGroupName, instanceId)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
 	}
-
-	force := true
-	_, err = client.BeginDelete(
-		ctx,
-		resourceGroupName,
-		vmScaleSetName,
-		instanceId,
-		&armcompute.VirtualMachineScaleSetVMsClientBeginDeleteOptions{
-			ForceDeletion: &force,
-		},
-	)
-	if err != nil {
-		logger.Error().Err(err).Send()
-	}
+	TrackOperation(ctx, Operation{
+		Kind:           OperationVmDelete,
+		SubscriptionId: subscriptionId,
+		Resource:       instanceId,
+		Description:    fmt.Sprintf("delete %s from %s", instanceId, vmScaleSetName),
+	}, resumeToken)
 	return
 }
 
-func UpdateStateReporting(ctx context.Context, stateParams BlobObjParams, report protocol.Report) (err error) {
-	leaseId, err := LockContainer(ctx, stateParams.StorageName, stateParams.ContainerName)
-	if err != nil {
-		return
-	}
-	defer UnlockContainer(ctx, stateParams.StorageName, stateParams.ContainerName, leaseId)
-
-	return UpdateStateReportingWithoutLocking(ctx, stateParams, report)
-}
-
-func AddClusterUpdate(ctx context.Context, stateParams BlobObjParams, update protocol.Update) (err error) {
-	leaseId, err := LockContainer(ctx, stateParams.StorageName, stateParams.ContainerName)
-	if err != nil {
-		return
-	}
-	defer UnlockContainer(ctx, stateParams.StorageName, stateParams.ContainerName, leaseId)
+func deleteUniformScaleSetVM(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, instanceId string) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Info().Msgf("Deleting instanceId %s from Uniform VMSS %s", instanceId, vmScaleSetName)
 
-	state, err := ReadState(ctx, stateParams)
+	resumeToken, err := CloudProviderFromCtx(ctx).DeleteScaleSetVm(ctx, subscriptionId, resourceGroupName, vmScaleSetName, instanceId)
 	if err != nil {
+		logger.Error().Err(err).Send()
 		return
 	}
+	TrackOperation(ctx, Operation{
+		Kind:           OperationScaleSetVmDelete,
+		SubscriptionId: subscriptionId,
+		Resource:       instanceId,
+		Description:    fmt.Sprintf("delete instance %s from %s", instanceId, vmScaleSetName),
+	}, resumeToken)
+	return
+}
 
-	reportLib.AddClusterUpdate(update, &state)
+// UpdateStateReporting adds the report to the state. The entries over the reports caps are appended to the archive
+// before the state without them is written, so a failed archive fails the report instead of losing the entries.
+// The entries are archived again when the state write conflicts, the archive may hold an entry twice but never
+// misses one.
+func UpdateStateReporting(ctx context.Context, store StateStore, stateParams BlobObjParams, report protocol.Report) (err error) {
+	limits := GetReportsLimits()
 
-	err = WriteState(ctx, stateParams, state)
-	if err != nil {
-		err = fmt.Errorf("failed addind cluster update to state")
-		return
-	}
+	_, err = UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		err := reportLib.UpdateReport(report, state)
+		if err != nil {
+			return err
+		}
+		archived := CompactReports(state, limits)
+		if err := ArchiveReports(ctx, store, stateParams, archived); err != nil {
+			return fmt.Errorf("failed archiving %d reports: %w", len(archived), err)
+		}
+		return nil
+	})
 	return
 }
 
-func UpdateStateReportingWithoutLocking(ctx context.Context, stateParams BlobObjParams, report protocol.Report) (err error) {
-	state, err := ReadState(ctx, stateParams)
-	if err != nil {
-		return
-	}
-	err = reportLib.UpdateReport(report, &state)
-	if err != nil {
-		err = fmt.Errorf("failed updating state report")
-		return
-	}
-	err = WriteState(ctx, stateParams, state)
+func AddClusterUpdate(ctx context.Context, store StateStore, stateParams BlobObjParams, update protocol.Update) (err error) {
+	_, err = UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		reportLib.AddClusterUpdate(update, state)
+		return nil
+	})
 	if err != nil {
-		err = fmt.Errorf("failed updating state report")
-		return
+		err = fmt.Errorf("failed adding cluster update to state: %v", err)
 	}
 	return
 }
@@ -1820,11 +1683,15 @@ func GetVmssConfig(ctx context.Context, resourceGroupName string, scaleSet *armc
 		}
 	}
 
-	// no need to retrieve custom data when reading the config
-	// var customData string
-	// if scaleSet.Properties.VirtualMachineProfile.OSProfile.CustomData != nil {
-	// 	customData = *scaleSet.Properties.VirtualMachineProfile.OSProfile.CustomData
-	// }
+	// the custom data is not returned by Azure, the user data it was generated from is kept in the model user data
+	var userData string
+	if scaleSet.Properties.VirtualMachineProfile.UserData != nil {
+		if decoded, err := base64.StdEncoding.DecodeString(*scaleSet.Properties.VirtualMachineProfile.UserData); err == nil {
+			userData = string(decoded)
+		} else {
+			logging.LoggerFromCtx(ctx).Error().Err(err).Msgf("cannot decode the user data of vmss %s", *scaleSet.Name)
+		}
+	}
 
 	var ppg *string
 	if scaleSet.Properties.ProximityPlacementGroup != nil {
@@ -1843,7 +1710,7 @@ func GetVmssConfig(ctx context.Context, resourceGroupName string, scaleSet *armc
 
 	tags := PtrMapToStrMap(scaleSet.Tags)
 	configHash := ""
-	if val, ok := tags["config_hash"]; ok {
+	if val, ok := tags[ConfigHashTag]; ok {
 		configHash = val
 	}
 
@@ -1874,6 +1741,7 @@ func GetVmssConfig(ctx context.Context, resourceGroupName string, scaleSet *armc
 		AdminUsername:      *scaleSet.Properties.VirtualMachineProfile.OSProfile.AdminUsername,
 		SshPublicKey:       sshPublicKey,
 		ComputerNamePrefix: *scaleSet.Properties.VirtualMachineProfile.OSProfile.ComputerNamePrefix,
+		UserData:           userData,
 
 		DisablePasswordAuthentication: *scaleSet.Properties.VirtualMachineProfile.OSProfile.LinuxConfiguration.DisablePasswordAuthentication,
 		ProximityPlacementGroupID:     ppg,
@@ -1900,18 +1768,7 @@ func GetVmssConfig(ctx context.Context, resourceGroupName string, scaleSet *armc
 func CreateOrUpdateVmss(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName, configHash string, config VMSSConfig, vmssSize int, customData string) (id *string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return
-	}
-
-	client, err := armcompute.NewVirtualMachineScaleSetsClient(subscriptionId, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
-
-	config.Tags["config_hash"] = configHash
+	config.Tags[ConfigHashTag] = configHash
 	config.Tags["config_applied_at"] = time.Now().Format(time.RFC3339)
 	size := int64(vmssSize)
 	forceDeletion := false
@@ -2002,6 +1859,8 @@ func CreateOrUpdateVmss(ctx context.Context, subscriptionId, resourceGroupName,
 		nics = append(nics, secondaryNicsConfig...)
 	}
 
+	userData := base64.StdEncoding.EncodeToString([]byte(config.UserData))
+
 	var healthProbe *armcompute.APIEntityReference
 	if config.HealthProbeID != "" {
 		healthProbe = &armcompute.APIEntityReference{
@@ -2049,6 +1908,8 @@ func CreateOrUpdateVmss(ctx context.Context, subscriptionId, resourceGroupName,
 					},
 					CustomData: &customData,
 				},
+				// not used by the VMs, it keeps the user data of the custom data (see GetVmssConfig)
+				UserData: &userData,
 				StorageProfile: &armcompute.VirtualMachineScaleSetStorageProfile{
 					OSDisk: &armcompute.VirtualMachineScaleSetOSDisk{
 						CreateOption: &osDiskCreateOption,
@@ -2079,17 +1940,13 @@ func CreateOrUpdateVmss(ctx context.Context, subscriptionId, resourceGroupName,
 		},
 	}
 
-	poller, err := client.BeginCreateOrUpdate(ctx, resourceGroupName, vmScaleSetName, vmss, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return
-	}
-	resp, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: time.Second})
+	scaleSet, err := CloudProviderFromCtx(ctx).CreateOrUpdateScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName, vmss)
 	if err != nil {
 		err = fmt.Errorf("cannot create/update vmss: %v", err)
+		logger.Error().Err(err).Send()
 		return
 	}
-	id = resp.VirtualMachineScaleSet.ID
+	id = scaleSet.ID
 	logger.Info().Msgf("vmss %s created/updated successfully", *id)
 	return
 }
@@ -2101,7 +1958,7 @@ func getPrimaryNicConfig(primaryNic *PrimaryNIC) *armcompute.VirtualMachineScale
 	}
 
 	var publicIPConfig *armcompute.VirtualMachineScaleSetPublicIPAddressConfiguration
-	if primaryNic.IPConfigurations[0].PublicIPAddress.Assign {
+	if publicIp := primaryNic.IPConfigurations[0].PublicIPAddress; publicIp != nil && publicIp.Assign {
 		publicIPConfig = &armcompute.VirtualMachineScaleSetPublicIPAddressConfiguration{
 			Name: &primaryNic.IPConfigurations[0].PublicIPAddress.Name,
 			Properties: &armcompute.VirtualMachineScaleSetPublicIPAddressConfigurationProperties{
@@ -2197,41 +2054,17 @@ func GetCurrentScaleSetConfiguration(ctx context.Context, vmssParams *ScaleSetPa
 func UpdateTagsOnVm(ctx context.Context, subscriptionId, resourceGroupName, vmName string, tags map[string]string) error {
 	logger := logging.LoggerFromCtx(ctx)
 
-	credential, err := getCredential(ctx)
-	if err != nil {
-		return err
-	}
-
-	client, err := armcompute.NewVirtualMachinesClient(subscriptionId, credential, nil)
-	if err != nil {
-		logger.Error().Err(err).Send()
-		return err
-	}
-
-	// get current tags
-	vm, err := client.Get(ctx, resourceGroupName, vmName, nil)
-	if err != nil {
-		err = fmt.Errorf("cannot get vm %s: %v", vmName, err)
-		logger.Error().Err(err).Send()
-		return err
-	}
-
-	vmTags := PtrMapToStrMap(vm.Tags)
-	// merge current tags with new tags
-	for k, v := range tags {
-		vmTags[k] = v
-	}
-
-	params := &armcompute.VirtualMachineUpdate{
-		Tags: StrMapToPtrMap(vmTags),
-	}
-
-	_, err = client.BeginUpdate(ctx, resourceGroupName, vmName, *params, nil)
+	resumeToken, err := CloudProviderFromCtx(ctx).UpdateVmTags(ctx, subscriptionId, resourceGroupName, vmName, tags)
 	if err != nil {
-		err = fmt.Errorf("cannot update tags on vm %s: %v", vmName, err)
 		logger.Error().Err(err).Send()
 		return err
 	}
+	TrackOperation(ctx, Operation{
+		Kind:           OperationVmTags,
+		SubscriptionId: subscriptionId,
+		Resource:       vmName,
+		Description:    fmt.Sprintf("update tags on %s", vmName),
+	}, resumeToken)
 	return nil
 }
 
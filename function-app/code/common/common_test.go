@@ -0,0 +1,59 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+func TestTerminateScaleSetInstances(t *testing.T) {
+	for _, flexible := range []bool{false, true} {
+		cloud := NewFakeCloudProvider()
+		cloud.AddScaleSet("sub", "rg", "vmss", flexible, 4)
+		ctx := ContextWithCloudProvider(context.TODO(), cloud)
+		vmssParams := &ScaleSetParams{SubscriptionId: "sub", ResourceGroupName: "rg", ScaleSetName: "vmss", Flexible: flexible}
+
+		instances, _ := cloud.GetInstances("sub", "rg", "vmss")
+		for _, instance := range instances {
+			_ = cloud.UpdateInstance("sub", "rg", "vmss", instance.InstanceId, func(instance *FakeInstance) {
+				instance.Protected = true
+			})
+		}
+		// the bulk deletion fails because of the missing instance, the others are still deleted one by one
+		toTerminate := []string{instances[0].InstanceId, "missing", instances[2].InstanceId}
+
+		terminated, errs := TerminateScaleSetInstances(ctx, vmssParams, toTerminate)
+		if len(terminated) != 2 || terminated[0] != instances[0].InstanceId || terminated[1] != instances[2].InstanceId {
+			t.Fatalf("flexible=%t: unexpected terminated instances %v", flexible, terminated)
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "missing") {
+			t.Fatalf("flexible=%t: expected a single error for the missing instance, got %v", flexible, errs)
+		}
+
+		remaining, _ := cloud.GetInstances("sub", "rg", "vmss")
+		if len(remaining) != 2 {
+			t.Fatalf("flexible=%t: expected 2 remaining instances, got %d", flexible, len(remaining))
+		}
+	}
+}
+
+func TestTerminateScaleSetInstancesBulkDeletion(t *testing.T) {
+	cloud := NewFakeCloudProvider()
+	cloud.AddScaleSet("sub", "rg", "vmss", false, 4)
+	ctx := ContextWithCloudProvider(context.TODO(), cloud)
+	vmssParams := &ScaleSetParams{SubscriptionId: "sub", ResourceGroupName: "rg", ScaleSetName: "vmss"}
+
+	// per instance deletions fail, so only the bulk deletion can delete the instances
+	cloud.FailOperations(OperationScaleSetVmDelete, &azcore.ResponseError{ErrorCode: "OperationNotAllowed", StatusCode: http.StatusConflict})
+	terminated, errs := TerminateScaleSetInstances(ctx, vmssParams, []string{"1", "2", "3"})
+	if len(errs) != 0 || len(terminated) != 3 {
+		t.Fatalf("expected all instances to be terminated at once, got %v, errors: %v", terminated, errs)
+	}
+	remaining, _ := cloud.GetInstances("sub", "rg", "vmss")
+	if len(remaining) != 1 || remaining[0].InstanceId != "0" {
+		t.Fatalf("unexpected remaining instances %+v", remaining)
+	}
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const deployedVmsPrefix = "deployed_vms"
+
+// DeployedVms are the VMs which got their deploy script with the bootstrap token, by VM name. The bootstrap token
+// is shared by all the VMs of a scale set, a VM holding it can't get the deploy script (and its instance token)
+// of another VM which already deployed.
+type DeployedVms struct {
+	Vms map[string]time.Time `json:"vms"`
+}
+
+// deployed VMs are kept next to the state they belong to, since protocol.ClusterState has no room for them
+func deployedVmsParams(stateParams BlobObjParams) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      path.Join(deployedVmsPrefix, stateParams.BlobName+".json"),
+	}
+}
+
+func newDeployedVms() DeployedVms {
+	return DeployedVms{Vms: map[string]time.Time{}}
+}
+
+// MarkVmDeployed records that the VM got its deploy script, it fails with ErrForbidden when the VM already did.
+// scaleSetVms are the names of the VMs of the scale set of the VM: the VMs which are not part of it anymore are
+// dropped from the record.
+func MarkVmDeployed(ctx context.Context, store StateStore, stateParams BlobObjParams, scaleSetName, vmName string, scaleSetVms []string) error {
+	instance, _, _ := strings.Cut(vmName, ":")
+	_, err := updateJsonObject(ctx, store, deployedVmsParams(stateParams), newDeployedVms, func(deployed *DeployedVms) error {
+		if deployedAt, ok := deployed.Vms[instance]; ok {
+			return fmt.Errorf("%w: vm %s already deployed at %s", ErrForbidden, instance, deployedAt.Format(time.RFC3339))
+		}
+		for name := range deployed.Vms {
+			if FindScaleSetOfVm([]string{scaleSetName}, name) != "" && !slices.Contains(scaleSetVms, name) {
+				delete(deployed.Vms, name)
+			}
+		}
+		deployed.Vms[instance] = time.Now()
+		return nil
+	})
+	return err
+}
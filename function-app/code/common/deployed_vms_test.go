@@ -0,0 +1,36 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMarkVmDeployed(t *testing.T) {
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	stateParams := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+
+	vms := []string{"cluster-vmss_0", "cluster-vmss_1"}
+	if err := MarkVmDeployed(ctx, store, stateParams, "cluster-vmss", "cluster-vmss_0:cluster-vmss000000", vms); err != nil {
+		t.Fatalf("failed marking vm deployed: %s", err)
+	}
+	if err := MarkVmDeployed(ctx, store, stateParams, "cluster-vmss", "cluster-vmss_0:cluster-vmss000000", vms); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("a vm should deploy once, got %v", err)
+	}
+	if err := MarkVmDeployed(ctx, store, stateParams, "cluster-vmss-v2", "cluster-vmss-v2_0", []string{"cluster-vmss-v2_0"}); err != nil {
+		t.Fatalf("failed marking vm of another scale set deployed: %s", err)
+	}
+
+	// cluster-vmss_0 was removed from the scale set, the vms of other scale sets are kept
+	if err := MarkVmDeployed(ctx, store, stateParams, "cluster-vmss", "cluster-vmss_2", []string{"cluster-vmss_1", "cluster-vmss_2"}); err != nil {
+		t.Fatalf("failed marking vm deployed: %s", err)
+	}
+	deployed, _, err := readJsonObject(ctx, store, deployedVmsParams(stateParams), newDeployedVms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := deployed.Vms["cluster-vmss_0"]; ok || len(deployed.Vms) != 2 {
+		t.Fatalf("unexpected deployed vms %v", deployed.Vms)
+	}
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// InvocationInfo identifies the function invocation that handles the request
+type InvocationInfo struct {
+	FunctionName string
+	InvocationId string
+}
+
+type invocationCtxKey struct{}
+
+func ContextWithInvocation(ctx context.Context, invocation InvocationInfo) context.Context {
+	return context.WithValue(ctx, invocationCtxKey{}, invocation)
+}
+
+func InvocationFromCtx(ctx context.Context) InvocationInfo {
+	invocation, _ := ctx.Value(invocationCtxKey{}).(InvocationInfo)
+	return invocation
+}
+
+// InvocationMiddleware injects the function name (taken from the request path) and the functions host invocation id
+// into the request context
+func InvocationMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		invocation := InvocationInfo{
+			FunctionName: strings.Trim(r.URL.Path, "/"),
+			InvocationId: r.Header.Get("X-Azure-Functions-InvocationId"),
+		}
+		next(w, r.WithContext(ContextWithInvocation(r.Context(), invocation)))
+	}
+}
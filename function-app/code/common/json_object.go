@@ -0,0 +1,51 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// number of conditional writes tried when updating a json object kept next to the state
+const jsonObjectUpdateAttempts = 10
+
+// readJsonObject returns the json object p, or newObject() when it doesn't exist. The returned ETag of a missing
+// object is IfNotExists, so that writing it back creates it only if no one else did meanwhile.
+func readJsonObject[T any](ctx context.Context, store StateStore, p BlobObjParams, newObject func() T) (obj T, etag string, err error) {
+	data, etag, err := store.Read(ctx, p)
+	if errors.Is(err, ErrStateObjectNotFound) {
+		return newObject(), IfNotExists, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &obj)
+	return
+}
+
+// updateJsonObject does a read-modify-write of the json object p using its ETag for optimistic concurrency.
+// updateFn is called once per attempt with a fresh copy of the object, the object is not written when it fails.
+func updateJsonObject[T any](ctx context.Context, store StateStore, p BlobObjParams, newObject func() T, updateFn func(obj *T) error) (obj T, err error) {
+	for attempt := 1; attempt <= jsonObjectUpdateAttempts; attempt++ {
+		var etag string
+		obj, etag, err = readJsonObject(ctx, store, p, newObject)
+		if err != nil {
+			return
+		}
+		if err = updateFn(&obj); err != nil {
+			return
+		}
+
+		var data []byte
+		data, err = json.Marshal(obj)
+		if err != nil {
+			return
+		}
+		_, err = store.Write(ctx, p, data, etag)
+		if !errors.Is(err, ErrStateConflict) {
+			return
+		}
+		stateUpdateBackoff(attempt)
+	}
+	return
+}
@@ -0,0 +1,334 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+// The metrics are kept in memory by each function app instance and exported in the prometheus text format
+// by the metrics function, labelled with the instance which serves the scrape. Counters start from zero when
+// an instance starts. The cluster gauges don't depend on the instance, they are computed at scrape time.
+var (
+	TerminatedInstances = newCounter("weka_terminated_instances_total",
+		"Number of instances set for termination", "vmss")
+	ClusterizationReelections = newCounter("weka_clusterization_reelections_total",
+		"Number of stalled clusterization instances replaced by the watchdog", "vmss")
+	TransientErrors = newCounter("weka_transient_errors_total",
+		"Number of transient errors returned by terminate", "vmss")
+	LockWaitSeconds = newHistogram("weka_lock_wait_seconds",
+		"Time spent waiting for a state container lease", lockWaitBuckets, "container")
+	AzureApiCallSeconds = newHistogram("weka_azure_api_call_duration_seconds",
+		"Latency of the Azure API calls, retries are measured separately", apiCallBuckets, "method", "resource_type", "status_code")
+	AzureApiErrors = newCounter("weka_azure_api_errors_total",
+		"Number of failed Azure API calls by error code", "resource_type", "error_code")
+	Reports = newCounter("weka_reports_total",
+		"Number of reports received by type", "type")
+)
+
+// ClusterGauges are computed from the state and the scale sets when the metrics are scraped, so that every function
+// app instance exports the same values. They are not labelled with the instance.
+type ClusterGauges struct {
+	VmssDesiredCapacity             *Gauge
+	VmssCapacity                    *Gauge
+	ReadyForClusterizationInstances *Gauge
+	Clusterized                     *Gauge
+}
+
+func NewClusterGauges() *ClusterGauges {
+	return &ClusterGauges{
+		VmssDesiredCapacity: &Gauge{newMetricVec("weka_vmss_desired_capacity",
+			"Desired capacity of the scale set, as kept in the state", "gauge", []string{"vmss"})},
+		VmssCapacity: &Gauge{newMetricVec("weka_vmss_capacity",
+			"Actual capacity of the scale set", "gauge", []string{"vmss"})},
+		ReadyForClusterizationInstances: &Gauge{newMetricVec("weka_instances_ready_for_clusterization",
+			"Number of instances ready for clusterization", "gauge", []string{"vmss"})},
+		Clusterized: &Gauge{newMetricVec("weka_clusterized",
+			"Whether the cluster is clusterized (1) or not (0)", "gauge", []string{"vmss"})},
+	}
+}
+
+func (g *ClusterGauges) Write(w io.Writer) {
+	for _, gauge := range []*Gauge{g.VmssDesiredCapacity, g.VmssCapacity, g.ReadyForClusterizationInstances, g.Clusterized} {
+		gauge.write(w, "")
+	}
+}
+
+var (
+	lockWaitBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	apiCallBuckets  = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+var metricsRegistry []metric
+
+type metric interface {
+	// write writes the series labelled with the function app instance, when it is not empty
+	write(w io.Writer, instance string)
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histogram only
+	buckets []uint64
+	count   uint64
+}
+
+// metricVec is a metric with labels, the series are keyed by their label values
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newMetricVec(name, help, metricType string, labelNames []string) metricVec {
+	return metricVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+}
+
+// get returns the series of the label values, the caller must hold the lock
+func (v *metricVec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects labels %v, got %v", v.name, v.labelNames, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sortedSeries returns the series ordered by label values, so the output is stable
+func (v *metricVec) sortedSeries() []*series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, v.series[key])
+	}
+	return result
+}
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.metricType)
+}
+
+// labels formats the label values of a series followed by the extra name and value pairs
+func (v *metricVec) labels(labelValues []string, extra ...string) string {
+	pairs := make([]string, 0, len(labelValues)+len(extra)/2)
+	for i, value := range labelValues {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, v.labelNames[i], escapeLabelValue(value)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if extra[i+1] != "" {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabelValue(extra[i+1])))
+		}
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type Counter struct {
+	metricVec
+}
+
+func newCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{newMetricVec(name, help, "counter", labelNames)}
+	metricsRegistry = append(metricsRegistry, c)
+	return c
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(labelValues).value += value
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer, instance string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	for _, s := range c.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels(s.labelValues, "instance", instance), formatFloat(s.value))
+	}
+}
+
+type Gauge struct {
+	metricVec
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues).value = value
+}
+
+func (g *Gauge) SetBool(value bool, labelValues ...string) {
+	if value {
+		g.Set(1, labelValues...)
+	} else {
+		g.Set(0, labelValues...)
+	}
+}
+
+func (g *Gauge) write(w io.Writer, instance string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w)
+	for _, s := range g.sortedSeries() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labels(s.labelValues, "instance", instance), formatFloat(s.value))
+	}
+}
+
+type Histogram struct {
+	metricVec
+	upperBounds []float64
+}
+
+func newHistogram(name, help string, upperBounds []float64, labelNames ...string) *Histogram {
+	h := &Histogram{metricVec: newMetricVec(name, help, "histogram", labelNames), upperBounds: upperBounds}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.upperBounds))
+	}
+	for i, upperBound := range h.upperBounds {
+		if value <= upperBound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+func (h *Histogram) ObserveDuration(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer, instance string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, s := range h.sortedSeries() {
+		for i, upperBound := range h.upperBounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(s.labelValues, "instance", instance, "le", formatFloat(upperBound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(s.labelValues, "instance", instance, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels(s.labelValues, "instance", instance), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels(s.labelValues, "instance", instance), s.count)
+	}
+}
+
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WriteMetrics writes the metrics of this function app instance in the prometheus text format, labelled with instance
+func WriteMetrics(w io.Writer, instance string) {
+	for _, m := range metricsRegistry {
+		m.write(w, instance)
+	}
+}
+
+// apiResourceType returns a low cardinality name of the resource an Azure API call acts on, e.g.
+// virtualMachineScaleSets/virtualMachines for .../virtualMachineScaleSets/vmss/virtualMachines/3/...
+func apiResourceType(req *http.Request) string {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, segment := range segments {
+		if !strings.EqualFold(segment, "providers") || i+1 >= len(segments) {
+			continue
+		}
+		// providers/<namespace>/<type>/<name>/<sub type>/<name>...
+		var types []string
+		for j := i + 2; j < len(segments); j += 2 {
+			types = append(types, segments[j])
+		}
+		if len(types) > 0 {
+			return strings.Join(types, "/")
+		}
+	}
+	switch {
+	case strings.Contains(req.URL.Host, ".vault."):
+		return "keyvault"
+	case strings.Contains(req.URL.Host, ".blob."):
+		return "blob"
+	default:
+		return req.URL.Host
+	}
+}
+
+// metricsPipelinePolicy measures every attempt of the SDK clients requests, it runs below the retry policy
+type metricsPipelinePolicy struct{}
+
+func (p metricsPipelinePolicy) Do(req *policy.Request) (resp *http.Response, err error) {
+	start := time.Now()
+	resp, err = req.Next()
+
+	resourceType := apiResourceType(req.Raw())
+	statusCode := "none"
+	if resp != nil {
+		statusCode = strconv.Itoa(resp.StatusCode)
+	}
+	AzureApiCallSeconds.ObserveDuration(start, req.Raw().Method, resourceType, statusCode)
+
+	switch {
+	case err != nil:
+		AzureApiErrors.Inc(resourceType, "transport_error")
+	case resp.StatusCode >= http.StatusBadRequest:
+		errorCode := statusCode
+		var respErr *azcore.ResponseError
+		if errors.As(runtime.NewResponseError(resp), &respErr) && respErr.ErrorCode != "" {
+			errorCode = respErr.ErrorCode
+		}
+		AzureApiErrors.Inc(resourceType, errorCode)
+	}
+	return
+}
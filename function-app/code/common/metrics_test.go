@@ -0,0 +1,68 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	counter := newCounter("test_reports_total", "Reports", "type")
+	counter.Inc("progress")
+	counter.Add(2, `say "hi"`)
+	histogram := newHistogram("test_wait_seconds", "Wait", []float64{1, 5}, "container")
+	histogram.Observe(0.5, "state")
+	histogram.Observe(3, "state")
+
+	var buf bytes.Buffer
+	counter.write(&buf, "worker-1")
+	histogram.write(&buf, "")
+	expected := `# HELP test_reports_total Reports
+# TYPE test_reports_total counter
+test_reports_total{type="progress",instance="worker-1"} 1
+test_reports_total{type="say \"hi\"",instance="worker-1"} 2
+# HELP test_wait_seconds Wait
+# TYPE test_wait_seconds histogram
+test_wait_seconds_bucket{container="state",le="1"} 1
+test_wait_seconds_bucket{container="state",le="5"} 2
+test_wait_seconds_bucket{container="state",le="+Inf"} 2
+test_wait_seconds_sum{container="state"} 3.5
+test_wait_seconds_count{container="state"} 2
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected metrics:\n%s", buf.String())
+	}
+}
+
+func TestMetricsPipelinePolicy(t *testing.T) {
+	transport := &fakeTransport{responses: []fakeResponse{{status: http.StatusConflict, code: "OperationNotAllowed"}}}
+	options := NewClientOptions(DefaultRetryPolicy)
+	options.PerCallPolicies = nil
+	options.Transport = transport
+	pipeline := runtime.NewPipeline("weka-deployment", "test", runtime.PipelineOptions{}, &options)
+
+	vmssUrl := "https://management.azure.com/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/3"
+	req, err := runtime.NewRequest(context.TODO(), http.MethodPut, vmssUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := pipeline.Do(req)
+	if err != nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("unexpected response %v, error: %v", resp, err)
+	}
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf, "")
+	for _, line := range []string{
+		`weka_azure_api_errors_total{resource_type="virtualMachineScaleSets/virtualMachines",error_code="OperationNotAllowed"} 1`,
+		`weka_azure_api_call_duration_seconds_count{method="PUT",resource_type="virtualMachineScaleSets/virtualMachines",status_code="409"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("missing %s in:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	operationsPrefix = "operations"
+	// failed operations kept for /status, older ones are dropped
+	failedOperationsLimit = 50
+	// operations still pending after this time are considered failed
+	operationTimeout      = time.Hour
+	operationPollInterval = 2 * time.Second
+)
+
+// OperationKind is the Azure long-running operation type, it tells how to resume the operation poller
+type OperationKind string
+
+const (
+	OperationScaleSetCapacity     OperationKind = "scale_set_capacity"
+	OperationScaleSetDelete       OperationKind = "scale_set_delete"
+	OperationScaleSetVmProtection OperationKind = "scale_set_vm_protection"
+	OperationScaleSetVmDelete     OperationKind = "scale_set_vm_delete"
+	OperationScaleSetVmsDelete    OperationKind = "scale_set_vms_delete"
+	OperationVmDelete             OperationKind = "vm_delete"
+	OperationVmTags               OperationKind = "vm_tags"
+	OperationStorageAccountCreate OperationKind = "storage_account_create"
+)
+
+type OperationStatus string
+
+const (
+	OperationPending OperationStatus = "pending"
+	OperationFailed  OperationStatus = "failed"
+)
+
+// Operation is a long-running Azure operation started by a function, later invocations poll it using its resume token
+type Operation struct {
+	Id             string        `json:"id"`
+	Kind           OperationKind `json:"kind"`
+	SubscriptionId string        `json:"subscription_id"`
+	// Resource is the scale set or vm the operation acts on, failures are reported under this name
+	Resource    string          `json:"resource"`
+	Description string          `json:"description"`
+	ResumeToken string          `json:"resume_token,omitempty"`
+	Status      OperationStatus `json:"status"`
+	Error       string          `json:"error,omitempty"`
+	// Reported is set by the invocation that reports the failure in the state, in the same write that claims it
+	Reported    bool       `json:"reported,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// Operations are the tracked operations of a state, completed operations are dropped once resolved
+type Operations struct {
+	Pending []Operation `json:"pending"`
+	Failed  []Operation `json:"failed"`
+}
+
+// Operations are kept in a separate object next to the state they belong to: protocol.ClusterState is the
+// go-cloud-lib type shared with the backend VMs and the other clouds, so it can't carry Azure resume tokens.
+// Keeping them apart also keeps the frequent operation updates from conflicting with the state ETag.
+func operationsParams(stateParams BlobObjParams) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      path.Join(operationsPrefix, stateParams.BlobName+".json"),
+	}
+}
+
+type operationsCtxKey struct{}
+
+// ContextWithOperationsState makes the operations started with ctx tracked under the given state
+func ContextWithOperationsState(ctx context.Context, stateParams BlobObjParams) context.Context {
+	return context.WithValue(ctx, operationsCtxKey{}, stateParams)
+}
+
+func operationsStateFromCtx(ctx context.Context) (BlobObjParams, bool) {
+	stateParams, ok := ctx.Value(operationsCtxKey{}).(BlobObjParams)
+	return stateParams, ok
+}
+
+func newOperations() Operations {
+	return Operations{Pending: []Operation{}, Failed: []Operation{}}
+}
+
+func GetOperations(ctx context.Context, store StateStore, stateParams BlobObjParams) (operations Operations, err error) {
+	operations, _, err = readJsonObject(ctx, store, operationsParams(stateParams), newOperations)
+	return
+}
+
+// updateOperations drops the oldest failed operations beyond failedOperationsLimit
+func updateOperations(ctx context.Context, store StateStore, stateParams BlobObjParams, updateFn func(operations *Operations)) (operations Operations, err error) {
+	return updateJsonObject(ctx, store, operationsParams(stateParams), newOperations, func(operations *Operations) error {
+		updateFn(operations)
+		if len(operations.Failed) > failedOperationsLimit {
+			operations.Failed = operations.Failed[len(operations.Failed)-failedOperationsLimit:]
+		}
+		return nil
+	})
+}
+
+// TrackOperation records a started operation as pending so that later invocations resolve it.
+// An empty resume token means the operation already completed. Operations started without a state
+// in the context (see ContextWithOperationsState) are not tracked.
+func TrackOperation(ctx context.Context, operation Operation, resumeToken string) {
+	logger := logging.LoggerFromCtx(ctx)
+	if resumeToken == "" {
+		return
+	}
+
+	stateParams, ok := operationsStateFromCtx(ctx)
+	if !ok {
+		logger.Debug().Msgf("operation %s on %s is not tracked", operation.Kind, operation.Resource)
+		return
+	}
+
+	operation.Id = uuid.New().String()
+	operation.ResumeToken = resumeToken
+	operation.Status = OperationPending
+	operation.StartedAt = time.Now().UTC()
+
+	_, err := updateOperations(ctx, StateStoreFromCtx(ctx), stateParams, func(operations *Operations) {
+		operations.Pending = append(operations.Pending, operation)
+	})
+	if err != nil {
+		logger.Error().Err(err).Msgf("cannot track operation %s on %s", operation.Kind, operation.Resource)
+	}
+}
+
+// waitOperation polls the operation until it completes. When it doesn't complete within the timeout,
+// it is tracked as pending and an error is returned.
+func waitOperation(ctx context.Context, operation Operation, resumeToken string, timeout time.Duration) error {
+	if resumeToken == "" {
+		return nil
+	}
+
+	cloud := CloudProviderFromCtx(ctx)
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := cloud.PollOperation(ctx, operation.SubscriptionId, operation.Kind, resumeToken)
+		if done {
+			return err
+		}
+		if time.Now().After(deadline) {
+			TrackOperation(ctx, operation, resumeToken)
+			return fmt.Errorf("%s did not complete within %s", operation.Description, timeout)
+		}
+		if err := sleepCtx(ctx, operationPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// pollOperation returns the failure of a completed operation, done is false while the operation is in progress
+func pollOperation(ctx context.Context, cloud CloudProvider, operation Operation, now time.Time) (done bool, opErr error) {
+	done, err := cloud.PollOperation(ctx, operation.SubscriptionId, operation.Kind, operation.ResumeToken)
+	if done {
+		return true, err
+	}
+	if err != nil {
+		logging.LoggerFromCtx(ctx).Warn().Err(err).Msgf("cannot poll operation %s on %s", operation.Kind, operation.Resource)
+	}
+	if now.Sub(operation.StartedAt) > operationTimeout {
+		return true, fmt.Errorf("operation did not complete within %s", operationTimeout)
+	}
+	return false, nil
+}
+
+// ResolveOperations polls the pending operations of the state. Completed operations are dropped, failed ones
+// (including the ones pending for longer than operationTimeout) are kept in the failed list and reported as errors in the state.
+// A failure is reported only by the invocation whose write marked it as reported, so concurrent invocations don't report it twice.
+func ResolveOperations(ctx context.Context, store StateStore, stateParams BlobObjParams) (operations Operations, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	operations, err = GetOperations(ctx, store, stateParams)
+	if err != nil || (len(operations.Pending) == 0 && !hasUnreportedFailures(operations)) {
+		return
+	}
+
+	cloud := CloudProviderFromCtx(ctx)
+	now := time.Now().UTC()
+	completed := make(map[string]bool)
+	failures := make(map[string]string)
+	for _, operation := range operations.Pending {
+		done, opErr := pollOperation(ctx, cloud, operation, now)
+		if !done {
+			continue
+		}
+		completed[operation.Id] = true
+		if opErr != nil {
+			failures[operation.Id] = opErr.Error()
+		}
+	}
+
+	// operations tracked meanwhile by other invocations are kept pending, and the ones already
+	// resolved by other invocations are left to them
+	var claimed []Operation
+	operations, err = updateOperations(ctx, store, stateParams, func(operations *Operations) {
+		claimed = nil
+		for i := range operations.Failed {
+			if !operations.Failed[i].Reported {
+				operations.Failed[i].Reported = true
+				claimed = append(claimed, operations.Failed[i])
+			}
+		}
+		pending := make([]Operation, 0, len(operations.Pending))
+		for _, operation := range operations.Pending {
+			if !completed[operation.Id] {
+				pending = append(pending, operation)
+				continue
+			}
+			opErr, failed := failures[operation.Id]
+			if !failed {
+				continue
+			}
+			operation.Status = OperationFailed
+			operation.Error = opErr
+			operation.ResumeToken = ""
+			operation.CompletedAt = &now
+			operation.Reported = true
+			operations.Failed = append(operations.Failed, operation)
+			claimed = append(claimed, operation)
+		}
+		operations.Pending = pending
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("cannot update operations")
+		return
+	}
+
+	var unreported []string
+	for _, operation := range claimed {
+		msg := fmt.Sprintf("%s (%s) failed: %s", operation.Kind, operation.Description, operation.Error)
+		logger.Error().Msg(msg)
+		reportErr := UpdateStateReporting(ctx, store, stateParams, protocol.Report{Type: "error", Hostname: operation.Resource, Message: msg})
+		if reportErr != nil {
+			logger.Error().Err(reportErr).Msgf("cannot report operation %s failure", operation.Id)
+			unreported = append(unreported, operation.Id)
+		}
+	}
+	if len(unreported) > 0 {
+		// the next invocation claims them again
+		operations, err = updateOperations(ctx, store, stateParams, func(operations *Operations) {
+			for i := range operations.Failed {
+				if slices.Contains(unreported, operations.Failed[i].Id) {
+					operations.Failed[i].Reported = false
+				}
+			}
+		})
+		if err != nil {
+			logger.Error().Err(err).Msg("cannot update operations")
+			return
+		}
+	}
+	logger.Info().Msgf("resolved %d operations, %d failures reported", len(completed), len(claimed)-len(unreported))
+	return
+}
+
+func hasUnreportedFailures(operations Operations) bool {
+	for _, operation := range operations.Failed {
+		if !operation.Reported {
+			return true
+		}
+	}
+	return false
+}
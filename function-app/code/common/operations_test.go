@@ -0,0 +1,180 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestResolveOperations(t *testing.T) {
+	cloud := NewFakeCloudProvider()
+	cloud.AddScaleSet("sub", "rg", "vmss", false, 3)
+	cloud.SetAsyncOperations(true)
+	cloud.FailOperations(OperationScaleSetVmDelete, &azcore.ResponseError{ErrorCode: "InternalExecutionError", StatusCode: http.StatusInternalServerError})
+
+	store := NewMemoryStateStore()
+	stateParams := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+	ctx := ContextWithOperationsState(ContextWithStateStore(ContextWithCloudProvider(context.TODO(), cloud), store), stateParams)
+	if _, err := EnsureStateIsCreated(ctx, store, stateParams, protocol.ClusterState{}); err != nil {
+		t.Fatalf("failed creating state: %s", err)
+	}
+
+	if err := ScaleUp(ctx, "sub", "rg", "vmss", 4); err != nil {
+		t.Fatalf("scale up failed: %s", err)
+	}
+	if err := deleteUniformScaleSetVM(ctx, "sub", "rg", "vmss", "1"); err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+
+	operations, err := GetOperations(ctx, store, stateParams)
+	if err != nil {
+		t.Fatalf("failed reading operations: %s", err)
+	}
+	if len(operations.Pending) != 2 || operations.Pending[0].ResumeToken == "" {
+		t.Fatalf("expected 2 pending operations, got %+v", operations)
+	}
+
+	operations, err = ResolveOperations(ctx, store, stateParams)
+	if err != nil {
+		t.Fatalf("failed resolving operations: %s", err)
+	}
+	if len(operations.Pending) != 0 || len(operations.Failed) != 1 {
+		t.Fatalf("expected the delete operation to fail, got %+v", operations)
+	}
+	failed := operations.Failed[0]
+	if failed.Kind != OperationScaleSetVmDelete || failed.Resource != "1" || failed.Status != OperationFailed {
+		t.Fatalf("unexpected failed operation: %+v", failed)
+	}
+
+	state, err := ReadState(ctx, store, stateParams)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Errors["1"]) != 1 {
+		t.Fatalf("expected the failure to be reported in the state, got %v", state.Errors)
+	}
+}
+
+func TestResolveOperationsReportsFailuresOnce(t *testing.T) {
+	cloud := NewFakeCloudProvider()
+	cloud.AddScaleSet("sub", "rg", "vmss", false, 3)
+	cloud.SetAsyncOperations(true)
+	cloud.FailOperations(OperationScaleSetVmDelete, &azcore.ResponseError{ErrorCode: "InternalExecutionError", StatusCode: http.StatusInternalServerError})
+
+	store := NewMemoryStateStore()
+	stateParams := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+	ctx := ContextWithOperationsState(ContextWithStateStore(ContextWithCloudProvider(context.TODO(), cloud), store), stateParams)
+	if _, err := EnsureStateIsCreated(ctx, store, stateParams, protocol.ClusterState{}); err != nil {
+		t.Fatalf("failed creating state: %s", err)
+	}
+	if err := deleteUniformScaleSetVM(ctx, "sub", "rg", "vmss", "1"); err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ResolveOperations(ctx, store, stateParams); err != nil {
+				t.Errorf("failed resolving operations: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	operations, err := GetOperations(ctx, store, stateParams)
+	if err != nil {
+		t.Fatalf("failed reading operations: %s", err)
+	}
+	if len(operations.Pending) != 0 || len(operations.Failed) != 1 || !operations.Failed[0].Reported {
+		t.Fatalf("expected a single reported failure, got %+v", operations)
+	}
+	state, err := ReadState(ctx, store, stateParams)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Errors["1"]) != 1 {
+		t.Fatalf("expected the failure to be reported once, got %v", state.Errors)
+	}
+}
+
+func TestResolveOperationsReportsUnreportedFailures(t *testing.T) {
+	cloud := NewFakeCloudProvider()
+	store := NewMemoryStateStore()
+	stateParams := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+	ctx := ContextWithStateStore(ContextWithCloudProvider(context.TODO(), cloud), store)
+	if _, err := EnsureStateIsCreated(ctx, store, stateParams, protocol.ClusterState{}); err != nil {
+		t.Fatalf("failed creating state: %s", err)
+	}
+	_, err := updateOperations(ctx, store, stateParams, func(operations *Operations) {
+		operations.Failed = append(operations.Failed, Operation{
+			Id: "op", Kind: OperationVmDelete, Resource: "vm", Status: OperationFailed, Error: "failed",
+		})
+	})
+	if err != nil {
+		t.Fatalf("failed writing operations: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := ResolveOperations(ctx, store, stateParams); err != nil {
+			t.Fatalf("failed resolving operations: %s", err)
+		}
+	}
+
+	operations, err := GetOperations(ctx, store, stateParams)
+	if err != nil {
+		t.Fatalf("failed reading operations: %s", err)
+	}
+	if len(operations.Failed) != 1 || !operations.Failed[0].Reported {
+		t.Fatalf("expected the failure to be marked as reported, got %+v", operations)
+	}
+	state, err := ReadState(ctx, store, stateParams)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Errors["vm"]) != 1 {
+		t.Fatalf("expected the failure to be reported once, got %v", state.Errors)
+	}
+}
+
+func TestCreateStorageAccountWaitsForCreation(t *testing.T) {
+	cloud := NewFakeCloudProvider()
+	cloud.SetAsyncOperations(true)
+	ctx := ContextWithCloudProvider(context.TODO(), cloud)
+
+	accessKey, err := CreateStorageAccount(ctx, "sub", "rg", "eastus", AzureObsParams{Name: "obs"})
+	if err != nil {
+		t.Fatalf("storage account creation failed: %s", err)
+	}
+	if accessKey != "obs-key" {
+		t.Fatalf("unexpected access key %q", accessKey)
+	}
+
+	cloud.FailOperations(OperationStorageAccountCreate, &azcore.ResponseError{ErrorCode: "InternalExecutionError", StatusCode: http.StatusInternalServerError})
+	if _, err := CreateStorageAccount(ctx, "sub", "rg", "eastus", AzureObsParams{Name: "obs2"}); err == nil {
+		t.Fatal("expected the failed storage account creation to be returned")
+	}
+}
+
+func TestTrackOperationWithoutState(t *testing.T) {
+	cloud := NewFakeCloudProvider()
+	cloud.AddScaleSet("sub", "rg", "vmss", false, 1)
+	cloud.SetAsyncOperations(true)
+	store := NewMemoryStateStore()
+	ctx := ContextWithStateStore(ContextWithCloudProvider(context.TODO(), cloud), store)
+
+	if err := ScaleUp(ctx, "sub", "rg", "vmss", 2); err != nil {
+		t.Fatalf("scale up failed: %s", err)
+	}
+	stateParams := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+	_, _, err := store.Read(ctx, operationsParams(stateParams))
+	if !errors.Is(err, ErrStateObjectNotFound) {
+		t.Fatalf("operations started without a state should not be tracked, got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ErrBadRequest is wrapped by the errors of requests which can't be decoded or miss required fields
+var ErrBadRequest = errors.New("bad request")
+
+type directCallCtxKey struct{}
+
+// isInvokeRequest tells whether the payload is a functions host request envelope, as opposed to a plain json body
+func isInvokeRequest(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	_, ok := fields["Data"]
+	return ok
+}
+
+// readRequestBody returns the http request body sent to the function, taken out of the functions host envelope
+// when there is one. An empty body is returned as an empty json object.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return []byte("{}"), nil
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read the request: %v", ErrBadRequest, err)
+	}
+	// the body may be read again by the handler
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	body := data
+	if isInvokeRequest(data) {
+		var invokeRequest InvokeRequest
+		if err := json.Unmarshal(data, &invokeRequest); err != nil {
+			return nil, fmt.Errorf("%w: cannot decode the request: %v", ErrBadRequest, err)
+		}
+		var reqData struct {
+			Body json.RawMessage
+		}
+		if req, ok := invokeRequest.Data["req"]; ok {
+			if err := json.Unmarshal(req, &reqData); err != nil {
+				return nil, fmt.Errorf("%w: cannot unmarshal the request data: %v", ErrBadRequest, err)
+			}
+		}
+		body = reqData.Body
+		// the functions host passes the body as a json string
+		var bodyStr string
+		if err := json.Unmarshal(body, &bodyStr); err == nil {
+			body = []byte(bodyStr)
+		}
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || bytes.Equal(body, []byte("null")) {
+		return []byte("{}"), nil
+	}
+	return body, nil
+}
+
+// invokeHttpRequest returns the http request data of the functions host envelope, it is empty when the request
+// is not an envelope
+func invokeHttpRequest(r *http.Request) (req struct {
+	Headers map[string][]string
+	Query   map[string]string
+}) {
+	if r.Body == nil {
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil || !isInvokeRequest(data) {
+		return
+	}
+
+	var invokeRequest InvokeRequest
+	if err := json.Unmarshal(data, &invokeRequest); err != nil {
+		return
+	}
+	_ = json.Unmarshal(invokeRequest.Data["req"], &req)
+	return
+}
+
+// requestHeader returns a header of the http request sent to the function, taken out of the functions host envelope
+// when there is one
+func requestHeader(r *http.Request, name string) string {
+	if value := r.Header.Get(name); value != "" {
+		return value
+	}
+	for key, values := range invokeHttpRequest(r).Headers {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// requestQuery returns a query parameter of the http request sent to the function, taken out of the functions host
+// envelope when there is one
+func requestQuery(r *http.Request, name string) string {
+	if value := r.URL.Query().Get(name); value != "" {
+		return value
+	}
+	return invokeHttpRequest(r).Query[name]
+}
+
+// DecodeBody decodes the request body into T, both for functions host invocations and for plain json requests.
+// Struct fields tagged with `validate:"required"` must be set (non-zero, non-nil).
+// The returned errors wrap ErrBadRequest.
+func DecodeBody[T any](r *http.Request) (body T, err error) {
+	data, err := readRequestBody(r)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &body); err != nil {
+		err = fmt.Errorf("%w: cannot unmarshal the request body: %v", ErrBadRequest, err)
+		return
+	}
+	if missing := missingRequiredFields(body); len(missing) > 0 {
+		err = fmt.Errorf("%w: missing required fields: %s", ErrBadRequest, strings.Join(missing, ", "))
+	}
+	return
+}
+
+// missingRequiredFields returns the json names of the required fields which are not set
+func missingRequiredFields(body any) (missing []string) {
+	v := reflect.ValueOf(body)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Tag.Get("validate") != "required" || !v.Field(i).IsZero() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		missing = append(missing, name)
+	}
+	return
+}
+
+// WriteBadRequestResponse rejects a request which can't be decoded. Unlike WriteErrorResponse,
+// the http status of the response is 400.
+func WriteBadRequestResponse(w http.ResponseWriter, err error) {
+	resData := map[string]any{
+		"statusCode": http.StatusBadRequest,
+		"body":       map[string]string{"error": err.Error()},
+	}
+	WriteResponse(w, resData, nil)
+}
+
+// directResponseWriter turns the functions host response envelope written by the handlers into a plain response
+type directResponseWriter struct {
+	http.ResponseWriter
+	buf        bytes.Buffer
+	statusCode int
+}
+
+func (w *directResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
+func (w *directResponseWriter) Write(data []byte) (int, error) {
+	return w.buf.Write(data)
+}
+
+func (w *directResponseWriter) flush() {
+	var invokeResponse struct {
+		Outputs struct {
+			Res struct {
+				StatusCode int             `json:"statusCode"`
+				Body       json.RawMessage `json:"body"`
+			} `json:"res"`
+		}
+	}
+	if err := json.Unmarshal(w.buf.Bytes(), &invokeResponse); err != nil || invokeResponse.Outputs.Res.Body == nil {
+		// not an envelope, pass the response as is
+		if w.statusCode != 0 {
+			w.ResponseWriter.WriteHeader(w.statusCode)
+		}
+		_, _ = w.ResponseWriter.Write(w.buf.Bytes())
+		return
+	}
+
+	statusCode := invokeResponse.Outputs.Res.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(statusCode)
+	_, _ = w.ResponseWriter.Write(invokeResponse.Outputs.Res.Body)
+}
+
+// IsDirectCall tells whether the function was called with a plain json request rather than by the functions host
+func IsDirectCall(ctx context.Context) bool {
+	direct, _ := ctx.Value(directCallCtxKey{}).(bool)
+	return direct
+}
+
+// DirectCallMiddleware allows calling the functions directly with plain json requests: the handlers decode
+// the body with DecodeBody, and their response is written without the functions host envelope
+func DirectCallMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Header.Get("X-Azure-Functions-InvocationId") != "" {
+			next(w, r)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteBadRequestResponse(w, fmt.Errorf("%w: cannot read the request: %v", ErrBadRequest, err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		if isInvokeRequest(data) {
+			next(w, r)
+			return
+		}
+
+		directWriter := &directResponseWriter{ResponseWriter: w}
+		next(directWriter, r.WithContext(context.WithValue(r.Context(), directCallCtxKey{}, true)))
+		directWriter.flush()
+	}
+}
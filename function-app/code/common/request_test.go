@@ -0,0 +1,70 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testRequest struct {
+	Name  string `json:"name" validate:"required"`
+	Count *int   `json:"count"`
+}
+
+func envelope(body string) string {
+	req, _ := json.Marshal(map[string]string{"Body": body})
+	data, _ := json.Marshal(InvokeRequest{Data: map[string]json.RawMessage{"req": req}})
+	return string(data)
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr bool
+	}{
+		{"functions host envelope", envelope(`{"name":"a","count":2}`), false},
+		{"plain json", `{"name":"a","count":2}`, false},
+		{"missing required field", envelope(`{"count":2}`), true},
+		{"empty envelope body", envelope(""), true},
+		{"invalid json", `{"name":`, true},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(test.payload))
+		body, err := DecodeBody[testRequest](r)
+		if test.wantErr {
+			if !errors.Is(err, ErrBadRequest) {
+				t.Errorf("%s: expected a bad request error, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil || body.Name != "a" || body.Count == nil || *body.Count != 2 {
+			t.Errorf("%s: unexpected body %+v, error: %v", test.name, body, err)
+		}
+	}
+}
+
+func TestDirectCallMiddleware(t *testing.T) {
+	handler := DirectCallMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := DecodeBody[testRequest](r); err != nil {
+			WriteBadRequestResponse(w, err)
+			return
+		}
+		WriteSuccessResponse(w, "ok")
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(`{}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"error"`) {
+		t.Fatalf("expected a plain 400 response, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(envelope(`{}`))))
+	if !strings.Contains(w.Body.String(), `"Outputs"`) {
+		t.Fatalf("expected the functions host envelope, got %s", w.Body.String())
+	}
+}
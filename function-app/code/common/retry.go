@@ -0,0 +1,225 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// retryableStatusCodes are the throttling and transient server failures
+var retryableStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// retryableErrorCodes are the Azure error codes worth retrying regardless of the status code
+var retryableErrorCodes = map[string]bool{
+	"TooManyRequests":                  true,
+	"SubscriptionRequestsThrottled":    true,
+	"ServerBusy":                       true,
+	"RetryableError":                   true,
+	"InternalExecutionError":           true,
+	"OperationTimedOut":                true,
+	"OperationPreempted":               true,
+	"NetworkingInternalOperationError": true,
+}
+
+// fatalErrorCodes are never retried, even when returned with a retryable status code
+var fatalErrorCodes = map[string]bool{
+	"ResourceNotFound":                  true,
+	"ResourceGroupNotFound":             true,
+	"OperationNotAllowed":               true,
+	"InvalidParameter":                  true,
+	"QuotaExceeded":                     true,
+	"SkuNotAvailable":                   true,
+	"ConditionNotMet":                   true,
+	"LeaseAlreadyPresent":               true,
+	"LeaseIdMismatchWithLeaseOperation": true,
+}
+
+// RetryPolicy is the retry and backoff policy of the Azure calls
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt
+	MaxAttempts int
+	BaseDelay   time.Duration
+	// MaxDelay caps the backoff, a Retry-After longer than MaxDelay is not waited for and the error is returned
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used until the client options are set at startup
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: time.Minute}
+
+// IsRetryableError classifies an Azure call error: throttling, transient server and network failures are retryable,
+// other errors (missing resources, conflicts, bad requests, canceled contexts) are fatal
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		if fatalErrorCodes[respErr.ErrorCode] {
+			return false
+		}
+		return retryableErrorCodes[respErr.ErrorCode] || retryableStatusCodes[respErr.StatusCode]
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// IsAuthorizationError tells whether the call was denied, which happens until the role assignments
+// of a new deployment propagate
+func IsAuthorizationError(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) &&
+		(respErr.ErrorCode == "AuthorizationFailed" || respErr.ErrorCode == "AuthorizationPermissionMismatch")
+}
+
+// retryAfter returns the delay requested by the response headers, zero when there is none
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	for _, header := range []string{"retry-after-ms", "x-ms-retry-after-ms"} {
+		if ms, err := strconv.Atoi(resp.Header.Get(header)); err == nil && ms > 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// Delay returns how long to wait before the next attempt, retry is false when the error shouldn't be retried
+// (fatal error, no attempts left, or Retry-After beyond MaxDelay)
+func (p RetryPolicy) Delay(attempt int, err error) (delay time.Duration, retry bool) {
+	if attempt >= p.MaxAttempts || !IsRetryableError(err) {
+		return 0, false
+	}
+
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		if delay = retryAfter(respErr.RawResponse); delay > 0 {
+			return delay, delay <= p.MaxDelay
+		}
+	}
+
+	// exponential backoff with jitter, between half and the full backoff
+	backoff := p.BaseDelay << (attempt - 1)
+	if backoff > p.MaxDelay || backoff <= 0 {
+		backoff = p.MaxDelay
+	}
+	delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	return delay, true
+}
+
+func sleepCtx(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isNonIdempotent tells whether the request may have been applied even though it failed
+func isNonIdempotent(req *http.Request) bool {
+	return req.Method == http.MethodPost || req.Method == http.MethodPut
+}
+
+// isRejectedBeforeApplied tells whether the server asked to retry later without applying the request
+func isRejectedBeforeApplied(resp *http.Response) bool {
+	return resp != nil &&
+		(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) &&
+		retryAfter(resp) > 0
+}
+
+// retryPipelinePolicy retries the requests of the SDK clients according to the retry policy,
+// it replaces the SDK retry policy which doesn't give up on long Retry-After.
+// POST and PUT requests are retried only when rejected with a Retry-After, other failures may have applied them.
+type retryPipelinePolicy struct {
+	policy RetryPolicy
+}
+
+func (p *retryPipelinePolicy) Do(req *policy.Request) (resp *http.Response, err error) {
+	ctx := req.Raw().Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	for attempt := 1; ; attempt++ {
+		resp, err = req.Clone(ctx).Next()
+
+		callErr := err
+		if err == nil && resp.StatusCode >= http.StatusBadRequest {
+			callErr = runtime.NewResponseError(resp)
+		}
+		if callErr == nil {
+			return
+		}
+		if isNonIdempotent(req.Raw()) && !isRejectedBeforeApplied(resp) {
+			return
+		}
+		delay, retry := p.policy.Delay(attempt, callErr)
+		if !retry {
+			return
+		}
+
+		logger.Warn().Err(callErr).Int("attempt", attempt).Msgf("retrying %s %s in %s", req.Raw().Method, req.Raw().URL.Path, delay)
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		if err = sleepCtx(ctx, delay); err != nil {
+			return nil, err
+		}
+		if err = req.RewindBody(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// NewClientOptions returns the options of the SDK clients, the SDK retries are disabled in favor of retryPolicy
+func NewClientOptions(retryPolicy RetryPolicy) azcore.ClientOptions {
+	return azcore.ClientOptions{
+		Retry: policy.RetryOptions{
+			MaxRetries: -1,
+		},
+		PerCallPolicies: []policy.Policy{
+			&retryPipelinePolicy{policy: retryPolicy},
+		},
+		PerRetryPolicies: []policy.Policy{
+			metricsPipelinePolicy{},
+		},
+		TracingProvider: azureTracingProvider(),
+	}
+}
+
+func armClientOptions() *arm.ClientOptions {
+	return &arm.ClientOptions{ClientOptions: sdkClients.clientOptions()}
+}
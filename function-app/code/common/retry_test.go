@@ -0,0 +1,203 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+type fakeResponse struct {
+	status  int
+	code    string
+	headers map[string]string
+}
+
+// fakeTransport replies with the given responses in order, then with 200
+type fakeTransport struct {
+	responses []fakeResponse
+	requests  int
+	bodies    []string
+}
+
+func (t *fakeTransport) Do(req *http.Request) (*http.Response, error) {
+	t.requests++
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		t.bodies = append(t.bodies, string(body))
+	}
+
+	response := fakeResponse{status: http.StatusOK}
+	if len(t.responses) > 0 {
+		response, t.responses = t.responses[0], t.responses[1:]
+	}
+	resp := &http.Response{
+		StatusCode: response.status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(`{}`)),
+		Request:    req,
+	}
+	if response.code != "" {
+		resp.Header.Set("x-ms-error-code", response.code)
+		resp.Body = io.NopCloser(strings.NewReader(`{"error":{"code":"` + response.code + `"}}`))
+	}
+	for k, v := range response.headers {
+		resp.Header.Set(k, v)
+	}
+	return resp, nil
+}
+
+func sendWithRetries(t *testing.T, method string, retryPolicy RetryPolicy, transport *fakeTransport) (*http.Response, error) {
+	options := NewClientOptions(retryPolicy)
+	options.Transport = transport
+	pipeline := runtime.NewPipeline("weka-deployment", "test", runtime.PipelineOptions{}, &options)
+
+	req, err := runtime.NewRequest(context.TODO(), method, "https://management.azure.com/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runtime.MarshalAsJSON(req, map[string]int{"capacity": 3}); err != nil {
+		t.Fatal(err)
+	}
+	return pipeline.Do(req)
+}
+
+func TestRetryPipelinePolicy(t *testing.T) {
+	retryPolicy := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Second}
+
+	t.Run("retries throttling and transient failures", func(t *testing.T) {
+		transport := &fakeTransport{responses: []fakeResponse{
+			{status: http.StatusTooManyRequests, code: "SubscriptionRequestsThrottled", headers: map[string]string{"Retry-After": "1"}},
+			{status: http.StatusServiceUnavailable, headers: map[string]string{"retry-after-ms": "10"}},
+		}}
+		start := time.Now()
+		resp, err := sendWithRetries(t, http.MethodPut, retryPolicy, transport)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected success, got %v %v", resp, err)
+		}
+		if transport.requests != 3 {
+			t.Fatalf("expected 3 requests, got %d", transport.requests)
+		}
+		if time.Since(start) < time.Second {
+			t.Fatalf("Retry-After was not honoured")
+		}
+		for _, body := range transport.bodies {
+			if body != `{"capacity":3}` {
+				t.Fatalf("request body was not rewound between attempts: %q", body)
+			}
+		}
+	})
+
+	t.Run("does not retry fatal errors", func(t *testing.T) {
+		transport := &fakeTransport{responses: []fakeResponse{
+			{status: http.StatusNotFound, code: "ResourceNotFound"},
+		}}
+		resp, err := sendWithRetries(t, http.MethodGet, retryPolicy, transport)
+		if err != nil || resp.StatusCode != http.StatusNotFound || transport.requests != 1 {
+			t.Fatalf("expected a single 404 response, got %v %v after %d requests", resp, err, transport.requests)
+		}
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		transport := &fakeTransport{responses: []fakeResponse{
+			{status: http.StatusInternalServerError, code: "InternalExecutionError"},
+			{status: http.StatusInternalServerError, code: "InternalExecutionError"},
+			{status: http.StatusInternalServerError, code: "InternalExecutionError"},
+			{status: http.StatusInternalServerError, code: "InternalExecutionError"},
+		}}
+		resp, err := sendWithRetries(t, http.MethodGet, retryPolicy, transport)
+		if err != nil || resp.StatusCode != http.StatusInternalServerError || transport.requests != 4 {
+			t.Fatalf("expected 4 attempts ending with 500, got %v %v after %d requests", resp, err, transport.requests)
+		}
+	})
+
+	t.Run("does not retry authorization failures", func(t *testing.T) {
+		transport := &fakeTransport{responses: []fakeResponse{
+			{status: http.StatusForbidden, code: "AuthorizationFailed"},
+		}}
+		resp, err := sendWithRetries(t, http.MethodGet, retryPolicy, transport)
+		if err != nil || resp.StatusCode != http.StatusForbidden || transport.requests != 1 {
+			t.Fatalf("expected a single 403 response, got %v %v after %d requests", resp, err, transport.requests)
+		}
+	})
+
+	t.Run("retries POST and PUT only when rejected with Retry-After", func(t *testing.T) {
+		for _, method := range []string{http.MethodPost, http.MethodPut} {
+			for _, response := range []fakeResponse{
+				{status: http.StatusInternalServerError, code: "InternalExecutionError"},
+				{status: http.StatusServiceUnavailable},
+				{status: http.StatusGatewayTimeout, headers: map[string]string{"Retry-After": "1"}},
+			} {
+				transport := &fakeTransport{responses: []fakeResponse{response}}
+				resp, err := sendWithRetries(t, method, retryPolicy, transport)
+				if err != nil || resp.StatusCode != response.status || transport.requests != 1 {
+					t.Fatalf("expected a single %s attempt ending with %d, got %v %v after %d requests", method, response.status, resp, err, transport.requests)
+				}
+			}
+
+			transport := &fakeTransport{responses: []fakeResponse{
+				{status: http.StatusServiceUnavailable, headers: map[string]string{"retry-after-ms": "10"}},
+			}}
+			resp, err := sendWithRetries(t, method, retryPolicy, transport)
+			if err != nil || resp.StatusCode != http.StatusOK || transport.requests != 2 {
+				t.Fatalf("expected %s to be retried after a 503 with Retry-After, got %v %v after %d requests", method, resp, err, transport.requests)
+			}
+		}
+	})
+
+	t.Run("does not wait for Retry-After beyond max delay", func(t *testing.T) {
+		transport := &fakeTransport{responses: []fakeResponse{
+			{status: http.StatusTooManyRequests, headers: map[string]string{"Retry-After": "120"}},
+		}}
+		resp, err := sendWithRetries(t, http.MethodGet, retryPolicy, transport)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || transport.requests != 1 {
+			t.Fatalf("expected a single 429 response, got %v %v after %d requests", resp, err, transport.requests)
+		}
+	})
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, true},
+		{&azcore.ResponseError{StatusCode: http.StatusInternalServerError, ErrorCode: "InternalExecutionError"}, true},
+		{&azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: "AuthorizationPermissionMismatch"}, false},
+		{&azcore.ResponseError{StatusCode: http.StatusNotFound, ErrorCode: "ResourceNotFound"}, false},
+		{&azcore.ResponseError{StatusCode: http.StatusConflict, ErrorCode: "OperationNotAllowed"}, false},
+		{&azcore.ResponseError{StatusCode: http.StatusPreconditionFailed, ErrorCode: "ConditionNotMet"}, false},
+		{context.Canceled, false},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("boom"), false},
+	}
+	for _, test := range tests {
+		if IsRetryableError(test.err) != test.retryable {
+			t.Errorf("IsRetryableError(%v) should be %t", test.err, test.retryable)
+		}
+	}
+}
+
+func TestIsAuthorizationError(t *testing.T) {
+	tests := []struct {
+		err           error
+		authorization bool
+	}{
+		{&azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: "AuthorizationFailed"}, true},
+		{fmt.Errorf("cannot set protection: %w", &azcore.ResponseError{StatusCode: http.StatusForbidden, ErrorCode: "AuthorizationPermissionMismatch"}), true},
+		{&azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, false},
+		{errors.New("boom"), false},
+	}
+	for _, test := range tests {
+		if IsAuthorizationError(test.err) != test.authorization {
+			t.Errorf("IsAuthorizationError(%v) should be %t", test.err, test.authorization)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"context"
+	"path"
+	"time"
+)
+
+const (
+	rollingUpgradePrefix = "rolling_upgrade"
+	// tag of the scale set and its instances telling the vmss config they were created from
+	ConfigHashTag = "config_hash"
+)
+
+type RollingUpgradePhase string
+
+const (
+	// waiting for weka to report the data fully protected before removing the next out-of-date instance
+	RollingUpgradeWaitingProtection RollingUpgradePhase = "waiting_protection"
+	// the weka host of the instance is being deactivated, the instance is deleted once weka removed the host
+	RollingUpgradeDeactivating RollingUpgradePhase = "deactivating"
+	// the instance was removed, waiting for its replacement to join the cluster
+	RollingUpgradeWaitingReplacement RollingUpgradePhase = "waiting_replacement"
+	RollingUpgradeCompleted          RollingUpgradePhase = "completed"
+)
+
+// RollingUpgrade is the progress of replacing the instances created from an older vmss config, one at a time.
+// The replaced instances are also recorded in the state updates.
+type RollingUpgrade struct {
+	// To is the config hash the instances are upgraded to, empty before the first upgrade
+	To     string              `json:"to"`
+	Phase  RollingUpgradePhase `json:"phase,omitempty"`
+	Paused bool                `json:"paused"`
+	// PauseReason is set when the upgrade paused itself, e.g. when a replacement didn't join in time
+	PauseReason string `json:"pause_reason,omitempty"`
+	// Instance is the instance being replaced, with the config hash it was created from
+	Instance     string `json:"instance,omitempty"`
+	InstanceId   string `json:"instance_id,omitempty"`
+	InstanceHash string `json:"instance_hash,omitempty"`
+	// ActiveBackends is the number of active weka backends before the instance removal, the replacement joined
+	// once it is reached again
+	ActiveBackends int        `json:"active_backends,omitempty"`
+	Replaced       []string   `json:"replaced"`
+	Remaining      int        `json:"remaining"`
+	StartedAt      time.Time  `json:"started_at"`
+	PhaseStartedAt time.Time  `json:"phase_started_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// SetPhase moves the upgrade to the next phase
+func (u *RollingUpgrade) SetPhase(phase RollingUpgradePhase) {
+	u.Phase = phase
+	u.PhaseStartedAt = time.Now()
+}
+
+// the rolling upgrade is kept next to the state it belongs to, like the operations
+func rollingUpgradeParams(stateParams BlobObjParams) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      path.Join(rollingUpgradePrefix, stateParams.BlobName+".json"),
+	}
+}
+
+func newRollingUpgrade() RollingUpgrade {
+	return RollingUpgrade{Replaced: []string{}}
+}
+
+func GetRollingUpgrade(ctx context.Context, store StateStore, stateParams BlobObjParams) (upgrade RollingUpgrade, err error) {
+	upgrade, _, err = readJsonObject(ctx, store, rollingUpgradeParams(stateParams), newRollingUpgrade)
+	return
+}
+
+func UpdateRollingUpgrade(ctx context.Context, store StateStore, stateParams BlobObjParams, updateFn func(upgrade *RollingUpgrade) error) (RollingUpgrade, error) {
+	return updateJsonObject(ctx, store, rollingUpgradeParams(stateParams), newRollingUpgrade, updateFn)
+}
+
+// WekaProtectionStatus is the part of the weka status telling whether the cluster can lose a backend
+type WekaProtectionStatus struct {
+	IoStatus string `json:"io_status"`
+	Hosts    struct {
+		Backends struct {
+			Active int `json:"active"`
+			Total  int `json:"total"`
+		} `json:"backends"`
+	} `json:"hosts"`
+	Rebuild struct {
+		// the share of the data by the number of failures it went through
+		ProtectionState []struct {
+			NumFailures int     `json:"numFailures"`
+			Percent     float64 `json:"percent"`
+		} `json:"protectionState"`
+	} `json:"rebuild"`
+}
+
+// FullyProtected tells whether the io is started and no data is left unprotected by a failure
+func (s *WekaProtectionStatus) FullyProtected() bool {
+	if s.IoStatus != "STARTED" {
+		return false
+	}
+	for _, state := range s.Rebuild.ProtectionState {
+		if state.NumFailures > 0 && state.Percent > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestUpdateRollingUpgrade(t *testing.T) {
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	stateParams := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+
+	upgrade, err := GetRollingUpgrade(ctx, store, stateParams)
+	if err != nil || upgrade.To != "" || upgrade.Replaced == nil {
+		t.Fatalf("expected an empty rolling upgrade, got %+v, %v", upgrade, err)
+	}
+
+	_, err = UpdateRollingUpgrade(ctx, store, stateParams, func(upgrade *RollingUpgrade) error {
+		upgrade.To = "hash"
+		upgrade.SetPhase(RollingUpgradeWaitingProtection)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed updating rolling upgrade: %s", err)
+	}
+	_, err = UpdateRollingUpgrade(ctx, store, stateParams, func(upgrade *RollingUpgrade) error {
+		upgrade.Paused = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed pausing rolling upgrade: %s", err)
+	}
+
+	upgrade, err = GetRollingUpgrade(ctx, store, stateParams)
+	if err != nil || upgrade.To != "hash" || upgrade.Phase != RollingUpgradeWaitingProtection || !upgrade.Paused {
+		t.Fatalf("unexpected rolling upgrade: %+v, %v", upgrade, err)
+	}
+}
+
+func TestWekaProtectionStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{`{"io_status": "STARTED", "rebuild": {"protectionState": [{"numFailures": 0, "percent": 100}]}}`, true},
+		{`{"io_status": "STARTED", "rebuild": {"protectionState": [{"numFailures": 0, "percent": 95}, {"numFailures": 1, "percent": 5}]}}`, false},
+		{`{"io_status": "STARTED", "rebuild": {"protectionState": [{"numFailures": 0, "percent": 100}, {"numFailures": 1, "percent": 0}]}}`, true},
+		{`{"io_status": "STOPPED"}`, false},
+	}
+	for _, test := range tests {
+		var status WekaProtectionStatus
+		if err := json.Unmarshal([]byte(test.status), &status); err != nil {
+			t.Fatalf("failed unmarshalling %s: %s", test.status, err)
+		}
+		if status.FullyProtected() != test.want {
+			t.Errorf("%s: expected fully protected %t", test.status, test.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	skuMigrationPrefix = "sku_migration"
+)
+
+type SkuMigrationPhase string
+
+const (
+	// the target scale set is created with the new SKU
+	SkuMigrationCreating SkuMigrationPhase = "creating"
+	// the target scale set is scaled to the desired size, waiting for its instances to join the cluster
+	SkuMigrationJoining SkuMigrationPhase = "joining"
+	// the target scale set is active, the source instances are removed by batches
+	SkuMigrationDraining SkuMigrationPhase = "draining"
+	// the source scale set is empty and being deleted
+	SkuMigrationRetiring  SkuMigrationPhase = "retiring"
+	SkuMigrationCompleted SkuMigrationPhase = "completed"
+)
+
+// SkuMigration moves the backends to a new scale set when the SKU changes, since the SKU of a scale set
+// with instances can't be changed. The scale sets are versioned, see GetVersionedScaleSetName.
+type SkuMigration struct {
+	// Active is the backends scale set, empty before the first migration
+	Active string `json:"active,omitempty"`
+	// Version is the version of the target scale set, the initial scale set is version 1
+	Version    int               `json:"version"`
+	Phase      SkuMigrationPhase `json:"phase,omitempty"`
+	Source     string            `json:"source"`
+	Target     string            `json:"target"`
+	FromSku    string            `json:"from_sku"`
+	ToSku      string            `json:"to_sku"`
+	FromHash   string            `json:"from_hash"`
+	ConfigHash string            `json:"config_hash"`
+	// SourceBackends is the number of active weka backends before the target instances joined
+	SourceBackends int `json:"source_backends,omitempty"`
+	// Batch is the source instances being removed, they are recorded before their weka hosts are deactivated
+	Batch []string `json:"batch,omitempty"`
+	// Deactivated is the instances of the batch whose weka host was removed, they are recorded before their deletion
+	Deactivated    []string   `json:"deactivated,omitempty"`
+	Removed        []string   `json:"removed"`
+	StartedAt      time.Time  `json:"started_at"`
+	PhaseStartedAt time.Time  `json:"phase_started_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// SetPhase moves the migration to the next phase
+func (m *SkuMigration) SetPhase(phase SkuMigrationPhase) {
+	m.Phase = phase
+	m.PhaseStartedAt = time.Now()
+}
+
+// InProgress tells whether the migration was started and not completed yet
+func (m *SkuMigration) InProgress() bool {
+	return m.Target != "" && m.Phase != SkuMigrationCompleted
+}
+
+// ActiveScaleSet returns the backends scale set, defaultName is the one of the initial deployment
+func (m *SkuMigration) ActiveScaleSet(defaultName string) string {
+	if m.Active != "" {
+		return m.Active
+	}
+	return defaultName
+}
+
+// ScaleSets returns the scale sets which may have backends, the active one first. Both the source and target
+// scale sets have backends while the target instances join and the source instances are removed.
+func (m *SkuMigration) ScaleSets(defaultName string) []string {
+	active := m.ActiveScaleSet(defaultName)
+	scaleSets := []string{active}
+	if m.Phase == SkuMigrationJoining || m.Phase == SkuMigrationDraining {
+		for _, name := range []string{m.Source, m.Target} {
+			if name != active {
+				scaleSets = append(scaleSets, name)
+			}
+		}
+	}
+	return scaleSets
+}
+
+// GetVersionedScaleSetName returns the name of a backends scale set created by a sku migration,
+// version 1 is the scale set created by the initial deployment
+func GetVersionedScaleSetName(prefix, clusterName string, version int) string {
+	name := GetVmScaleSetName(prefix, clusterName)
+	if version <= 1 {
+		return name
+	}
+	return fmt.Sprintf("%s-v%d", name, version)
+}
+
+// the sku migration is kept next to the state it belongs to, like the operations
+func skuMigrationParams(stateParams BlobObjParams) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      path.Join(skuMigrationPrefix, stateParams.BlobName+".json"),
+	}
+}
+
+func newSkuMigration() SkuMigration {
+	return SkuMigration{Version: 1, Removed: []string{}}
+}
+
+func GetSkuMigration(ctx context.Context, store StateStore, stateParams BlobObjParams) (migration SkuMigration, err error) {
+	migration, _, err = readJsonObject(ctx, store, skuMigrationParams(stateParams), newSkuMigration)
+	return
+}
+
+func UpdateSkuMigration(ctx context.Context, store StateStore, stateParams BlobObjParams, updateFn func(migration *SkuMigration) error) (SkuMigration, error) {
+	return updateJsonObject(ctx, store, skuMigrationParams(stateParams), newSkuMigration, updateFn)
+}
+
+// GetBackendsScaleSetName returns the scale set the backends are created in, it changes after a sku migration
+func GetBackendsScaleSetName(ctx context.Context, store StateStore, stateParams BlobObjParams, prefix, clusterName string) (string, error) {
+	migration, err := GetSkuMigration(ctx, store, stateParams)
+	if err != nil {
+		return "", fmt.Errorf("cannot read sku migration: %w", err)
+	}
+	return migration.ActiveScaleSet(GetVmScaleSetName(prefix, clusterName)), nil
+}
+
+// GetBackendsScaleSetNames returns the scale sets which may have backends, both the source and target scale sets
+// have backends during a sku migration. The active scale set is first.
+func GetBackendsScaleSetNames(ctx context.Context, store StateStore, stateParams BlobObjParams, prefix, clusterName string) ([]string, error) {
+	migration, err := GetSkuMigration(ctx, store, stateParams)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read sku migration: %w", err)
+	}
+	return migration.ScaleSets(GetVmScaleSetName(prefix, clusterName)), nil
+}
+
+// FindScaleSetOfVm returns the scale set of a Uniform scale set vm given its name (<scale set>_<instance id>, optionally
+// followed by :<hostname>), empty when the vm is in none of the scale sets
+func FindScaleSetOfVm(scaleSets []string, vmName string) string {
+	vmName = strings.Split(vmName, ":")[0]
+	i := strings.LastIndex(vmName, "_")
+	if i < 0 {
+		return ""
+	}
+	for _, name := range scaleSets {
+		if vmName[:i] == name {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestSkuMigrationScaleSets(t *testing.T) {
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	stateParams := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+	initial := GetVmScaleSetName("weka", "poc")
+
+	scaleSets, err := GetBackendsScaleSetNames(ctx, store, stateParams, "weka", "poc")
+	if err != nil || !slices.Equal(scaleSets, []string{initial}) {
+		t.Fatalf("expected the initial scale set only, got %v, %v", scaleSets, err)
+	}
+
+	target := GetVersionedScaleSetName("weka", "poc", 2)
+	if target != initial+"-v2" || GetVersionedScaleSetName("weka", "poc", 1) != initial {
+		t.Fatalf("unexpected versioned scale set names: %s", target)
+	}
+
+	phases := []struct {
+		phase     SkuMigrationPhase
+		active    string
+		scaleSets []string
+	}{
+		{SkuMigrationCreating, initial, []string{initial}},
+		{SkuMigrationJoining, initial, []string{initial, target}},
+		{SkuMigrationDraining, target, []string{target, initial}},
+		{SkuMigrationRetiring, target, []string{target}},
+		{SkuMigrationCompleted, target, []string{target}},
+	}
+	for _, p := range phases {
+		_, err := UpdateSkuMigration(ctx, store, stateParams, func(migration *SkuMigration) error {
+			migration.Source, migration.Target, migration.Version = initial, target, 2
+			if p.active != initial {
+				migration.Active = p.active
+			}
+			migration.SetPhase(p.phase)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed updating sku migration: %s", err)
+		}
+		active, _ := GetBackendsScaleSetName(ctx, store, stateParams, "weka", "poc")
+		scaleSets, _ := GetBackendsScaleSetNames(ctx, store, stateParams, "weka", "poc")
+		if active != p.active || !slices.Equal(scaleSets, p.scaleSets) {
+			t.Errorf("%s: unexpected active %s and scale sets %v", p.phase, active, scaleSets)
+		}
+	}
+
+	scaleSets = []string{initial, target}
+	if vmss := FindScaleSetOfVm(scaleSets, target+"_3:weka-poc-backend-v2000003"); vmss != target {
+		t.Errorf("expected the vm in %s, got %q", target, vmss)
+	}
+	if vmss := FindScaleSetOfVm(scaleSets, initial+"_3"); vmss != initial {
+		t.Errorf("expected the vm in %s, got %q", initial, vmss)
+	}
+	if vmss := FindScaleSetOfVm(scaleSets, "other-vmss_3"); vmss != "" {
+		t.Errorf("expected no scale set, got %q", vmss)
+	}
+}
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// key vault secret holding the key used for signing exported state bundles, it is set by terraform
+const StateBundleSigningKeySecret = "state-bundle-signing-key"
+
+var ErrInvalidStateBundleSignature = errors.New("state bundle signature is invalid")
+
+// StateBundle is a portable copy of the deployment state, used for moving the state between storage accounts
+// and for restoring it after the state container was lost
+type StateBundle struct {
+	SchemaVersion   int                    `json:"schema_version"`
+	CreatedAt       time.Time              `json:"created_at"`
+	ScaleSetName    string                 `json:"vmss_name"`
+	VmssConfigHash  string                 `json:"vmss_config_hash"`
+	State           protocol.ClusterState  `json:"state"`
+	NfsScaleSetName string                 `json:"nfs_vmss_name,omitempty"`
+	NfsState        *protocol.ClusterState `json:"nfs_state,omitempty"`
+}
+
+// SignedStateBundle is the exported form of StateBundle, the signature is a hex HMAC-SHA256 of the bundle bytes
+type SignedStateBundle struct {
+	Bundle    json.RawMessage `json:"bundle"`
+	Signature string          `json:"signature"`
+}
+
+// StateValidation is the result of validating a state against the live vmss
+type StateValidation struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func (v *StateValidation) AddError(format string, args ...interface{}) {
+	v.Errors = append(v.Errors, fmt.Sprintf(format, args...))
+}
+
+func (v *StateValidation) AddWarning(format string, args ...interface{}) {
+	v.Warnings = append(v.Warnings, fmt.Sprintf(format, args...))
+}
+
+// GetStateBundleSigningKey returns the bundle signing key. The key is created by terraform and never by the function
+// app: concurrent invocations creating it would race, and the bundles signed with the losing key couldn't be imported.
+func GetStateBundleSigningKey(ctx context.Context, keyVaultUri string) (key []byte, err error) {
+	secret, err := GetKeyVaultValue(ctx, keyVaultUri, StateBundleSigningKeySecret)
+	if err != nil {
+		err = fmt.Errorf("cannot get state bundle signing key: %v", err)
+		return
+	}
+	if secret == "" {
+		err = fmt.Errorf("state bundle signing key %s is empty", StateBundleSigningKeySecret)
+		return
+	}
+	return []byte(secret), nil
+}
+
+func stateBundleSignature(data, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func SignStateBundle(bundle StateBundle, key []byte) (signed SignedStateBundle, err error) {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return
+	}
+	signed.Bundle = data
+	signed.Signature = stateBundleSignature(data, key)
+	return
+}
+
+// VerifyStateBundle checks the bundle signature and returns the decoded bundle
+func VerifyStateBundle(signed SignedStateBundle, key []byte) (bundle StateBundle, err error) {
+	expected := stateBundleSignature(signed.Bundle, key)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signed.Signature))) {
+		err = ErrInvalidStateBundleSignature
+		return
+	}
+	if err = json.Unmarshal(signed.Bundle, &bundle); err != nil {
+		err = fmt.Errorf("cannot decode state bundle: %v", err)
+		return
+	}
+	if bundle.SchemaVersion > StateSchemaVersion {
+		err = fmt.Errorf("%w: bundle schema version %d", ErrUnsupportedStateVersion, bundle.SchemaVersion)
+	}
+	return
+}
+
+func isProtectedVm(vm *VMInfoSummary) bool {
+	return vm.ProtectionPolicy != nil && vm.ProtectionPolicy.ProtectFromScaleSetActions != nil && *vm.ProtectionPolicy.ProtectFromScaleSetActions
+}
+
+func hasNfsInterfaceGroupTag(vm *VMInfoSummary) bool {
+	val, ok := vm.Tags[NfsInterfaceGroupPortKey]
+	return ok && val != nil && *val == NfsInterfaceGroupPortValue
+}
+
+// ValidateStateAgainstInstances checks that the state matches the live vmss instances.
+// Instances in the state are named "<vm name>:<hostname>", as reported by the deploy script.
+func ValidateStateAgainstInstances(state protocol.ClusterState, vms []*VMInfoSummary, validation *StateValidation) {
+	liveNames := make(map[string]bool)
+	for _, vm := range vms {
+		liveNames[vm.Name] = true
+		if vm.ComputerName != nil {
+			liveNames[*vm.ComputerName] = true
+		}
+	}
+
+	for _, instance := range state.Instances {
+		vmName, hostname, _ := strings.Cut(instance.Name, ":")
+		if !liveNames[vmName] && !liveNames[hostname] {
+			validation.AddError("instance %s is not part of the vmss", instance.Name)
+		}
+	}
+
+	if state.DesiredSize < 0 || state.InitialSize < 0 || state.ClusterizationTarget < 0 {
+		validation.AddError("state sizes must not be negative")
+	}
+	if !state.Clusterized && len(state.Instances) > state.ClusterizationTarget {
+		validation.AddError("state has %d instances waiting for clusterization, more than the clusterization target %d", len(state.Instances), state.ClusterizationTarget)
+	}
+	if state.Clusterized && len(state.Instances) > 0 {
+		validation.AddWarning("state is clusterized but still lists %d instances", len(state.Instances))
+	}
+	if state.Clusterized && state.DesiredSize < len(vms) {
+		validation.AddWarning("desired size %d is smaller than the %d live vmss instances, instances will be scaled down", state.DesiredSize, len(vms))
+	}
+
+	protected := 0
+	for _, vm := range vms {
+		if isProtectedVm(vm) {
+			protected++
+		}
+	}
+	if !state.Clusterized && protected >= state.ClusterizationTarget && state.ClusterizationTarget > 0 {
+		validation.AddWarning("state is not clusterized but %d vmss instances are protected, the cluster may already be clusterized", protected)
+	}
+}
+
+// ReconstructClusterState builds a best-effort state from the live vmss instances, for when no state backup exists.
+// A cluster is considered clusterized when enough instances are protected (or tagged with the NFS interface group
+// port), since protection is set only after an instance joined the cluster. Instances waiting for clusterization
+// can't be recovered, as they are known only from the clusterize calls.
+func ReconstructClusterState(vms []*VMInfoSummary, capacity, initialSize, clusterizationTarget int) (state protocol.ClusterState, warnings []string) {
+	state = protocol.ClusterState{
+		InitialSize:          initialSize,
+		DesiredSize:          capacity,
+		ClusterizationTarget: clusterizationTarget,
+		Instances:            []protocol.Vm{},
+		Progress:             map[string][]string{},
+		Errors:               map[string][]string{},
+		Debug:                map[string][]string{},
+	}
+	if state.DesiredSize < initialSize {
+		state.DesiredSize = initialSize
+	}
+
+	joined := 0
+	for _, vm := range vms {
+		if isProtectedVm(vm) || hasNfsInterfaceGroupTag(vm) {
+			joined++
+		}
+	}
+	state.Clusterized = joined > 0 && joined >= clusterizationTarget
+
+	if !state.Clusterized && len(vms) > 0 {
+		warnings = append(warnings, fmt.Sprintf("cluster is not clusterized (%d of %d instances joined), instances waiting for clusterization can't be recovered and have to re-run clusterize", joined, clusterizationTarget))
+	}
+	if state.Clusterized && joined < len(vms) {
+		warnings = append(warnings, fmt.Sprintf("%d instances are not protected, they may still be joining the cluster", len(vms)-joined))
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestStateBundleSignature(t *testing.T) {
+	key := []byte("signing-key")
+	bundle := StateBundle{
+		SchemaVersion: StateSchemaVersion,
+		ScaleSetName:  "vmss",
+		State:         protocol.ClusterState{InitialSize: 6, DesiredSize: 8, ClusterizationTarget: 6, Clusterized: true},
+	}
+
+	signed, err := SignStateBundle(bundle, key)
+	if err != nil {
+		t.Fatalf("failed signing bundle: %s", err)
+	}
+	verified, err := VerifyStateBundle(signed, key)
+	if err != nil || verified.State.DesiredSize != 8 || !verified.State.Clusterized {
+		t.Fatalf("unexpected verified bundle: %+v, %v", verified, err)
+	}
+
+	if _, err = VerifyStateBundle(signed, []byte("other-key")); !errors.Is(err, ErrInvalidStateBundleSignature) {
+		t.Fatalf("expected signature error for a wrong key, got %v", err)
+	}
+	signed.Bundle = []byte(string(signed.Bundle[:len(signed.Bundle)-1]) + ` `)
+	if _, err = VerifyStateBundle(signed, key); !errors.Is(err, ErrInvalidStateBundleSignature) {
+		t.Fatalf("expected signature error for a modified bundle, got %v", err)
+	}
+}
+
+func TestReconstructClusterState(t *testing.T) {
+	protected, unprotected := true, false
+	vm := func(name string, protect bool) *VMInfoSummary {
+		return &VMInfoSummary{
+			Name:             name,
+			ProtectionPolicy: &armcompute.VirtualMachineScaleSetVMProtectionPolicy{ProtectFromScaleSetActions: &protect},
+		}
+	}
+
+	vms := []*VMInfoSummary{vm("vm_0", protected), vm("vm_1", protected), vm("vm_2", protected), vm("vm_3", unprotected)}
+	state, warnings := ReconstructClusterState(vms, 7, 6, 3)
+	if !state.Clusterized || state.DesiredSize != 7 || state.InitialSize != 6 || len(warnings) != 1 {
+		t.Fatalf("unexpected clusterized state: %+v, %v", state, warnings)
+	}
+
+	state, warnings = ReconstructClusterState(vms[2:], 2, 6, 3)
+	if state.Clusterized || state.DesiredSize != 6 || len(warnings) != 1 {
+		t.Fatalf("unexpected not clusterized state: %+v, %v", state, warnings)
+	}
+
+	var validation StateValidation
+	ValidateStateAgainstInstances(protocol.ClusterState{ClusterizationTarget: 3, Instances: []protocol.Vm{{Name: "vm_9:host9"}}}, vms, &validation)
+	if len(validation.Errors) != 1 || len(validation.Warnings) != 1 {
+		t.Fatalf("unexpected validation: %+v", validation)
+	}
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	stateHistoryPrefix = "history"
+	// number of state versions kept until SetStateHistoryRetention is called
+	defaultStateHistoryRetention = 50
+)
+
+// stateHistoryRetention is the number of state versions to keep, 0 disables the history
+var stateHistoryRetention = defaultStateHistoryRetention
+
+// StateVersion is a snapshot of the state taken on write, versions are numbered by their write time
+type StateVersion struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+// SetStateHistoryRetention sets the number of state versions to keep, it is called at startup
+func SetStateHistoryRetention(retention int) {
+	stateHistoryRetention = retention
+}
+
+func stateHistoryDir(stateParams BlobObjParams) string {
+	return path.Join(stateHistoryPrefix, stateParams.BlobName) + "/"
+}
+
+func stateVersionParams(stateParams BlobObjParams, version string) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      stateHistoryDir(stateParams) + version,
+	}
+}
+
+// saveStateVersion keeps a snapshot of the state that was just written and removes versions beyond the retention.
+// The state itself is already written at this point, so failures are only logged.
+func saveStateVersion(ctx context.Context, store StateStore, stateParams BlobObjParams, stateAsByteArray []byte) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	retention := stateHistoryRetention
+	if retention <= 0 {
+		return
+	}
+
+	version := fmt.Sprintf("%020d", time.Now().UTC().UnixNano())
+	_, err := store.Write(ctx, stateVersionParams(stateParams, version), stateAsByteArray, "")
+	if err != nil {
+		logger.Error().Err(err).Msg("failed saving state version")
+		return
+	}
+
+	versions, err := ListStateVersions(ctx, store, stateParams)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed listing state versions")
+		return
+	}
+	for i := 0; i < len(versions)-retention; i++ {
+		err = store.Delete(ctx, stateVersionParams(stateParams, versions[i].Version))
+		if err != nil {
+			logger.Error().Err(err).Msgf("failed deleting state version %s", versions[i].Version)
+		}
+	}
+}
+
+// ListStateVersions returns the kept versions of the state, oldest first
+func ListStateVersions(ctx context.Context, store StateStore, stateParams BlobObjParams) (versions []StateVersion, err error) {
+	historyDir := stateHistoryDir(stateParams)
+	names, err := store.List(ctx, BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      historyDir,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		version := strings.TrimPrefix(name, historyDir)
+		nanos, err2 := strconv.ParseInt(version, 10, 64)
+		if err2 != nil {
+			continue
+		}
+		versions = append(versions, StateVersion{Version: version, Time: time.Unix(0, nanos).UTC()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+	return
+}
+
+func ReadStateVersion(ctx context.Context, store StateStore, stateParams BlobObjParams, version string) (state protocol.ClusterState, err error) {
+	if _, err = strconv.ParseInt(version, 10, 64); err != nil {
+		err = fmt.Errorf("invalid state version %q", version)
+		return
+	}
+	return ReadState(ctx, store, stateVersionParams(stateParams, version))
+}
+
+// RestoreStateVersion writes the given state version as the current state, while holding the container lock
+func RestoreStateVersion(ctx context.Context, store StateStore, stateParams BlobObjParams, version string) (state protocol.ClusterState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	state, err = ReadStateVersion(ctx, store, stateParams, version)
+	if err != nil {
+		return
+	}
+
+	lock, err := LockContainer(ctx, store, stateParams)
+	if err != nil {
+		return
+	}
+	defer UnlockContainer(ctx, lock)
+
+	err = WriteState(ctx, store, stateParams, state)
+	if err != nil {
+		return
+	}
+
+	logger.Info().Msgf("state restored to version %s", version)
+	return
+}
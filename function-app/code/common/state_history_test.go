@@ -0,0 +1,54 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func TestStateHistory(t *testing.T) {
+	SetStateHistoryRetention(3)
+	t.Cleanup(func() { SetStateHistoryRetention(defaultStateHistoryRetention) })
+
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	p := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+
+	for size := 1; size <= 5; size++ {
+		if err := WriteState(ctx, store, p, protocol.ClusterState{DesiredSize: size}); err != nil {
+			t.Fatalf("failed writing state: %s", err)
+		}
+	}
+
+	versions, err := ListStateVersions(ctx, store, p)
+	if err != nil {
+		t.Fatalf("failed listing versions: %s", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+
+	oldest, err := ReadStateVersion(ctx, store, p, versions[0].Version)
+	if err != nil {
+		t.Fatalf("failed reading version: %s", err)
+	}
+	if oldest.DesiredSize != 3 {
+		t.Fatalf("expected oldest kept version to have desired size 3, got %d", oldest.DesiredSize)
+	}
+
+	if _, err = RestoreStateVersion(ctx, store, p, versions[0].Version); err != nil {
+		t.Fatalf("failed restoring version: %s", err)
+	}
+	state, err := ReadState(ctx, store, p)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if state.DesiredSize != 3 {
+		t.Fatalf("expected restored desired size 3, got %d", state.DesiredSize)
+	}
+
+	if _, err = ReadStateVersion(ctx, store, p, "../state"); err == nil {
+		t.Fatal("expected invalid version error")
+	}
+}
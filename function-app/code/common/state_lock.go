@@ -0,0 +1,145 @@
+package common
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const (
+	LockLeaseDuration = 60 * time.Second
+	// the lease is renewed well before it expires, so a slow renewal doesn't lose the lock
+	lockRenewInterval = LockLeaseDuration / 3
+)
+
+// LockHolder describes who holds a container lock, it is kept next to the lock (container metadata for blob storage)
+type LockHolder struct {
+	FunctionName string    `json:"function_name"`
+	InvocationId string    `json:"invocation_id"`
+	Hostname     string    `json:"hostname"`
+	AcquiredAt   time.Time `json:"acquired_at"`
+}
+
+// LockInfo is the current state of a container lock, as shown by the debug function
+type LockInfo struct {
+	Locked  bool        `json:"locked"`
+	Holder  *LockHolder `json:"holder,omitempty"`
+	HeldFor string      `json:"held_for,omitempty"`
+}
+
+func newLockHolder(ctx context.Context) LockHolder {
+	invocation := InvocationFromCtx(ctx)
+	hostname, _ := os.Hostname()
+	return LockHolder{
+		FunctionName: invocation.FunctionName,
+		InvocationId: invocation.InvocationId,
+		Hostname:     hostname,
+		AcquiredAt:   time.Now().UTC(),
+	}
+}
+
+// ContainerLock is a held container lock. Its lease is renewed in the background until it is unlocked,
+// so it can guard critical sections which take longer than the lease duration.
+type ContainerLock struct {
+	LockId *string
+	Params BlobObjParams
+
+	store      StateStore
+	stopRenew  context.CancelFunc
+	renewDone  chan struct{}
+	unlockOnce sync.Once
+}
+
+func (l *ContainerLock) keepAlive(ctx context.Context) {
+	logger := logging.LoggerFromCtx(ctx)
+	defer close(l.renewDone)
+
+	ticker := time.NewTicker(lockRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := l.store.RenewLock(ctx, l.Params, l.LockId)
+			if err != nil && ctx.Err() == nil {
+				logger.Error().Err(err).Msgf("failed renewing lock on %s", l.Params.ContainerName)
+			}
+		}
+	}
+}
+
+func LockContainer(ctx context.Context, store StateStore, p BlobObjParams) (*ContainerLock, error) {
+	logger := logging.LoggerFromCtx(ctx)
+	logger.Debug().Msgf("locking %s", p.ContainerName)
+
+	spanCtx, span := StartSpan(ctx, "lock "+p.ContainerName, SpanKindInternal)
+	start := time.Now()
+	lockId, err := store.Lock(spanCtx, p, newLockHolder(ctx))
+	LockWaitSeconds.ObserveDuration(start, p.ContainerName)
+	span.Finish(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// the renewal must outlive the request context, it is stopped by UnlockContainer
+	renewCtx, stopRenew := context.WithCancel(context.WithoutCancel(ctx))
+	lock := &ContainerLock{
+		LockId:    lockId,
+		Params:    p,
+		store:     store,
+		stopRenew: stopRenew,
+		renewDone: make(chan struct{}),
+	}
+	go lock.keepAlive(renewCtx)
+	return lock, nil
+}
+
+func UnlockContainer(ctx context.Context, lock *ContainerLock) (err error) {
+	if lock == nil {
+		return
+	}
+	logger := logging.LoggerFromCtx(ctx)
+
+	lock.unlockOnce.Do(func() {
+		logger.Debug().Msgf("unlocking %s", lock.Params.ContainerName)
+		lock.stopRenew()
+		<-lock.renewDone
+
+		err = lock.store.Unlock(ctx, lock.Params, lock.LockId)
+		if err != nil {
+			logger.Error().Msgf("Failed to unlock container: %s", err)
+		}
+	})
+	return
+}
+
+type containerLockCtxKey struct{}
+
+// ContextWithContainerLock marks the container lock as held by the context, so that state updates made
+// inside the critical section don't try to take it again
+func ContextWithContainerLock(ctx context.Context, lock *ContainerLock) context.Context {
+	return context.WithValue(ctx, containerLockCtxKey{}, lock)
+}
+
+func holdsContainerLock(ctx context.Context, p BlobObjParams) bool {
+	lock, ok := ctx.Value(containerLockCtxKey{}).(*ContainerLock)
+	return ok && lock.Params.StorageName == p.StorageName && lock.Params.ContainerName == p.ContainerName
+}
+
+func GetContainerLockInfo(ctx context.Context, store StateStore, p BlobObjParams) (info LockInfo, err error) {
+	holder, err := store.GetLockHolder(ctx, p)
+	if err != nil || holder == nil {
+		return
+	}
+
+	info.Locked = true
+	info.Holder = holder
+	if !holder.AcquiredAt.IsZero() {
+		info.HeldFor = time.Since(holder.AcquiredAt).Round(time.Second).String()
+	}
+	return
+}
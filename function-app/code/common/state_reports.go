@@ -0,0 +1,170 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	// reports kept in the state per host and per report type until SetReportsLimits is called
+	defaultReportsPerHostLimit = 50
+	// reports kept in the state per report type until SetReportsLimits is called
+	defaultReportsTotalLimit = 1000
+	stateArchivePrefix       = "archive"
+	defaultArchivePageSize   = 100
+)
+
+// ArchivedReport is a report entry moved out of the state, archived reports are stored as json lines
+type ArchivedReport struct {
+	Type       string    `json:"type"`
+	Hostname   string    `json:"hostname"`
+	Entry      string    `json:"entry"`
+	ArchivedAt time.Time `json:"archived_at"`
+}
+
+// ArchivedReportsPage is a page of archived reports, page 0 holds the most recently archived ones
+type ArchivedReportsPage struct {
+	Reports  []ArchivedReport `json:"reports"`
+	Page     int              `json:"page"`
+	PageSize int              `json:"page_size"`
+	Total    int              `json:"total"`
+}
+
+// ReportsLimits are the caps on the reports kept in the state, a non-positive cap disables it
+type ReportsLimits struct {
+	PerHost int
+	Total   int
+}
+
+var reportsLimits = ReportsLimits{PerHost: defaultReportsPerHostLimit, Total: defaultReportsTotalLimit}
+
+// SetReportsLimits sets the caps on the reports kept in the state, it is called at startup
+func SetReportsLimits(limits ReportsLimits) {
+	reportsLimits = limits
+}
+
+func GetReportsLimits() ReportsLimits {
+	return reportsLimits
+}
+
+func reportsArchiveParams(stateParams BlobObjParams) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      path.Join(stateArchivePrefix, stateParams.BlobName, "reports.jsonl"),
+	}
+}
+
+// compactReportsMap trims the oldest entries of each host over the per host cap, then trims the oldest entries
+// of the hosts with most entries until the total cap is met. It returns the removed entries.
+func compactReportsMap(reportType string, reports map[string][]string, limits ReportsLimits, now time.Time) (archived []ArchivedReport) {
+	trim := func(hostname string, count int) {
+		for _, entry := range reports[hostname][:count] {
+			archived = append(archived, ArchivedReport{Type: reportType, Hostname: hostname, Entry: entry, ArchivedAt: now})
+		}
+		reports[hostname] = reports[hostname][count:]
+	}
+
+	total := 0
+	for hostname, entries := range reports {
+		if limits.PerHost > 0 && len(entries) > limits.PerHost {
+			trim(hostname, len(entries)-limits.PerHost)
+		}
+		total += len(reports[hostname])
+	}
+
+	for limits.Total > 0 && total > limits.Total {
+		largestHost := ""
+		for hostname, entries := range reports {
+			if len(entries) > len(reports[largestHost]) || (len(entries) == len(reports[largestHost]) && hostname < largestHost) {
+				largestHost = hostname
+			}
+		}
+		trim(largestHost, 1)
+		total--
+	}
+	return
+}
+
+// CompactReports applies the reports caps to the state, returning the entries which should be archived
+func CompactReports(state *protocol.ClusterState, limits ReportsLimits) (archived []ArchivedReport) {
+	now := time.Now().UTC()
+	archived = append(archived, compactReportsMap("progress", state.Progress, limits, now)...)
+	archived = append(archived, compactReportsMap("error", state.Errors, limits, now)...)
+	archived = append(archived, compactReportsMap("debug", state.Debug, limits, now)...)
+	return
+}
+
+func ArchiveReports(ctx context.Context, store StateStore, stateParams BlobObjParams, archived []ArchivedReport) error {
+	if len(archived) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, report := range archived {
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	}
+	return store.Append(ctx, reportsArchiveParams(stateParams), buf.Bytes())
+}
+
+// GetArchivedReports returns a page of the archived reports, newest first
+func GetArchivedReports(ctx context.Context, store StateStore, stateParams BlobObjParams, page, pageSize int) (result ArchivedReportsPage, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if pageSize <= 0 {
+		pageSize = defaultArchivePageSize
+	}
+	if page < 0 {
+		page = 0
+	}
+	result.Page = page
+	result.PageSize = pageSize
+	result.Reports = []ArchivedReport{}
+
+	data, _, err := store.Read(ctx, reportsArchiveParams(stateParams))
+	if errors.Is(err, ErrStateObjectNotFound) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	var reports []ArchivedReport
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var report ArchivedReport
+		if err2 := json.Unmarshal(scanner.Bytes(), &report); err2 != nil {
+			logger.Warn().Err(err2).Msg("skipping malformed archived report")
+			continue
+		}
+		reports = append(reports, report)
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	result.Total = len(reports)
+	// newest entries are at the end of the archive
+	end := len(reports) - page*pageSize
+	start := end - pageSize
+	if start < 0 {
+		start = 0
+	}
+	for i := end - 1; i >= start; i-- {
+		result.Reports = append(result.Reports, reports[i])
+	}
+	return
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func entries(prefix string, n int) (res []string) {
+	for i := 0; i < n; i++ {
+		res = append(res, fmt.Sprintf("%s-%d", prefix, i))
+	}
+	return
+}
+
+func TestCompactReports(t *testing.T) {
+	state := protocol.ClusterState{
+		Progress: map[string][]string{
+			"vm-0": entries("p0", 8),
+			"vm-1": entries("p1", 3),
+		},
+		Errors: map[string][]string{
+			"vm-0": entries("e0", 2),
+		},
+		Debug: map[string][]string{},
+	}
+
+	archived := CompactReports(&state, ReportsLimits{PerHost: 5, Total: 6})
+
+	// vm-0 is first trimmed to 5 entries, then once more to meet the total
+	if len(state.Progress["vm-0"]) != 3 || len(state.Progress["vm-1"]) != 3 {
+		t.Fatalf("unexpected progress after compaction: %v", state.Progress)
+	}
+	if state.Progress["vm-0"][0] != "p0-5" {
+		t.Fatalf("expected the oldest entries to be removed, got %v", state.Progress["vm-0"])
+	}
+	if len(state.Errors["vm-0"]) != 2 {
+		t.Fatalf("errors under the limits should be kept, got %v", state.Errors)
+	}
+	if len(archived) != 5 || archived[0].Entry != "p0-0" || archived[0].Type != "progress" {
+		t.Fatalf("unexpected archived reports: %+v", archived)
+	}
+}
+
+func TestArchivedReportsPaging(t *testing.T) {
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	p := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+
+	page, err := GetArchivedReports(ctx, store, p, 0, 10)
+	if err != nil || page.Total != 0 {
+		t.Fatalf("expected an empty archive, got %+v, %v", page, err)
+	}
+
+	for batch := 0; batch < 3; batch++ {
+		var archived []ArchivedReport
+		for i := 0; i < 10; i++ {
+			archived = append(archived, ArchivedReport{Type: "progress", Hostname: "vm-0", Entry: fmt.Sprintf("%d", batch*10+i)})
+		}
+		if err = ArchiveReports(ctx, store, p, archived); err != nil {
+			t.Fatalf("failed archiving reports: %s", err)
+		}
+	}
+
+	page, err = GetArchivedReports(ctx, store, p, 1, 12)
+	if err != nil {
+		t.Fatalf("failed reading archive: %s", err)
+	}
+	if page.Total != 30 || len(page.Reports) != 12 || page.Reports[0].Entry != "17" || page.Reports[11].Entry != "6" {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+
+	page, _ = GetArchivedReports(ctx, store, p, 2, 12)
+	if len(page.Reports) != 6 || page.Reports[5].Entry != "0" {
+		t.Fatalf("unexpected last page: %+v", page)
+	}
+}
+
+func TestUpdateStateReportingArchivesBeforeTrimming(t *testing.T) {
+	limits := GetReportsLimits()
+	SetReportsLimits(ReportsLimits{PerHost: 2, Total: limits.Total})
+	t.Cleanup(func() { SetReportsLimits(limits) })
+
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	p := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+	if err := WriteState(ctx, store, p, protocol.ClusterState{InitialSize: 1}); err != nil {
+		t.Fatalf("failed writing state: %s", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		report := protocol.Report{Type: "progress", Hostname: "vm-0", Message: fmt.Sprintf("step %d", i)}
+		if err := UpdateStateReporting(ctx, store, p, report); err != nil {
+			t.Fatalf("failed reporting: %s", err)
+		}
+	}
+
+	state, err := ReadState(ctx, store, p)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Progress["vm-0"]) != 2 {
+		t.Fatalf("expected 2 reports kept in the state, got %v", state.Progress["vm-0"])
+	}
+	page, err := GetArchivedReports(ctx, store, p, 0, 10)
+	if err != nil {
+		t.Fatalf("failed reading archive: %s", err)
+	}
+	if page.Total != 2 {
+		t.Fatalf("expected the 2 trimmed reports in the archive, got %+v", page)
+	}
+
+	// identical entries are distinct reports, each of them is archived
+	for i := 0; i < 4; i++ {
+		report := protocol.Report{Type: "progress", Hostname: "vm-0", Message: "retrying"}
+		if err := UpdateStateReporting(ctx, store, p, report); err != nil {
+			t.Fatalf("failed reporting: %s", err)
+		}
+	}
+	if page, _ = GetArchivedReports(ctx, store, p, 0, 10); page.Total != 6 || page.Reports[0].Entry != page.Reports[1].Entry {
+		t.Fatalf("expected the identical reports to be archived, got %+v", page)
+	}
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// StateSchemaVersion is the version of the state envelope written by this function app.
+// Bump it together with a new entry in stateMigrations whenever the stored state layout changes.
+const StateSchemaVersion = 2
+
+// legacyStateSchemaVersion is the version of states written before the envelope existed,
+// they are plain json encoded protocol.ClusterState objects
+const legacyStateSchemaVersion = 1
+
+var ErrUnsupportedStateVersion = errors.New("unsupported state schema version")
+
+// stateEnvelope is the stored representation of the state
+type stateEnvelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	State         json.RawMessage `json:"state"`
+}
+
+// stateMigration upgrades the raw state json from version N to version N+1
+type stateMigration func(state map[string]json.RawMessage) (map[string]json.RawMessage, error)
+
+// stateMigrations holds the migrations by the version they upgrade from
+var stateMigrations = map[int]stateMigration{
+	// version 2 only introduced the envelope, the state itself is unchanged
+	1: func(state map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+		return state, nil
+	},
+}
+
+func isStateEnvelope(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	_, ok := fields["schema_version"]
+	return ok
+}
+
+// migrateState upgrades the raw state json from the given schema version to StateSchemaVersion
+func migrateState(version int, rawState json.RawMessage) (json.RawMessage, error) {
+	if version > StateSchemaVersion || version < legacyStateSchemaVersion {
+		return nil, fmt.Errorf("%w: %d (supported up to %d)", ErrUnsupportedStateVersion, version, StateSchemaVersion)
+	}
+	if version == StateSchemaVersion {
+		return rawState, nil
+	}
+
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(rawState, &state); err != nil {
+		return nil, err
+	}
+	for ; version < StateSchemaVersion; version++ {
+		migration, ok := stateMigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("no state migration from schema version %d", version)
+		}
+		var err error
+		state, err = migration(state)
+		if err != nil {
+			return nil, fmt.Errorf("failed migrating state from schema version %d: %v", version, err)
+		}
+	}
+	return json.Marshal(state)
+}
+
+// decodeState parses a stored state of any supported schema version, upgrading it to the current one in memory
+func decodeState(data []byte) (state protocol.ClusterState, err error) {
+	envelope := stateEnvelope{
+		SchemaVersion: legacyStateSchemaVersion,
+		State:         data,
+	}
+	if isStateEnvelope(data) {
+		err = json.Unmarshal(data, &envelope)
+		if err != nil {
+			return
+		}
+	}
+
+	rawState, err := migrateState(envelope.SchemaVersion, envelope.State)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(rawState, &state)
+	return
+}
+
+// encodeState serializes the state with the current schema version
+func encodeState(state protocol.ClusterState) ([]byte, error) {
+	rawState, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(stateEnvelope{
+		SchemaVersion: StateSchemaVersion,
+		State:         rawState,
+	})
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeState(t *testing.T) {
+	tests := []struct {
+		fixture         string
+		wantErr         error
+		wantDesiredSize int
+		wantInstances   int
+		wantClusterized bool
+		wantUpdates     int
+	}{
+		{fixture: "v1_terraform_initial.json", wantDesiredSize: 6},
+		{fixture: "v1_clusterizing.json", wantDesiredSize: 6, wantInstances: 2},
+		{fixture: "v1_clusterized_with_updates.json", wantDesiredSize: 8, wantClusterized: true, wantUpdates: 1},
+		{fixture: "v2_clusterized.json", wantDesiredSize: 7, wantClusterized: true},
+		{fixture: "v99_future.json", wantErr: ErrUnsupportedStateVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "state", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := decodeState(data)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed decoding state: %s", err)
+			}
+			if state.DesiredSize != tt.wantDesiredSize {
+				t.Errorf("desired size: expected %d, got %d", tt.wantDesiredSize, state.DesiredSize)
+			}
+			if len(state.Instances) != tt.wantInstances {
+				t.Errorf("instances: expected %d, got %d", tt.wantInstances, len(state.Instances))
+			}
+			if state.Clusterized != tt.wantClusterized {
+				t.Errorf("clusterized: expected %v, got %v", tt.wantClusterized, state.Clusterized)
+			}
+			if len(state.Updates) != tt.wantUpdates {
+				t.Errorf("updates: expected %d, got %d", tt.wantUpdates, len(state.Updates))
+			}
+		})
+	}
+}
+
+func TestLegacyStateIsUpgradedOnWrite(t *testing.T) {
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	p := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+
+	data, err := os.ReadFile(filepath.Join("testdata", "state", "v1_terraform_initial.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Write(ctx, p, data, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := ReadState(ctx, store, p)
+	if err != nil {
+		t.Fatalf("failed reading legacy state: %s", err)
+	}
+	if err = WriteState(ctx, store, p, state); err != nil {
+		t.Fatalf("failed writing state: %s", err)
+	}
+
+	data, _, err = store.Read(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isStateEnvelope(data) {
+		t.Fatalf("expected the state to be written in an envelope, got %s", data)
+	}
+}
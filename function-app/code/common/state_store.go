@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrStateObjectNotFound = errors.New("state object not found")
+	// ErrStateConflict is returned by a conditional write when the object was modified since it was read
+	ErrStateConflict = errors.New("state object was modified concurrently")
+)
+
+// IfNotExists is the ifMatch of a create-only write (If-None-Match: *), it never matches the ETag of a stored object
+const IfNotExists = "if-none-match:*"
+
+// StateStore persists the cluster state objects and serializes their writers.
+// The blob implementation is used by the function app, the file and memory implementations
+// allow running the state machine locally and in unit tests.
+type StateStore interface {
+	// EnsureContainer creates the container of the state object if it doesn't exist
+	EnsureContainer(ctx context.Context, p BlobObjParams) error
+	Exists(ctx context.Context, p BlobObjParams) (bool, error)
+	// Read returns the object together with its current ETag
+	Read(ctx context.Context, p BlobObjParams) (data []byte, etag string, err error)
+	// Write stores the object and returns its new ETag. When ifMatch is not empty, the write succeeds only if
+	// the stored object still has this ETag, otherwise ErrStateConflict is returned. When ifMatch is IfNotExists,
+	// the write succeeds only if the object doesn't exist.
+	Write(ctx context.Context, p BlobObjParams, data []byte, ifMatch string) (etag string, err error)
+	// Append adds data to the end of an append-only object (append blob), creating it if needed
+	Append(ctx context.Context, p BlobObjParams, data []byte) error
+	Delete(ctx context.Context, p BlobObjParams) error
+	// List returns the names of the objects in the container of p which start with p.BlobName
+	List(ctx context.Context, p BlobObjParams) ([]string, error)
+	// Lock takes an exclusive lock on the container of the state object, blocking until it is acquired.
+	// The lock expires after LockLeaseDuration unless it is renewed.
+	Lock(ctx context.Context, p BlobObjParams, holder LockHolder) (lockId *string, err error)
+	RenewLock(ctx context.Context, p BlobObjParams, lockId *string) error
+	Unlock(ctx context.Context, p BlobObjParams, lockId *string) error
+	// GetLockHolder returns the holder of the container lock, or nil when the container isn't locked
+	GetLockHolder(ctx context.Context, p BlobObjParams) (*LockHolder, error)
+}
+
+type stateStoreCtxKey struct{}
+
+func ContextWithStateStore(ctx context.Context, store StateStore) context.Context {
+	return context.WithValue(ctx, stateStoreCtxKey{}, store)
+}
+
+// StateStoreFromCtx returns the state store injected into the context (blob state store by default)
+func StateStoreFromCtx(ctx context.Context) StateStore {
+	if store, ok := ctx.Value(stateStoreCtxKey{}).(StateStore); ok {
+		return store
+	}
+	return NewBlobStateStore()
+}
+
+// StateStoreMiddleware injects the state store into the request context
+func StateStoreMiddleware(store StateStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ContextWithStateStore(r.Context(), store)
+		next(w, r.WithContext(ctx))
+	}
+}
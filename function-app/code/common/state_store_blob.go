@@ -0,0 +1,228 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/appendblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// BlobStateStore keeps the state in Azure blob storage and locks it with container leases
+type BlobStateStore struct{}
+
+func NewBlobStateStore() *BlobStateStore {
+	return &BlobStateStore{}
+}
+
+func (s *BlobStateStore) EnsureContainer(ctx context.Context, p BlobObjParams) error {
+	return ensureStorageContainer(ctx, p.StorageName, p.ContainerName)
+}
+
+func (s *BlobStateStore) Exists(ctx context.Context, p BlobObjParams) (bool, error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	blobClient, err := getBlobClient(ctx, p)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to create blob client")
+		return false, err
+	}
+	return blobExists(ctx, blobClient)
+}
+
+func (s *BlobStateStore) Read(ctx context.Context, p BlobObjParams) ([]byte, string, error) {
+	data, etag, err := readBlobObjectWithETag(ctx, p)
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) && responseErr.ErrorCode == string(bloberror.BlobNotFound) {
+		return nil, "", fmt.Errorf("%w: %v", ErrStateObjectNotFound, err)
+	}
+	return data, etag, err
+}
+
+func (s *BlobStateStore) Write(ctx context.Context, p BlobObjParams, data []byte, ifMatch string) (string, error) {
+	etag, err := writeBlobObjectIfMatch(ctx, p, data, ifMatch)
+	var responseErr *azcore.ResponseError
+	// a create-only write of an existing blob fails with BlobAlreadyExists
+	if errors.As(err, &responseErr) && (responseErr.ErrorCode == string(bloberror.ConditionNotMet) || responseErr.ErrorCode == string(bloberror.BlobAlreadyExists)) {
+		return "", fmt.Errorf("%w: %v", ErrStateConflict, err)
+	}
+	return etag, err
+}
+
+func (s *BlobStateStore) Append(ctx context.Context, p BlobObjParams, data []byte) error {
+	appendClient, err := getAppendBlobClient(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	_, err = appendClient.AppendBlock(ctx, streaming.NopCloser(bytes.NewReader(data)), nil)
+	if !bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return err
+	}
+
+	// create the append blob only if no one else did meanwhile, creating an existing append blob truncates it
+	anyETag := azcore.ETagAny
+	_, err = appendClient.Create(ctx, &appendblob.CreateOptions{
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &anyETag},
+		},
+	})
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobAlreadyExists) {
+		return err
+	}
+	_, err = appendClient.AppendBlock(ctx, streaming.NopCloser(bytes.NewReader(data)), nil)
+	return err
+}
+
+func (s *BlobStateStore) Delete(ctx context.Context, p BlobObjParams) error {
+	blobClient, err := getBlobClient(ctx, p)
+	if err != nil {
+		return err
+	}
+	_, err = blobClient.Delete(ctx, nil)
+	return err
+}
+
+func (s *BlobStateStore) List(ctx context.Context, p BlobObjParams) (names []string, err error) {
+	containerClient, err := getContainerClient(ctx, p.StorageName, p.ContainerName)
+	if err != nil {
+		return
+	}
+
+	pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &p.BlobName})
+	for pager.More() {
+		page, err2 := pager.NextPage(ctx)
+		if err2 != nil {
+			err = err2
+			return
+		}
+		for _, item := range page.Segment.BlobItems {
+			names = append(names, *item.Name)
+		}
+	}
+	return
+}
+
+// container metadata keys of the lock holder
+const (
+	lockFunctionMetadataKey   = "lock_function"
+	lockInvocationMetadataKey = "lock_invocation_id"
+	lockHostnameMetadataKey   = "lock_hostname"
+	lockAcquiredMetadataKey   = "lock_acquired_at"
+)
+
+func (s *BlobStateStore) Lock(ctx context.Context, p BlobObjParams, holder LockHolder) (*string, error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	leaseId, err := leaseContainerAcquire(ctx, p.StorageName, p.ContainerName, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	holderMetadata := map[string]string{
+		lockFunctionMetadataKey:   holder.FunctionName,
+		lockInvocationMetadataKey: holder.InvocationId,
+		lockHostnameMetadataKey:   holder.Hostname,
+		lockAcquiredMetadataKey:   holder.AcquiredAt.Format(time.RFC3339),
+	}
+	// the holder is informative only, failing to record it doesn't fail the lock
+	if err = setLockHolderMetadata(ctx, p, leaseId, holderMetadata); err != nil {
+		logger.Warn().Err(err).Msgf("failed recording lock holder on %s", p.ContainerName)
+	}
+	return leaseId, nil
+}
+
+func (s *BlobStateStore) RenewLock(ctx context.Context, p BlobObjParams, lockId *string) error {
+	return leaseContainerRenew(ctx, p.StorageName, p.ContainerName, lockId)
+}
+
+func (s *BlobStateStore) Unlock(ctx context.Context, p BlobObjParams, lockId *string) error {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if err := setLockHolderMetadata(ctx, p, lockId, nil); err != nil {
+		logger.Warn().Err(err).Msgf("failed clearing lock holder on %s", p.ContainerName)
+	}
+	return leaseContainerRelease(ctx, p.StorageName, p.ContainerName, lockId)
+}
+
+func (s *BlobStateStore) GetLockHolder(ctx context.Context, p BlobObjParams) (*LockHolder, error) {
+	containerClient, err := getContainerClient(ctx, p.StorageName, p.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+
+	props, err := containerClient.GetProperties(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if props.LeaseState == nil || *props.LeaseState != lease.StateTypeLeased {
+		return nil, nil
+	}
+
+	holder := &LockHolder{}
+	for key, value := range props.Metadata {
+		if value == nil {
+			continue
+		}
+		// metadata keys casing isn't preserved by the service
+		switch strings.ToLower(key) {
+		case lockFunctionMetadataKey:
+			holder.FunctionName = *value
+		case lockInvocationMetadataKey:
+			holder.InvocationId = *value
+		case lockHostnameMetadataKey:
+			holder.Hostname = *value
+		case lockAcquiredMetadataKey:
+			holder.AcquiredAt, _ = time.Parse(time.RFC3339, *value)
+		}
+	}
+	return holder, nil
+}
+
+// setLockHolderMetadata replaces the lock holder keys of the container metadata. Setting the metadata replaces all
+// of it, so the other keys are read and written back: the container may be supplied by the user, with its own metadata.
+func setLockHolderMetadata(ctx context.Context, p BlobObjParams, leaseId *string, holderMetadata map[string]string) error {
+	containerClient, err := getContainerClient(ctx, p.StorageName, p.ContainerName)
+	if err != nil {
+		return err
+	}
+
+	props, err := containerClient.GetProperties(ctx, nil)
+	if err != nil {
+		return err
+	}
+	metadata := map[string]*string{}
+	for key, value := range props.Metadata {
+		if !isLockHolderMetadataKey(key) {
+			metadata[key] = value
+		}
+	}
+	for key, value := range StrMapToPtrMap(holderMetadata) {
+		metadata[key] = value
+	}
+
+	_, err = containerClient.SetMetadata(ctx, &container.SetMetadataOptions{
+		Metadata:              metadata,
+		LeaseAccessConditions: &container.LeaseAccessConditions{LeaseID: leaseId},
+	})
+	return err
+}
+
+func isLockHolderMetadataKey(key string) bool {
+	// metadata keys casing isn't preserved by the service
+	switch strings.ToLower(key) {
+	case lockFunctionMetadataKey, lockInvocationMetadataKey, lockHostnameMetadataKey, lockAcquiredMetadataKey:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+const (
+	fileLockName         = ".lock"
+	fileLockPollInterval = 100 * time.Millisecond
+)
+
+// FileStateStore keeps the state on the local filesystem, under <Root>/<storage>/<container>/<blob>.
+// The container is locked by exclusively creating a lock file in its directory.
+type FileStateStore struct {
+	Root string
+
+	mu sync.Mutex
+}
+
+func NewFileStateStore(root string) *FileStateStore {
+	return &FileStateStore{Root: root}
+}
+
+func (s *FileStateStore) containerDir(p BlobObjParams) string {
+	return filepath.Join(s.Root, p.StorageName, p.ContainerName)
+}
+
+func (s *FileStateStore) objectPath(p BlobObjParams) string {
+	return filepath.Join(s.containerDir(p), p.BlobName)
+}
+
+func (s *FileStateStore) EnsureContainer(ctx context.Context, p BlobObjParams) error {
+	return os.MkdirAll(s.containerDir(p), 0o755)
+}
+
+func (s *FileStateStore) Exists(ctx context.Context, p BlobObjParams) (bool, error) {
+	_, err := os.Stat(s.objectPath(p))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func fileETag(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func (s *FileStateStore) Read(ctx context.Context, p BlobObjParams) ([]byte, string, error) {
+	data, err := os.ReadFile(s.objectPath(p))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", fmt.Errorf("%w: %s", ErrStateObjectNotFound, s.objectPath(p))
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, fileETag(data), nil
+}
+
+// Write is atomic within the process only, which is enough for a single local function host
+func (s *FileStateStore) Write(ctx context.Context, p BlobObjParams, data []byte, ifMatch string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.objectPath(p)
+	if ifMatch != "" {
+		current, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		conflict := err != nil || fileETag(current) != ifMatch
+		if ifMatch == IfNotExists {
+			conflict = err == nil
+		}
+		if conflict {
+			return "", fmt.Errorf("%w: %s", ErrStateConflict, path)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	// write to a temporary file first, so readers never see a partially written state
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return "", err
+	}
+	return fileETag(data), nil
+}
+
+func (s *FileStateStore) Append(ctx context.Context, p BlobObjParams, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.objectPath(p)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+func (s *FileStateStore) Delete(ctx context.Context, p BlobObjParams) error {
+	err := os.Remove(s.objectPath(p))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStateStore) List(ctx context.Context, p BlobObjParams) ([]string, error) {
+	dir := s.containerDir(p)
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || d.Name() == fileLockName || strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, p.BlobName) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// fileLock is the content of the lock file
+type fileLock struct {
+	LockId string     `json:"lock_id"`
+	Holder LockHolder `json:"holder"`
+}
+
+func (s *FileStateStore) lockPath(p BlobObjParams) string {
+	return filepath.Join(s.containerDir(p), fileLockName)
+}
+
+func (s *FileStateStore) readLock(p BlobObjParams) (*fileLock, error) {
+	data, err := os.ReadFile(s.lockPath(p))
+	if err != nil {
+		return nil, err
+	}
+	var lock fileLock
+	err = json.Unmarshal(data, &lock)
+	return &lock, err
+}
+
+func (s *FileStateStore) Lock(ctx context.Context, p BlobObjParams, holder LockHolder) (*string, error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if err := s.EnsureContainer(ctx, p); err != nil {
+		return nil, err
+	}
+	lockPath := s.lockPath(p)
+	lockId := uuid.New().String()
+	lockData, err := json.Marshal(fileLock{LockId: lockId, Holder: holder})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_, err = f.Write(lockData)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			return &lockId, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		// the lock file modification time is refreshed on renewal, like a container lease
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > LockLeaseDuration {
+			logger.Info().Msgf("lock %s expired, breaking it", lockPath)
+			os.Remove(lockPath)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(fileLockPollInterval):
+		}
+	}
+}
+
+func (s *FileStateStore) checkLockId(p BlobObjParams, lockId *string) error {
+	lock, err := s.readLock(p)
+	if err != nil {
+		return err
+	}
+	if lockId == nil || lock.LockId != *lockId {
+		return fmt.Errorf("lock %s is not held by %v", s.lockPath(p), lockId)
+	}
+	return nil
+}
+
+func (s *FileStateStore) RenewLock(ctx context.Context, p BlobObjParams, lockId *string) error {
+	if err := s.checkLockId(p, lockId); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(s.lockPath(p), now, now)
+}
+
+func (s *FileStateStore) Unlock(ctx context.Context, p BlobObjParams, lockId *string) error {
+	if err := s.checkLockId(p, lockId); err != nil {
+		return err
+	}
+	return os.Remove(s.lockPath(p))
+}
+
+func (s *FileStateStore) GetLockHolder(ctx context.Context, p BlobObjParams) (*LockHolder, error) {
+	info, err := os.Stat(s.lockPath(p))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(info.ModTime()) > LockLeaseDuration {
+		return nil, nil
+	}
+	lock, err := s.readLock(p)
+	if err != nil {
+		return nil, err
+	}
+	return &lock.Holder, nil
+}
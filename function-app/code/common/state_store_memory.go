@@ -0,0 +1,184 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const memoryLockPollInterval = 10 * time.Millisecond
+
+// MemoryStateStore keeps the state in memory, it is meant for unit tests and local runs
+type MemoryStateStore struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+	locks   map[string]memoryLock
+}
+
+type memoryLock struct {
+	lockId string
+	holder LockHolder
+}
+
+type memoryObject struct {
+	data    []byte
+	version int
+}
+
+func (o memoryObject) etag() string {
+	return strconv.Itoa(o.version)
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		objects: make(map[string]memoryObject),
+		locks:   make(map[string]memoryLock),
+	}
+}
+
+func memoryObjectKey(p BlobObjParams) string {
+	return path.Join(p.StorageName, p.ContainerName, p.BlobName)
+}
+
+func memoryContainerKey(p BlobObjParams) string {
+	return path.Join(p.StorageName, p.ContainerName)
+}
+
+func (s *MemoryStateStore) EnsureContainer(ctx context.Context, p BlobObjParams) error {
+	return nil
+}
+
+func (s *MemoryStateStore) Exists(ctx context.Context, p BlobObjParams) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.objects[memoryObjectKey(p)]
+	return ok, nil
+}
+
+func (s *MemoryStateStore) Read(ctx context.Context, p BlobObjParams) ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[memoryObjectKey(p)]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrStateObjectNotFound, memoryObjectKey(p))
+	}
+	return append([]byte(nil), obj.data...), obj.etag(), nil
+}
+
+func (s *MemoryStateStore) Write(ctx context.Context, p BlobObjParams, data []byte, ifMatch string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := memoryObjectKey(p)
+	obj, exists := s.objects[key]
+	if ifMatch == IfNotExists && !exists {
+		ifMatch = ""
+	}
+	if ifMatch != "" && ifMatch != obj.etag() {
+		return "", fmt.Errorf("%w: %s", ErrStateConflict, key)
+	}
+	obj = memoryObject{data: append([]byte(nil), data...), version: obj.version + 1}
+	s.objects[key] = obj
+	return obj.etag(), nil
+}
+
+func (s *MemoryStateStore) Append(ctx context.Context, p BlobObjParams, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := memoryObjectKey(p)
+	obj := s.objects[key]
+	obj = memoryObject{data: append(append([]byte(nil), obj.data...), data...), version: obj.version + 1}
+	s.objects[key] = obj
+	return nil
+}
+
+func (s *MemoryStateStore) Delete(ctx context.Context, p BlobObjParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects, memoryObjectKey(p))
+	return nil
+}
+
+func (s *MemoryStateStore) List(ctx context.Context, p BlobObjParams) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	containerPrefix := memoryContainerKey(p) + "/"
+	var names []string
+	for key := range s.objects {
+		name, ok := strings.CutPrefix(key, containerPrefix)
+		if ok && strings.HasPrefix(name, p.BlobName) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemoryStateStore) Lock(ctx context.Context, p BlobObjParams, holder LockHolder) (*string, error) {
+	key := memoryContainerKey(p)
+	lockId := uuid.New().String()
+
+	for {
+		s.mu.Lock()
+		if _, locked := s.locks[key]; !locked {
+			s.locks[key] = memoryLock{lockId: lockId, holder: holder}
+			s.mu.Unlock()
+			return &lockId, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(memoryLockPollInterval):
+		}
+	}
+}
+
+// RenewLock only validates the lock, memory locks don't expire
+func (s *MemoryStateStore) RenewLock(ctx context.Context, p BlobObjParams, lockId *string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := memoryContainerKey(p)
+	if lockId == nil || s.locks[key].lockId != *lockId {
+		return fmt.Errorf("container %s is not locked by %v", key, lockId)
+	}
+	return nil
+}
+
+func (s *MemoryStateStore) Unlock(ctx context.Context, p BlobObjParams, lockId *string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := memoryContainerKey(p)
+	if lockId == nil || s.locks[key].lockId != *lockId {
+		return fmt.Errorf("container %s is not locked by %v", key, lockId)
+	}
+	delete(s.locks, key)
+	return nil
+}
+
+func (s *MemoryStateStore) GetLockHolder(ctx context.Context, p BlobObjParams) (*LockHolder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, ok := s.locks[memoryContainerKey(p)]
+	if !ok {
+		return nil, nil
+	}
+	holder := lock.holder
+	return &holder, nil
+}
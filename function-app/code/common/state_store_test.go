@@ -0,0 +1,160 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+func testStateStore(t *testing.T, store StateStore) {
+	ctx := context.TODO()
+	p := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+
+	if _, err := ReadState(ctx, store, p); !errors.Is(err, ErrStateObjectNotFound) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+
+	state, err := ReadStateOrCreateNew(ctx, store, p, protocol.ClusterState{InitialSize: 6, DesiredSize: 6})
+	if err != nil {
+		t.Fatalf("failed creating state: %s", err)
+	}
+	if state.InitialSize != 6 {
+		t.Fatalf("unexpected initial size %d", state.InitialSize)
+	}
+
+	state.DesiredSize = 10
+	if err = WriteState(ctx, store, p, state); err != nil {
+		t.Fatalf("failed writing state: %s", err)
+	}
+	state, err = ReadStateOrCreateNew(ctx, store, p, protocol.ClusterState{})
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if state.DesiredSize != 10 {
+		t.Fatalf("unexpected desired size %d", state.DesiredSize)
+	}
+
+	created := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "created.json"}
+	if _, err = store.Write(ctx, created, []byte("{}"), IfNotExists); err != nil {
+		t.Fatalf("failed creating object: %s", err)
+	}
+	if _, err = store.Write(ctx, created, []byte("{}"), IfNotExists); !errors.Is(err, ErrStateConflict) {
+		t.Fatalf("expected a conflict creating an existing object, got %v", err)
+	}
+
+	lockCtx := ContextWithInvocation(ctx, InvocationInfo{FunctionName: "clusterize", InvocationId: "invocation-1"})
+	lock, err := LockContainer(lockCtx, store, p)
+	if err != nil {
+		t.Fatalf("failed locking container: %s", err)
+	}
+	lockInfo, err := GetContainerLockInfo(ctx, store, p)
+	if err != nil {
+		t.Fatalf("failed getting lock info: %s", err)
+	}
+	if !lockInfo.Locked || lockInfo.Holder.FunctionName != "clusterize" || lockInfo.Holder.InvocationId != "invocation-1" {
+		t.Fatalf("unexpected lock info %+v", lockInfo)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if _, err = LockContainer(timeoutCtx, store, p); err == nil {
+		t.Fatal("expected the second lock to time out")
+	}
+	if err = UnlockContainer(ctx, lock); err != nil {
+		t.Fatalf("failed unlocking container: %s", err)
+	}
+	if lockInfo, _ = GetContainerLockInfo(ctx, store, p); lockInfo.Locked {
+		t.Fatal("expected the container to be unlocked")
+	}
+	lock, err = LockContainer(ctx, store, p)
+	if err != nil {
+		t.Fatalf("failed re-locking container: %s", err)
+	}
+	_ = UnlockContainer(ctx, lock)
+}
+
+func TestUpdateStateConcurrentWriters(t *testing.T) {
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	p := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+
+	if err := WriteState(ctx, store, p, protocol.ClusterState{InitialSize: 20}); err != nil {
+		t.Fatalf("failed writing state: %s", err)
+	}
+
+	writers := 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vm := protocol.Vm{Name: fmt.Sprintf("vm-%d", i)}
+			if _, err := AddInstanceToState(ctx, store, "", "", p, vm); err != nil {
+				t.Errorf("failed adding instance: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	state, err := ReadState(ctx, store, p)
+	if err != nil {
+		t.Fatalf("failed reading state: %s", err)
+	}
+	if len(state.Instances) != writers {
+		t.Fatalf("expected %d instances, got %d", writers, len(state.Instances))
+	}
+
+	_, err = AddInstanceToState(ctx, store, "", "", p, protocol.Vm{Name: "extra"})
+	if _, ok := err.(*ShutdownRequired); !ok {
+		t.Fatalf("expected shutdown required, got %v", err)
+	}
+}
+
+func TestUpdateJsonObjectConcurrentCreators(t *testing.T) {
+	ctx := context.TODO()
+	store := NewMemoryStateStore()
+	p := BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "counter.json"}
+
+	type counter struct {
+		Writers []int `json:"writers"`
+	}
+	newCounter := func() counter { return counter{Writers: []int{}} }
+
+	// all the writers find the object missing, only one of them may create it
+	const writers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := updateJsonObject(ctx, store, p, newCounter, func(c *counter) error {
+				c.Writers = append(c.Writers, i)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("writer %d failed: %s", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c, _, err := readJsonObject(ctx, store, p, newCounter)
+	if err != nil {
+		t.Fatalf("failed reading object: %s", err)
+	}
+	if len(c.Writers) != writers {
+		t.Fatalf("expected %d writers, got %v", writers, c.Writers)
+	}
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	testStateStore(t, NewMemoryStateStore())
+}
+
+func TestFileStateStore(t *testing.T) {
+	testStateStore(t, NewFileStateStore(t.TempDir()))
+}
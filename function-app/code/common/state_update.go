@@ -0,0 +1,129 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	// number of conditional writes tried before falling back to the container lock
+	stateUpdateOptimisticAttempts = 10
+	// number of conditional writes tried while holding the container lock
+	stateUpdateLockedAttempts = 50
+	stateUpdateMaxBackoff     = 500 * time.Millisecond
+)
+
+var (
+	stateUpdates       atomic.Int64
+	stateConflicts     atomic.Int64
+	stateLockFallbacks atomic.Int64
+)
+
+// StateUpdateStats counts the state updates done by this function host process and how contended they were
+type StateUpdateStats struct {
+	Updates       int64 `json:"updates"`
+	Conflicts     int64 `json:"conflicts"`
+	LockFallbacks int64 `json:"lock_fallbacks"`
+}
+
+func GetStateUpdateStats() StateUpdateStats {
+	return StateUpdateStats{
+		Updates:       stateUpdates.Load(),
+		Conflicts:     stateConflicts.Load(),
+		LockFallbacks: stateLockFallbacks.Load(),
+	}
+}
+
+// UpdateState does a read-modify-write of the state object using the object ETag for optimistic concurrency.
+// updateFn changes the state in place and may be called several times, once per attempt, always with a fresh copy
+// of the state; returning an error from it aborts the update without writing.
+// When the state keeps being modified concurrently, the update is retried while holding the container lock.
+func UpdateState(ctx context.Context, store StateStore, stateParams BlobObjParams, updateFn func(state *protocol.ClusterState) error) (state protocol.ClusterState, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	stateUpdates.Add(1)
+
+	conflicts := 0
+	defer func() {
+		if conflicts > 0 {
+			logger.Info().Int("state_conflicts", conflicts).Str("state_container", stateParams.ContainerName).Msg("state update was contended")
+		}
+	}()
+
+	for attempt := 0; attempt < stateUpdateOptimisticAttempts; attempt++ {
+		state, err = tryUpdateState(ctx, store, stateParams, updateFn)
+		if !errors.Is(err, ErrStateConflict) {
+			return
+		}
+		conflicts++
+		stateConflicts.Add(1)
+		stateUpdateBackoff(conflicts)
+	}
+
+	logger.Warn().Int("state_conflicts", conflicts).Msg("state is highly contended, falling back to container lock")
+	stateLockFallbacks.Add(1)
+
+	// the lock is already held when updating the state from within a locked critical section
+	if !holdsContainerLock(ctx, stateParams) {
+		lock, err2 := LockContainer(ctx, store, stateParams)
+		if err2 != nil {
+			err = err2
+			return
+		}
+		defer UnlockContainer(ctx, lock)
+	}
+
+	for attempt := 0; attempt < stateUpdateLockedAttempts; attempt++ {
+		state, err = tryUpdateState(ctx, store, stateParams, updateFn)
+		if !errors.Is(err, ErrStateConflict) {
+			return
+		}
+		conflicts++
+		stateConflicts.Add(1)
+		stateUpdateBackoff(conflicts)
+	}
+	logger.Error().Err(err).Int("state_conflicts", conflicts).Msg("failed updating state")
+	return
+}
+
+func tryUpdateState(ctx context.Context, store StateStore, stateParams BlobObjParams, updateFn func(state *protocol.ClusterState) error) (state protocol.ClusterState, err error) {
+	stateAsByteArray, etag, err := store.Read(ctx, stateParams)
+	if err != nil {
+		return
+	}
+	state, err = decodeState(stateAsByteArray)
+	if err != nil {
+		return
+	}
+
+	err = updateFn(&state)
+	if err != nil {
+		return
+	}
+
+	stateAsByteArray, err = encodeState(state)
+	if err != nil {
+		return
+	}
+	_, err = store.Write(ctx, stateParams, stateAsByteArray, etag)
+	if err != nil {
+		return
+	}
+
+	saveStateVersion(ctx, store, stateParams, stateAsByteArray)
+	return
+}
+
+// stateUpdateBackoff sleeps a random, growing interval so that conflicting writers spread out
+func stateUpdateBackoff(conflicts int) {
+	maxSleep := time.Duration(conflicts) * 50 * time.Millisecond
+	if maxSleep > stateUpdateMaxBackoff {
+		maxSleep = stateUpdateMaxBackoff
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(maxSleep))) + 10*time.Millisecond)
+}
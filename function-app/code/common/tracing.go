@@ -0,0 +1,228 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing uses OpenTelemetry and follows the W3C trace context: the spans of an invocation join the trace of the
+// caller when the request carries a traceparent header, and the generated scripts pass the trace of the function
+// which generated them to the functions they call. Tracing is disabled until SetupTracing sets an exporter.
+
+const (
+	TraceparentHeader = "traceparent"
+
+	tracerName          = "weka-deployment"
+	otlpExporterTimeout = 10 * time.Second
+)
+
+type SpanKind = trace.SpanKind
+
+const (
+	SpanKindInternal = trace.SpanKindInternal
+	SpanKindServer   = trace.SpanKindServer
+	SpanKindClient   = trace.SpanKindClient
+)
+
+var traceContext = propagation.TraceContext{}
+
+// Span is a timed operation of a trace, it is a no-op span when tracing is disabled
+type Span struct {
+	span trace.Span
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	s.span.SetAttributes(spanAttribute(key, value))
+}
+
+func (s *Span) AddEvent(name string, attributes map[string]any) {
+	eventAttributes := make([]attribute.KeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		eventAttributes = append(eventAttributes, spanAttribute(key, value))
+	}
+	s.span.AddEvent(name, trace.WithAttributes(eventAttributes...))
+}
+
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// Finish ends the span, err (if not nil) sets the span status to error
+func (s *Span) Finish(err error) {
+	s.SetError(err)
+	s.span.End()
+}
+
+// Traceparent returns the W3C traceparent header value of the span, empty when the span is not part of a trace
+func (s *Span) Traceparent() string {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(trace.ContextWithSpan(context.Background(), s.span), carrier)
+	return carrier.Get(TraceparentHeader)
+}
+
+func spanAttribute(key string, value any) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
+
+func SpanFromCtx(ctx context.Context) *Span {
+	return &Span{span: trace.SpanFromContext(ctx)}
+}
+
+// TraceparentFromCtx returns the traceparent of the current span, empty when there is none
+func TraceparentFromCtx(ctx context.Context) string {
+	return SpanFromCtx(ctx).Traceparent()
+}
+
+func ContextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+	return traceContext.Extract(ctx, propagation.MapCarrier{TraceparentHeader: strings.TrimSpace(traceparent)})
+}
+
+// StartSpan starts a child span of the current span (or of the remote caller span), the span must be finished
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(kind))
+	return ctx, &Span{span: span}
+}
+
+// TracingMiddleware starts a span for each function invocation, as a child of the traceparent of the request
+func TracingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		invocation := InvocationFromCtx(r.Context())
+		ctx := ContextWithTraceparent(r.Context(), requestHeader(r, TraceparentHeader))
+		ctx, span := StartSpan(ctx, invocation.FunctionName, SpanKindServer)
+		defer span.Finish(nil)
+
+		span.SetAttribute("faas.name", invocation.FunctionName)
+		span.SetAttribute("faas.invocation_id", invocation.InvocationId)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// NewOtlpTraceExporter exports the spans with OTLP/HTTP to the collector at endpoint, headers is a comma separated
+// list of key=value pairs (as in OTEL_EXPORTER_OTLP_HEADERS)
+func NewOtlpTraceExporter(ctx context.Context, endpoint, headers string) (sdktrace.SpanExporter, error) {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	headerValues := make(map[string]string)
+	for _, header := range strings.Split(headers, ",") {
+		if key, value, ok := strings.Cut(header, "="); ok {
+			headerValues[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(url),
+		otlptracehttp.WithHeaders(headerValues),
+		otlptracehttp.WithTimeout(otlpExporterTimeout),
+	)
+}
+
+// NewFileTraceExporter appends the spans to the file at path, one json span per line
+func NewFileTraceExporter(path string) (sdktrace.SpanExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return stdouttrace.New(stdouttrace.WithWriter(f))
+}
+
+// SetupTracing enables tracing: the ended spans are batched and exported in the background. resourceAttributes
+// describe the function app (e.g. service.name) in the exported spans. The returned provider must be shut down
+// before exiting, it exports the spans which were not exported yet.
+func SetupTracing(exporter sdktrace.SpanExporter, resourceAttributes map[string]string) *sdktrace.TracerProvider {
+	attributes := make([]attribute.KeyValue, 0, len(resourceAttributes))
+	for key, value := range resourceAttributes {
+		attributes = append(attributes, attribute.String(key, value))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attributes...)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider
+}
+
+// azureTracingProvider creates the spans of the Azure SDK clients: a span per client method and a child span
+// per http request
+func azureTracingProvider() tracing.Provider {
+	newSpan := func(ctx context.Context, name string, options *tracing.SpanOptions) (context.Context, tracing.Span) {
+		kind := SpanKindInternal
+		if options != nil && options.Kind == tracing.SpanKindClient {
+			kind = SpanKindClient
+		}
+		ctx, span := StartSpan(ctx, name, kind)
+		if !span.span.IsRecording() {
+			return ctx, tracing.Span{}
+		}
+		if options != nil {
+			setAzureAttributes(span, options.Attributes)
+		}
+		return ctx, tracing.NewSpan(tracing.SpanImpl{
+			End:           func() { span.Finish(nil) },
+			SetAttributes: func(attributes ...tracing.Attribute) { setAzureAttributes(span, attributes) },
+			AddEvent: func(name string, attributes ...tracing.Attribute) {
+				eventAttributes := make(map[string]any, len(attributes))
+				for _, attribute := range attributes {
+					eventAttributes[attribute.Key] = attribute.Value
+				}
+				span.AddEvent(name, eventAttributes)
+			},
+			SetStatus: func(status tracing.SpanStatus, description string) {
+				if status == tracing.SpanStatusError {
+					span.SetError(fmt.Errorf("%s", description))
+				}
+			},
+		})
+	}
+	spanFromCtx := func(ctx context.Context) tracing.Span {
+		span := SpanFromCtx(ctx)
+		if !span.span.IsRecording() {
+			return tracing.Span{}
+		}
+		return tracing.NewSpan(tracing.SpanImpl{
+			SetAttributes: func(attributes ...tracing.Attribute) { setAzureAttributes(span, attributes) },
+		})
+	}
+
+	return tracing.NewProvider(func(name, version string) tracing.Tracer {
+		return tracing.NewTracer(newSpan, &tracing.TracerOptions{SpanFromContext: spanFromCtx})
+	}, nil)
+}
+
+func setAzureAttributes(span *Span, attributes []tracing.Attribute) {
+	for _, attribute := range attributes {
+		span.SetAttribute(attribute.Key, attribute.Value)
+	}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func enableTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := SetupTracing(exporter, map[string]string{"service.name": "test"})
+	t.Cleanup(func() {
+		_ = provider.Shutdown(context.Background())
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+	return exporter
+}
+
+// readTraces returns the ended spans, in the order they ended
+func readTraces(t *testing.T, exporter *tracetest.InMemoryExporter) []tracetest.SpanStub {
+	t.Helper()
+	if err := otel.GetTracerProvider().(*sdktrace.TracerProvider).ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return exporter.GetSpans()
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := enableTestTracing(t)
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	var childTraceparent string
+	handler := InvocationMiddleware(TracingMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		_, span := StartSpan(r.Context(), "child", SpanKindInternal)
+		childTraceparent = span.Traceparent()
+		span.Finish(nil)
+	}))
+	// the traceparent of the original request is passed in the functions host envelope
+	body := `{"Data":{"req":{"Headers":{"Traceparent":["00-` + traceId + `-00f067aa0ba902b7-01"]},"Body":"{}"}}}`
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(body)))
+
+	spans := readTraces(t, exporter)
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %+v", spans)
+	}
+	child, invocation := spans[0], spans[1]
+	if invocation.Name != "report" || invocation.SpanContext.TraceID().String() != traceId || invocation.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("invocation span should join the caller trace, got %+v", invocation)
+	}
+	if child.SpanContext.TraceID() != invocation.SpanContext.TraceID() || child.Parent.SpanID() != invocation.SpanContext.SpanID() {
+		t.Errorf("unexpected child span %+v", child)
+	}
+	if childTraceparent != "00-"+traceId+"-"+child.SpanContext.SpanID().String()+"-01" {
+		t.Errorf("unexpected traceparent %s", childTraceparent)
+	}
+}
+
+func TestAzureTracingProvider(t *testing.T) {
+	exporter := enableTestTracing(t)
+
+	options := NewClientOptions(DefaultRetryPolicy)
+	options.PerCallPolicies = nil
+	options.Transport = &fakeTransport{responses: []fakeResponse{{status: http.StatusNotFound, code: "ResourceNotFound"}}}
+	pipeline := runtime.NewPipeline("weka-deployment", "test", runtime.PipelineOptions{}, &options)
+	tracer := options.TracingProvider.NewTracer("armcompute", "v5")
+
+	ctx, span := StartSpan(context.Background(), "scale_up", SpanKindServer)
+	ctx, endSpan := runtime.StartSpan(ctx, "VirtualMachineScaleSetsClient.Get", tracer, nil)
+	req, err := runtime.NewRequest(ctx, http.MethodGet, "https://management.azure.com/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pipeline.Do(req)
+	endSpan(runtime.NewResponseError(&http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Request: req.Raw()}))
+	span.Finish(err)
+
+	spans := readTraces(t, exporter)
+	if len(spans) != 3 {
+		t.Fatalf("expected the http request, client method and invocation spans, got %+v", spans)
+	}
+	request, method, invocation := spans[0], spans[1], spans[2]
+	if method.Name != "VirtualMachineScaleSetsClient.Get" || method.Parent.SpanID() != invocation.SpanContext.SpanID() || method.Status.Code != codes.Error {
+		t.Errorf("unexpected client method span %+v", method)
+	}
+	if request.SpanKind != SpanKindClient || request.Parent.SpanID() != method.SpanContext.SpanID() {
+		t.Errorf("unexpected http request span %+v", request)
+	}
+}
@@ -0,0 +1,347 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// The VMs call back the function app with VM tokens instead of the function key, so that a VM can't call the
+// operator functions (resize, terminate, state...) nor report and deploy for other VMs. A token is signed with
+// a key held in the key vault, it is bound to a scale set and lists the functions it allows:
+//   - the bootstrap token is embedded in the vmss custom data, it allows deploy for the VMs of the scale set which
+//     didn't deploy yet. It expires after VM_BOOTSTRAP_TOKEN_TTL, scale_up rotates it before.
+//   - the instance tokens are issued by deploy and clusterize to the generated scripts, they are bound to a single
+//     VM and expire after VM_TOKEN_TTL.
+//   - the monitor token is issued by deploy to the maintenance monitor of the VM, it allows fetch only and is
+//     valid as long as the VM is part of the scale set.
+//
+// The VM-callable functions are anonymous for the functions host, VmAuthMiddleware accepts either a VM token or
+// the function key, so that the operators keep working.
+
+const (
+	VmTokenHeader = "X-Weka-Vm-Token"
+	// key vault secret holding the key used for signing the VM tokens, it is created by terraform
+	VmTokenSigningKeySecret = "vm-token-signing-key"
+	// vmss tag holding the expiry of the bootstrap token of the scale set custom data (RFC 3339)
+	BootstrapVmTokenExpiresAtTag = "bootstrap_token_expires_at"
+	// file the deploy script writes the monitor token to
+	MonitorVmTokenFile = "/etc/weka-maintenance-monitor/vm-token"
+	FunctionKeySecret  = "function-app-default-key"
+
+	functionKeyHeader = "x-functions-key"
+	// the secrets used for authenticating the callbacks are read from the key vault at most once per period
+	vmAuthSecretsCacheTtl = 5 * time.Minute
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+var (
+	BootstrapVmTokenFunctions = []string{"deploy"}
+	InstanceVmTokenFunctions  = []string{"report", "clusterize", "clusterize_finalization", "join_finalization", "fetch", "status"}
+	MonitorVmTokenFunctions   = []string{"fetch"}
+)
+
+// vmCallableFunctions are the functions whose trigger is anonymous, they are authenticated by VmAuthMiddleware
+var vmCallableFunctions = []string{"deploy", "report", "clusterize", "clusterize_finalization", "join_finalization", "fetch", "status"}
+
+// VmToken are the claims of a VM token
+type VmToken struct {
+	ScaleSetName string `json:"vmss,omitempty"`
+	// Instance is the VM name and Hostname its computer name, both are empty for the bootstrap token
+	Instance  string   `json:"instance,omitempty"`
+	Hostname  string   `json:"hostname,omitempty"`
+	Functions []string `json:"functions"`
+	// ExpiresAt is a unix time, zero for the monitor tokens
+	ExpiresAt int64 `json:"exp,omitempty"`
+}
+
+func NewBootstrapVmToken(scaleSetName string, expiresAt time.Time) VmToken {
+	return VmToken{ScaleSetName: scaleSetName, Functions: BootstrapVmTokenFunctions, ExpiresAt: expiresAt.Unix()}
+}
+
+// NewInstanceVmToken creates the token of a VM, vmName is formatted as in the deploy requests (<vm name>:<hostname>)
+func NewInstanceVmToken(scaleSetName, vmName string, ttl time.Duration) VmToken {
+	instance, hostname, found := strings.Cut(vmName, ":")
+	if !found {
+		hostname = instance
+	}
+	return VmToken{
+		ScaleSetName: scaleSetName,
+		Instance:     instance,
+		Hostname:     hostname,
+		Functions:    InstanceVmTokenFunctions,
+		ExpiresAt:    time.Now().Add(ttl).Unix(),
+	}
+}
+
+// NewMonitorVmToken creates the token of the maintenance monitor of a VM, vmName is formatted as in the deploy
+// requests. The token doesn't expire, fetch rejects it once the VM is not part of the scale set.
+func NewMonitorVmToken(scaleSetName, vmName string) VmToken {
+	token := NewInstanceVmToken(scaleSetName, vmName, 0)
+	token.Functions = MonitorVmTokenFunctions
+	token.ExpiresAt = 0
+	return token
+}
+
+func (t *VmToken) IsBootstrap() bool {
+	return t.Instance == ""
+}
+
+// IsMonitor tells whether the token is a monitor token, see NewMonitorVmToken
+func (t *VmToken) IsMonitor() bool {
+	return !t.IsBootstrap() && t.ExpiresAt == 0
+}
+
+func (t *VmToken) Allows(function string) bool {
+	return slices.Contains(t.Functions, function)
+}
+
+// AuthorizeVm checks that the token was issued to the VM, vmName is either the VM name or <vm name>:<hostname>.
+// The bootstrap token is authorized for all the VMs of its scale set.
+func (t *VmToken) AuthorizeVm(vmName string) error {
+	instance, _, _ := strings.Cut(vmName, ":")
+	if t.IsBootstrap() {
+		// the scale set VM names are <vmss name>_<instance id> (uniform) or <vmss name>_<random id> (flexible)
+		if t.ScaleSetName == "" || !strings.HasPrefix(instance, t.ScaleSetName+"_") {
+			return fmt.Errorf("%w: vm %s is not part of scale set %s", ErrForbidden, instance, t.ScaleSetName)
+		}
+		return nil
+	}
+	if instance != t.Instance {
+		return fmt.Errorf("%w: the token was issued to vm %s, not to %s", ErrForbidden, t.Instance, instance)
+	}
+	return nil
+}
+
+// AuthorizeHostname checks that the token was issued to the VM with the hostname, any hostname is authorized for
+// the bootstrap token
+func (t *VmToken) AuthorizeHostname(hostname string) error {
+	if t.IsBootstrap() || strings.EqualFold(hostname, t.Hostname) {
+		return nil
+	}
+	return fmt.Errorf("%w: the token was issued to host %s, not to %s", ErrForbidden, t.Hostname, hostname)
+}
+
+func vmTokenSignature(payload string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignVmToken encodes the token as <base64url claims>.<base64url HMAC-SHA256 of the encoded claims>
+func SignVmToken(token VmToken, key []byte) (string, error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + vmTokenSignature(payload, key), nil
+}
+
+// VerifyVmToken checks the token signature and expiry and returns its claims, the errors wrap ErrUnauthorized
+func VerifyVmToken(signed string, key []byte, now time.Time) (token VmToken, err error) {
+	payload, signature, found := strings.Cut(signed, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(vmTokenSignature(payload, key))) {
+		err = fmt.Errorf("%w: vm token signature is invalid", ErrUnauthorized)
+		return
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err == nil {
+		err = json.Unmarshal(data, &token)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: cannot decode vm token: %v", ErrUnauthorized, err)
+		return
+	}
+	if token.ExpiresAt == 0 && token.IsBootstrap() {
+		// the bootstrap tokens are shared by the VMs of the scale set, they always expire
+		err = fmt.Errorf("%w: the bootstrap token has no expiry", ErrUnauthorized)
+		return
+	}
+	if token.ExpiresAt != 0 && now.Unix() >= token.ExpiresAt {
+		err = fmt.Errorf("%w: vm token expired at %s", ErrUnauthorized, time.Unix(token.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	return
+}
+
+// secretCache keeps the key vault secrets used on every callback, so that they are not read for each request
+type secretCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value     string
+	expiresAt time.Time
+}
+
+func newSecretCache(ttl time.Duration) *secretCache {
+	return &secretCache{ttl: ttl, entries: make(map[string]cachedSecret)}
+}
+
+var vmAuthSecrets = newSecretCache(vmAuthSecretsCacheTtl)
+
+// get returns the cached secret, or reads it with read when it is missing or expired
+func (c *secretCache) get(key string, read func() (string, error)) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.value, nil
+	}
+
+	value, err := read()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.entries[key] = cachedSecret{value: value, expiresAt: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// GetVmTokenSigningKey returns the VM tokens signing key. The key is created by terraform and never by the function
+// app: concurrent invocations creating it would race, and the tokens signed with the losing key would be rejected.
+func GetVmTokenSigningKey(ctx context.Context, keyVaultUri string) ([]byte, error) {
+	secret, err := vmAuthSecrets.get(keyVaultUri+VmTokenSigningKeySecret, func() (string, error) {
+		return GetKeyVaultValue(ctx, keyVaultUri, VmTokenSigningKeySecret)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get vm token signing key: %v", err)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("vm token signing key %s is empty", VmTokenSigningKeySecret)
+	}
+	return []byte(secret), nil
+}
+
+// IssueVmToken signs the token with the key held in the key vault
+func IssueVmToken(ctx context.Context, keyVaultUri string, token VmToken) (string, error) {
+	key, err := GetVmTokenSigningKey(ctx, keyVaultUri)
+	if err != nil {
+		return "", err
+	}
+	return SignVmToken(token, key)
+}
+
+type vmTokenCtxKey struct{}
+
+// VmTokenFromCtx returns the token the request was authenticated with, nil when it was authenticated with the
+// function key (or not authenticated, for the functions which are not VM-callable)
+func VmTokenFromCtx(ctx context.Context) *VmToken {
+	token, _ := ctx.Value(vmTokenCtxKey{}).(*VmToken)
+	return token
+}
+
+// AuthorizeVm checks that the request may act for the VM, see VmToken.AuthorizeVm
+func AuthorizeVm(ctx context.Context, vmName string) error {
+	if token := VmTokenFromCtx(ctx); token != nil {
+		return token.AuthorizeVm(vmName)
+	}
+	return nil
+}
+
+// AuthorizeHostname checks that the request may act for the host, see VmToken.AuthorizeHostname
+func AuthorizeHostname(ctx context.Context, hostname string) error {
+	if token := VmTokenFromCtx(ctx); token != nil {
+		return token.AuthorizeHostname(hostname)
+	}
+	return nil
+}
+
+// WriteAuthErrorResponse rejects a request which isn't authenticated (401) or authorized (403)
+func WriteAuthErrorResponse(w http.ResponseWriter, err error) {
+	statusCode := http.StatusForbidden
+	if errors.Is(err, ErrUnauthorized) {
+		statusCode = http.StatusUnauthorized
+	}
+	resData := map[string]any{
+		"statusCode": statusCode,
+		"body":       map[string]string{"error": err.Error()},
+	}
+	WriteResponse(w, resData, nil)
+}
+
+func authenticateVmCall(ctx context.Context, r *http.Request, keyVaultUri, function string) (*VmToken, error) {
+	if signed := requestHeader(r, VmTokenHeader); signed != "" {
+		key, err := GetVmTokenSigningKey(ctx, keyVaultUri)
+		if err != nil {
+			return nil, err
+		}
+		token, err := VerifyVmToken(signed, key, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if !token.Allows(function) {
+			return nil, fmt.Errorf("%w: the vm token doesn't allow calling %s", ErrForbidden, function)
+		}
+		return &token, nil
+	}
+
+	functionKey := requestHeader(r, functionKeyHeader)
+	if functionKey == "" {
+		functionKey = requestQuery(r, "code")
+	}
+	if functionKey == "" {
+		if IsDirectCall(ctx) {
+			// there is no functions host in front of the direct calls, they are used only locally
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: neither a vm token nor a function key was sent", ErrUnauthorized)
+	}
+	expected, err := vmAuthSecrets.get(keyVaultUri+FunctionKeySecret, func() (string, error) {
+		return GetKeyVaultValue(ctx, keyVaultUri, FunctionKeySecret)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get function key: %v", err)
+	}
+	if !hmac.Equal([]byte(functionKey), []byte(expected)) {
+		return nil, fmt.Errorf("%w: invalid function key", ErrUnauthorized)
+	}
+	return nil, nil
+}
+
+// VmAuthMiddleware authenticates the calls of the VM-callable functions with a VM token or the function key, the
+// token is injected into the request context. The other functions are authenticated by the functions host.
+func VmAuthMiddleware(keyVaultUri string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		function := InvocationFromCtx(ctx).FunctionName
+		if !slices.Contains(vmCallableFunctions, function) {
+			next(w, r)
+			return
+		}
+
+		token, err := authenticateVmCall(ctx, r, keyVaultUri, function)
+		if err != nil {
+			logging.LoggerFromCtx(ctx).Warn().Err(err).Msgf("rejected call of %s", function)
+			if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrForbidden) {
+				WriteAuthErrorResponse(w, err)
+			} else {
+				WriteErrorResponse(w, err)
+			}
+			return
+		}
+		if token != nil {
+			SpanFromCtx(ctx).SetAttribute("weka.vm_token.instance", token.Instance)
+			ctx = context.WithValue(ctx, vmTokenCtxKey{}, token)
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVmToken(t *testing.T) {
+	key := []byte("signing-key")
+	now := time.Now()
+
+	token := NewInstanceVmToken("cluster-vmss", "cluster-vmss_3:cluster-vmss000003", time.Hour)
+	signed, err := SignVmToken(token, key)
+	if err != nil {
+		t.Fatalf("failed signing token: %s", err)
+	}
+	verified, err := VerifyVmToken(signed, key, now)
+	if err != nil || verified.Instance != "cluster-vmss_3" || verified.Hostname != "cluster-vmss000003" {
+		t.Fatalf("unexpected verified token: %+v, %v", verified, err)
+	}
+	if !verified.Allows("report") || verified.Allows("resize") {
+		t.Fatalf("unexpected functions of the instance token: %v", verified.Functions)
+	}
+	if err := verified.AuthorizeVm("cluster-vmss_3:cluster-vmss000003"); err != nil {
+		t.Fatalf("the token should be authorized for its vm: %v", err)
+	}
+	if err := verified.AuthorizeVm("cluster-vmss_4"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("the token should not be authorized for another vm, got %v", err)
+	}
+	if err := verified.AuthorizeHostname("cluster-vmss000004"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("the token should not be authorized for another host, got %v", err)
+	}
+
+	if _, err := VerifyVmToken(signed, key, now.Add(2*time.Hour)); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected an expired token error, got %v", err)
+	}
+	if _, err := VerifyVmToken(signed, []byte("other-key"), now); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected a signature error for a wrong key, got %v", err)
+	}
+	other, _ := SignVmToken(NewInstanceVmToken("cluster-vmss", "cluster-vmss_4:cluster-vmss000004", time.Hour), key)
+	forged := strings.Split(other, ".")[0] + "." + strings.Split(signed, ".")[1]
+	if _, err := VerifyVmToken(forged, key, now); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected a signature error for modified claims, got %v", err)
+	}
+
+	bootstrap := NewBootstrapVmToken("cluster-vmss", now.Add(time.Hour))
+	first, _ := SignVmToken(bootstrap, key)
+	second, _ := SignVmToken(bootstrap, key)
+	if first != second {
+		t.Fatalf("the bootstrap token must be deterministic")
+	}
+	if err := bootstrap.AuthorizeVm("cluster-vmss_7:cluster-vmss000007"); err != nil {
+		t.Fatalf("the bootstrap token should be authorized for the vms of its scale set: %v", err)
+	}
+	if err := bootstrap.AuthorizeVm("cluster-nfs_1"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("the bootstrap token should not be authorized for another scale set, got %v", err)
+	}
+	if _, err := VerifyVmToken(first, key, now.Add(2*time.Hour)); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected an expired bootstrap token error, got %v", err)
+	}
+	legacy, _ := SignVmToken(VmToken{ScaleSetName: "cluster-vmss", Functions: BootstrapVmTokenFunctions}, key)
+	if _, err := VerifyVmToken(legacy, key, now); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("a bootstrap token without expiry should be rejected, got %v", err)
+	}
+
+	monitor := NewMonitorVmToken("cluster-vmss", "cluster-vmss_3:cluster-vmss000003")
+	signedMonitor, _ := SignVmToken(monitor, key)
+	verified, err = VerifyVmToken(signedMonitor, key, now.Add(365*24*time.Hour))
+	if err != nil || !verified.IsMonitor() || verified.Instance != "cluster-vmss_3" {
+		t.Fatalf("unexpected verified monitor token: %+v, %v", verified, err)
+	}
+	if !verified.Allows("fetch") || verified.Allows("report") || verified.Allows("deploy") {
+		t.Fatalf("unexpected functions of the monitor token: %v", verified.Functions)
+	}
+}
+
+func authEnvelope(headers map[string][]string, query map[string]string) string {
+	req, _ := json.Marshal(map[string]any{"Body": `{}`, "Headers": headers, "Query": query})
+	data, _ := json.Marshal(InvokeRequest{Data: map[string]json.RawMessage{"req": req}})
+	return string(data)
+}
+
+func TestVmAuthMiddleware(t *testing.T) {
+	vmAuthSecrets = newSecretCache(vmAuthSecretsCacheTtl)
+	keyVaultUri := "https://test.vault.azure.net/"
+	provider := NewFakeCloudProvider()
+	ctx := ContextWithCloudProvider(context.Background(), provider)
+	_ = provider.SetSecret(ctx, keyVaultUri, FunctionKeySecret, "function-key")
+	_ = provider.SetSecret(ctx, keyVaultUri, VmTokenSigningKeySecret, "signing-key")
+
+	instanceToken, err := IssueVmToken(ctx, keyVaultUri, NewInstanceVmToken("vmss", "vmss_1:vmss000001", time.Hour))
+	if err != nil {
+		t.Fatalf("failed issuing token: %s", err)
+	}
+	bootstrapToken, _ := IssueVmToken(ctx, keyVaultUri, NewBootstrapVmToken("vmss", time.Now().Add(time.Hour)))
+
+	var authenticated *VmToken
+	handler := VmAuthMiddleware(keyVaultUri, func(w http.ResponseWriter, r *http.Request) {
+		authenticated = VmTokenFromCtx(r.Context())
+		WriteSuccessResponse(w, "ok")
+	})
+
+	tests := []struct {
+		name       string
+		function   string
+		payload    string
+		wantStatus int
+		wantToken  bool
+	}{
+		{"instance token", "report", authEnvelope(map[string][]string{VmTokenHeader: {instanceToken}}, nil), http.StatusOK, true},
+		{"function not allowed by the token", "deploy", authEnvelope(map[string][]string{VmTokenHeader: {instanceToken}}, nil), http.StatusForbidden, false},
+		{"bootstrap token", "deploy", authEnvelope(map[string][]string{VmTokenHeader: {bootstrapToken}}, nil), http.StatusOK, true},
+		{"report with the bootstrap token", "report", authEnvelope(map[string][]string{VmTokenHeader: {bootstrapToken}}, nil), http.StatusForbidden, false},
+		{"invalid token", "report", authEnvelope(map[string][]string{VmTokenHeader: {"invalid"}}, nil), http.StatusUnauthorized, false},
+		{"function key query", "report", authEnvelope(nil, map[string]string{"code": "function-key"}), http.StatusOK, false},
+		{"function key header", "status", authEnvelope(map[string][]string{"X-Functions-Key": {"function-key"}}, nil), http.StatusOK, false},
+		{"invalid function key", "report", authEnvelope(nil, map[string]string{"code": "other-key"}), http.StatusUnauthorized, false},
+		{"no credentials", "report", authEnvelope(nil, nil), http.StatusUnauthorized, false},
+		{"function authenticated by the host", "resize", authEnvelope(nil, nil), http.StatusOK, false},
+	}
+	for _, test := range tests {
+		authenticated = nil
+		r := httptest.NewRequest(http.MethodPost, "/"+test.function, strings.NewReader(test.payload))
+		r = r.WithContext(ContextWithInvocation(ctx, InvocationInfo{FunctionName: test.function}))
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		var response struct {
+			Outputs struct {
+				Res struct {
+					StatusCode int `json:"statusCode"`
+				} `json:"res"`
+			}
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &response)
+		status := response.Outputs.Res.StatusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status != test.wantStatus || (authenticated != nil) != test.wantToken {
+			t.Errorf("%s: unexpected status %d (token %+v): %s", test.name, status, authenticated, w.Body.String())
+		}
+	}
+}
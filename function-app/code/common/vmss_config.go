@@ -89,11 +89,12 @@ type VMSSConfig struct {
 
 // Compares two vmss configs - works with copies of VMSSConfig structs
 // NOTES:
-// - does not compare "config_hash" and "config_applied_at" tags, and names which include version
+// - does not compare "config_hash", "config_applied_at" and "bootstrap_token_expires_at" tags, and names which include version
 func VmssConfigsDiff(old, new VMSSConfig) string {
 	old.UserData, new.UserData = "", "" // ignore user data when generating diff (as it may contain sensitive data)
 	old.Tags["config_hash"], new.Tags["config_hash"] = "", ""
 	old.Tags["config_applied_at"], new.Tags["config_applied_at"] = "", ""
+	old.Tags[BootstrapVmTokenExpiresAtTag], new.Tags[BootstrapVmTokenExpiresAtTag] = "", ""
 	old.ComputerNamePrefix, new.ComputerNamePrefix = "", ""
 	old.Name, new.Name = "", ""
 	old.ConfigHash, new.ConfigHash = "", ""
@@ -121,6 +122,8 @@ type VMSSStateVerbose struct {
 	CurrentConfigHash string            `json:"current_config_hash"`
 	NeedUpdate        bool              `json:"need_update"`
 	UpdatesLog        []protocol.Update `json:"updates,omitempty"`
+	// PendingPlan is the config change waiting for approval, see VmssPlan
+	PendingPlan *VmssPlan `json:"pending_plan,omitempty"`
 }
 
 func ToEnumStrValue[T interface{ ~string }](val string, possibleEnumValues []T) (*T, error) {
@@ -0,0 +1,268 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+)
+
+const (
+	vmssPlansPrefix = "vmss_plans"
+	// number of decided plans kept, the oldest ones are dropped
+	vmssPlansHistory = 20
+)
+
+type VmssPlanStatus string
+
+const (
+	VmssPlanPending  VmssPlanStatus = "pending"
+	VmssPlanApproved VmssPlanStatus = "approved"
+	VmssPlanRejected VmssPlanStatus = "rejected"
+	// the scale set was updated to the plan config
+	VmssPlanApplied VmssPlanStatus = "applied"
+	// the vmss config changed again before the plan was applied
+	VmssPlanSuperseded VmssPlanStatus = "superseded"
+)
+
+type VmssPlanRisk string
+
+const (
+	// the scale set model is updated in place
+	VmssPlanRiskLow VmssPlanRisk = "low"
+	// the instances are replaced
+	VmssPlanRiskMedium VmssPlanRisk = "medium"
+	// the backends are moved to a new scale set, or the update can't be applied
+	VmssPlanRiskHigh VmssPlanRisk = "high"
+)
+
+// vmss config fields which are applied to the scale set without replacing its instances, the other fields only
+// apply to the instances created from the updated model
+var vmssInPlaceFields = map[string]bool{
+	"tags":            true,
+	"upgrade_mode":    true,
+	"health_probe_id": true,
+	"overprovision":   true,
+	"identity":        true,
+}
+
+// vmss config fields which can't be changed on an existing scale set
+var vmssImmutableFields = map[string]bool{
+	"location":               true,
+	"resource_group_name":    true,
+	"orchestration_mode":     true,
+	"single_placement_group": true,
+}
+
+// VmssPlan is a vmss config change waiting for approval, when VMSS_UPDATE_APPROVAL_REQUIRED is set
+// scale_up only applies approved plans
+type VmssPlan struct {
+	// Id is the config hash the scale set is updated to
+	Id     string         `json:"id"`
+	Vmss   string         `json:"vmss"`
+	From   string         `json:"from"`
+	Status VmssPlanStatus `json:"status"`
+	// Diff is the config diff (-current +target), the user data is not part of it
+	Diff string `json:"diff"`
+	// ReplacementFields are the changed fields which only apply to new instances
+	ReplacementFields []string     `json:"replacement_fields"`
+	InPlaceFields     []string     `json:"in_place_fields"`
+	Risk              VmssPlanRisk `json:"risk"`
+	RiskSummary       []string     `json:"risk_summary"`
+	CreatedAt         time.Time    `json:"created_at"`
+	DecidedAt         *time.Time   `json:"decided_at,omitempty"`
+	// Reason is given when the plan is rejected
+	Reason    string     `json:"reason,omitempty"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// VmssPlans are the vmss config change plans, oldest first. At most one plan is pending.
+type VmssPlans struct {
+	Plans []VmssPlan `json:"plans"`
+}
+
+// Pending returns the plan waiting for approval, nil when there is none
+func (p *VmssPlans) Pending() *VmssPlan {
+	for i := range p.Plans {
+		if p.Plans[i].Status == VmssPlanPending {
+			return &p.Plans[i]
+		}
+	}
+	return nil
+}
+
+// Find returns the latest plan of the config change, nil when there is none
+func (p *VmssPlans) Find(from, to string) *VmssPlan {
+	for i := len(p.Plans) - 1; i >= 0; i-- {
+		if p.Plans[i].From == from && p.Plans[i].Id == to && p.Plans[i].Status != VmssPlanSuperseded {
+			return &p.Plans[i]
+		}
+	}
+	return nil
+}
+
+// Add adds a pending plan, the plans which were not applied yet are superseded by it
+func (p *VmssPlans) Add(plan VmssPlan) {
+	for i := range p.Plans {
+		if p.Plans[i].Status == VmssPlanPending || p.Plans[i].Status == VmssPlanApproved {
+			p.Plans[i].Status = VmssPlanSuperseded
+		}
+	}
+	p.Plans = append(p.Plans, plan)
+	if len(p.Plans) > vmssPlansHistory {
+		p.Plans = p.Plans[len(p.Plans)-vmssPlansHistory:]
+	}
+}
+
+// NewVmssPlan classifies the changes from the current to the target config. instances is the number of instances of
+// the scale set, they are replaced when a replacement field changes.
+func NewVmssPlan(current, target VMSSConfig, instances int, skuMigrationEnabled bool) (plan VmssPlan, err error) {
+	// work on copies, VmssConfigsDiff changes the tags and NICs in place
+	if current, err = copyVmssConfig(current); err != nil {
+		return
+	}
+	if target, err = copyVmssConfig(target); err != nil {
+		return
+	}
+	replacement, inPlace, err := classifyVmssConfigChanges(current, target)
+	if err != nil {
+		return
+	}
+
+	plan = VmssPlan{
+		Id:                target.ConfigHash,
+		Vmss:              current.Name,
+		From:              current.ConfigHash,
+		Status:            VmssPlanPending,
+		ReplacementFields: replacement,
+		InPlaceFields:     inPlace,
+		Risk:              VmssPlanRiskLow,
+		RiskSummary:       []string{},
+		CreatedAt:         time.Now(),
+	}
+
+	raise := func(risk VmssPlanRisk, summary string) {
+		if risk == VmssPlanRiskHigh || plan.Risk == VmssPlanRiskLow {
+			plan.Risk = risk
+		}
+		plan.RiskSummary = append(plan.RiskSummary, summary)
+	}
+	for _, field := range append(replacement, inPlace...) {
+		if vmssImmutableFields[field] {
+			raise(VmssPlanRiskHigh, fmt.Sprintf("%s can't be changed on an existing scale set, the update will fail", field))
+		}
+	}
+	if current.SKU != target.SKU {
+		if skuMigrationEnabled {
+			raise(VmssPlanRiskHigh, fmt.Sprintf("the SKU changes from %s to %s, the %d backends are moved to a new scale set", current.SKU, target.SKU, instances))
+		} else {
+			raise(VmssPlanRiskHigh, fmt.Sprintf("the SKU changes from %s to %s and SKU_MIGRATION_ENABLED is not set, the update will fail", current.SKU, target.SKU))
+		}
+	} else if len(replacement) > 0 {
+		if current.UpgradeMode == string(armcompute.UpgradeModeManual) {
+			raise(VmssPlanRiskMedium, fmt.Sprintf("the %d instances are replaced one at a time by the rolling upgrade (%s)", instances, strings.Join(replacement, ", ")))
+		} else {
+			raise(VmssPlanRiskMedium, fmt.Sprintf("the %d instances are updated by Azure according to the %s upgrade mode (%s)", instances, current.UpgradeMode, strings.Join(replacement, ", ")))
+		}
+	}
+	if len(plan.RiskSummary) == 0 {
+		plan.RiskSummary = append(plan.RiskSummary, "the scale set model is updated in place, no instance is replaced")
+	}
+
+	plan.Diff = VmssConfigsDiff(current, target)
+	return
+}
+
+func copyVmssConfig(config VMSSConfig) (copied VMSSConfig, err error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &copied)
+	copied.ConfigHash = config.ConfigHash
+	return
+}
+
+// classifyVmssConfigChanges returns the json names of the changed fields, ignoring the same fields as VmssConfigsDiff
+// except the user data, which is only applied to new instances
+func classifyVmssConfigChanges(current, target VMSSConfig) (replacement, inPlace []string, err error) {
+	normalize := func(config VMSSConfig) (fields map[string]any, err error) {
+		delete(config.Tags, ConfigHashTag)
+		delete(config.Tags, "config_applied_at")
+		delete(config.Tags, BootstrapVmTokenExpiresAtTag)
+		config.Name, config.ComputerNamePrefix = "", ""
+		for i := range config.PrimaryNIC.IPConfigurations {
+			if config.PrimaryNIC.IPConfigurations[i].PublicIPAddress != nil {
+				config.PrimaryNIC.IPConfigurations[i].PublicIPAddress.DomainNameLabel = ""
+			}
+		}
+		if target.OSDisk.DiskSizeGB == nil {
+			config.OSDisk.DiskSizeGB = nil
+		}
+		data, err := json.Marshal(config)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(data, &fields)
+		return
+	}
+	currentFields, err := normalize(current)
+	if err != nil {
+		return
+	}
+	targetFields, err := normalize(target)
+	if err != nil {
+		return
+	}
+
+	names := make([]string, 0, len(targetFields))
+	for name := range targetFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if reflect.DeepEqual(currentFields[name], targetFields[name]) {
+			continue
+		}
+		if vmssInPlaceFields[name] {
+			inPlace = append(inPlace, name)
+		} else {
+			replacement = append(replacement, name)
+		}
+	}
+	if replacement == nil {
+		replacement = []string{}
+	}
+	if inPlace == nil {
+		inPlace = []string{}
+	}
+	return
+}
+
+// the vmss plans are kept next to the state they belong to, like the operations
+func vmssPlansParams(stateParams BlobObjParams) BlobObjParams {
+	return BlobObjParams{
+		StorageName:   stateParams.StorageName,
+		ContainerName: stateParams.ContainerName,
+		BlobName:      path.Join(vmssPlansPrefix, stateParams.BlobName+".json"),
+	}
+}
+
+func newVmssPlans() VmssPlans {
+	return VmssPlans{Plans: []VmssPlan{}}
+}
+
+func GetVmssPlans(ctx context.Context, store StateStore, stateParams BlobObjParams) (plans VmssPlans, err error) {
+	plans, _, err = readJsonObject(ctx, store, vmssPlansParams(stateParams), newVmssPlans)
+	return
+}
+
+func UpdateVmssPlans(ctx context.Context, store StateStore, stateParams BlobObjParams, updateFn func(plans *VmssPlans) error) (VmssPlans, error) {
+	return updateJsonObject(ctx, store, vmssPlansParams(stateParams), newVmssPlans, updateFn)
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"slices"
+	"testing"
+)
+
+func testVmssConfig(configHash string) VMSSConfig {
+	return VMSSConfig{
+		Name:          "weka-poc-vmss",
+		SKU:           "Standard_L8s_v3",
+		SourceImageID: "image-1",
+		UpgradeMode:   "Manual",
+		Tags:          map[string]string{ConfigHashTag: configHash, "env": "test"},
+		UserData:      "user-data",
+		PrimaryNIC: PrimaryNIC{IPConfigurations: []IPConfiguration{{
+			Primary:         true,
+			PublicIPAddress: &PublicIPAddress{Assign: true, DomainNameLabel: "weka-poc"},
+		}}},
+		ConfigHash: configHash,
+	}
+}
+
+func TestNewVmssPlan(t *testing.T) {
+	current := testVmssConfig("hash-1")
+
+	tagsOnly := testVmssConfig("hash-2")
+	tagsOnly.Tags["env"] = "prod"
+	tagsOnly.PrimaryNIC.IPConfigurations[0].PublicIPAddress.DomainNameLabel = "weka-poc-v2"
+	plan, err := NewVmssPlan(current, tagsOnly, 6, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Id != "hash-2" || plan.From != "hash-1" || plan.Status != VmssPlanPending {
+		t.Errorf("unexpected plan identity: %+v", plan)
+	}
+	if plan.Risk != VmssPlanRiskLow || len(plan.ReplacementFields) != 0 || !slices.Equal(plan.InPlaceFields, []string{"tags"}) {
+		t.Errorf("expected an in place tags change, got risk %s, replacement %v, in place %v", plan.Risk, plan.ReplacementFields, plan.InPlaceFields)
+	}
+	if current.Tags[ConfigHashTag] != "hash-1" || tagsOnly.PrimaryNIC.IPConfigurations[0].PublicIPAddress.DomainNameLabel != "weka-poc-v2" {
+		t.Error("the configs must not be changed by the plan")
+	}
+
+	image := testVmssConfig("hash-3")
+	image.SourceImageID, image.UserData = "image-2", "new-user-data"
+	plan, _ = NewVmssPlan(current, image, 6, false)
+	if plan.Risk != VmssPlanRiskMedium || !slices.Equal(plan.ReplacementFields, []string{"source_image_id", "user_data"}) {
+		t.Errorf("expected the instances to be replaced, got risk %s, replacement %v", plan.Risk, plan.ReplacementFields)
+	}
+
+	sku := testVmssConfig("hash-4")
+	sku.SKU = "Standard_L16s_v3"
+	plan, _ = NewVmssPlan(current, sku, 6, true)
+	if plan.Risk != VmssPlanRiskHigh || !slices.Equal(plan.ReplacementFields, []string{"sku"}) {
+		t.Errorf("expected a high risk sku change, got risk %s, replacement %v", plan.Risk, plan.ReplacementFields)
+	}
+}
+
+func TestVmssPlansAdd(t *testing.T) {
+	plans := VmssPlans{}
+	plans.Add(VmssPlan{Id: "hash-2", From: "hash-1", Status: VmssPlanPending})
+	plans.Add(VmssPlan{Id: "hash-3", From: "hash-1", Status: VmssPlanPending})
+
+	if pending := plans.Pending(); pending == nil || pending.Id != "hash-3" {
+		t.Fatalf("expected hash-3 pending, got %+v", pending)
+	}
+	if plans.Find("hash-1", "hash-2") != nil {
+		t.Error("the superseded plan must not be found")
+	}
+
+	for i := 0; i < vmssPlansHistory; i++ {
+		plans.Add(VmssPlan{Id: "hash", From: "hash-1", Status: VmssPlanPending})
+	}
+	if len(plans.Plans) != vmssPlansHistory {
+		t.Errorf("expected %d plans kept, got %d", vmssPlansHistory, len(plans.Plans))
+	}
+}
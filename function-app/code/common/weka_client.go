@@ -0,0 +1,85 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/weka/go-cloud-lib/connectors"
+	"github.com/weka/go-cloud-lib/lib/jrpc"
+	"github.com/weka/go-cloud-lib/lib/weka"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+	"github.com/weka/go-cloud-lib/scale_down"
+)
+
+// WekaClient wraps the weka api calls made by the functions. The jrpc implementation calls the weka api of the
+// backends, the fake implementation simulates the weka hosts in memory for unit tests.
+type WekaClient interface {
+	// Status calls the weka status api on one of the scale set vms and decodes the status into result
+	Status(ctx context.Context, vmssParams *ScaleSetParams, keyVaultUri string, result any) error
+	// ScaleDown deactivates the hosts of info.WekaBackendInstances beyond the desired capacity and removes the
+	// inactive ones, the instances of the removed hosts are returned in ToTerminate
+	ScaleDown(ctx context.Context, info protocol.HostGroupInfoResponse) (protocol.ScaleResponse, error)
+}
+
+type wekaClientCtxKey struct{}
+
+func ContextWithWekaClient(ctx context.Context, client WekaClient) context.Context {
+	return context.WithValue(ctx, wekaClientCtxKey{}, client)
+}
+
+// WekaClientFromCtx returns the weka client injected into the context (jrpc by default)
+func WekaClientFromCtx(ctx context.Context) WekaClient {
+	if client, ok := ctx.Value(wekaClientCtxKey{}).(WekaClient); ok {
+		return client
+	}
+	return jrpcWekaClient{}
+}
+
+type jrpcWekaClient struct{}
+
+func (jrpcWekaClient) Status(ctx context.Context, vmssParams *ScaleSetParams, keyVaultUri string, result any) (err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	credentials, err := GetWekaClusterCredentials(ctx, keyVaultUri)
+	if err != nil {
+		return
+	}
+
+	jrpcBuilder := func(ip string) *jrpc.BaseClient {
+		return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, credentials.Username, credentials.Password)
+	}
+
+	vmIps, err := GetVmsPrivateIps(ctx, vmssParams)
+	if err != nil {
+		return
+	}
+	ips := make([]string, 0, len(vmIps))
+	for _, ip := range vmIps {
+		ips = append(ips, ip)
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	logger.Info().Msgf("ips: %s", ips)
+	jpool := &jrpc.Pool{
+		Ips:     ips,
+		Clients: map[string]*jrpc.BaseClient{},
+		Active:  "",
+		Builder: jrpcBuilder,
+		Ctx:     ctx,
+	}
+
+	var rawWekaStatus json.RawMessage
+
+	err = jpool.Call(weka.JrpcStatus, struct{}{}, &rawWekaStatus)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(rawWekaStatus, result)
+}
+
+func (jrpcWekaClient) ScaleDown(ctx context.Context, info protocol.HostGroupInfoResponse) (protocol.ScaleResponse, error) {
+	return scale_down.ScaleDown(ctx, info)
+}
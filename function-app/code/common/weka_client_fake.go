@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// FakeWekaClient simulates the weka api for unit tests: the status is set by the test, the scale down deactivates
+// the hosts beyond the desired capacity and removes them on the next scale down, as weka does once their data is
+// rebuilt on the other hosts
+type FakeWekaClient struct {
+	mu     sync.Mutex
+	status any
+	// hosts being deactivated, by private ip
+	deactivating map[string]bool
+}
+
+func NewFakeWekaClient() *FakeWekaClient {
+	return &FakeWekaClient{deactivating: make(map[string]bool)}
+}
+
+// SetStatus sets the status returned by the status api, the status api fails until it is set
+func (c *FakeWekaClient) SetStatus(status any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+// Deactivating tells whether the host of the private ip is being deactivated
+func (c *FakeWekaClient) Deactivating(privateIp string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deactivating[privateIp]
+}
+
+func (c *FakeWekaClient) Status(ctx context.Context, vmssParams *ScaleSetParams, keyVaultUri string, result any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status == nil {
+		return errors.New("weka api is not reachable")
+	}
+	data, err := json.Marshal(c.status)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (c *FakeWekaClient) ScaleDown(ctx context.Context, info protocol.HostGroupInfoResponse) (response protocol.ScaleResponse, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	response.Version = protocol.Version
+	desired := min(max(info.WekaBackendsDesiredCapacity, 0), len(info.WekaBackendInstances))
+	for i, instance := range info.WekaBackendInstances {
+		host := protocol.ScaleResponseHost{InstanceId: instance.Id, PrivateIp: instance.PrivateIp}
+		switch {
+		case i < desired:
+			response.Hosts = append(response.Hosts, host)
+		case c.deactivating[instance.PrivateIp]:
+			delete(c.deactivating, instance.PrivateIp)
+			response.ToTerminate = append(response.ToTerminate, instance)
+		default:
+			c.deactivating[instance.PrivateIp] = true
+			response.Hosts = append(response.Hosts, host)
+		}
+	}
+	return
+}
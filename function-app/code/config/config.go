@@ -0,0 +1,348 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// Config is the function app configuration, set by terraform as app settings.
+// Fields are read from the environment variable of their `env` tag; `default` is used when the variable is unset,
+// `validate:"required"` fields must be set and `secret:"true"` fields are redacted when the config is shown.
+type Config struct {
+	SubscriptionId    string `env:"SUBSCRIPTION_ID" validate:"required"`
+	ResourceGroupName string `env:"RESOURCE_GROUP_NAME" validate:"required"`
+	Location          string `env:"LOCATION"`
+	Prefix            string `env:"PREFIX" validate:"required"`
+	ClusterName       string `env:"CLUSTER_NAME" validate:"required"`
+	FunctionAppName   string `env:"FUNCTION_APP_NAME"`
+	// FunctionsBaseUrl overrides the function app url called by the generated scripts
+	FunctionsBaseUrl string `env:"FUNCTIONS_BASE_URL"`
+	KeyVaultUri      string `env:"KEY_VAULT_URI"`
+	// WebsiteInstanceId is set by the functions host, it identifies the instance serving the request
+	WebsiteInstanceId string `env:"WEBSITE_INSTANCE_ID"`
+
+	// state of the backends cluster
+	StateStorageName   string `env:"STATE_STORAGE_NAME" validate:"required"`
+	StateContainerName string `env:"STATE_CONTAINER_NAME" validate:"required"`
+	StateBlobName      string `env:"STATE_BLOB_NAME" validate:"required"`
+
+	InitialClusterSize   int    `env:"INITIAL_CLUSTER_SIZE"`
+	ClusterizationTarget int    `env:"CLUSTERIZATION_TARGET"`
+	VmssConfig           string `env:"VMSS_CONFIG"`
+
+	// weka cluster settings
+	StripeWidth          int    `env:"STRIPE_WIDTH"`
+	ProtectionLevel      int    `env:"PROTECTION_LEVEL"`
+	Hotspare             int    `env:"HOTSPARE"`
+	InstallDpdk          bool   `env:"INSTALL_DPDK"`
+	InstallUrl           string `env:"INSTALL_URL" secret:"true"`
+	ProxyUrl             string `env:"PROXY_URL"`
+	WekaHomeUrl          string `env:"WEKA_HOME_URL"`
+	AptRepoServer        string `env:"APT_REPO_SERVER"`
+	CgroupsMode          string `env:"CGROUPS_MODE"`
+	SetDefaultFs         bool   `env:"SET_DEFAULT_FS"`
+	CreateConfigFs       bool   `env:"CREATE_CONFIG_FS"`
+	TracesPerFrontend    int    `env:"TRACES_PER_FRONTEND"`
+	ComputeMemory        string `env:"COMPUTE_MEMORY"`
+	ComputeContainerNum  int    `env:"COMPUTE_CONTAINER_CORES_NUM"`
+	FrontendContainerNum int    `env:"FRONTEND_CONTAINER_CORES_NUM"`
+	DriveContainerNum    int    `env:"DRIVE_CONTAINER_CORES_NUM"`
+	NicsNum              int    `env:"NICS_NUM"`
+	NvmesNum             int    `env:"NVMES_NUM"`
+	DiskSize             int    `env:"DISK_SIZE"`
+	Subnet               string `env:"SUBNET"`
+	SubnetId             string `env:"SUBNET_ID"`
+	BackendLbIp          string `env:"BACKEND_LB_IP"`
+
+	// scripts run on the backends
+	PreStartIoScript          string `env:"PRE_START_IO_SCRIPT"`
+	PostClusterCreationScript string `env:"POST_CLUSTER_CREATION_SCRIPT"`
+	PostClusterSetupScript    string `env:"POST_CLUSTER_SETUP_SCRIPT"`
+
+	// tiering
+	SetObs                    bool   `env:"SET_OBS"`
+	ObsName                   string `env:"OBS_NAME"`
+	ObsContainerName          string `env:"OBS_CONTAINER_NAME"`
+	ObsAccessKey              string `env:"OBS_ACCESS_KEY" secret:"true"`
+	ObsNetworkAccess          string `env:"OBS_NETWORK_ACCESS"`
+	ObsAllowedSubnets         string `env:"OBS_ALLOWED_SUBNETS"`
+	ObsAllowedPublicIps       string `env:"OBS_ALLOWED_PUBLIC_IPS"`
+	TieringSsdPercent         string `env:"TIERING_SSD_PERCENT"`
+	TieringTargetSsdRetention int    `env:"TIERING_TARGET_SSD_RETENTION"`
+	TieringStartDemote        int    `env:"TIERING_START_DEMOTE"`
+	BlobPrivateDnsZoneId      string `env:"BLOB_PRIVATE_DNS_ZONE_ID"`
+	CreateBlobPrivateEndpoint bool   `env:"CREATE_BLOB_PRIVATE_ENDPOINT"`
+
+	// protocol gateways
+	NfsStateContainerName        string `env:"NFS_STATE_CONTAINER_NAME"`
+	NfsStateBlobName             string `env:"NFS_STATE_BLOB_NAME"`
+	NfsVmssName                  string `env:"NFS_VMSS_NAME"`
+	NfsInterfaceGroupName        string `env:"NFS_INTERFACE_GROUP_NAME"`
+	NfsProtocolGatewaysNum       int    `env:"NFS_PROTOCOL_GATEWAYS_NUM"`
+	NfsSecondaryIpsNum           int    `env:"NFS_SECONDARY_IPS_NUM"`
+	NfsProtocolGatewayFeCoresNum int    `env:"NFS_PROTOCOL_GATEWAY_FE_CORES_NUM"`
+	NfsDiskSize                  int    `env:"NFS_DISK_SIZE"`
+	SmbProtocolGatewayFeCoresNum int    `env:"SMB_PROTOCOL_GATEWAY_FE_CORES_NUM"`
+	SmbDiskSize                  int    `env:"SMB_DISK_SIZE"`
+	S3ProtocolGatewayFeCoresNum  int    `env:"S3_PROTOCOL_GATEWAY_FE_CORES_NUM"`
+	S3DiskSize                   int    `env:"S3_DISK_SIZE"`
+
+	// function app tuning, the defaults match the ones of the common package
+	DownBackendsRemovalTimeout time.Duration `env:"DOWN_BACKENDS_REMOVAL_TIMEOUT"`
+	StateHistoryRetention      int           `env:"STATE_HISTORY_RETENTION" default:"50"`
+	ReportsPerHostLimit        int           `env:"REPORTS_PER_HOST_LIMIT" default:"50"`
+	ReportsTotalLimit          int           `env:"REPORTS_TOTAL_LIMIT" default:"1000"`
+	AzureRetryMaxAttempts      int           `env:"AZURE_RETRY_MAX_ATTEMPTS" default:"5"`
+	AzureRetryBaseDelayMs      int           `env:"AZURE_RETRY_BASE_DELAY_MS" default:"1000"`
+	AzureRetryMaxDelaySeconds  int           `env:"AZURE_RETRY_MAX_DELAY_SECONDS" default:"60"`
+	// lifetime of the VM tokens issued to the deploy and clusterize scripts
+	VmTokenTtl time.Duration `env:"VM_TOKEN_TTL" default:"6h"`
+	// lifetime of the bootstrap token of the vmss custom data, scale_up rotates it after half of its lifetime
+	VmBootstrapTokenTtl time.Duration `env:"VM_BOOTSTRAP_TOKEN_TTL" default:"168h"`
+	// the rolling upgrade pauses when the replacement of an instance doesn't join within the timeout
+	RollingUpgradeJoinTimeout time.Duration `env:"ROLLING_UPGRADE_JOIN_TIMEOUT" default:"2h"`
+	// a SKU change migrates the backends to a new scale set instead of being refused, the old instances are removed
+	// by batches of SkuMigrationBatchSize, lower than ProtectionLevel so that the cluster can still lose a backend
+	SkuMigrationEnabled   bool `env:"SKU_MIGRATION_ENABLED"`
+	SkuMigrationBatchSize int  `env:"SKU_MIGRATION_BATCH_SIZE" default:"1"`
+	// the vmss config changes are kept as plans until they are approved with the vmss function
+	VmssUpdateApprovalRequired bool `env:"VMSS_UPDATE_APPROVAL_REQUIRED"`
+	// the clusterization instance is replaced when it doesn't report for longer than the timeout (0 disables it),
+	// at most ClusterizationMaxReelections times
+	ClusterizationTimeout        time.Duration `env:"CLUSTERIZATION_TIMEOUT" default:"45m"`
+	ClusterizationMaxReelections int           `env:"CLUSTERIZATION_MAX_REELECTIONS" default:"3"`
+
+	// tracing: TRACES_EXPORTER is none, otlp (OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT) or file (json spans appended to TRACES_FILE)
+	TracesExporter string `env:"TRACES_EXPORTER" default:"none"`
+	OtlpEndpoint   string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OtlpHeaders    string `env:"OTEL_EXPORTER_OTLP_HEADERS" secret:"true"`
+	TracesFile     string `env:"TRACES_FILE"`
+}
+
+// GetFunctionsBaseUrl returns the url of the functions called by the generated scripts
+func (c *Config) GetFunctionsBaseUrl() string {
+	if c.FunctionsBaseUrl != "" {
+		return c.FunctionsBaseUrl
+	}
+	return fmt.Sprintf("https://%s.azurewebsites.net/api/", c.FunctionAppName)
+}
+
+// ValidationError lists all the configuration problems found at load
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(e.Problems, "\n  "))
+}
+
+// Load reads the configuration from the environment and validates it.
+// All the problems are returned at once as a *ValidationError.
+func Load() (*Config, error) {
+	return loadAndValidate(os.LookupEnv)
+}
+
+// LoadLocal loads the configuration of the local mode: the settings which are not set in the environment
+// get local defaults, and the generated scripts call the functions on baseUrl
+func LoadLocal(baseUrl string) (*Config, error) {
+	return loadAndValidate(func(name string) (string, bool) {
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			return value, true
+		}
+		if name == "FUNCTIONS_BASE_URL" {
+			return baseUrl, true
+		}
+		value, ok := localDefaults[name]
+		return value, ok
+	})
+}
+
+func loadAndValidate(lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg, problems := load(lookupEnv)
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return cfg, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+func load(lookupEnv func(string) (string, bool)) (*Config, []string) {
+	cfg := &Config{}
+	var problems []string
+
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := field.Tag.Get("env")
+		value, ok := lookupEnv(name)
+		if !ok || value == "" {
+			if field.Tag.Get("validate") == "required" {
+				problems = append(problems, fmt.Sprintf("%s is required", name))
+				continue
+			}
+			if value, ok = field.Tag.Lookup("default"); !ok {
+				continue
+			}
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	return cfg, problems
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// validate checks the consistency of the parsed settings
+func (c *Config) validate() (problems []string) {
+	nonNegative := map[string]int{
+		"INITIAL_CLUSTER_SIZE":      c.InitialClusterSize,
+		"CLUSTERIZATION_TARGET":     c.ClusterizationTarget,
+		"STRIPE_WIDTH":              c.StripeWidth,
+		"PROTECTION_LEVEL":          c.ProtectionLevel,
+		"HOTSPARE":                  c.Hotspare,
+		"NICS_NUM":                  c.NicsNum,
+		"DISK_SIZE":                 c.DiskSize,
+		"NFS_PROTOCOL_GATEWAYS_NUM": c.NfsProtocolGatewaysNum,
+		"AZURE_RETRY_MAX_ATTEMPTS":  c.AzureRetryMaxAttempts,
+		"AZURE_RETRY_BASE_DELAY_MS": c.AzureRetryBaseDelayMs,
+	}
+	for name, value := range nonNegative {
+		if value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative, got %d", name, value))
+		}
+	}
+	if c.DownBackendsRemovalTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("DOWN_BACKENDS_REMOVAL_TIMEOUT must not be negative, got %s", c.DownBackendsRemovalTimeout))
+	}
+	if c.RollingUpgradeJoinTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf("ROLLING_UPGRADE_JOIN_TIMEOUT must be positive, got %s", c.RollingUpgradeJoinTimeout))
+	}
+	if c.ClusterizationTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("CLUSTERIZATION_TIMEOUT must not be negative, got %s", c.ClusterizationTimeout))
+	}
+	if c.ClusterizationMaxReelections < 0 {
+		problems = append(problems, fmt.Sprintf("CLUSTERIZATION_MAX_REELECTIONS must not be negative, got %d", c.ClusterizationMaxReelections))
+	}
+	if c.SkuMigrationBatchSize <= 0 {
+		problems = append(problems, fmt.Sprintf("SKU_MIGRATION_BATCH_SIZE must be positive, got %d", c.SkuMigrationBatchSize))
+	}
+	if c.SkuMigrationEnabled && c.SkuMigrationBatchSize > c.ProtectionLevel-1 {
+		problems = append(problems, fmt.Sprintf("SKU_MIGRATION_BATCH_SIZE (%d) must be at most PROTECTION_LEVEL - 1 (%d)", c.SkuMigrationBatchSize, c.ProtectionLevel-1))
+	}
+	if c.VmTokenTtl <= 0 {
+		problems = append(problems, fmt.Sprintf("VM_TOKEN_TTL must be positive, got %s", c.VmTokenTtl))
+	}
+	if c.VmBootstrapTokenTtl <= 0 {
+		problems = append(problems, fmt.Sprintf("VM_BOOTSTRAP_TOKEN_TTL must be positive, got %s", c.VmBootstrapTokenTtl))
+	}
+	if c.ClusterizationTarget > c.InitialClusterSize {
+		problems = append(problems, fmt.Sprintf("CLUSTERIZATION_TARGET (%d) is greater than INITIAL_CLUSTER_SIZE (%d)", c.ClusterizationTarget, c.InitialClusterSize))
+	}
+	if c.VmssConfig != "" && !json.Valid([]byte(c.VmssConfig)) {
+		problems = append(problems, "VMSS_CONFIG is not valid json")
+	}
+	if c.SetObs && (c.ObsName == "" || c.ObsContainerName == "") {
+		problems = append(problems, "OBS_NAME and OBS_CONTAINER_NAME are required when SET_OBS is true")
+	}
+	if c.NfsVmssName != "" && (c.NfsStateContainerName == "" || c.NfsStateBlobName == "") {
+		problems = append(problems, "NFS_STATE_CONTAINER_NAME and NFS_STATE_BLOB_NAME are required when NFS_VMSS_NAME is set")
+	}
+	switch c.TracesExporter {
+	case "none":
+	case "otlp":
+		if c.OtlpEndpoint == "" {
+			problems = append(problems, "OTEL_EXPORTER_OTLP_ENDPOINT is required when TRACES_EXPORTER is otlp")
+		}
+	case "file":
+		if c.TracesFile == "" {
+			problems = append(problems, "TRACES_FILE is required when TRACES_EXPORTER is file")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("TRACES_EXPORTER must be none, otlp or file, got %q", c.TracesExporter))
+	}
+	// map iteration order is random
+	sort.Strings(problems)
+	return
+}
+
+// Redacted returns the settings by environment variable name, with the secrets redacted
+func (c *Config) Redacted() map[string]any {
+	result := make(map[string]any)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if field.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			value = redacted
+		}
+		result[field.Tag.Get("env")] = value
+	}
+	return result
+}
+
+type configCtxKey struct{}
+
+func ContextWithConfig(ctx context.Context, cfg *Config) context.Context {
+	return context.WithValue(ctx, configCtxKey{}, cfg)
+}
+
+// FromCtx returns the config injected into the context (see Middleware). It panics without one, since
+// the config is loaded and validated once at startup and never read from the environment afterwards.
+func FromCtx(ctx context.Context) *Config {
+	cfg, ok := ctx.Value(configCtxKey{}).(*Config)
+	if !ok || cfg == nil {
+		panic("config: no config in the context, the function must be served through config.Middleware")
+	}
+	return cfg
+}
+
+// Middleware injects the config into the request context
+func Middleware(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ContextWithConfig(r.Context(), cfg)
+		next(w, r.WithContext(ctx))
+	}
+}
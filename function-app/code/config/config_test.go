@@ -0,0 +1,120 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func validEnv() map[string]string {
+	return map[string]string{
+		"SUBSCRIPTION_ID":               "sub",
+		"RESOURCE_GROUP_NAME":           "rg",
+		"PREFIX":                        "weka",
+		"CLUSTER_NAME":                  "poc",
+		"STATE_STORAGE_NAME":            "storage",
+		"STATE_CONTAINER_NAME":          "container",
+		"STATE_BLOB_NAME":               "state",
+		"INITIAL_CLUSTER_SIZE":          "6",
+		"CLUSTERIZATION_TARGET":         "6",
+		"STRIPE_WIDTH":                  "3",
+		"SET_OBS":                       "false",
+		"OBS_ACCESS_KEY":                "secret-key",
+		"DOWN_BACKENDS_REMOVAL_TIMEOUT": "3h",
+		"VMSS_CONFIG":                   `{"name":"vmss"}`,
+	}
+}
+
+func loadEnv(t *testing.T, env map[string]string) (*Config, error) {
+	t.Helper()
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	return Load()
+}
+
+func TestLoad(t *testing.T) {
+	cfg, err := loadEnv(t, validEnv())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StripeWidth != 3 || cfg.InitialClusterSize != 6 || cfg.DownBackendsRemovalTimeout != 3*time.Hour {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if cfg.ReportsTotalLimit != 1000 {
+		t.Fatalf("expected the default reports total limit, got %d", cfg.ReportsTotalLimit)
+	}
+
+	redacted := cfg.Redacted()
+	if redacted["OBS_ACCESS_KEY"] != "<redacted>" || redacted["CLUSTER_NAME"] != "poc" || redacted["DOWN_BACKENDS_REMOVAL_TIMEOUT"] != "3h0m0s" {
+		t.Fatalf("unexpected redacted config %v", redacted)
+	}
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+	env := validEnv()
+	env["CLUSTER_NAME"] = ""
+	env["STRIPE_WIDTH"] = "three"
+	env["DOWN_BACKENDS_REMOVAL_TIMEOUT"] = "3 hours"
+	env["SET_OBS"] = "true"
+
+	_, err := loadEnv(t, env)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	for _, name := range []string{"CLUSTER_NAME", "STRIPE_WIDTH", "DOWN_BACKENDS_REMOVAL_TIMEOUT", "OBS_NAME"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s problem is not reported: %v", name, err)
+		}
+	}
+	if len(validationErr.Problems) != 4 {
+		t.Errorf("expected 4 problems, got %v", validationErr.Problems)
+	}
+}
+
+func TestLoadSkuMigrationBatchSize(t *testing.T) {
+	env := validEnv()
+	env["SKU_MIGRATION_ENABLED"] = "true"
+	env["PROTECTION_LEVEL"] = "2"
+	if _, err := loadEnv(t, env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	env["SKU_MIGRATION_BATCH_SIZE"] = "2"
+	_, err := loadEnv(t, env)
+	if err == nil || !strings.Contains(err.Error(), "SKU_MIGRATION_BATCH_SIZE (2) must be at most PROTECTION_LEVEL - 1 (1)") {
+		t.Fatalf("expected the batch size to be rejected, got %v", err)
+	}
+}
+
+func TestLoadLocal(t *testing.T) {
+	t.Setenv("CLUSTER_NAME", "dev")
+	cfg, err := LoadLocal("http://localhost:8080/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ClusterName != "dev" || cfg.InitialClusterSize != 6 {
+		t.Fatalf("environment should override the local defaults, got %+v", cfg)
+	}
+	if cfg.GetFunctionsBaseUrl() != "http://localhost:8080/" {
+		t.Fatalf("unexpected functions base url %s", cfg.GetFunctionsBaseUrl())
+	}
+}
+
+func TestFromCtx(t *testing.T) {
+	cfg := &Config{ClusterName: "cluster"}
+	if FromCtx(ContextWithConfig(context.TODO(), cfg)) != cfg {
+		t.Fatal("expected the injected config")
+	}
+
+	t.Setenv("CLUSTER_NAME", "cluster")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic without an injected config")
+		}
+	}()
+	FromCtx(context.TODO())
+}
@@ -0,0 +1,30 @@
+package config
+
+// localDefaults simulate a small backends cluster without protocol gateways
+var localDefaults = map[string]string{
+	"SUBSCRIPTION_ID":               "00000000-0000-0000-0000-000000000000",
+	"RESOURCE_GROUP_NAME":           "local-rg",
+	"LOCATION":                      "local",
+	"PREFIX":                        "local",
+	"CLUSTER_NAME":                  "poc",
+	"FUNCTION_APP_NAME":             "local",
+	"KEY_VAULT_URI":                 "https://local.vault.azure.net/",
+	"STATE_STORAGE_NAME":            "local",
+	"STATE_CONTAINER_NAME":          "local-state",
+	"STATE_BLOB_NAME":               "state",
+	"INITIAL_CLUSTER_SIZE":          "6",
+	"CLUSTERIZATION_TARGET":         "6",
+	"STRIPE_WIDTH":                  "3",
+	"PROTECTION_LEVEL":              "2",
+	"HOTSPARE":                      "1",
+	"INSTALL_URL":                   "https://get.weka.io/dist/v1/install/local",
+	"COMPUTE_MEMORY":                "8GB",
+	"COMPUTE_CONTAINER_CORES_NUM":   "1",
+	"DRIVE_CONTAINER_CORES_NUM":     "1",
+	"NICS_NUM":                      "2",
+	"NVMES_NUM":                     "1",
+	"DISK_SIZE":                     "48",
+	"SUBNET":                        "10.0.0.0/24",
+	"TIERING_SSD_PERCENT":           "20",
+	"DOWN_BACKENDS_REMOVAL_TIMEOUT": "3h",
+}
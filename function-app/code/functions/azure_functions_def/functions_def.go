@@ -2,6 +2,7 @@ package azure_functions_def
 
 import (
 	"fmt"
+	"weka-deployment/common"
 
 	"github.com/weka/go-cloud-lib/functions_def"
 )
@@ -9,19 +10,54 @@ import (
 type AzureFuncDef struct {
 	baseFunctionUrl string
 	functionKey     string
+	// vmToken is sent instead of the function key when set
+	vmToken string
+	// vmTokenFile is read by the script when calling a function, for the long-running scripts getting their token
+	// after they are generated
+	vmTokenFile string
+	// traceparent joins the function calls of the script to the trace of the function which generated it
+	traceparent string
 }
 
-func NewFuncDef(baseFunctionUrl, functionKey string) functions_def.FunctionDef {
+// NewVmFuncDef creates the function definitions of the scripts run by the VMs, the functions are called with
+// the VM token rather than with the function key
+func NewVmFuncDef(baseFunctionUrl, vmToken, traceparent string) functions_def.FunctionDef {
 	return &AzureFuncDef{
 		baseFunctionUrl: baseFunctionUrl,
-		functionKey:     functionKey,
+		vmToken:         vmToken,
+		traceparent:     traceparent,
 	}
 }
 
+// NewVmTokenFileFuncDef creates the function definitions of the scripts run by the VMs, the functions are called
+// with the VM token read from tokenFile on each call
+func NewVmTokenFileFuncDef(baseFunctionUrl, tokenFile string) functions_def.FunctionDef {
+	return &AzureFuncDef{
+		baseFunctionUrl: baseFunctionUrl,
+		vmTokenFile:     tokenFile,
+	}
+}
+
+// curlArgs returns the url and the headers of the curl calling the function
+func (d *AzureFuncDef) curlArgs(name functions_def.FunctionName) string {
+	args := d.baseFunctionUrl + string(name)
+	if d.vmToken != "" {
+		args += fmt.Sprintf(" -H '%s:%s'", common.VmTokenHeader, d.vmToken)
+	} else if d.vmTokenFile != "" {
+		args += fmt.Sprintf(" -H \"%s:$(cat %s)\"", common.VmTokenHeader, d.vmTokenFile)
+	} else {
+		args += "?code=" + d.functionKey
+	}
+	args += " -H 'Content-Type:application/json'"
+	if d.traceparent != "" {
+		args += fmt.Sprintf(" -H 'traceparent:%s'", d.traceparent)
+	}
+	return args
+}
+
 // each function takes json payload as an argument
 // e.g. "{\"hostname\": \"$HOSTNAME\", \"type\": \"$message_type\", \"message\": \"$message\"}"
 func (d *AzureFuncDef) GetFunctionCmdDefinition(name functions_def.FunctionName) string {
-	functionUrl := d.baseFunctionUrl + string(name)
 	var funcDef string
 	if name == functions_def.Protect {
 		funcDefTemplate := `
@@ -31,25 +67,24 @@ func (d *AzureFuncDef) GetFunctionCmdDefinition(name functions_def.FunctionName)
 		`
 		funcDef = fmt.Sprintf(funcDefTemplate, name, name)
 	} else if name == functions_def.JoinNfsFinalization {
-		functionUrl := d.baseFunctionUrl + string(functions_def.JoinFinalization)
 		// edit json_data to add the missing "protocol":"nfs" field
 		funcDefTemplate := `
 		function %s {
 			local json_data=$1
 			json_data=$(echo $json_data | jq -c '.protocol="nfs"')
 
-			curl --retry 10 %s?code=%s -H 'Content-Type:application/json' -d "$json_data"
+			curl --retry 10 %s -d "$json_data"
 		}
 		`
-		funcDef = fmt.Sprintf(funcDefTemplate, name, functionUrl, d.functionKey)
+		funcDef = fmt.Sprintf(funcDefTemplate, name, d.curlArgs(functions_def.JoinFinalization))
 	} else {
 		funcDefTemplate := `
 		function %s {
 			local json_data=$1
-			curl --retry 10 %s?code=%s -H 'Content-Type:application/json' -d "$json_data"
+			curl --retry 10 %s -d "$json_data"
 		}
 		`
-		funcDef = fmt.Sprintf(funcDefTemplate, name, functionUrl, d.functionKey)
+		funcDef = fmt.Sprintf(funcDefTemplate, name, d.curlArgs(name))
 	}
 
 	return funcDef
@@ -2,11 +2,8 @@ package clusterize
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 
 	"github.com/lithammer/dedent"
@@ -19,6 +16,7 @@ import (
 	"github.com/weka/go-cloud-lib/utils"
 
 	"weka-deployment/common"
+	"weka-deployment/config"
 	"weka-deployment/functions/azure_functions_def"
 )
 
@@ -119,7 +117,12 @@ func PrepareWekaObs(ctx context.Context, p *ClusterizationParams) (err error) {
 	return
 }
 
-func HandleLastClusterVm(ctx context.Context, state protocol.ClusterState, p ClusterizationParams, funcDef functions_def.FunctionDef) (clusterizeScript string, err error) {
+func keyVaultValueExists(ctx context.Context, get func(ctx context.Context, keyVaultUri string) (string, error), keyVaultUri string) bool {
+	value, err := get(ctx, keyVaultUri)
+	return err == nil && value != ""
+}
+
+func HandleLastClusterVm(ctx context.Context, store common.StateStore, state protocol.ClusterState, p ClusterizationParams, funcDef functions_def.FunctionDef) (clusterizeScript string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msg("This is the last instance in the cluster, creating obs and clusterization script")
 
@@ -129,26 +132,38 @@ func HandleLastClusterVm(ctx context.Context, state protocol.ClusterState, p Clu
 		err = PrepareWekaObs(ctx, &p)
 		if err != nil {
 			logger.Error().Err(err).Send()
-			common.ReportMsg(ctx, p.Vm.Name, p.StateParams, "error", err.Error())
+			common.ReportMsg(ctx, store, p.Vm.Name, p.StateParams, "error", err.Error())
 			p.Cluster.SetObs = false
 		}
 	}
 
-	logger.Info().Msg("setting weka admin password in secrets manager")
-	adminPassword := utils.GeneratePassword(16, 1, 1, 1)
-	err = common.SetWekaAdminPassword(ctx, p.KeyVaultUri, adminPassword)
+	// a clusterization instance replaced by the scale up watchdog may have set the passwords on the cluster before
+	// it stalled, they are kept
+	watch, err := common.GetClusterizationWatch(ctx, store, p.StateParams)
 	if err != nil {
-		logger.Error().Err(err).Send()
-		return
+		logger.Error().Err(err).Msg("cannot read clusterization watch")
 	}
+	reelected := len(watch.Reelections) > 0
 
-	logger.Info().Msg("setting weka deployment password in key vault")
-	wekaServicePassword := utils.GeneratePassword(16, 1, 1, 1)
-	err = common.SetWekaDeploymentPassword(ctx, p.KeyVaultUri, wekaServicePassword)
-	if err != nil {
-		err = fmt.Errorf("failed to set weka service password: %w", err)
-		logger.Error().Err(err).Send()
-		return
+	if !reelected || !keyVaultValueExists(ctx, common.GetWekaAdminPassword, p.KeyVaultUri) {
+		logger.Info().Msg("setting weka admin password in secrets manager")
+		adminPassword := utils.GeneratePassword(16, 1, 1, 1)
+		err = common.SetWekaAdminPassword(ctx, p.KeyVaultUri, adminPassword)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return
+		}
+	}
+
+	if !reelected || !keyVaultValueExists(ctx, common.GetWekaDeploymentPassword, p.KeyVaultUri) {
+		logger.Info().Msg("setting weka deployment password in key vault")
+		wekaServicePassword := utils.GeneratePassword(16, 1, 1, 1)
+		err = common.SetWekaDeploymentPassword(ctx, p.KeyVaultUri, wekaServicePassword)
+		if err != nil {
+			err = fmt.Errorf("failed to set weka service password: %w", err)
+			logger.Error().Err(err).Send()
+			return
+		}
 	}
 
 	vmssParams := &common.ScaleSetParams{
@@ -193,23 +208,28 @@ func HandleLastClusterVm(ctx context.Context, state protocol.ClusterState, p Clu
 	return
 }
 
-func Clusterize(ctx context.Context, p ClusterizationParams) (clusterizeScript string) {
-	functionAppKey, err := common.GetKeyVaultValue(ctx, p.KeyVaultUri, "function-app-default-key")
+func Clusterize(ctx context.Context, store common.StateStore, p ClusterizationParams) (clusterizeScript string) {
+	cfg := config.FromCtx(ctx)
+	vmScaleSetName := common.GetVmScaleSetName(p.Prefix, p.Cluster.ClusterName)
+	if p.Vm.Protocol == protocol.NFS {
+		vmScaleSetName = cfg.NfsVmssName
+	}
+	// the clusterize script calls the functions with a token issued to the VM
+	vmToken, err := common.IssueVmToken(ctx, p.KeyVaultUri, common.NewInstanceVmToken(vmScaleSetName, p.Vm.Name, cfg.VmTokenTtl))
 	if err != nil {
 		clusterizeScript = GetErrorScript(err)
 		return
 	}
 
-	baseFunctionUrl := fmt.Sprintf("https://%s.azurewebsites.net/api/", p.FunctionAppName)
-	funcDef := azure_functions_def.NewFuncDef(baseFunctionUrl, functionAppKey)
+	funcDef := azure_functions_def.NewVmFuncDef(cfg.GetFunctionsBaseUrl(), vmToken, common.TraceparentFromCtx(ctx))
 	reportFunction := funcDef.GetFunctionCmdDefinition(functions_def.Report)
 
 	if p.Vm.Protocol == protocol.NFS {
-		clusterizeScript, err = doNFSClusterize(ctx, p, funcDef)
+		clusterizeScript, err = doNFSClusterize(ctx, store, p, funcDef)
 	} else if p.Vm.Protocol == protocol.SMB || p.Vm.Protocol == protocol.SMBW || p.Vm.Protocol == protocol.S3 {
 		clusterizeScript = "echo 'SMB / S3 clusterization is not supported'"
 	} else {
-		clusterizeScript, err = doClusterize(ctx, p, funcDef)
+		clusterizeScript, err = doClusterize(ctx, store, p, funcDef)
 	}
 
 	if err != nil {
@@ -224,16 +244,17 @@ func Clusterize(ctx context.Context, p ClusterizationParams) (clusterizeScript s
 	return
 }
 
-func doNFSClusterize(ctx context.Context, p ClusterizationParams, funcDef functions_def.FunctionDef) (clusterizeScript string, err error) {
-	nfsInterfaceGroupName := os.Getenv("NFS_INTERFACE_GROUP_NAME")
-	nfsProtocolgwsNum, _ := strconv.Atoi(os.Getenv("NFS_PROTOCOL_GATEWAYS_NUM"))
-	nfsSecondaryIpsNum, _ := strconv.Atoi(os.Getenv("NFS_SECONDARY_IPS_NUM"))
-	nfsVmssName := os.Getenv("NFS_VMSS_NAME")
-	backendLbIp := os.Getenv("BACKEND_LB_IP")
+func doNFSClusterize(ctx context.Context, store common.StateStore, p ClusterizationParams, funcDef functions_def.FunctionDef) (clusterizeScript string, err error) {
+	cfg := config.FromCtx(ctx)
+	nfsInterfaceGroupName := cfg.NfsInterfaceGroupName
+	nfsProtocolgwsNum := cfg.NfsProtocolGatewaysNum
+	nfsSecondaryIpsNum := cfg.NfsSecondaryIpsNum
+	nfsVmssName := cfg.NfsVmssName
+	backendLbIp := cfg.BackendLbIp
 
 	logger := logging.LoggerFromCtx(ctx)
 
-	state, err := common.AddInstanceToState(ctx, p.SubscriptionId, p.ResourceGroupName, p.NFSStateParams, p.Vm)
+	state, err := common.AddInstanceToState(ctx, store, p.SubscriptionId, p.ResourceGroupName, p.NFSStateParams, p.Vm)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
@@ -292,7 +313,7 @@ func doNFSClusterize(ctx context.Context, p ClusterizationParams, funcDef functi
 	return
 }
 
-func doClusterize(ctx context.Context, p ClusterizationParams, funcDef functions_def.FunctionDef) (clusterizeScript string, err error) {
+func doClusterize(ctx context.Context, store common.StateStore, p ClusterizationParams, funcDef functions_def.FunctionDef) (clusterizeScript string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
 	instanceName := strings.Split(p.Vm.Name, ":")[0]
@@ -314,7 +335,7 @@ func doClusterize(ctx context.Context, p ClusterizationParams, funcDef functions
 	}
 
 	state, err := common.AddInstanceToState(
-		ctx, p.SubscriptionId, p.ResourceGroupName, p.StateParams, p.Vm,
+		ctx, store, p.SubscriptionId, p.ResourceGroupName, p.StateParams, p.Vm,
 	)
 	if err != nil {
 		return
@@ -327,7 +348,16 @@ func doClusterize(ctx context.Context, p ClusterizationParams, funcDef functions
 		logger.Info().Msgf(msg)
 		clusterizeScript = cloudCommon.GetScriptWithReport(msg, reportFunction, p.Vm.Protocol)
 	} else if len(state.Instances) == state.ClusterizationTarget {
-		clusterizeScript, err = HandleLastClusterVm(ctx, state, p, funcDef)
+		// obs, private endpoint and key vault setup may outlive a single lease, the lock is renewed until released
+		lock, err2 := common.LockContainer(ctx, store, p.StateParams)
+		if err2 != nil {
+			err = err2
+			clusterizeScript = cloudCommon.GetErrorScript(err, reportFunction, p.Vm.Protocol)
+			return
+		}
+		defer common.UnlockContainer(ctx, lock)
+
+		clusterizeScript, err = HandleLastClusterVm(common.ContextWithContainerLock(ctx, lock), store, state, p, funcDef)
 		if err != nil {
 			clusterizeScript = cloudCommon.GetErrorScript(err, reportFunction, p.Vm.Protocol)
 		}
@@ -361,48 +391,49 @@ func doClusterize(ctx context.Context, p ClusterizationParams, funcDef functions
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	clusterizationTarget, _ := strconv.Atoi(os.Getenv("CLUSTERIZATION_TARGET"))
-	clusterName := os.Getenv("CLUSTER_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	setObs, _ := strconv.ParseBool(os.Getenv("SET_OBS"))
-	createConfigFs, _ := strconv.ParseBool(os.Getenv("CREATE_CONFIG_FS"))
-	obsName := os.Getenv("OBS_NAME")
-	obsContainerName := os.Getenv("OBS_CONTAINER_NAME")
-	obsAccessKey := os.Getenv("OBS_ACCESS_KEY")
-	obsNetworkAccess := os.Getenv("OBS_NETWORK_ACCESS")
-	obsAllowedSubnetsStr := os.Getenv("OBS_ALLOWED_SUBNETS")
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	clusterizationTarget := cfg.ClusterizationTarget
+	clusterName := cfg.ClusterName
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	setObs := cfg.SetObs
+	createConfigFs := cfg.CreateConfigFs
+	obsName := cfg.ObsName
+	obsContainerName := cfg.ObsContainerName
+	obsAccessKey := cfg.ObsAccessKey
+	obsNetworkAccess := cfg.ObsNetworkAccess
+	obsAllowedSubnetsStr := cfg.ObsAllowedSubnets
 	obsAllowedSubnets := []string{}
-	obsAllowedPublicIpsStr := os.Getenv("OBS_ALLOWED_PUBLIC_IPS")
+	obsAllowedPublicIpsStr := cfg.ObsAllowedPublicIps
 	obsAllowedPublicIps := []string{}
-	location := os.Getenv("LOCATION")
-	tieringSsdPercent := os.Getenv("TIERING_SSD_PERCENT")
-	tieringTargetSsdRetention, _ := strconv.Atoi(os.Getenv("TIERING_TARGET_SSD_RETENTION"))
-	tieringStartDemote, _ := strconv.Atoi(os.Getenv("TIERING_START_DEMOTE"))
-	prefix := os.Getenv("PREFIX")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
-	subnetId := os.Getenv("SUBNET_ID")
-	blobPrivateDnsZoneId := os.Getenv("BLOB_PRIVATE_DNS_ZONE_ID")
-	createblobPrivateEndpoint, _ := strconv.ParseBool(os.Getenv("CREATE_BLOB_PRIVATE_ENDPOINT"))
+	location := cfg.Location
+	tieringSsdPercent := cfg.TieringSsdPercent
+	tieringTargetSsdRetention := cfg.TieringTargetSsdRetention
+	tieringStartDemote := cfg.TieringStartDemote
+	prefix := cfg.Prefix
+	keyVaultUri := cfg.KeyVaultUri
+	subnetId := cfg.SubnetId
+	blobPrivateDnsZoneId := cfg.BlobPrivateDnsZoneId
+	createblobPrivateEndpoint := cfg.CreateBlobPrivateEndpoint
 	// data protection-related vars
-	stripeWidth, _ := strconv.Atoi(os.Getenv("STRIPE_WIDTH"))
-	protectionLevel, _ := strconv.Atoi(os.Getenv("PROTECTION_LEVEL"))
-	hotspare, _ := strconv.Atoi(os.Getenv("HOTSPARE"))
-	installDpdk, _ := strconv.ParseBool(os.Getenv("INSTALL_DPDK"))
-	addFrontendNum, _ := strconv.Atoi(os.Getenv("FRONTEND_CONTAINER_CORES_NUM"))
-	functionAppName := os.Getenv("FUNCTION_APP_NAME")
-	proxyUrl := os.Getenv("PROXY_URL")
-	wekaHomeUrl := os.Getenv("WEKA_HOME_URL")
-	preStartIoScript := os.Getenv("PRE_START_IO_SCRIPT")
-	postClusterCreationScript := os.Getenv("POST_CLUSTER_CREATION_SCRIPT")
+	stripeWidth := cfg.StripeWidth
+	protectionLevel := cfg.ProtectionLevel
+	hotspare := cfg.Hotspare
+	installDpdk := cfg.InstallDpdk
+	addFrontendNum := cfg.FrontendContainerNum
+	functionAppName := cfg.FunctionAppName
+	proxyUrl := cfg.ProxyUrl
+	wekaHomeUrl := cfg.WekaHomeUrl
+	preStartIoScript := cfg.PreStartIoScript
+	postClusterCreationScript := cfg.PostClusterCreationScript
 	// NFS state
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-	setDefaultFs, _ := strconv.ParseBool(os.Getenv("SET_DEFAULT_FS"))
-	postClusterSetupScript := os.Getenv("POST_CLUSTER_SETUP_SCRIPT")
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	setDefaultFs := cfg.SetDefaultFs
+	postClusterSetupScript := cfg.PostClusterSetupScript
 
 	addFrontend := false
 	if addFrontendNum > 0 {
@@ -417,29 +448,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resData := make(map[string]interface{})
-	var invokeRequest common.InvokeRequest
-
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	d := json.NewDecoder(r.Body)
-	if err := d.Decode(&invokeRequest); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	if err := json.Unmarshal(invokeRequest.Data["req"], &reqData); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
+	vm, err := common.DecodeBody[protocol.Vm](r)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
-
-	var vm protocol.Vm
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &vm); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
+	if err := common.AuthorizeVm(ctx, vm.Name); err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteAuthErrorResponse(w, err)
 		return
 	}
 
@@ -495,7 +516,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		resData["body"] = msg
 		status = http.StatusBadRequest
 	} else {
-		clusterizeScript := Clusterize(ctx, params)
+		clusterizeScript := Clusterize(ctx, store, params)
 		resData["body"] = clusterizeScript
 	}
 	common.WriteResponse(w, resData, &status)
@@ -1,12 +1,11 @@
 package clusterize_finalization
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"weka-deployment/common"
+	"weka-deployment/config"
 
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
@@ -17,42 +16,23 @@ type Protocol struct {
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-
-	var invokeRequest common.InvokeRequest
+	cfg := config.FromCtx(r.Context())
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
 
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
-	if err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	vmProtocol, err := common.DecodeBody[Protocol](r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
 		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var vmProtocol Protocol
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &vmProtocol); err != nil {
-		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
 
@@ -65,9 +45,10 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	if vmProtocol.Protocol == protocol.NFS {
 		stateParams.ContainerName = nfsStateContainerName
 		stateParams.BlobName = nfsStateBlobName
+		ctx = common.ContextWithOperationsState(ctx, stateParams)
 
 		// Add tag to all clusterized NFS instances
-		state, err := common.ReadState(ctx, stateParams)
+		state, err := common.ReadState(ctx, store, stateParams)
 		if err != nil {
 			logger.Error().Err(err).Msg("cannot read state")
 			common.WriteErrorResponse(w, err)
@@ -85,14 +66,14 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			err := common.UpdateTagsOnVm(ctx, subscriptionId, resourceGroupName, name, tags)
 			if err != nil {
 				msg := fmt.Sprintf("cannot update tags on VM %v", err)
-				common.ReportMsg(ctx, instanceName, stateParams, "error", msg)
+				common.ReportMsg(ctx, store, instanceName, stateParams, "error", msg)
 				logger.Error().Err(err).Str("instance", instanceName).Msg("cannot update tags")
 				continue
 			}
 		}
 	}
 
-	state, err := common.UpdateClusterized(ctx, subscriptionId, resourceGroupName, stateParams)
+	state, err := common.UpdateClusterized(ctx, store, subscriptionId, resourceGroupName, stateParams)
 	if err != nil {
 		common.WriteErrorResponse(w, err)
 		return
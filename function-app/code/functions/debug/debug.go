@@ -4,9 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"strconv"
 	"weka-deployment/common"
+	"weka-deployment/config"
 	"weka-deployment/functions/azure_functions_def"
 	clusterizeFunc "weka-deployment/functions/clusterize"
 
@@ -16,70 +15,45 @@ import (
 	"github.com/weka/go-cloud-lib/logging"
 )
 
+type DebugRequest struct {
+	Function *string `json:"function" validate:"required"`
+	IpIndex  *string `json:"ip_index"`
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	setObs, _ := strconv.ParseBool(os.Getenv("SET_OBS"))
-	obsName := os.Getenv("OBS_NAME")
-	obsContainerName := os.Getenv("OBS_CONTAINER_NAME")
-	obsAccessKey := os.Getenv("OBS_ACCESS_KEY")
-	location := os.Getenv("LOCATION")
-	tieringSsdPercent := os.Getenv("TIERING_SSD_PERCENT")
-	prefix := os.Getenv("PREFIX")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	clusterName := cfg.ClusterName
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	setObs := cfg.SetObs
+	obsName := cfg.ObsName
+	obsContainerName := cfg.ObsContainerName
+	obsAccessKey := cfg.ObsAccessKey
+	location := cfg.Location
+	tieringSsdPercent := cfg.TieringSsdPercent
+	prefix := cfg.Prefix
+	keyVaultUri := cfg.KeyVaultUri
 	// data protection-related vars
-	stripeWidth, _ := strconv.Atoi(os.Getenv("STRIPE_WIDTH"))
-	protectionLevel, _ := strconv.Atoi(os.Getenv("PROTECTION_LEVEL"))
-	hotspare, _ := strconv.Atoi(os.Getenv("HOTSPARE"))
-
-	vmScaleSetName := common.GetVmScaleSetName(prefix, clusterName)
+	stripeWidth := cfg.StripeWidth
+	protectionLevel := cfg.ProtectionLevel
+	hotspare := cfg.Hotspare
 
 	outputs := make(map[string]interface{})
 	resData := make(map[string]interface{})
 
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	var invokeRequest common.InvokeRequest
-
-	var function struct {
-		Function *string `json:"function"`
-		IpIndex  *string `json:"ip_index"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err := json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	function, err := common.DecodeBody[DebugRequest](r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
 		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &function); err != nil {
-		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
-	if function.Function == nil {
-		err := fmt.Errorf("wrong request format. 'function' is required")
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
 	logger.Info().Msgf("The requested function is %s", *function.Function)
 	var result interface{}
 
@@ -89,6 +63,12 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		BlobName:      stateBlobName,
 	}
 
+	vmScaleSetName, err := common.GetBackendsScaleSetName(ctx, store, stateParams, prefix, clusterName)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
 	vmssParams := &common.ScaleSetParams{
 		SubscriptionId:    subscriptionId,
 		ResourceGroupName: resourceGroupName,
@@ -96,7 +76,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if *function.Function == "clusterize" {
-		state, err := common.ReadState(ctx, stateParams)
+		state, err := common.ReadState(ctx, store, stateParams)
 		if err != nil {
 			result = clusterizeFunc.GetErrorScript(err)
 		} else {
@@ -123,7 +103,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 					TieringSsdPercent: tieringSsdPercent,
 				},
 			}
-			result, err = clusterizeFunc.HandleLastClusterVm(ctx, state, params, &azure_functions_def.AzureFuncDef{})
+			result, err = clusterizeFunc.HandleLastClusterVm(ctx, store, state, params, &azure_functions_def.AzureFuncDef{})
 			if err != nil {
 				result = clusterizeFunc.GetErrorScript(err)
 			}
@@ -156,6 +136,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			result = ips
 		}
+	} else if *function.Function == "lock" {
+		lockInfo, err1 := common.GetContainerLockInfo(ctx, store, stateParams)
+		if err1 != nil {
+			result = err1.Error()
+		} else {
+			result = lockInfo
+		}
+	} else if *function.Function == "state_stats" {
+		result = common.GetStateUpdateStats()
+	} else if *function.Function == "client_cache" {
+		result = common.GetClientCacheStats()
+	} else if *function.Function == "config" {
+		result = cfg.Redacted()
 	} else {
 		result = "unsupported function"
 	}
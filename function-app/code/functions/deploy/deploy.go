@@ -2,14 +2,16 @@ package deploy
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"os"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"weka-deployment/common"
+	"weka-deployment/config"
 	"weka-deployment/functions/azure_functions_def"
 
 	"github.com/weka/go-cloud-lib/deploy"
@@ -72,16 +74,11 @@ func getWekaIoToken(ctx context.Context, keyVaultUri string) (token string, err
 	return
 }
 
-func getFunctionKey(ctx context.Context, keyVaultUri string) (functionAppKey string, err error) {
-	functionAppKey, err = common.GetKeyVaultValue(ctx, keyVaultUri, "function-app-default-key")
-	return
-}
-
-func GetNfsDeployScript(ctx context.Context, funcDef functions_def.FunctionDef, p AzureDeploymentParams) (bashScript string, err error) {
+func GetNfsDeployScript(ctx context.Context, store common.StateStore, funcDef functions_def.FunctionDef, p AzureDeploymentParams) (bashScript string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msg("Getting NFS deploy script")
 
-	state, err := common.ReadState(ctx, p.NFSStateParams)
+	state, err := common.ReadState(ctx, store, p.NFSStateParams)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		return
@@ -173,10 +170,10 @@ func GetProtocolDeployScript(ctx context.Context, funcDef functions_def.Function
 	return
 }
 
-func GetDeployScript(ctx context.Context, funcDef functions_def.FunctionDef, p AzureDeploymentParams) (bashScript string, err error) {
+func GetDeployScript(ctx context.Context, store common.StateStore, funcDef functions_def.FunctionDef, p AzureDeploymentParams) (bashScript string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 
-	state, err := common.ReadState(ctx, p.StateParams)
+	state, err := common.ReadState(ctx, store, p.StateParams)
 	if err != nil {
 		return
 	}
@@ -219,14 +216,8 @@ func GetDeployScript(ctx context.Context, funcDef functions_def.FunctionDef, p A
 		}
 		bashScript = deployScriptGenerator.GetDeployScript()
 	} else {
-		vmScaleSetName := common.GetVmScaleSetName(p.Prefix, p.ClusterName)
-		vmssParams := &common.ScaleSetParams{
-			SubscriptionId:    p.SubscriptionId,
-			ResourceGroupName: p.ResourceGroupName,
-			ScaleSetName:      vmScaleSetName,
-			Flexible:          false,
-		}
-		vmsPrivateIps, err := common.GetVmsPrivateIps(ctx, vmssParams)
+		// during a sku migration the backends of both scale sets are cluster members
+		scaleSets, err := common.GetBackendsScaleSetNames(ctx, store, p.StateParams, p.Prefix, p.ClusterName)
 		if err != nil {
 			logger.Error().Err(err).Send()
 			return "", err
@@ -236,14 +227,27 @@ func GetDeployScript(ctx context.Context, funcDef functions_def.FunctionDef, p A
 		vmName := vmNameParts[0]
 
 		var ips []string
-		for ipVmName, ip := range vmsPrivateIps {
-			// exclude ip of the machine itself
-			if ipVmName != vmName {
-				ips = append(ips, ip)
+		for _, vmScaleSetName := range scaleSets {
+			vmssParams := &common.ScaleSetParams{
+				SubscriptionId:    p.SubscriptionId,
+				ResourceGroupName: p.ResourceGroupName,
+				ScaleSetName:      vmScaleSetName,
+				Flexible:          false,
+			}
+			vmsPrivateIps, err := common.GetVmsPrivateIps(ctx, vmssParams)
+			if err != nil {
+				logger.Error().Err(err).Send()
+				return "", err
+			}
+			for ipVmName, ip := range vmsPrivateIps {
+				// exclude ip of the machine itself
+				if ipVmName != vmName {
+					ips = append(ips, ip)
+				}
 			}
 		}
 		if len(ips) == 0 {
-			err = fmt.Errorf("no instances found for scale set %s, can't join", vmScaleSetName)
+			err = fmt.Errorf("no instances found for scale sets %v, can't join", scaleSets)
 			logger.Error().Err(err).Send()
 			return "", err
 		}
@@ -298,73 +302,58 @@ func getGateways(subnet string, nicsNum int) (gateways []string) {
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
-	computeMemory := os.Getenv("COMPUTE_MEMORY")
-	computeContainerNum, _ := strconv.Atoi(os.Getenv("COMPUTE_CONTAINER_CORES_NUM"))
-	frontendContainerNum, _ := strconv.Atoi(os.Getenv("FRONTEND_CONTAINER_CORES_NUM"))
-	driveContainerNum, _ := strconv.Atoi(os.Getenv("DRIVE_CONTAINER_CORES_NUM"))
-	installDpdk, _ := strconv.ParseBool(os.Getenv("INSTALL_DPDK"))
-	nicsNum := os.Getenv("NICS_NUM")
-	nicsNumInt, _ := strconv.Atoi(nicsNum)
-	subnet := os.Getenv("SUBNET")
-	functionAppName := os.Getenv("FUNCTION_APP_NAME")
-	diskSize, _ := strconv.Atoi(os.Getenv("DISK_SIZE"))
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	clusterName := cfg.ClusterName
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	prefix := cfg.Prefix
+	keyVaultUri := cfg.KeyVaultUri
+	computeMemory := cfg.ComputeMemory
+	computeContainerNum := cfg.ComputeContainerNum
+	frontendContainerNum := cfg.FrontendContainerNum
+	driveContainerNum := cfg.DriveContainerNum
+	installDpdk := cfg.InstallDpdk
+	nicsNum := cfg.NicsNum
+	subnet := cfg.Subnet
+	functionAppName := cfg.FunctionAppName
+	diskSize := cfg.DiskSize
 	// nfs params
-	nfsInterfaceGroupName := os.Getenv("NFS_INTERFACE_GROUP_NAME")
-	nfsProtocolgwsNum, _ := strconv.Atoi(os.Getenv("NFS_PROTOCOL_GATEWAYS_NUM"))
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-	nfsSecondaryIpsNum, _ := strconv.Atoi(os.Getenv("NFS_SECONDARY_IPS_NUM"))
-	nfsProtocolGatewayFeCoresNum, _ := strconv.Atoi(os.Getenv("NFS_PROTOCOL_GATEWAY_FE_CORES_NUM"))
-	smbProtocolGatewayFeCoresNum, _ := strconv.Atoi(os.Getenv("SMB_PROTOCOL_GATEWAY_FE_CORES_NUM"))
-	s3ProtocolGatewayFeCoresNum, _ := strconv.Atoi(os.Getenv("S3_PROTOCOL_GATEWAY_FE_CORES_NUM"))
-	nfsVmssName := os.Getenv("NFS_VMSS_NAME")
-	nfsDiskSize, _ := strconv.Atoi(os.Getenv("NFS_DISK_SIZE"))
-	smbDiskSize, _ := strconv.Atoi(os.Getenv("SMB_DISK_SIZE"))
-	s3DiskSize, _ := strconv.Atoi(os.Getenv("S3_DISK_SIZE"))
-	tracesPerFrontend, _ := strconv.Atoi(os.Getenv("TRACES_PER_FRONTEND"))
-	backendLbIp := os.Getenv("BACKEND_LB_IP")
-	nvmesNum, _ := strconv.Atoi(os.Getenv("NVMES_NUM"))
-	cgroupsMode := os.Getenv("CGROUPS_MODE")
-
-	installUrl := os.Getenv("INSTALL_URL")
-	proxyUrl := os.Getenv("PROXY_URL")
-
-	var invokeRequest common.InvokeRequest
+	nfsInterfaceGroupName := cfg.NfsInterfaceGroupName
+	nfsProtocolgwsNum := cfg.NfsProtocolGatewaysNum
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	nfsSecondaryIpsNum := cfg.NfsSecondaryIpsNum
+	nfsProtocolGatewayFeCoresNum := cfg.NfsProtocolGatewayFeCoresNum
+	smbProtocolGatewayFeCoresNum := cfg.SmbProtocolGatewayFeCoresNum
+	s3ProtocolGatewayFeCoresNum := cfg.S3ProtocolGatewayFeCoresNum
+	nfsVmssName := cfg.NfsVmssName
+	nfsDiskSize := cfg.NfsDiskSize
+	smbDiskSize := cfg.SmbDiskSize
+	s3DiskSize := cfg.S3DiskSize
+	tracesPerFrontend := cfg.TracesPerFrontend
+	backendLbIp := cfg.BackendLbIp
+	nvmesNum := cfg.NvmesNum
+	cgroupsMode := cfg.CgroupsMode
+
+	installUrl := cfg.InstallUrl
+	proxyUrl := cfg.ProxyUrl
 
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
+	vm, err := common.DecodeBody[protocol.Vm](r)
 	if err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
 		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
-	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
-
-	var vm protocol.Vm
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &vm); err != nil {
-		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
+	if err := common.AuthorizeVm(ctx, vm.Name); err != nil {
 		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteAuthErrorResponse(w, err)
 		return
 	}
 
@@ -384,9 +373,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		DriveContainerNum:     driveContainerNum,
 		DiskSize:              diskSize,
 		InstallDpdk:           installDpdk,
-		NicsNum:               nicsNum,
+		NicsNum:               strconv.Itoa(nicsNum),
 		FunctionAppName:       functionAppName,
-		Gateways:              getGateways(subnet, nicsNumInt),
+		Gateways:              getGateways(subnet, nicsNum),
 		NFSInterfaceGroupName: nfsInterfaceGroupName,
 		NFSProtocolGWsNum:     nfsProtocolgwsNum,
 		NFSStateParams:        common.BlobObjParams{StorageName: stateStorageName, ContainerName: nfsStateContainerName, BlobName: nfsStateBlobName},
@@ -403,28 +392,115 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		CgroupsMode:           cgroupsMode,
 	}
 
-	// create Function Definer
-	functionKey, err := getFunctionKey(ctx, params.KeyVaultUri)
+	// create Function Definer, the deploy script calls the functions with a token issued to the VM
+	// the SMB and S3 gateways are not part of a scale set of the function app
+	var vmScaleSetName string
+	switch vm.Protocol {
+	case "":
+		scaleSets, err := common.GetBackendsScaleSetNames(ctx, store, params.StateParams, prefix, clusterName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			common.WriteErrorResponse(w, err)
+			return
+		}
+		// during a sku migration the vm may be in the target scale set
+		vmScaleSetName = common.FindScaleSetOfVm(scaleSets, vm.Name)
+		if vmScaleSetName == "" {
+			vmScaleSetName = scaleSets[0]
+		}
+	case protocol.NFS:
+		vmScaleSetName = nfsVmssName
+	}
+	// the bootstrap token is shared by the vms of the scale set, the deploy script is given once to the vms of
+	// the scale set only
+	var bootstrapScaleSetVms []string
+	if token := common.VmTokenFromCtx(ctx); token != nil && token.IsBootstrap() {
+		bootstrapScaleSetVms, err = getBootstrapScaleSetVms(ctx, token, vm.Name)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			common.WriteAuthErrorResponse(w, err)
+			return
+		}
+	}
+
+	vmToken, err := common.IssueVmToken(ctx, keyVaultUri, common.NewInstanceVmToken(vmScaleSetName, vm.Name, cfg.VmTokenTtl))
 	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
 		return
 	}
-	baseFunctionUrl := fmt.Sprintf("https://%s.azurewebsites.net/api/", params.FunctionAppName)
-	funcDef := azure_functions_def.NewFuncDef(baseFunctionUrl, functionKey)
+	baseFunctionUrl := cfg.GetFunctionsBaseUrl()
+	funcDef := azure_functions_def.NewVmFuncDef(baseFunctionUrl, vmToken, common.TraceparentFromCtx(ctx))
 
 	var bashScript string
 	if vm.Protocol == protocol.NFS {
-		bashScript, err = GetNfsDeployScript(ctx, funcDef, params)
+		bashScript, err = GetNfsDeployScript(ctx, store, funcDef, params)
 	} else if vm.Protocol == protocol.SMB || vm.Protocol == protocol.SMBW || vm.Protocol == protocol.S3 {
 		bashScript, err = GetProtocolDeployScript(ctx, funcDef, params, vm.Protocol)
 	} else if vm.Protocol != "" {
 		err = fmt.Errorf("unsupported protocol: %s", vm.Protocol)
 	} else {
-		bashScript, err = GetDeployScript(ctx, funcDef, params)
+		bashScript, err = GetDeployScript(ctx, store, funcDef, params)
 	}
 
+	if err == nil && vm.Protocol == "" {
+		bashScript, err = withMonitorVmToken(ctx, bashScript, vmScaleSetName, vm.Name)
+	}
 	if err != nil {
 		common.WriteErrorResponse(w, err)
 		return
 	}
+
+	if bootstrapScaleSetVms != nil {
+		// marked once the script is generated, so that the vm can retry when the generation fails
+		err = common.MarkVmDeployed(ctx, store, params.StateParams, common.VmTokenFromCtx(ctx).ScaleSetName, vm.Name, bootstrapScaleSetVms)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			if errors.Is(err, common.ErrForbidden) {
+				common.WriteAuthErrorResponse(w, err)
+			} else {
+				common.WriteErrorResponse(w, err)
+			}
+			return
+		}
+	}
 	common.WriteSuccessResponse(w, bashScript)
 }
+
+// getBootstrapScaleSetVms returns the vm names of the scale set of the bootstrap token, it fails with
+// common.ErrForbidden when the vm is not one of them
+func getBootstrapScaleSetVms(ctx context.Context, token *common.VmToken, vmName string) (names []string, err error) {
+	cfg := config.FromCtx(ctx)
+	vms, err := common.GetScaleSetInstances(ctx, &common.ScaleSetParams{
+		SubscriptionId:    cfg.SubscriptionId,
+		ResourceGroupName: cfg.ResourceGroupName,
+		ScaleSetName:      token.ScaleSetName,
+	})
+	if err != nil {
+		return
+	}
+	names = []string{}
+	for _, vm := range vms {
+		names = append(names, vm.Name)
+	}
+	instance, _, _ := strings.Cut(vmName, ":")
+	if !slices.Contains(names, instance) {
+		err = fmt.Errorf("%w: vm %s is not part of scale set %s", common.ErrForbidden, instance, token.ScaleSetName)
+	}
+	return
+}
+
+// withMonitorVmToken makes the deploy script write the token of the maintenance monitor of the vm, which is
+// installed by the vmss custom data once the script has run
+func withMonitorVmToken(ctx context.Context, script, vmScaleSetName, vmName string) (string, error) {
+	monitorToken, err := common.IssueVmToken(ctx, config.FromCtx(ctx).KeyVaultUri, common.NewMonitorVmToken(vmScaleSetName, vmName))
+	if err != nil {
+		return "", err
+	}
+	writeToken := fmt.Sprintf("mkdir -p %s\n(umask 077 && echo '%s' > %s)\n", path.Dir(common.MonitorVmTokenFile), monitorToken, common.MonitorVmTokenFile)
+	if strings.HasPrefix(script, "#!") {
+		shebang, rest, _ := strings.Cut(script, "\n")
+		return shebang + "\n" + writeToken + rest, nil
+	}
+	return writeToken + script, nil
+}
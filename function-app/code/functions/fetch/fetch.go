@@ -2,12 +2,12 @@ package fetch
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"slices"
 	"time"
 	"weka-deployment/common"
+	"weka-deployment/config"
 
 	"github.com/weka/go-cloud-lib/lib/types"
 	"github.com/weka/go-cloud-lib/logging"
@@ -17,32 +17,38 @@ import (
 const defaultDownBackendsRemovalTimeout = 30 * time.Minute
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-	nfsScaleSetName := "" //Disabling Scale down. To return support, need to change to: 'os.Getenv("NFS_VMSS_NAME")'
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
-	downBackendsRemovalTimeout, _ := time.ParseDuration(os.Getenv("DOWN_BACKENDS_REMOVAL_TIMEOUT"))
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	nfsScaleSetName := "" //Disabling Scale down. To return support, need to change to: 'cfg.NfsVmssName'
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	prefix := cfg.Prefix
+	clusterName := cfg.ClusterName
+	keyVaultUri := cfg.KeyVaultUri
+	downBackendsRemovalTimeout := cfg.DownBackendsRemovalTimeout
 
 	if downBackendsRemovalTimeout == 0 {
 		downBackendsRemovalTimeout = defaultDownBackendsRemovalTimeout
 	}
 
-	vmScaleSetName := common.GetVmScaleSetName(prefix, clusterName)
-
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	fetchRequest, err := parseFetchRequest(r)
+	fetchRequest, err := common.DecodeBody[protocol.FetchRequest](r)
 	if err != nil {
 		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+	if fetchRequest.ShowAdminPassword && common.VmTokenFromCtx(ctx) != nil {
+		err = fmt.Errorf("%w: the admin password is not shown to the vms", common.ErrForbidden)
+		logger.Error().Err(err).Send()
+		common.WriteAuthErrorResponse(w, err)
 		return
 	}
 
@@ -52,20 +58,44 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		BlobName:      stateBlobName,
 	}
 
-	vmssParams := &common.ScaleSetParams{
-		SubscriptionId:    subscriptionId,
-		ResourceGroupName: resourceGroupName,
-		ScaleSetName:      vmScaleSetName,
-		Flexible:          false,
-	}
-
-	instances, err := common.GetScaleSetInstancesInfo(ctx, vmssParams)
+	skuMigration, err := common.GetSkuMigration(ctx, store, backendsStateParams)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		common.WriteErrorResponse(w, err)
 		return
 	}
 
+	var (
+		instances []protocol.HgInstance
+		vmNames   []string
+	)
+	for _, vmScaleSetName := range skuMigration.ScaleSets(common.GetVmScaleSetName(prefix, clusterName)) {
+		vmssParams := &common.ScaleSetParams{
+			SubscriptionId:    subscriptionId,
+			ResourceGroupName: resourceGroupName,
+			ScaleSetName:      vmScaleSetName,
+			Flexible:          false,
+		}
+		scaleSetInstances, err := common.GetScaleSetInstancesInfo(ctx, vmssParams)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			common.WriteErrorResponse(w, err)
+			return
+		}
+		instances = append(instances, scaleSetInstances...)
+		for _, instance := range scaleSetInstances {
+			vmNames = append(vmNames, vmScaleSetName+"_"+instance.Id)
+		}
+	}
+
+	// the monitor tokens don't expire, they are valid as long as their vm is part of the cluster scale sets
+	if token := common.VmTokenFromCtx(ctx); token != nil && token.IsMonitor() && !slices.Contains(vmNames, token.Instance) {
+		err = fmt.Errorf("%w: vm %s is not part of the cluster scale sets", common.ErrForbidden, token.Instance)
+		logger.Error().Err(err).Send()
+		common.WriteAuthErrorResponse(w, err)
+		return
+	}
+
 	var wekaPassword string
 	var adminPassword string
 	username := common.WekaDeploymentUsername
@@ -98,13 +128,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		username = credentials.Username
 	}
 
-	desiredCapacity, err := getCapacity(ctx, backendsStateParams)
+	desiredCapacity, err := getCapacity(ctx, store, backendsStateParams)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		common.WriteErrorResponse(w, err)
 		return
 	}
 
+	if skuMigration.InProgress() {
+		// the sku migration removes the backends of the source scale set itself, the scale down must not
+		// deactivate backends while both scale sets are in the cluster
+		desiredCapacity = max(desiredCapacity, len(instances))
+	}
+
 	response := protocol.HostGroupInfoResponse{
 		Username:                    username,
 		Password:                    wekaPassword,
@@ -131,7 +167,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			Flexible:          true,
 		}
 
-		nfsDesiredCapacity, err := getCapacity(ctx, nfsStateParams)
+		nfsDesiredCapacity, err := getCapacity(ctx, store, nfsStateParams)
 		if err != nil {
 			logger.Error().Err(err).Send()
 			common.WriteErrorResponse(w, err)
@@ -187,39 +223,11 @@ func getBackendIps(instances []protocol.HgInstance) (ips []string) {
 	return
 }
 
-func getCapacity(ctx context.Context, stateParams common.BlobObjParams) (desired int, err error) {
-	state, err := common.ReadState(ctx, stateParams)
+func getCapacity(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams) (desired int, err error) {
+	state, err := common.ReadState(ctx, store, stateParams)
 	if err != nil {
 		return
 	}
 	desired = state.DesiredSize
 	return
 }
-
-func parseFetchRequest(r *http.Request) (fetchRequest protocol.FetchRequest, err error) {
-	var invokeRequest common.InvokeRequest
-
-	if err = json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %w", err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
-	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %w", err)
-		return
-	}
-
-	if reqData["Body"] == nil {
-		return
-	}
-
-	err = json.Unmarshal([]byte(reqData["Body"].(string)), &fetchRequest)
-	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request body: %w", err)
-		return
-	}
-
-	return
-}
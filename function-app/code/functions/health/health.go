@@ -0,0 +1,172 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/config"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// each dependency probe is given up after probeTimeout, so a hanging dependency doesn't hang the readiness check
+const probeTimeout = 10 * time.Second
+
+type DependencyStatus struct {
+	Name      string `json:"name"`
+	Ok        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	// Detail describes a successful probe when there is something to tell, e.g. a resource not created yet
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Ready        bool               `json:"ready"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// probe checks a dependency, detail is reported when the dependency is usable
+type probe struct {
+	name  string
+	check func(ctx context.Context) (detail string, err error)
+}
+
+func stateProbe(name string, store common.StateStore, stateParams common.BlobObjParams) probe {
+	return probe{name, func(ctx context.Context) (string, error) {
+		_, err := common.ReadState(ctx, store, stateParams)
+		if errors.Is(err, common.ErrStateObjectNotFound) {
+			return "state is not created yet", nil
+		}
+		return "", err
+	}}
+}
+
+func secretProbe(name, keyVaultUri, secretName string) probe {
+	return probe{name, func(ctx context.Context) (string, error) {
+		_, err := common.CloudProviderFromCtx(ctx).GetSecret(ctx, keyVaultUri, secretName)
+		return "", err
+	}}
+}
+
+func scaleSetProbe(name, subscriptionId, resourceGroupName, vmScaleSetName string) probe {
+	return probe{name, func(ctx context.Context) (string, error) {
+		return checkScaleSet(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	}}
+}
+
+func checkScaleSet(ctx context.Context, subscriptionId, resourceGroupName, vmScaleSetName string) (string, error) {
+	scaleSet, err := common.GetScaleSetOrNil(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	if err == nil && scaleSet == nil {
+		return "scale set is not created yet", nil
+	}
+	return "", err
+}
+
+// backendsScaleSetProbe checks the active backends scale set, it changes after a sku migration
+func backendsScaleSetProbe(name string, cfg *config.Config, store common.StateStore, stateParams common.BlobObjParams) probe {
+	return probe{name, func(ctx context.Context) (string, error) {
+		vmScaleSetName, err := common.GetBackendsScaleSetName(ctx, store, stateParams, cfg.Prefix, cfg.ClusterName)
+		if err != nil {
+			return "", err
+		}
+		return checkScaleSet(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, vmScaleSetName)
+	}}
+}
+
+func readinessProbes(cfg *config.Config, store common.StateStore) []probe {
+	stateParams := common.BlobObjParams{
+		StorageName:   cfg.StateStorageName,
+		ContainerName: cfg.StateContainerName,
+		BlobName:      cfg.StateBlobName,
+	}
+	probes := []probe{
+		{"managed_identity", func(ctx context.Context) (string, error) {
+			return "", common.CloudProviderFromCtx(ctx).CheckIdentity(ctx)
+		}},
+		stateProbe("state", store, stateParams),
+		secretProbe("key_vault_function_key", cfg.KeyVaultUri, "function-app-default-key"),
+		{"key_vault_weka_credentials", func(ctx context.Context) (string, error) {
+			credentials, err := common.GetWekaClusterCredentials(ctx, cfg.KeyVaultUri)
+			if err != nil {
+				return "", err
+			}
+			return "using the " + credentials.Username + " user", nil
+		}},
+		backendsScaleSetProbe("vmss", cfg, store, stateParams),
+	}
+	if cfg.NfsVmssName != "" {
+		probes = append(probes,
+			stateProbe("nfs_state", store, common.BlobObjParams{
+				StorageName:   cfg.StateStorageName,
+				ContainerName: cfg.NfsStateContainerName,
+				BlobName:      cfg.NfsStateBlobName,
+			}),
+			scaleSetProbe("nfs_vmss", cfg.SubscriptionId, cfg.ResourceGroupName, cfg.NfsVmssName),
+		)
+	}
+	return probes
+}
+
+func runProbe(ctx context.Context, p probe) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	ctx, span := common.StartSpan(ctx, "probe "+p.name, common.SpanKindInternal)
+
+	start := time.Now()
+	detail, err := p.check(ctx)
+	status := DependencyStatus{
+		Name:      p.name,
+		Ok:        err == nil,
+		LatencyMs: time.Since(start).Milliseconds(),
+		Detail:    detail,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	span.Finish(err)
+	return status
+}
+
+// CheckReadiness probes all the dependencies in parallel
+func CheckReadiness(ctx context.Context, cfg *config.Config, store common.StateStore) Readiness {
+	probes := readinessProbes(cfg, store)
+	readiness := Readiness{Ready: true, Dependencies: make([]DependencyStatus, len(probes))}
+
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func(i int, p probe) {
+			defer wg.Done()
+			readiness.Dependencies[i] = runProbe(ctx, p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	for _, dependency := range readiness.Dependencies {
+		readiness.Ready = readiness.Ready && dependency.Ok
+	}
+	return readiness
+}
+
+// HealthzHandler tells that the function app process is alive, it doesn't check the dependencies
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	common.WriteSuccessResponse(w, map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler tells whether the function app can reach its dependencies, it replies 503 when it can't
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	readiness := CheckReadiness(ctx, config.FromCtx(ctx), common.StateStoreFromCtx(ctx))
+	statusCode := http.StatusOK
+	if !readiness.Ready {
+		statusCode = http.StatusServiceUnavailable
+		logger.Warn().Msgf("function app is not ready: %+v", readiness.Dependencies)
+	}
+	common.WriteResponse(w, map[string]any{"statusCode": statusCode, "body": readiness}, nil)
+}
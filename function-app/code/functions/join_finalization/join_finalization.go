@@ -1,66 +1,79 @@
 package join_finalization
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"weka-deployment/common"
+	"weka-deployment/config"
 
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
 )
 
 type RequestBody struct {
-	Name     string              `json:"name"`
+	Name     string              `json:"name" validate:"required"`
 	Protocol protocol.ProtocolGW `json:"protocol"`
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	var invokeRequest common.InvokeRequest
-
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
+	data, err := common.DecodeBody[RequestBody](r)
 	if err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
-
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
-	if err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
+	if err := common.AuthorizeVm(ctx, data.Name); err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteAuthErrorResponse(w, err)
 		return
 	}
 
-	var data RequestBody
+	cfg := config.FromCtx(r.Context())
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	prefix := cfg.Prefix
+	clusterName := cfg.ClusterName
+	nfsScaleSetName := cfg.NfsVmssName
+	stateStorageName := cfg.StateStorageName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	stateContainerName := cfg.StateContainerName
+	stateBlobName := cfg.StateBlobName
 
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &data); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
+	stateParams := common.BlobObjParams{
+		StorageName:   stateStorageName,
+		ContainerName: stateContainerName,
+		BlobName:      stateBlobName,
 	}
-
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	nfsScaleSetName := os.Getenv("NFS_VMSS_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-
 	vmssParams := &common.ScaleSetParams{
 		SubscriptionId:    subscriptionId,
 		ResourceGroupName: resourceGroupName,
 		ScaleSetName:      common.GetVmScaleSetName(prefix, clusterName),
 		Flexible:          false,
 	}
+	if data.Protocol == protocol.NFS {
+		stateParams.ContainerName = nfsStateContainerName
+		stateParams.BlobName = nfsStateBlobName
+	}
+	ctx = common.ContextWithOperationsState(ctx, stateParams)
+
+	if data.Protocol == "" {
+		// during a sku migration the vm may be in the target scale set
+		scaleSets, err := common.GetBackendsScaleSetNames(ctx, store, stateParams, prefix, clusterName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			common.WriteErrorResponse(w, err)
+			return
+		}
+		if scaleSet := common.FindScaleSetOfVm(scaleSets, data.Name); scaleSet != "" {
+			vmssParams.ScaleSetName = scaleSet
+		}
+	}
+
 	if data.Protocol == protocol.NFS {
 		vmssParams.ScaleSetName = nfsScaleSetName
 		vmssParams.Flexible = true
@@ -74,13 +87,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			err := fmt.Errorf("cannot update tags on VM %w", err)
 			logger.Error().Err(err).Str("instance", data.Name).Send()
-
-			stateParams := common.BlobObjParams{
-				StorageName:   stateStorageName,
-				ContainerName: nfsStateContainerName,
-				BlobName:      nfsStateBlobName,
-			}
-			common.ReportMsg(ctx, data.Name, stateParams, "error", err.Error())
+			common.ReportMsg(ctx, store, data.Name, stateParams, "error", err.Error())
 		}
 	}
 
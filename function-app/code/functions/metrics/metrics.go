@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/weka/go-cloud-lib/logging"
+
+	"weka-deployment/common"
+	"weka-deployment/config"
+	"weka-deployment/functions/status"
+)
+
+// Handler exports the metrics in the prometheus text format: the cluster gauges computed from the state and the
+// scale sets, and the metrics of the function app instance serving the scrape, labelled with the instance
+func Handler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromCtx(r.Context())
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+
+	var buf bytes.Buffer
+	// the scrape doesn't fail with the cluster gauges, the instance metrics tell about the failure
+	if err := writeClusterGauges(ctx, &buf); err != nil {
+		logger.Error().Err(err).Msg("cannot compute cluster gauges")
+	}
+
+	instance := cfg.WebsiteInstanceId
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	common.WriteMetrics(&buf, instance)
+
+	if common.IsDirectCall(r.Context()) {
+		w.Header().Set("Content-Type", common.MetricsContentType)
+		_, _ = w.Write(buf.Bytes())
+		return
+	}
+
+	resData := map[string]any{
+		"statusCode": http.StatusOK,
+		"headers":    map[string]string{"Content-Type": common.MetricsContentType},
+		"body":       buf.String(),
+	}
+	common.WriteResponse(w, resData, nil)
+}
+
+func writeClusterGauges(ctx context.Context, w io.Writer) error {
+	cfg := config.FromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
+
+	stateParams := common.BlobObjParams{
+		StorageName:   cfg.StateStorageName,
+		ContainerName: cfg.StateContainerName,
+		BlobName:      cfg.StateBlobName,
+	}
+	vmScaleSetName, err := common.GetBackendsScaleSetName(ctx, store, stateParams, cfg.Prefix, cfg.ClusterName)
+	if err != nil {
+		return err
+	}
+	vmssParams := &common.ScaleSetParams{
+		SubscriptionId:    cfg.SubscriptionId,
+		ResourceGroupName: cfg.ResourceGroupName,
+		ScaleSetName:      vmScaleSetName,
+		Flexible:          false,
+	}
+
+	state, err := common.ReadState(ctx, store, stateParams)
+	if err != nil {
+		return err
+	}
+	reports, err := status.GetReports(ctx, store, stateParams, vmssParams)
+	if err != nil {
+		return err
+	}
+	gauges := common.NewClusterGauges()
+	gauges.VmssDesiredCapacity.Set(float64(state.DesiredSize), vmScaleSetName)
+	gauges.ReadyForClusterizationInstances.Set(float64(len(reports.ReadyForClusterization)), vmScaleSetName)
+	gauges.Clusterized.SetBool(reports.Summary.Clusterized, vmScaleSetName)
+
+	// the backends may be spread over several scale sets during a SKU migration
+	scaleSets, err := common.GetBackendsScaleSetNames(ctx, store, stateParams, cfg.Prefix, cfg.ClusterName)
+	if err != nil {
+		return err
+	}
+	for _, name := range scaleSets {
+		scaleSet, err := common.GetScaleSetOrNil(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, name)
+		if err != nil {
+			return err
+		}
+		if scaleSet != nil && scaleSet.SKU != nil && scaleSet.SKU.Capacity != nil {
+			gauges.VmssCapacity.Set(float64(*scaleSet.SKU.Capacity), name)
+		}
+	}
+
+	gauges.Write(w)
+	return nil
+}
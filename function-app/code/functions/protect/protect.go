@@ -1,58 +1,43 @@
 package protect
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 	"weka-deployment/common"
+	"weka-deployment/config"
 
 	"github.com/weka/go-cloud-lib/logging"
 )
 
 type RequestBody struct {
-	Vm       string `json:"vm"`
+	// <vm name>:<hostname>
+	Vm       string `json:"vm" validate:"required"`
 	Protocol string `json:"protocol"`
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-	nfsScaleSetName := os.Getenv("NFS_VMSS_NAME")
-
-	var invokeRequest common.InvokeRequest
+	cfg := config.FromCtx(r.Context())
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	prefix := cfg.Prefix
+	clusterName := cfg.ClusterName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	nfsScaleSetName := cfg.NfsVmssName
 
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
+	data, err := common.DecodeBody[RequestBody](r)
 	if err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
-	if err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var data RequestBody
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &data); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
 
@@ -69,6 +54,20 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		Flexible:          false,
 	}
 
+	if data.Protocol == "" {
+		// during a sku migration the vm may be in the target scale set
+		scaleSets, err := common.GetBackendsScaleSetNames(ctx, store, stateParams, prefix, clusterName)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			common.WriteErrorResponse(w, err)
+			return
+		}
+		vmssParams.ScaleSetName = scaleSets[0]
+		if scaleSet := common.FindScaleSetOfVm(scaleSets, data.Vm); scaleSet != "" {
+			vmssParams.ScaleSetName = scaleSet
+		}
+	}
+
 	if data.Protocol == "nfs" {
 		stateParams.ContainerName = nfsStateContainerName
 		stateParams.BlobName = nfsStateBlobName
@@ -77,14 +76,19 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		vmssParams.Flexible = true
 	}
 
-	instanceName := strings.Split(data.Vm, ":")[0]
-	hostName := strings.Split(data.Vm, ":")[1]
+	instanceName, hostName, found := strings.Cut(data.Vm, ":")
+	if !found {
+		err = fmt.Errorf("%w: vm %q is not in <vm name>:<hostname> format", common.ErrBadRequest, data.Vm)
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
 	instanceId := common.GetScaleSetVmIndex(instanceName, vmssParams.Flexible)
 
 	maxAttempts := 10
 	authSleepInterval := time.Minute * 2
 
-	err = common.RetrySetDeletionProtectionAndReport(ctx, vmssParams, stateParams, instanceId, hostName, maxAttempts, authSleepInterval)
+	err = common.RetrySetDeletionProtectionAndReport(ctx, store, vmssParams, stateParams, instanceId, hostName, maxAttempts, authSleepInterval)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		common.WriteErrorResponse(w, err)
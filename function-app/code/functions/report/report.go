@@ -2,12 +2,11 @@ package report
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"time"
 	"weka-deployment/common"
+	"weka-deployment/config"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/weka/go-cloud-lib/logging"
@@ -21,12 +20,12 @@ func isPermissionsMismatch(err error) bool {
 	return ok && readErr.ErrorCode == BlobPermissionsErrorCode
 }
 
-func UpdateStateReportingWithRetry(ctx context.Context, subscriptionId, resourceGroupName string, stateParams common.BlobObjParams, report protocol.Report) (err error) {
+func UpdateStateReportingWithRetry(ctx context.Context, store common.StateStore, subscriptionId, resourceGroupName string, stateParams common.BlobObjParams, report protocol.Report) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
 	counter := 0
 	authSleepInterval := 10 //seconds
 	for {
-		err = common.UpdateStateReporting(ctx, stateParams, report)
+		err = common.UpdateStateReporting(ctx, store, stateParams, report)
 		if err == nil {
 			break
 		}
@@ -47,41 +46,31 @@ func UpdateStateReportingWithRetry(ctx context.Context, subscriptionId, resource
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
 
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	var invokeRequest common.InvokeRequest
-	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err := json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	report, err := common.DecodeBody[protocol.Report](r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
 		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
-
-	var report protocol.Report
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &report); err != nil {
-		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
+	if err := common.AuthorizeHostname(ctx, report.Hostname); err != nil {
 		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteAuthErrorResponse(w, err)
 		return
 	}
+	common.Reports.Inc(report.Type)
 
 	stateParams := common.BlobObjParams{
 		StorageName:   stateStorageName,
@@ -96,7 +85,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	logger.Info().Msgf("Updating state %s with %s", report.Type, report.Message)
-	err = common.UpdateStateReporting(ctx, stateParams, report)
+	err = common.UpdateStateReporting(ctx, store, stateParams, report)
 
 	// Sometimes when we create a resource group and immediately run weka terraform deployment, the function-app
 	// permissions are not fully ready when we invoke this endpoint. It results in a blob read permissions issue.
@@ -106,9 +95,9 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			Message:  fmt.Sprintf("Handled %s successfully", BlobPermissionsErrorCode),
 			Hostname: report.Hostname,
 		}
-		err2 := UpdateStateReportingWithRetry(ctx, subscriptionId, resourceGroupName, stateParams, progressReport)
+		err2 := UpdateStateReportingWithRetry(ctx, store, subscriptionId, resourceGroupName, stateParams, progressReport)
 		if err2 == nil {
-			err = common.UpdateStateReporting(ctx, stateParams, report)
+			err = common.UpdateStateReporting(ctx, store, stateParams, report)
 		}
 	}
 
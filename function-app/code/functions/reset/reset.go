@@ -0,0 +1,174 @@
+package reset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/config"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// ResetRequest restarts a failed initial deployment of the backends. The soft mode clears the instances and the
+// reports of the state and keeps the scale set, the hard mode also deletes the scale set, which scale_up creates
+// again once it is deleted. Every request is recorded in the audit log, including the refused ones.
+type ResetRequest struct {
+	// soft or hard
+	Mode string `json:"mode" validate:"required"`
+	// reset a clusterized cluster
+	Force  bool   `json:"force"`
+	Reason string `json:"reason"`
+}
+
+type ResetResponse struct {
+	Mode             string   `json:"mode"`
+	RemovedInstances []string `json:"removed_instances"`
+	// DeletedScaleSets are the scale sets being deleted by a hard reset
+	DeletedScaleSets []string `json:"deleted_scale_sets"`
+	Message          string   `json:"message"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromCtx(r.Context())
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
+
+	resetReq, err := common.DecodeBody[ResetRequest](r)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+	if resetReq.Mode != "soft" && resetReq.Mode != "hard" {
+		err = fmt.Errorf("%w: mode must be soft or hard, got %q", common.ErrBadRequest, resetReq.Mode)
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+
+	stateParams := common.BlobObjParams{
+		StorageName:   cfg.StateStorageName,
+		ContainerName: cfg.StateContainerName,
+		BlobName:      cfg.StateBlobName,
+	}
+	ctx = common.ContextWithOperationsState(ctx, stateParams)
+
+	// the clusterization is not prepared while the state is reset
+	lock, err := common.LockContainer(ctx, store, stateParams)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+	defer common.UnlockContainer(ctx, lock)
+	ctx = common.ContextWithContainerLock(ctx, lock)
+
+	response, err := reset(ctx, store, stateParams, resetReq)
+
+	entry := common.AuditEntry{
+		Action: "reset",
+		Reason: resetReq.Reason,
+		Details: map[string]any{
+			"mode":               resetReq.Mode,
+			"force":              resetReq.Force,
+			"removed_instances":  response.RemovedInstances,
+			"deleted_scale_sets": response.DeletedScaleSets,
+		},
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if auditErr := common.AppendAuditEntry(ctx, store, stateParams, entry); auditErr != nil {
+		logger.Error().Err(auditErr).Msg("cannot write audit entry")
+	}
+
+	if errors.Is(err, common.ErrBadRequest) {
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+	logger.Info().Msg(response.Message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", response.Message)
+	common.WriteSuccessResponse(w, response)
+}
+
+func reset(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, resetReq ResetRequest) (response ResetResponse, err error) {
+	cfg := config.FromCtx(ctx)
+	response = ResetResponse{Mode: resetReq.Mode, RemovedInstances: []string{}, DeletedScaleSets: []string{}}
+
+	state, err := common.ReadState(ctx, store, stateParams)
+	if err != nil {
+		return
+	}
+	if state.Clusterized && !resetReq.Force {
+		err = fmt.Errorf("%w: the cluster is clusterized, set force to reset it", common.ErrBadRequest)
+		return
+	}
+
+	if resetReq.Mode == "hard" {
+		var scaleSets []string
+		scaleSets, err = common.GetBackendsScaleSetNames(ctx, store, stateParams, cfg.Prefix, cfg.ClusterName)
+		if err != nil {
+			return
+		}
+		for _, name := range scaleSets {
+			scaleSet, err := common.GetScaleSetOrNil(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, name)
+			if err != nil {
+				return response, err
+			}
+			if scaleSet == nil {
+				continue
+			}
+			if err = common.DeleteScaleSet(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, name); err != nil {
+				return response, fmt.Errorf("cannot delete scale set %s: %v", name, err)
+			}
+			response.DeletedScaleSets = append(response.DeletedScaleSets, name)
+		}
+		// the scale set is created again with the initial name
+		_, err = common.UpdateSkuMigration(ctx, store, stateParams, func(migration *common.SkuMigration) error {
+			*migration = common.SkuMigration{Version: 1, Removed: []string{}}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = common.UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		if state.Clusterized && !resetReq.Force {
+			return fmt.Errorf("%w: the cluster is clusterized, set force to reset it", common.ErrBadRequest)
+		}
+		response.RemovedInstances = append([]string{}, common.GetStateInstancesNames(state.Instances)...)
+		state.Instances = []protocol.Vm{}
+		state.Progress = map[string][]string{}
+		state.Errors = map[string][]string{}
+		state.Clusterized = false
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// the watchdog starts over, with no clusterization instance replaced
+	_, err = common.UpdateClusterizationWatch(ctx, store, stateParams, func(watch *common.ClusterizationWatch) error {
+		*watch = common.ClusterizationWatch{Reelections: []common.ClusterizationReelection{}}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	response.Message = fmt.Sprintf("%s reset removed %d instances from the state", resetReq.Mode, len(response.RemovedInstances))
+	if len(response.DeletedScaleSets) > 0 {
+		response.Message = fmt.Sprintf("%s, scale sets %v are being deleted, scale_up creates the initial scale set once they are deleted",
+			response.Message, response.DeletedScaleSets)
+	}
+	return
+}
@@ -2,73 +2,54 @@ package resize
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"weka-deployment/common"
+	"weka-deployment/config"
 
 	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
 )
 
+type ResizeRequest struct {
+	Value    *int    `json:"value" validate:"required"`
+	Protocol *string `json:"protocol"`
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-	nfsScaleSetName := os.Getenv("NFS_VMSS_NAME")
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	prefix := cfg.Prefix
+	clusterName := cfg.ClusterName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	nfsScaleSetName := cfg.NfsVmssName
 
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	var invokeRequest common.InvokeRequest
-
-	var resizeReq struct {
-		Value    *int    `json:"value"`
-		Protocol *string `json:"protocol"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err := json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	resizeReq, err := common.DecodeBody[ResizeRequest](r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &resizeReq); err != nil {
-		err = fmt.Errorf("cannot unmarshal the request body: %v", err)
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
-		return
-	}
-	if resizeReq.Value == nil {
-		err := fmt.Errorf("wrong request format. 'new_size' is required")
 		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
-
-	vmScaleSetName := common.GetVmScaleSetName(prefix, clusterName)
-
 	stateParams := common.BlobObjParams{
 		StorageName:   stateStorageName,
 		ContainerName: stateContainerName,
 		BlobName:      stateBlobName,
 	}
+	vmScaleSetName, err := common.GetBackendsScaleSetName(ctx, store, stateParams, prefix, clusterName)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
 	isNFSProtocol := resizeReq.Protocol != nil && *resizeReq.Protocol == "nfs"
 	if isNFSProtocol {
 		stateParams.ContainerName = nfsStateContainerName
@@ -89,7 +70,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = updateDesiredClusterSize(ctx, *resizeReq.Value, subscriptionId, resourceGroupName, vmScaleSetName, stateParams)
+	ctx = common.ContextWithOperationsState(ctx, stateParams)
+	err = updateDesiredClusterSize(ctx, store, *resizeReq.Value, subscriptionId, resourceGroupName, vmScaleSetName, stateParams)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		common.WriteErrorResponse(w, err)
@@ -101,26 +83,22 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	common.WriteSuccessResponse(w, msg)
 }
 
-func updateDesiredClusterSize(ctx context.Context, newSize int, subscriptionId, resourceGroupName, vmScaleSetName string, stateParams common.BlobObjParams) error {
-	state, err := common.ReadState(ctx, stateParams)
+func updateDesiredClusterSize(ctx context.Context, store common.StateStore, newSize int, subscriptionId, resourceGroupName, vmScaleSetName string, stateParams common.BlobObjParams) error {
+	var oldSize int
+	_, err := common.UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		if !state.Clusterized {
+			return fmt.Errorf("weka cluster is not ready (vmss: %s)", vmScaleSetName)
+		}
+		oldSize = state.DesiredSize
+		state.DesiredSize = newSize
+		return nil
+	})
 	if err != nil {
-		return err
-	}
-
-	if !state.Clusterized {
-		err = fmt.Errorf("weka cluster is not ready (vmss: %s)", vmScaleSetName)
+		err = fmt.Errorf("cannot update state to %d: %v", newSize, err)
 		logger := logging.LoggerFromCtx(ctx)
 		logger.Error().Err(err).Send()
 		return err
 	}
-	oldSize := state.DesiredSize
-	state.DesiredSize = newSize
-
-	err = common.WriteState(ctx, stateParams, state)
-	if err != nil {
-		err = fmt.Errorf("cannot update state to %d: %v", newSize, err)
-		return err
-	}
 
 	if oldSize < newSize {
 		err = common.ScaleUp(ctx, subscriptionId, resourceGroupName, vmScaleSetName, int64(newSize))
@@ -1,46 +1,25 @@
 package scale_down
 
 import (
-	"encoding/json"
 	"net/http"
 	"weka-deployment/common"
 
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
-	"github.com/weka/go-cloud-lib/scale_down"
 )
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	var invokeRequest common.InvokeRequest
-
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
+	info, err := common.DecodeBody[protocol.HostGroupInfoResponse](r)
 	if err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
-	if err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var info protocol.HostGroupInfoResponse
-
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &info); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
 
-	scaleResponse, err := scale_down.ScaleDown(ctx, info)
+	scaleResponse, err := common.WekaClientFromCtx(ctx).ScaleDown(ctx, info)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		common.WriteErrorResponse(w, err)
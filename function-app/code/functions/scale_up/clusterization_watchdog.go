@@ -0,0 +1,178 @@
+package scale_up
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+
+	"weka-deployment/common"
+	"weka-deployment/config"
+)
+
+// The instance which reaches the clusterization target in the state runs the clusterization script, the cluster
+// is never clusterized when it dies or hangs. The watchdog replaces such an instance: it is terminated and removed
+// from the state, together with the instances which were told to join the cluster it was creating. The next instance
+// ready for clusterization is elected and runs the clusterization again.
+
+var errClusterizationInstanceChanged = errors.New("the clusterization instance changed")
+
+// watchClusterization re-elects the clusterization instance when it is gone, unhealthy or didn't report within
+// CLUSTERIZATION_TIMEOUT
+func watchClusterization(ctx context.Context, store common.StateStore, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams, vms []*common.VMInfoSummary, unhealthy []string) (message string) {
+	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
+	if cfg.ClusterizationTimeout == 0 {
+		return
+	}
+
+	state, err := common.ReadState(ctx, store, stateParams)
+	if err != nil {
+		logger.Error().Err(err).Msg("cannot read state")
+		return
+	}
+	watch, err := observeClusterization(ctx, store, stateParams, state)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	if watch.Instance == "" {
+		return
+	}
+
+	reason := ""
+	now := time.Now()
+	vm := findInstanceByName(vms, strings.Split(watch.Instance, ":")[0])
+	switch {
+	case vm == nil:
+		reason = "the instance is gone"
+	case slices.Contains(unhealthy, common.GetScaleSetVmId(vm.ID)):
+		reason = "the instance is stopped or failed"
+	case watch.Stalled(now, cfg.ClusterizationTimeout):
+		reason = fmt.Sprintf("no report for %s", now.Sub(watch.LastProgressAt).Round(time.Second))
+	default:
+		return fmt.Sprintf("clusterization instance %s last reported %s ago", watch.Instance, now.Sub(watch.LastProgressAt).Round(time.Second))
+	}
+
+	if len(watch.Reelections) >= cfg.ClusterizationMaxReelections {
+		message = fmt.Sprintf("clusterization instance %s stalled (%s), it is not replaced since %d instances were already replaced",
+			watch.Instance, reason, len(watch.Reelections))
+		logger.Error().Msg(message)
+		return
+	}
+
+	message, err = reelectClusterizationInstance(ctx, store, vmssParams, stateParams, watch.Instance, reason, vms, unhealthy)
+	if err != nil {
+		message = fmt.Sprintf("cannot replace clusterization instance %s: %v", watch.Instance, err)
+		logger.Error().Msg(message)
+		common.ReportMsg(ctx, store, "vmss", stateParams, "error", message)
+	}
+	return
+}
+
+// observeClusterization follows the progress of the clusterization instance, the watch is only written when it changes
+func observeClusterization(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, state protocol.ClusterState) (watch common.ClusterizationWatch, err error) {
+	watch, err = common.GetClusterizationWatch(ctx, store, stateParams)
+	if err != nil {
+		return watch, fmt.Errorf("cannot read clusterization watch: %v", err)
+	}
+	observed := watch
+	observed.Observe(state, time.Now())
+	if observed.Instance == watch.Instance && observed.LastReport == watch.LastReport {
+		return
+	}
+
+	watch, err = common.UpdateClusterizationWatch(ctx, store, stateParams, func(watch *common.ClusterizationWatch) error {
+		watch.Observe(state, time.Now())
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("cannot save clusterization watch: %v", err)
+	}
+	return
+}
+
+// reelectClusterizationInstance terminates the clusterization instance and the instances elected after it, then
+// removes them from the state. The instances are terminated first, so that a failure is retried by the next run.
+func reelectClusterizationInstance(ctx context.Context, store common.StateStore, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams, instance, reason string, vms []*common.VMInfoSummary, unhealthy []string) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	// the clusterization instance prepares the clusterization under the lock, it is not replaced meanwhile
+	lock, err := common.LockContainer(ctx, store, stateParams)
+	if err != nil {
+		return
+	}
+	defer common.UnlockContainer(ctx, lock)
+	ctx = common.ContextWithContainerLock(ctx, lock)
+
+	state, err := common.ReadState(ctx, store, stateParams)
+	if err != nil {
+		return
+	}
+	if common.GetClusterizationInstance(state) != instance {
+		// clusterized or re-elected meanwhile
+		return "", nil
+	}
+	removed := common.GetStateInstancesNames(state.Instances[state.ClusterizationTarget-1:])
+
+	// the unhealthy instances are already being terminated
+	instanceIds := make([]string, 0, len(removed))
+	for _, name := range removed {
+		vm := findInstanceByName(vms, strings.Split(name, ":")[0])
+		if vm != nil && !slices.Contains(unhealthy, common.GetScaleSetVmId(vm.ID)) {
+			instanceIds = append(instanceIds, vm.InstanceID)
+		}
+	}
+	_, errs := common.TerminateScaleSetInstances(ctx, &vmssParams, instanceIds)
+	if len(errs) > 0 {
+		return "", fmt.Errorf("cannot terminate instances %v: %v", instanceIds, errors.Join(errs...))
+	}
+
+	_, err = common.UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		if common.GetClusterizationInstance(*state) != instance {
+			return errClusterizationInstanceChanged
+		}
+		state.Instances = state.Instances[:state.ClusterizationTarget-1]
+		return nil
+	})
+	if errors.Is(err, errClusterizationInstanceChanged) {
+		return "", nil
+	}
+	if err != nil {
+		return
+	}
+
+	_, err = common.UpdateClusterizationWatch(ctx, store, stateParams, func(watch *common.ClusterizationWatch) error {
+		watch.Reelections = append(watch.Reelections, common.ClusterizationReelection{
+			Instance: instance,
+			Reason:   reason,
+			Removed:  removed,
+			Time:     time.Now(),
+		})
+		watch.Instance, watch.LastReport = "", ""
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("cannot save clusterization watch")
+	}
+	common.ClusterizationReelections.Add(1, vmssParams.ScaleSetName)
+
+	message = fmt.Sprintf("replaced clusterization instance %s (%s), removed instances %v, the next ready instance clusterizes", instance, reason, removed)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "error", message)
+	return message, nil
+}
+
+func findInstanceByName(vms []*common.VMInfoSummary, name string) *common.VMInfoSummary {
+	for _, vm := range vms {
+		if vm.Name == name {
+			return vm
+		}
+	}
+	return nil
+}
@@ -14,8 +14,11 @@ NICS_NUM=%d
 SUBNET_RANGE="%s"
 APT_REPO_SERVER="%s"
 
-# report function definition
-%s
+# the bootstrap token doesn't allow report, the init script logs its reports and the deploy script reports
+# with the token of the vm
+function report {
+  echo "$(date -u): report $1"
+}
 
 # deploy function definition
 %s
@@ -207,6 +210,6 @@ report "{\"hostname\": \"$HOSTNAME\", \"type\": \"progress\", \"message\": \"Wek
 `
 )
 
-func getInitScript(userData string, diskSize int, nicsNum int, subnetRange string, aptRepoServer string, reportFuncDef string, deployFuncDef string, clusterName string, monitorScript string, serviceUnit string) string {
-	return fmt.Sprintf(initScript, userData, diskSize, nicsNum, subnetRange, aptRepoServer, reportFuncDef, deployFuncDef, clusterName, monitorScript, serviceUnit)
+func getInitScript(userData string, diskSize int, nicsNum int, subnetRange string, aptRepoServer string, deployFuncDef string, clusterName string, monitorScript string, serviceUnit string) string {
+	return fmt.Sprintf(initScript, userData, diskSize, nicsNum, subnetRange, aptRepoServer, deployFuncDef, clusterName, monitorScript, serviceUnit)
 }
@@ -0,0 +1,93 @@
+package scale_up
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/weka/go-cloud-lib/protocol"
+
+	"weka-deployment/common"
+	"weka-deployment/config"
+	"weka-deployment/functions/terminate"
+)
+
+// The rolling upgrade and the sku migration remove instances the way the scale down does: the scale down deactivates
+// their weka hosts, weka rebuilds their data on the other hosts and removes the hosts once inactive, and only then
+// terminate deletes the instances. Deleting an instance while its host is active would leave its data unprotected.
+
+// deactivateInstances deactivates the weka hosts of the instances through the scale down and returns the ids of the
+// instances whose host weka removed. The weka api is called on the backends. It is called until all the hosts are
+// removed: a host is deactivated by the first call and reported removed by a later one.
+func deactivateInstances(ctx context.Context, instances, backends []protocol.HgInstance) (removed []string, err error) {
+	cfg := config.FromCtx(ctx)
+
+	credentials, err := common.GetWekaClusterCredentials(ctx, cfg.KeyVaultUri)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get weka cluster credentials: %v", err)
+	}
+	backendIps := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		backendIps = append(backendIps, backend.PrivateIp)
+	}
+
+	// the scale down only handles the hosts of WekaBackendInstances, all of them are beyond the desired capacity
+	info := protocol.HostGroupInfoResponse{
+		Username:                    credentials.Username,
+		Password:                    credentials.Password,
+		WekaBackendsDesiredCapacity: 0,
+		WekaBackendInstances:        instances,
+		DownBackendsRemovalTimeout:  cfg.DownBackendsRemovalTimeout,
+		BackendIps:                  backendIps,
+		Role:                        "backend",
+		Version:                     protocol.Version,
+	}
+	response, err := common.WekaClientFromCtx(ctx).ScaleDown(ctx, info)
+	if err != nil {
+		return nil, fmt.Errorf("cannot deactivate the weka hosts: %v", err)
+	}
+	for _, instance := range response.ToTerminate {
+		if slices.ContainsFunc(instances, func(i protocol.HgInstance) bool { return i.Id == instance.Id }) {
+			removed = append(removed, instance.Id)
+		}
+	}
+	return
+}
+
+// terminateInstances deletes the instances of the scale set whose weka host was removed through terminate,
+// remaining are the backends which stay in the cluster
+func terminateInstances(ctx context.Context, store common.StateStore, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams, instanceIds []string, remaining []protocol.HgInstance) error {
+	scaleResponse := protocol.ScaleResponse{Version: protocol.Version}
+	for _, backend := range remaining {
+		scaleResponse.Hosts = append(scaleResponse.Hosts, protocol.ScaleResponseHost{InstanceId: backend.Id, PrivateIp: backend.PrivateIp})
+	}
+	for _, instanceId := range instanceIds {
+		scaleResponse.ToTerminate = append(scaleResponse.ToTerminate, protocol.HgInstance{Id: instanceId})
+	}
+
+	response, err := terminate.Terminate(ctx, store, scaleResponse, &vmssParams, stateParams)
+	if err != nil {
+		return err
+	}
+	if len(response.TransientErrors) > 0 {
+		var errs []error
+		for _, transientError := range response.TransientErrors {
+			errs = append(errs, errors.New(transientError))
+		}
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// splitInstances splits the instances of the scale set into the ones with the given ids and the other ones
+func splitInstances(instances []protocol.HgInstance, ids []string) (selected, others []protocol.HgInstance) {
+	for _, instance := range instances {
+		if slices.Contains(ids, instance.Id) {
+			selected = append(selected, instance)
+		} else {
+			others = append(others, instance)
+		}
+	}
+	return
+}
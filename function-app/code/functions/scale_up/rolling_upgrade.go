@@ -0,0 +1,291 @@
+package scale_up
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+
+	"weka-deployment/common"
+	"weka-deployment/config"
+)
+
+// The vmss update only changes the scale set model of a Manual upgrade scale set, the existing instances keep
+// running the previous image, NICs and user data. The rolling upgrade replaces them one at a time, each scale_up
+// invocation moves it at most one step forward:
+//  1. wait until weka reports the data fully protected, then pick the oldest out-of-date instance
+//  2. deactivate its weka host through the scale down, and delete the instance through terminate once weka removed
+//     the host (see deactivateInstances)
+//  3. the scale up restores the capacity, the replacement is created from the latest model and joins the cluster,
+//     the upgrade waits until weka has as many active backends as before the removal and is fully protected again
+//
+// The instance being replaced is recorded before its host is deactivated, and the host removal before the instance
+// is deleted, so an interrupted invocation is resumed by the next one.
+
+// getOutdatedInstances returns the instances which are not tagged with the config hash, oldest first
+func getOutdatedInstances(vms []*common.VMInfoSummary, configHash string) (outdated []*common.VMInfoSummary) {
+	for _, vm := range vms {
+		if vm.ProvisioningState != nil && *vm.ProvisioningState == "Deleting" {
+			continue
+		}
+		if hash, ok := vm.Tags[common.ConfigHashTag]; !ok || hash == nil || *hash != configHash {
+			outdated = append(outdated, vm)
+		}
+	}
+	sortInstances(outdated)
+	return
+}
+
+// sortInstances sorts the instances by instance id, oldest first
+func sortInstances(vms []*common.VMInfoSummary) {
+	sort.Slice(vms, func(i, j int) bool {
+		a, errA := strconv.Atoi(vms[i].InstanceID)
+		b, errB := strconv.Atoi(vms[j].InstanceID)
+		if errA != nil || errB != nil {
+			return vms[i].InstanceID < vms[j].InstanceID
+		}
+		return a < b
+	})
+}
+
+func findInstance(vms []*common.VMInfoSummary, instanceId string) *common.VMInfoSummary {
+	for _, vm := range vms {
+		if vm.InstanceID == instanceId {
+			return vm
+		}
+	}
+	return nil
+}
+
+func getWekaProtectionStatus(ctx context.Context, vmssParams common.ScaleSetParams) (protection common.WekaProtectionStatus, err error) {
+	err = common.WekaClientFromCtx(ctx).Status(ctx, &vmssParams, config.FromCtx(ctx).KeyVaultUri, &protection)
+	if err != nil {
+		err = fmt.Errorf("cannot get weka status: %v", err)
+	}
+	return
+}
+
+// saveRollingUpgrade writes the upgrade, keeping the pause state set meanwhile by the upgrade function
+func saveRollingUpgrade(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, upgrade common.RollingUpgrade) error {
+	_, err := common.UpdateRollingUpgrade(ctx, store, stateParams, func(stored *common.RollingUpgrade) error {
+		paused, pauseReason := stored.Paused, stored.PauseReason
+		*stored = upgrade
+		if paused && !upgrade.Paused {
+			stored.Paused, stored.PauseReason = paused, pauseReason
+		}
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("cannot save rolling upgrade: %v", err)
+	}
+	return err
+}
+
+// handleRollingUpgrade replaces the instances which are not created from the current vmss config
+func handleRollingUpgrade(ctx context.Context, store common.StateStore, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams, configHash string) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	upgrade, err := common.GetRollingUpgrade(ctx, store, stateParams)
+	if err != nil {
+		return
+	}
+	vms, err := common.GetScaleSetVmsExpandedView(ctx, &vmssParams)
+	if err != nil {
+		return
+	}
+	outdated := getOutdatedInstances(vms, configHash)
+
+	if upgrade.To != configHash {
+		// the weka host of the instance being replaced is already deactivated, its replacement is completed as
+		// part of the new upgrade since it is created from the latest model anyway
+		replacing := upgrade.Phase == common.RollingUpgradeDeactivating || upgrade.Phase == common.RollingUpgradeWaitingReplacement
+		if len(outdated) == 0 && !replacing {
+			return
+		}
+		message = fmt.Sprintf("starting rolling upgrade of %d instances to config %s", len(outdated), configHash)
+		if replacing {
+			message += fmt.Sprintf(", carrying over the replacement of %s", upgrade.Instance)
+		}
+		logger.Info().Msg(message)
+		common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+		previous := upgrade
+		upgrade = common.RollingUpgrade{
+			To:          configHash,
+			Paused:      previous.Paused,
+			PauseReason: previous.PauseReason,
+			Replaced:    []string{},
+			StartedAt:   time.Now(),
+		}
+		upgrade.SetPhase(common.RollingUpgradeWaitingProtection)
+		if replacing {
+			upgrade.Instance, upgrade.InstanceId, upgrade.InstanceHash = previous.Instance, previous.InstanceId, previous.InstanceHash
+			upgrade.ActiveBackends = previous.ActiveBackends
+			upgrade.Phase, upgrade.PhaseStartedAt = previous.Phase, previous.PhaseStartedAt
+		}
+	}
+	upgrade.Remaining = len(outdated)
+
+	switch {
+	case upgrade.Paused:
+		message = fmt.Sprintf("rolling upgrade to config %s is paused, %d instances left", configHash, len(outdated))
+	case upgrade.Phase == common.RollingUpgradeCompleted && len(outdated) == 0:
+		return
+	default:
+		message, err = rollingUpgradeStep(ctx, store, vmssParams, stateParams, &upgrade, vms, outdated)
+	}
+
+	if saveErr := saveRollingUpgrade(ctx, store, stateParams, upgrade); saveErr != nil {
+		err = errors.Join(err, saveErr)
+	}
+	return
+}
+
+func rollingUpgradeStep(ctx context.Context, store common.StateStore, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams, upgrade *common.RollingUpgrade, vms, outdated []*common.VMInfoSummary) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
+
+	if upgrade.Phase == common.RollingUpgradeCompleted {
+		// instances were added from an older model meanwhile
+		upgrade.CompletedAt = nil
+		upgrade.SetPhase(common.RollingUpgradeWaitingProtection)
+	}
+
+	if upgrade.Phase == common.RollingUpgradeDeactivating {
+		return deactivateInstance(ctx, store, vmssParams, stateParams, upgrade, vms)
+	}
+
+	if upgrade.Phase == common.RollingUpgradeWaitingReplacement {
+		if instance := findInstance(vms, upgrade.InstanceId); instance != nil {
+			// the previous deletion failed or was interrupted, weka already removed the host
+			return removeInstance(ctx, store, vmssParams, stateParams, upgrade, vms)
+		}
+
+		protection, err := getWekaProtectionStatus(ctx, vmssParams)
+		if err != nil {
+			return "", err
+		}
+		if !protection.FullyProtected() || protection.Hosts.Backends.Active < upgrade.ActiveBackends {
+			if time.Since(upgrade.PhaseStartedAt) > cfg.RollingUpgradeJoinTimeout {
+				upgrade.Paused = true
+				upgrade.PauseReason = fmt.Sprintf("the replacement of %s didn't join within %s", upgrade.Instance, cfg.RollingUpgradeJoinTimeout)
+				common.ReportMsg(ctx, store, "vmss", stateParams, "error", "rolling upgrade paused: "+upgrade.PauseReason)
+				return "rolling upgrade paused: " + upgrade.PauseReason, nil
+			}
+			message = fmt.Sprintf("rolling upgrade waiting for the replacement of %s to join (%d/%d active backends, fully protected: %t)",
+				upgrade.Instance, protection.Hosts.Backends.Active, upgrade.ActiveBackends, protection.FullyProtected())
+			return message, nil
+		}
+
+		message = fmt.Sprintf("instance %s was replaced by an instance of config %s", upgrade.Instance, upgrade.To)
+		logger.Info().Msg(message)
+		common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+		if err := common.AddClusterUpdate(ctx, store, stateParams, protocol.Update{From: upgrade.InstanceHash, To: upgrade.To, Time: time.Now()}); err != nil {
+			logger.Error().Err(err).Send()
+		}
+		upgrade.Replaced = append(upgrade.Replaced, upgrade.Instance)
+		upgrade.Instance, upgrade.InstanceId, upgrade.InstanceHash, upgrade.ActiveBackends = "", "", "", 0
+		upgrade.SetPhase(common.RollingUpgradeWaitingProtection)
+		return message, nil
+	}
+
+	if len(outdated) == 0 {
+		now := time.Now()
+		upgrade.CompletedAt = &now
+		upgrade.SetPhase(common.RollingUpgradeCompleted)
+		message = fmt.Sprintf("rolling upgrade to config %s completed, %d instances replaced", upgrade.To, len(upgrade.Replaced))
+		logger.Info().Msg(message)
+		common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+		return message, nil
+	}
+
+	protection, err := getWekaProtectionStatus(ctx, vmssParams)
+	if err != nil {
+		return "", err
+	}
+	if !protection.FullyProtected() {
+		return fmt.Sprintf("rolling upgrade waiting for the cluster to be fully protected, %d instances left", len(outdated)), nil
+	}
+
+	instance := outdated[0]
+	upgrade.Instance = instance.Name
+	upgrade.InstanceId = instance.InstanceID
+	upgrade.InstanceHash = ""
+	if hash := instance.Tags[common.ConfigHashTag]; hash != nil {
+		upgrade.InstanceHash = *hash
+	}
+	upgrade.ActiveBackends = protection.Hosts.Backends.Active
+	upgrade.SetPhase(common.RollingUpgradeDeactivating)
+	// the instance must be recorded before its host is deactivated, so that the upgrade is resumed if it is interrupted
+	if err := saveRollingUpgrade(ctx, store, stateParams, *upgrade); err != nil {
+		return "", err
+	}
+	message = fmt.Sprintf("deactivating the weka host of instance %s (config %s) for the rolling upgrade", upgrade.Instance, upgrade.InstanceHash)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	return deactivateInstance(ctx, store, vmssParams, stateParams, upgrade, vms)
+}
+
+// deactivateInstance deactivates the weka host of the instance being replaced, the instance is deleted once weka
+// removed the host
+func deactivateInstance(ctx context.Context, store common.StateStore, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams, upgrade *common.RollingUpgrade, vms []*common.VMInfoSummary) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	if findInstance(vms, upgrade.InstanceId) == nil {
+		// the scale down removed the inactive host and terminate deleted the instance meanwhile
+		upgrade.SetPhase(common.RollingUpgradeWaitingReplacement)
+		return fmt.Sprintf("instance %s was removed, waiting for its replacement", upgrade.Instance), nil
+	}
+
+	instances, err := common.GetScaleSetInstancesInfoFromVms(ctx, &vmssParams, vms)
+	if err != nil {
+		return
+	}
+	instance, _ := splitInstances(instances, []string{upgrade.InstanceId})
+	removed, err := deactivateInstances(ctx, instance, instances)
+	if err != nil {
+		err = fmt.Errorf("cannot deactivate the weka host of instance %s for the rolling upgrade, will retry: %v", upgrade.Instance, err)
+		logger.Error().Err(err).Send()
+		return
+	}
+	if len(removed) == 0 {
+		return fmt.Sprintf("rolling upgrade waiting for weka to deactivate and remove the host of instance %s", upgrade.Instance), nil
+	}
+
+	upgrade.SetPhase(common.RollingUpgradeWaitingReplacement)
+	// the host removal must be recorded before the instance is deleted, weka doesn't report it again
+	if err = saveRollingUpgrade(ctx, store, stateParams, *upgrade); err != nil {
+		return
+	}
+	return removeInstance(ctx, store, vmssParams, stateParams, upgrade, vms)
+}
+
+// removeInstance deletes the instance being replaced once weka removed its host, the scale up which follows
+// creates its replacement
+func removeInstance(ctx context.Context, store common.StateStore, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams, upgrade *common.RollingUpgrade, vms []*common.VMInfoSummary) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	instances, err := common.GetScaleSetInstancesInfoFromVms(ctx, &vmssParams, vms)
+	if err != nil {
+		return
+	}
+	_, remaining := splitInstances(instances, []string{upgrade.InstanceId})
+	if err = terminateInstances(ctx, store, vmssParams, stateParams, []string{upgrade.InstanceId}, remaining); err != nil {
+		err = fmt.Errorf("cannot remove instance %s for the rolling upgrade, will retry: %v", upgrade.Instance, err)
+		logger.Error().Err(err).Send()
+		errStr := err.Error()
+		if updateErr := common.AddClusterUpdate(ctx, store, stateParams, protocol.Update{From: upgrade.InstanceHash, To: upgrade.To, Time: time.Now(), Error: &errStr}); updateErr != nil {
+			logger.Error().Err(updateErr).Send()
+		}
+		return
+	}
+
+	message = fmt.Sprintf("removed instance %s (config %s) for the rolling upgrade, waiting for its replacement", upgrade.Instance, upgrade.InstanceHash)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	return
+}
@@ -5,67 +5,60 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net/http"
-	"os"
-	"strconv"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
 	"github.com/weka/go-cloud-lib/functions_def"
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
 
 	"weka-deployment/common"
+	"weka-deployment/config"
 	"weka-deployment/functions/azure_functions_def"
 )
 
-var (
-	stateStorageName   = os.Getenv("STATE_STORAGE_NAME")
-	stateContainerName = os.Getenv("STATE_CONTAINER_NAME")
-	stateBlobName      = os.Getenv("STATE_BLOB_NAME")
-	prefix             = os.Getenv("PREFIX")
-	clusterName        = os.Getenv("CLUSTER_NAME")
-	subscriptionId     = os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName  = os.Getenv("RESOURCE_GROUP_NAME")
-	nfsContainerName   = os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName   = os.Getenv("NFS_STATE_BLOB_NAME")
-	nfsScaleSetName    = os.Getenv("NFS_VMSS_NAME")
-	vmssConfigStr      = os.Getenv("VMSS_CONFIG")
-	// initial state of the cluster
-	initialClusterSize, _ = strconv.Atoi(os.Getenv("INITIAL_CLUSTER_SIZE"))
-	clusterizeTarget, _   = strconv.Atoi(os.Getenv("CLUSTERIZATION_TARGET"))
-	initialNfsSize, _     = strconv.Atoi(os.Getenv("NFS_PROTOCOL_GATEWAYS_NUM"))
-	clusterInitialState   = protocol.ClusterState{
-		InitialSize:          initialClusterSize,
-		DesiredSize:          initialClusterSize,
-		ClusterizationTarget: clusterizeTarget,
-	}
-	nfsInitialState = protocol.ClusterState{
-		InitialSize:          initialNfsSize,
-		DesiredSize:          initialNfsSize,
-		ClusterizationTarget: initialNfsSize,
+// initial state of the cluster
+func clusterInitialState(cfg *config.Config) protocol.ClusterState {
+	return protocol.ClusterState{
+		InitialSize:          cfg.InitialClusterSize,
+		DesiredSize:          cfg.InitialClusterSize,
+		ClusterizationTarget: cfg.ClusterizationTarget,
 	}
-)
+}
+
+func nfsInitialState(cfg *config.Config) protocol.ClusterState {
+	return protocol.ClusterState{
+		InitialSize:          cfg.NfsProtocolGatewaysNum,
+		DesiredSize:          cfg.NfsProtocolGatewaysNum,
+		ClusterizationTarget: cfg.NfsProtocolGatewaysNum,
+	}
+}
 
-func getBackendCustomDataScript(ctx context.Context, userData string) (customData string, err error) {
-	functionAppName := os.Getenv("FUNCTION_APP_NAME")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
-	diskSize, _ := strconv.Atoi(os.Getenv("DISK_SIZE"))
-	nicsNum, _ := strconv.Atoi(os.Getenv("NICS_NUM"))
-	subnet := os.Getenv("SUBNET")
-	aptRepo := os.Getenv("APT_REPO_SERVER")
+func getBackendCustomDataScript(ctx context.Context, vmssName, userData string) (customData string, tokenExpiresAt time.Time, err error) {
+	cfg := config.FromCtx(ctx)
+	keyVaultUri := cfg.KeyVaultUri
+	diskSize := cfg.DiskSize
+	nicsNum := cfg.NicsNum
+	subnet := cfg.Subnet
+	aptRepo := cfg.AptRepoServer
 
 	logger := logging.LoggerFromCtx(ctx)
 
-	functionAppKey, err := common.GetKeyVaultValue(ctx, keyVaultUri, "function-app-default-key")
+	// the bootstrap token is part of the vmss config, it is rotated by scale_up before it expires
+	tokenExpiresAt = time.Now().Add(cfg.VmBootstrapTokenTtl)
+	vmToken, err := common.IssueVmToken(ctx, keyVaultUri, common.NewBootstrapVmToken(vmssName, tokenExpiresAt))
 	if err != nil {
-		logger.Error().Err(err).Msg("cannot get function app key")
+		logger.Error().Err(err).Msg("cannot issue bootstrap vm token")
 		return
 	}
 
-	baseFunctionUrl := fmt.Sprintf("https://%s.azurewebsites.net/api/", functionAppName)
-	funcDef := azure_functions_def.NewFuncDef(baseFunctionUrl, functionAppKey)
-	reportFunction := funcDef.GetFunctionCmdDefinition(functions_def.Report)
+	baseFunctionUrl := cfg.GetFunctionsBaseUrl()
+	// no trace context, the custom data is not generated for a single request
+	funcDef := azure_functions_def.NewVmFuncDef(baseFunctionUrl, vmToken, "")
 	deployFunction := funcDef.GetFunctionCmdDefinition(functions_def.Deploy)
-	fetchFunction := funcDef.GetFunctionCmdDefinition(functions_def.Fetch)
+	// the maintenance monitor runs as long as the vm, it fetches with the monitor token written by the deploy script
+	monitorFuncDef := azure_functions_def.NewVmTokenFileFuncDef(baseFunctionUrl, common.MonitorVmTokenFile)
+	fetchFunction := monitorFuncDef.GetFunctionCmdDefinition(functions_def.Fetch)
 
 	// Get maintenance monitor script and service files
 	monitorScript, err := common.GetMaintenanceMonitorScript(fetchFunction)
@@ -80,37 +73,102 @@ func getBackendCustomDataScript(ctx context.Context, userData string) (customDat
 		return
 	}
 
-	customDataStr := getInitScript(userData, diskSize, nicsNum, subnet, aptRepo, reportFunction, deployFunction, clusterName, monitorScript, serviceUnit)
+	customDataStr := getInitScript(userData, diskSize, nicsNum, subnet, aptRepo, deployFunction, cfg.ClusterName, monitorScript, serviceUnit)
 	// base64 encode the custom data
 	customData = base64.StdEncoding.EncodeToString([]byte(customDataStr))
 	return
 }
 
+func setBootstrapTokenExpiry(vmssConfig *common.VMSSConfig, expiresAt time.Time) {
+	vmssConfig.Tags[common.BootstrapVmTokenExpiresAtTag] = expiresAt.UTC().Format(time.RFC3339)
+}
+
+// bootstrapTokenNeedsRotation tells whether the bootstrap token of the scale set custom data is past half of its
+// lifetime (or has no expiry)
+func bootstrapTokenNeedsRotation(scaleSet *armcompute.VirtualMachineScaleSet, ttl time.Duration, now time.Time) bool {
+	expiresAt, ok := scaleSet.Tags[common.BootstrapVmTokenExpiresAtTag]
+	if !ok || expiresAt == nil {
+		return true
+	}
+	t, err := time.Parse(time.RFC3339, *expiresAt)
+	return err != nil || now.After(t.Add(-ttl/2))
+}
+
+// rotateBootstrapToken updates the scale set custom data with a new bootstrap token. The token is generated for the
+// deployed config, so a pending plan or a sku migration doesn't stop the rotation. The config hash doesn't change,
+// so the rolling upgrade doesn't replace the instances: they deployed already and don't use the bootstrap token.
+func rotateBootstrapToken(ctx context.Context, scaleSet *armcompute.VirtualMachineScaleSet, vmssConfig *common.VMSSConfig, desiredSize int) error {
+	cfg := config.FromCtx(ctx)
+	vmssName := *scaleSet.Name
+
+	currentConfig := common.GetVmssConfig(ctx, cfg.ResourceGroupName, scaleSet)
+	if scaleSet.Properties.VirtualMachineProfile.UserData == nil {
+		// the scale sets updated before the user data was kept in the model
+		if currentConfig.ConfigHash != vmssConfig.ConfigHash {
+			return fmt.Errorf("the user data of vmss %s config %s is unknown, the bootstrap token is rotated once config %s is applied", vmssName, currentConfig.ConfigHash, vmssConfig.ConfigHash)
+		}
+		currentConfig.UserData = vmssConfig.UserData
+	}
+
+	customData, tokenExpiresAt, err := getBackendCustomDataScript(ctx, vmssName, currentConfig.UserData)
+	if err != nil {
+		return err
+	}
+	setBootstrapTokenExpiry(currentConfig, tokenExpiresAt)
+	_, err = common.CreateOrUpdateVmss(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, vmssName, currentConfig.ConfigHash, *currentConfig, desiredSize, customData)
+	if err != nil {
+		return fmt.Errorf("cannot update vmss %s custom data: %v", vmssName, err)
+	}
+	logging.LoggerFromCtx(ctx).Info().Msgf("rotated the bootstrap token of vmss %s, it expires at %s", vmssName, tokenExpiresAt.UTC().Format(time.RFC3339))
+	return nil
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	vmScaleSetName := common.GetVmScaleSetName(prefix, clusterName)
 	stateParams := common.BlobObjParams{
-		StorageName:   stateStorageName,
-		ContainerName: stateContainerName,
-		BlobName:      stateBlobName,
+		StorageName:   cfg.StateStorageName,
+		ContainerName: cfg.StateContainerName,
+		BlobName:      cfg.StateBlobName,
+	}
+	ctx = common.ContextWithOperationsState(ctx, stateParams)
+
+	// resolve the operations started by previous invocations, their failures are reported in the state
+	if _, err := common.ResolveOperations(ctx, store, stateParams); err != nil {
+		logger.Error().Err(err).Msg("cannot resolve pending operations")
 	}
 
-	state, err := common.ReadStateOrCreateNew(ctx, stateParams, clusterInitialState)
+	state, err := common.ReadStateOrCreateNew(ctx, store, stateParams, clusterInitialState(cfg))
 	if err != nil {
 		logger.Error().Err(err).Msg("cannot read state")
 		common.WriteErrorResponse(w, err)
 		return
 	}
 
-	scaleSet, err := common.GetScaleSetOrNil(ctx, subscriptionId, resourceGroupName, vmScaleSetName)
+	skuMigration, err := common.GetSkuMigration(ctx, store, stateParams)
+	if err != nil {
+		logger.Error().Err(err).Msg("cannot read sku migration")
+		common.WriteErrorResponse(w, err)
+		return
+	}
+	vmScaleSetName := skuMigration.ActiveScaleSet(common.GetVmScaleSetName(cfg.Prefix, cfg.ClusterName))
+
+	scaleSet, err := common.GetScaleSetOrNil(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, vmScaleSetName)
 	if err != nil {
 		logger.Error().Err(err).Msg("cannot get scale set")
 		common.WriteErrorResponse(w, err)
 		return
 	}
 
+	if scaleSet != nil && scaleSet.Properties != nil && scaleSet.Properties.ProvisioningState != nil && *scaleSet.Properties.ProvisioningState == "Deleting" {
+		// deleted by a hard reset, the initial vmss is created once the deletion completes
+		common.WriteSuccessResponse(w, fmt.Sprintf("vmss %s is being deleted", vmScaleSetName))
+		return
+	}
+
 	if scaleSet == nil && (state.Clusterized || len(state.Instances) > 0) {
 		err := fmt.Errorf("vmss %s is not found but state already contains clusterization info", vmScaleSetName)
 		logger.Error().Err(err).Send()
@@ -119,7 +177,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// get expected vmss config
-	vmssConfig, err := common.ReadVmssConfig(ctx, vmssConfigStr)
+	vmssConfig, err := common.ReadVmssConfig(ctx, cfg.VmssConfig)
 	if err != nil {
 		logger.Error().Err(err).Msgf("cannot read vmss config")
 		common.WriteErrorResponse(w, err)
@@ -143,22 +201,62 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	if !state.Clusterized {
 		msg := fmt.Sprintf("Not clusterized yet, initial size %d is set", state.InitialSize)
 		vmssParams := common.ScaleSetParams{
-			SubscriptionId:    subscriptionId,
-			ResourceGroupName: resourceGroupName,
+			SubscriptionId:    cfg.SubscriptionId,
+			ResourceGroupName: cfg.ResourceGroupName,
 			ScaleSetName:      vmScaleSetName,
 		}
-		handleProgressingClusterization(ctx, &state, vmssParams, stateParams)
+		vms, unhealthy := handleProgressingClusterization(ctx, store, &state, vmssParams, stateParams)
+		if vms != nil {
+			if watchMsg := watchClusterization(ctx, store, vmssParams, stateParams, vms, unhealthy); watchMsg != "" {
+				msg = fmt.Sprintf("%s; %s", msg, watchMsg)
+			}
+		}
 		logger.Info().Msg(msg)
 		returnMsg = msg
+	} else if skuMigration.InProgress() {
+		// 2. SKU migration flow: the config changes are applied once the migration is completed
+		message, err := handleSkuMigration(ctx, store, &state, stateParams, &skuMigration, &vmssConfig)
+		if err != nil {
+			logger.Error().Err(err).Msg("sku migration failed")
+			common.ReportMsg(ctx, store, "vmss", stateParams, "error", fmt.Sprintf("sku migration failed: %v", err))
+			common.WriteErrorResponse(w, err)
+			return
+		}
+		returnMsg = message
 	} else {
-		currentConfig := common.GetVmssConfig(ctx, resourceGroupName, scaleSet)
+		currentConfig := common.GetVmssConfig(ctx, cfg.ResourceGroupName, scaleSet)
+		// the scale sets created by a sku migration have versioned computer names
+		vmssConfig = versionedVmssConfig(vmssConfig, vmScaleSetName, skuMigration.Version)
+
+		// 3. Update flow: compare current vmss config with expected vmss config and update if needed
+		if vmssConfig.ConfigHash != currentConfig.ConfigHash && cfg.VmssUpdateApprovalRequired {
+			plan, err := planVmssUpdate(ctx, store, stateParams, scaleSet, currentConfig, &vmssConfig)
+			if err != nil {
+				logger.Error().Err(err).Send()
+				common.WriteErrorResponse(w, err)
+				return
+			}
+			if plan.Status != common.VmssPlanApproved {
+				returnMsg = fmt.Sprintf("vmss update to config %s is %s", plan.Id, plan.Status)
+			}
+		}
 
-		// 2. Update flow: compare current vmss config with expected vmss config and update if needed
-		if vmssConfig.ConfigHash != currentConfig.ConfigHash {
+		if vmssConfig.ConfigHash != currentConfig.ConfigHash && returnMsg == "" {
 			diff := common.VmssConfigsDiff(*currentConfig, vmssConfig)
 			logger.Info().Msgf("vmss config diff: %s", diff)
 
-			err := handleVmssUpdate(ctx, currentConfig, &vmssConfig, stateParams, state.DesiredSize)
+			if currentConfig.SKU != vmssConfig.SKU && cfg.SkuMigrationEnabled {
+				skuMigration, err = startSkuMigration(ctx, store, stateParams, currentConfig, &vmssConfig)
+				if err != nil {
+					logger.Error().Err(err).Send()
+					common.WriteErrorResponse(w, err)
+					return
+				}
+				common.WriteSuccessResponse(w, fmt.Sprintf("started sku migration to vmss %s", skuMigration.Target))
+				return
+			}
+
+			err := handleVmssUpdate(ctx, store, currentConfig, &vmssConfig, stateParams, state.DesiredSize)
 			if err != nil {
 				common.WriteErrorResponse(w, err)
 				return
@@ -166,11 +264,45 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			common.WriteSuccessResponse(w, "vmss update handled successfully")
 			return
 		}
-		returnMsg = "vmss is up to date"
+		if returnMsg == "" {
+			returnMsg = "vmss is up to date"
+			if cfg.VmssUpdateApprovalRequired {
+				if err := markVmssPlanApplied(ctx, store, stateParams, currentConfig.ConfigHash); err != nil {
+					logger.Error().Err(err).Send()
+				}
+			}
+		}
+
+		// the instances of a Manual upgrade scale set are replaced by the rolling upgrade, a pending plan
+		// doesn't stop the upgrade to the current scale set model
+		if currentConfig.UpgradeMode == string(armcompute.UpgradeModeManual) {
+			vmssParams := common.ScaleSetParams{
+				SubscriptionId:    cfg.SubscriptionId,
+				ResourceGroupName: cfg.ResourceGroupName,
+				ScaleSetName:      vmScaleSetName,
+			}
+			upgradeMsg, err := handleRollingUpgrade(ctx, store, vmssParams, stateParams, currentConfig.ConfigHash)
+			if err != nil {
+				logger.Error().Err(err).Msg("rolling upgrade failed")
+				common.ReportMsg(ctx, store, "vmss", stateParams, "error", fmt.Sprintf("rolling upgrade failed: %v", err))
+			} else if upgradeMsg != "" {
+				returnMsg = fmt.Sprintf("%s; %s", returnMsg, upgradeMsg)
+			}
+		}
+	}
+
+	// the new instances need a valid bootstrap token whatever the state of the config changes
+	if bootstrapTokenNeedsRotation(scaleSet, cfg.VmBootstrapTokenTtl, time.Now()) {
+		if err := rotateBootstrapToken(ctx, scaleSet, &vmssConfig, state.DesiredSize); err != nil {
+			logger.Error().Err(err).Msg("cannot rotate the bootstrap token")
+			common.ReportMsg(ctx, store, "vmss", stateParams, "error", fmt.Sprintf("cannot rotate the bootstrap token: %v", err))
+		} else {
+			returnMsg = fmt.Sprintf("%s; rotated the bootstrap token of vmss %s", returnMsg, vmScaleSetName)
+		}
 	}
 
 	// Scale up latest vmss if needed
-	err = common.ScaleUp(ctx, subscriptionId, resourceGroupName, *scaleSet.Name, int64(state.DesiredSize))
+	err = common.ScaleUp(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, *scaleSet.Name, int64(state.DesiredSize))
 	if err != nil {
 		common.WriteErrorResponse(w, err)
 		return
@@ -179,8 +311,8 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	logger.Info().Msg(returnMsg)
 
 	// handle NFS vmss
-	if nfsScaleSetName != "" {
-		message, err := handleNFSScaleUp(ctx)
+	if cfg.NfsVmssName != "" {
+		message, err := handleNFSScaleUp(ctx, store)
 		if err != nil {
 			common.WriteErrorResponse(w, err)
 			return
@@ -191,15 +323,22 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	common.WriteSuccessResponse(w, returnMsg)
 }
 
-func handleNFSScaleUp(ctx context.Context) (message string, err error) {
+func handleNFSScaleUp(ctx context.Context, store common.StateStore) (message string, err error) {
 	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
 
 	nfsStateParams := common.BlobObjParams{
-		StorageName:   stateStorageName,
-		ContainerName: nfsContainerName,
-		BlobName:      nfsStateBlobName,
+		StorageName:   cfg.StateStorageName,
+		ContainerName: cfg.NfsStateContainerName,
+		BlobName:      cfg.NfsStateBlobName,
+	}
+	ctx = common.ContextWithOperationsState(ctx, nfsStateParams)
+
+	if _, err := common.ResolveOperations(ctx, store, nfsStateParams); err != nil {
+		logger.Error().Err(err).Msg("cannot resolve pending NFS operations")
 	}
-	nfsState, err := common.ReadStateOrCreateNew(ctx, nfsStateParams, nfsInitialState)
+
+	nfsState, err := common.ReadStateOrCreateNew(ctx, store, nfsStateParams, nfsInitialState(cfg))
 	if err != nil {
 		logger.Error().Err(err).Msg("cannot read NFS state")
 		return
@@ -209,37 +348,39 @@ func handleNFSScaleUp(ctx context.Context) (message string, err error) {
 		message = fmt.Sprintf("NFS not clusterized yet, initial size %d is set", nfsState.InitialSize)
 
 		vmssParams := common.ScaleSetParams{
-			SubscriptionId:    subscriptionId,
-			ResourceGroupName: resourceGroupName,
-			ScaleSetName:      nfsScaleSetName,
+			SubscriptionId:    cfg.SubscriptionId,
+			ResourceGroupName: cfg.ResourceGroupName,
+			ScaleSetName:      cfg.NfsVmssName,
 			Flexible:          true,
 		}
-		handleProgressingClusterization(ctx, &nfsState, vmssParams, nfsStateParams)
+		handleProgressingClusterization(ctx, store, &nfsState, vmssParams, nfsStateParams)
 		logger.Info().Msg(message)
 	}
 
-	err = common.ScaleUp(ctx, subscriptionId, resourceGroupName, nfsScaleSetName, int64(nfsState.DesiredSize))
+	err = common.ScaleUp(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, cfg.NfsVmssName, int64(nfsState.DesiredSize))
 	if err != nil {
 		err = fmt.Errorf("cannot scale up NFS vmss: %v", err)
 		return
 	}
-	message = fmt.Sprintf("scaled up NFS vmss %s to size %d successfully", nfsScaleSetName, nfsState.DesiredSize)
+	message = fmt.Sprintf("scaled up NFS vmss %s to size %d successfully", cfg.NfsVmssName, nfsState.DesiredSize)
 	logger.Info().Msg(message)
 	return
 }
 
 func createVmss(ctx context.Context, vmssConfig *common.VMSSConfig, vmssName string, vmssSize int) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
 	vmssConfigHash := vmssConfig.ConfigHash
 
-	customData, err := getBackendCustomDataScript(ctx, vmssConfig.UserData)
+	customData, tokenExpiresAt, err := getBackendCustomDataScript(ctx, vmssName, vmssConfig.UserData)
 	if err != nil {
 		logger.Error().Err(err).Msg("cannot get custom data script")
 		return err
 	}
+	setBootstrapTokenExpiry(vmssConfig, tokenExpiresAt)
 
 	logger.Info().Msgf("creating new vmss %s of size %d", vmssName, vmssSize)
-	_, err = common.CreateOrUpdateVmss(ctx, subscriptionId, resourceGroupName, vmssName, vmssConfigHash, *vmssConfig, vmssSize, customData)
+	_, err = common.CreateOrUpdateVmss(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, vmssName, vmssConfigHash, *vmssConfig, vmssSize, customData)
 	if err != nil {
 		return err
 	}
@@ -247,8 +388,9 @@ func createVmss(ctx context.Context, vmssConfig *common.VMSSConfig, vmssName str
 	return nil
 }
 
-func handleVmssUpdate(ctx context.Context, currentConfig, newConfig *common.VMSSConfig, stateParams common.BlobObjParams, desiredSize int) (err error) {
+func handleVmssUpdate(ctx context.Context, store common.StateStore, currentConfig, newConfig *common.VMSSConfig, stateParams common.BlobObjParams, desiredSize int) (err error) {
 	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
 
 	newConfigHash := newConfig.ConfigHash
 	logger.Info().Msgf("updating vmss %s (hash %s) to new config_hash %s", currentConfig.Name, currentConfig.ConfigHash, newConfigHash)
@@ -260,20 +402,21 @@ func handleVmssUpdate(ctx context.Context, currentConfig, newConfig *common.VMSS
 	}
 
 	if currentConfig.SKU != newConfig.SKU {
-		err := fmt.Errorf("cannot update vmss %s SKU from %s to %s", currentConfig.Name, currentConfig.SKU, newConfig.SKU)
+		err := fmt.Errorf("cannot update vmss %s SKU from %s to %s, SKU_MIGRATION_ENABLED is not set", currentConfig.Name, currentConfig.SKU, newConfig.SKU)
 		logger.Error().Err(err).Send()
 		errStr := err.Error()
 		update.Error = &errStr
-		return common.AddClusterUpdate(ctx, stateParams, update)
+		return common.AddClusterUpdate(ctx, store, stateParams, update)
 	}
 
-	customData, err := getBackendCustomDataScript(ctx, newConfig.UserData)
+	customData, tokenExpiresAt, err := getBackendCustomDataScript(ctx, currentConfig.Name, newConfig.UserData)
 	if err != nil {
 		logger.Error().Err(err).Msg("cannot get custom data script")
 		return err
 	}
+	setBootstrapTokenExpiry(newConfig, tokenExpiresAt)
 
-	_, err = common.CreateOrUpdateVmss(ctx, subscriptionId, resourceGroupName, currentConfig.Name, newConfigHash, *newConfig, desiredSize, customData)
+	_, err = common.CreateOrUpdateVmss(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, currentConfig.Name, newConfigHash, *newConfig, desiredSize, customData)
 	if err != nil {
 		logger.Error().Err(err).Msgf("cannot update vmss %s", currentConfig.Name)
 		errStr := err.Error()
@@ -282,28 +425,31 @@ func handleVmssUpdate(ctx context.Context, currentConfig, newConfig *common.VMSS
 		logger.Info().Msgf("updated vmss %s to new config_hash %s", currentConfig.Name, newConfigHash)
 	}
 
-	return common.AddClusterUpdate(ctx, stateParams, update)
+	return common.AddClusterUpdate(ctx, store, stateParams, update)
 }
 
-func handleProgressingClusterization(ctx context.Context, state *protocol.ClusterState, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams) {
+// handleProgressingClusterization terminates the unhealthy instances, it returns the scale set instances and the ids
+// of the unhealthy ones, nil when the instances can't be listed
+func handleProgressingClusterization(ctx context.Context, store common.StateStore, state *protocol.ClusterState, vmssParams common.ScaleSetParams, stateParams common.BlobObjParams) (vms []*common.VMInfoSummary, toTerminate []string) {
 	logger := logging.LoggerFromCtx(ctx)
 
 	vms, err := common.GetScaleSetVmsExpandedView(ctx, &vmssParams)
 	if err != nil {
 		msg := fmt.Sprintf("Failed getting vms list for vmss %s: %v", vmssParams.ScaleSetName, err)
-		common.ReportMsg(ctx, "vmss", stateParams, "error", msg)
-		return
+		common.ReportMsg(ctx, store, "vmss", stateParams, "error", msg)
+		return nil, nil
 	}
-	toTerminate := common.GetUnhealthyInstancesToTerminate(ctx, vms)
+	toTerminate = common.GetUnhealthyInstancesToTerminate(ctx, vms)
 	if len(toTerminate) > 0 {
 		msg := fmt.Sprintf("Terminating unhealthy instances indexes: %v", toTerminate)
-		common.ReportMsg(ctx, "vmss", stateParams, "debug", msg)
+		common.ReportMsg(ctx, store, "vmss", stateParams, "debug", msg)
 	}
 
 	_, terminateErrors := common.TerminateScaleSetInstances(ctx, &vmssParams, toTerminate)
 	if len(terminateErrors) > 0 {
 		msg := fmt.Sprintf("errors during terminating unhealthy instances: %v", terminateErrors)
 		logger.Info().Msgf(msg)
-		common.ReportMsg(ctx, "vmss", stateParams, "error", msg)
+		common.ReportMsg(ctx, store, "vmss", stateParams, "error", msg)
 	}
+	return
 }
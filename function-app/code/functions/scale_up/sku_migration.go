@@ -0,0 +1,354 @@
+package scale_up
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+
+	"weka-deployment/common"
+	"weka-deployment/config"
+)
+
+// The SKU of a scale set can't be changed while it has instances, a SKU change migrates the backends to a new
+// scale set instead (blue/green). Each scale_up invocation moves the migration at most one step forward:
+//  1. creating: once weka reports the data fully protected, the target scale set is created empty, with a versioned
+//     name, computer name prefix and public ip labels
+//  2. joining: the target is scaled to the desired size, its instances deploy through the join path of the deploy
+//     function since the cluster is clusterized. Once weka has both the source and target backends active and is
+//     fully protected, the target becomes the active backends scale set.
+//  3. draining: the source instances are removed by batches of at most PROTECTION_LEVEL - 1 instances, each batch
+//     once weka reports the data fully protected. The weka hosts of a batch are deactivated through the scale down
+//     and the instances are deleted through terminate once weka removed their hosts (see deactivateInstances).
+//  4. retiring: the empty source scale set is deleted
+//
+// The phase and the batch are recorded before the Azure calls they lead to, these calls are idempotent so that an
+// interrupted invocation is resumed by the next one.
+
+// versionedVmssConfig returns the config of a versioned backends scale set, the computer names and public ip
+// domain name labels of the scale sets must not overlap
+func versionedVmssConfig(vmssConfig common.VMSSConfig, name string, version int) common.VMSSConfig {
+	if version <= 1 {
+		return vmssConfig
+	}
+	suffix := fmt.Sprintf("-v%d", version)
+	vmssConfig.Name = name
+	vmssConfig.ComputerNamePrefix += suffix
+	vmssConfig.Tags = maps.Clone(vmssConfig.Tags)
+	vmssConfig.PrimaryNIC.IPConfigurations = versionedIpConfigurations(vmssConfig.PrimaryNIC.IPConfigurations, suffix)
+	if vmssConfig.SecondaryNICs != nil {
+		secondaryNics := *vmssConfig.SecondaryNICs
+		secondaryNics.IPConfigurations = versionedIpConfigurations(secondaryNics.IPConfigurations, suffix)
+		vmssConfig.SecondaryNICs = &secondaryNics
+	}
+	return vmssConfig
+}
+
+func versionedIpConfigurations(ipConfigurations []common.IPConfiguration, suffix string) []common.IPConfiguration {
+	versioned := slices.Clone(ipConfigurations)
+	for i, ipConfig := range versioned {
+		if ipConfig.PublicIPAddress != nil && ipConfig.PublicIPAddress.DomainNameLabel != "" {
+			publicIp := *ipConfig.PublicIPAddress
+			publicIp.DomainNameLabel += suffix
+			versioned[i].PublicIPAddress = &publicIp
+		}
+	}
+	return versioned
+}
+
+func startSkuMigration(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, currentConfig, newConfig *common.VMSSConfig) (migration common.SkuMigration, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
+
+	migration, err = common.UpdateSkuMigration(ctx, store, stateParams, func(migration *common.SkuMigration) error {
+		if migration.InProgress() {
+			// started by a concurrent invocation
+			return nil
+		}
+		version := migration.Version + 1
+		*migration = common.SkuMigration{
+			Active:     migration.Active,
+			Version:    version,
+			Source:     currentConfig.Name,
+			Target:     common.GetVersionedScaleSetName(cfg.Prefix, cfg.ClusterName, version),
+			FromSku:    currentConfig.SKU,
+			ToSku:      newConfig.SKU,
+			FromHash:   currentConfig.ConfigHash,
+			ConfigHash: newConfig.ConfigHash,
+			Removed:    []string{},
+			StartedAt:  time.Now(),
+		}
+		migration.SetPhase(common.SkuMigrationCreating)
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("cannot start sku migration: %v", err)
+		return
+	}
+
+	message := fmt.Sprintf("starting sku migration of vmss %s from %s to %s, the target vmss is %s", migration.Source, migration.FromSku, migration.ToSku, migration.Target)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	return
+}
+
+// saveSkuMigration writes the migration, the migration is only changed by the scale_up
+func saveSkuMigration(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, migration common.SkuMigration) error {
+	_, err := common.UpdateSkuMigration(ctx, store, stateParams, func(stored *common.SkuMigration) error {
+		*stored = migration
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("cannot save sku migration: %v", err)
+	}
+	return err
+}
+
+// handleSkuMigration moves the sku migration one step forward, newConfig is the target scale set config
+func handleSkuMigration(ctx context.Context, store common.StateStore, state *protocol.ClusterState, stateParams common.BlobObjParams, migration *common.SkuMigration, newConfig *common.VMSSConfig) (message string, err error) {
+	cfg := config.FromCtx(ctx)
+	sourceParams := common.ScaleSetParams{
+		SubscriptionId:    cfg.SubscriptionId,
+		ResourceGroupName: cfg.ResourceGroupName,
+		ScaleSetName:      migration.Source,
+	}
+	targetParams := sourceParams
+	targetParams.ScaleSetName = migration.Target
+
+	switch migration.Phase {
+	case common.SkuMigrationCreating:
+		return createTargetScaleSet(ctx, store, stateParams, migration, newConfig, sourceParams)
+	case common.SkuMigrationJoining:
+		return waitTargetJoined(ctx, store, state, stateParams, migration, sourceParams)
+	case common.SkuMigrationDraining:
+		return drainSourceScaleSet(ctx, store, stateParams, migration, sourceParams, targetParams)
+	case common.SkuMigrationRetiring:
+		return retireSourceScaleSet(ctx, store, stateParams, migration)
+	default:
+		return "", fmt.Errorf("unknown sku migration phase %q", migration.Phase)
+	}
+}
+
+func createTargetScaleSet(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, migration *common.SkuMigration, newConfig *common.VMSSConfig, sourceParams common.ScaleSetParams) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	protection, err := getWekaProtectionStatus(ctx, sourceParams)
+	if err != nil {
+		return
+	}
+	if !protection.FullyProtected() {
+		return "sku migration waiting for the cluster to be fully protected before creating the target vmss", nil
+	}
+
+	// the target is created empty, it is scaled up once the migration is recorded in the joining phase
+	targetConfig := versionedVmssConfig(*newConfig, migration.Target, migration.Version)
+	if err = createVmss(ctx, &targetConfig, migration.Target, 0); err != nil {
+		err = fmt.Errorf("cannot create target vmss %s: %v", migration.Target, err)
+		return
+	}
+
+	migration.SourceBackends = protection.Hosts.Backends.Active
+	migration.SetPhase(common.SkuMigrationJoining)
+	if err = saveSkuMigration(ctx, store, stateParams, *migration); err != nil {
+		return
+	}
+	message = fmt.Sprintf("created target vmss %s with sku %s", migration.Target, migration.ToSku)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	return
+}
+
+func waitTargetJoined(ctx context.Context, store common.StateStore, state *protocol.ClusterState, stateParams common.BlobObjParams, migration *common.SkuMigration, sourceParams common.ScaleSetParams) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
+
+	err = common.ScaleUp(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, migration.Target, int64(state.DesiredSize))
+	if err != nil {
+		err = fmt.Errorf("cannot scale up target vmss %s: %v", migration.Target, err)
+		return
+	}
+
+	protection, err := getWekaProtectionStatus(ctx, sourceParams)
+	if err != nil {
+		return
+	}
+	expected := migration.SourceBackends + state.DesiredSize
+	if !protection.FullyProtected() || protection.Hosts.Backends.Active < expected {
+		message = fmt.Sprintf("sku migration waiting for the instances of %s to join (%d/%d active backends, fully protected: %t)",
+			migration.Target, protection.Hosts.Backends.Active, expected, protection.FullyProtected())
+		return message, nil
+	}
+
+	migration.Active = migration.Target
+	migration.SetPhase(common.SkuMigrationDraining)
+	if err = saveSkuMigration(ctx, store, stateParams, *migration); err != nil {
+		return
+	}
+	message = fmt.Sprintf("the instances of %s joined the cluster, it is the active vmss, draining %s", migration.Target, migration.Source)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	return
+}
+
+func drainSourceScaleSet(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, migration *common.SkuMigration, sourceParams, targetParams common.ScaleSetParams) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
+
+	vms, err := common.GetScaleSetVmsExpandedView(ctx, &sourceParams)
+	if err != nil {
+		return
+	}
+	var remaining, pending []*common.VMInfoSummary
+	for _, vm := range vms {
+		if vm.ProvisioningState != nil && *vm.ProvisioningState == "Deleting" {
+			continue
+		}
+		remaining = append(remaining, vm)
+		if slices.Contains(migration.Batch, vm.InstanceID) {
+			pending = append(pending, vm)
+		}
+	}
+	sortInstances(remaining)
+
+	if len(pending) > 0 {
+		// the hosts of the batch are being deactivated, or the previous deletion failed or was interrupted
+		return removeSourceInstances(ctx, store, stateParams, migration, sourceParams, targetParams, remaining)
+	}
+
+	if len(remaining) == 0 {
+		migration.Batch, migration.Deactivated = nil, nil
+		migration.SetPhase(common.SkuMigrationRetiring)
+		if err = saveSkuMigration(ctx, store, stateParams, *migration); err != nil {
+			return
+		}
+		message = fmt.Sprintf("vmss %s is drained, retiring it", migration.Source)
+		logger.Info().Msg(message)
+		common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+		return
+	}
+
+	protection, err := getWekaProtectionStatus(ctx, targetParams)
+	if err != nil {
+		return
+	}
+	if !protection.FullyProtected() {
+		return fmt.Sprintf("sku migration waiting for the cluster to be fully protected, %d instances of %s left", len(remaining), migration.Source), nil
+	}
+
+	// the cluster must still be able to lose a backend while the hosts of the batch are deactivated
+	batchSize := min(cfg.SkuMigrationBatchSize, max(cfg.ProtectionLevel-1, 1))
+	batch := remaining[:min(batchSize, len(remaining))]
+	migration.Batch, migration.Deactivated = nil, nil
+	var names []string
+	for _, vm := range batch {
+		migration.Batch = append(migration.Batch, vm.InstanceID)
+		migration.Removed = append(migration.Removed, vm.Name)
+		names = append(names, vm.Name)
+	}
+	// the batch must be recorded before its hosts are deactivated, so that the removal is resumed if it is interrupted
+	if err = saveSkuMigration(ctx, store, stateParams, *migration); err != nil {
+		return
+	}
+	message = fmt.Sprintf("deactivating the weka hosts of instances %v of %s for the sku migration", names, migration.Source)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	return removeSourceInstances(ctx, store, stateParams, migration, sourceParams, targetParams, remaining)
+}
+
+// removeSourceInstances deactivates the weka hosts of the batch, and deletes the instances of the batch once weka
+// removed their hosts. remaining are the source instances, including the batch.
+func removeSourceInstances(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, migration *common.SkuMigration, sourceParams, targetParams common.ScaleSetParams, remaining []*common.VMInfoSummary) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	sourceInstances, err := common.GetScaleSetInstancesInfoFromVms(ctx, &sourceParams, remaining)
+	if err != nil {
+		return
+	}
+	targetInstances, err := common.GetScaleSetInstancesInfo(ctx, &targetParams)
+	if err != nil {
+		return
+	}
+	batch, _ := splitInstances(sourceInstances, migration.Batch)
+	deactivated, others := splitInstances(sourceInstances, migration.Deactivated)
+	deactivating, _ := splitInstances(others, migration.Batch)
+
+	if len(deactivating) > 0 {
+		removed, err := deactivateInstances(ctx, deactivating, append(slices.Clone(targetInstances), others...))
+		if err != nil {
+			return "", fmt.Errorf("cannot deactivate the weka hosts of %s for the sku migration, will retry: %v", migration.Source, err)
+		}
+		if len(removed) > 0 {
+			// the host removals must be recorded before the instances are deleted, weka doesn't report them again
+			migration.Deactivated = append(migration.Deactivated, removed...)
+			if err = saveSkuMigration(ctx, store, stateParams, *migration); err != nil {
+				return "", err
+			}
+			deactivated, others = splitInstances(sourceInstances, migration.Deactivated)
+			deactivating, _ = splitInstances(others, migration.Batch)
+		}
+	}
+
+	if len(deactivated) > 0 {
+		var ids, names []string
+		for _, instance := range deactivated {
+			ids = append(ids, instance.Id)
+			if vm := findInstance(remaining, instance.Id); vm != nil {
+				names = append(names, vm.Name)
+			}
+		}
+		// the target instances stay in the cluster too, the last batch leaves no source instance
+		if err = terminateInstances(ctx, store, sourceParams, stateParams, ids, append(slices.Clone(targetInstances), others...)); err != nil {
+			return "", fmt.Errorf("cannot remove instances %v of %s for the sku migration, will retry: %v", names, migration.Source, err)
+		}
+		message = fmt.Sprintf("removed instances %v of %s for the sku migration", names, migration.Source)
+		logger.Info().Msg(message)
+		common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	}
+
+	if len(deactivating) > 0 {
+		waiting := fmt.Sprintf("sku migration waiting for weka to deactivate and remove the hosts of %d/%d instances of the batch", len(deactivating), len(batch))
+		if message == "" {
+			return waiting, nil
+		}
+		message = fmt.Sprintf("%s; %s", message, waiting)
+	}
+	return
+}
+
+func retireSourceScaleSet(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, migration *common.SkuMigration) (message string, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
+
+	scaleSet, err := common.GetScaleSetOrNil(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, migration.Source)
+	if err != nil {
+		return
+	}
+	if scaleSet != nil {
+		// deleting a scale set which is already being deleted is accepted
+		if err = common.DeleteScaleSet(ctx, cfg.SubscriptionId, cfg.ResourceGroupName, migration.Source); err != nil {
+			err = fmt.Errorf("cannot delete vmss %s: %v", migration.Source, err)
+			return
+		}
+		return fmt.Sprintf("deleting vmss %s", migration.Source), nil
+	}
+
+	now := time.Now()
+	migration.CompletedAt = &now
+	migration.Batch = nil
+	migration.SetPhase(common.SkuMigrationCompleted)
+	if err = saveSkuMigration(ctx, store, stateParams, *migration); err != nil {
+		return
+	}
+	message = fmt.Sprintf("sku migration from %s (%s) to %s (%s) completed", migration.Source, migration.FromSku, migration.Target, migration.ToSku)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	update := protocol.Update{From: migration.FromHash, To: migration.ConfigHash, Time: now}
+	if err := common.AddClusterUpdate(ctx, store, stateParams, update); err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return
+}
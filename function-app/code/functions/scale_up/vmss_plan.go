@@ -0,0 +1,92 @@
+package scale_up
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/weka/go-cloud-lib/logging"
+
+	"weka-deployment/common"
+	"weka-deployment/config"
+)
+
+// planVmssUpdate returns the plan of the config change, a new pending plan is recorded the first time the change
+// is seen. The change is only applied once the plan is approved with the vmss function.
+func planVmssUpdate(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, scaleSet *armcompute.VirtualMachineScaleSet, currentConfig, newConfig *common.VMSSConfig) (plan common.VmssPlan, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+	cfg := config.FromCtx(ctx)
+
+	plans, err := common.GetVmssPlans(ctx, store, stateParams)
+	if err != nil {
+		err = fmt.Errorf("cannot read vmss plans: %v", err)
+		return
+	}
+	if existing := plans.Find(currentConfig.ConfigHash, newConfig.ConfigHash); existing != nil {
+		return *existing, nil
+	}
+
+	instances := 0
+	if scaleSet.SKU != nil && scaleSet.SKU.Capacity != nil {
+		instances = int(*scaleSet.SKU.Capacity)
+	}
+	plan, err = common.NewVmssPlan(*currentConfig, *newConfig, instances, cfg.SkuMigrationEnabled)
+	if err != nil {
+		err = fmt.Errorf("cannot plan vmss update: %v", err)
+		return
+	}
+	_, err = common.UpdateVmssPlans(ctx, store, stateParams, func(plans *common.VmssPlans) error {
+		if existing := plans.Find(plan.From, plan.Id); existing != nil {
+			plan = *existing
+			return nil
+		}
+		plans.Add(plan)
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("cannot save vmss plan: %v", err)
+		return
+	}
+
+	message := fmt.Sprintf("vmss %s config change from %s to %s waits for approval (risk: %s)", plan.Vmss, plan.From, plan.Id, plan.Risk)
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	return
+}
+
+// markVmssPlanApplied marks the approved plan of the config the scale set was updated to as applied
+func markVmssPlanApplied(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, configHash string) error {
+	plans, err := common.GetVmssPlans(ctx, store, stateParams)
+	if err != nil {
+		return fmt.Errorf("cannot read vmss plans: %v", err)
+	}
+	if !hasApprovedPlan(plans, configHash) {
+		return nil
+	}
+
+	_, err = common.UpdateVmssPlans(ctx, store, stateParams, func(plans *common.VmssPlans) error {
+		now := time.Now()
+		for i := range plans.Plans {
+			if plans.Plans[i].Id == configHash && plans.Plans[i].Status == common.VmssPlanApproved {
+				plans.Plans[i].Status = common.VmssPlanApplied
+				plans.Plans[i].AppliedAt = &now
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot save vmss plans: %v", err)
+	}
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", fmt.Sprintf("vmss plan %s was applied", configHash))
+	return nil
+}
+
+func hasApprovedPlan(plans common.VmssPlans, configHash string) bool {
+	for _, plan := range plans.Plans {
+		if plan.Id == configHash && plan.Status == common.VmssPlanApproved {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"weka-deployment/common"
+	"weka-deployment/config"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+// currentVersion refers to the current state in diff requests
+const currentVersion = "current"
+
+type StateRequest struct {
+	// one of: list, diff, restore
+	Action   string  `json:"action" validate:"required"`
+	Protocol *string `json:"protocol"`
+	// version to restore
+	Version string `json:"version"`
+	// versions to diff, "to" defaults to the current state
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func readVersion(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, version string) (protocol.ClusterState, error) {
+	if version == "" || version == currentVersion {
+		return common.ReadState(ctx, store, stateParams)
+	}
+	return common.ReadStateVersion(ctx, store, stateParams, version)
+}
+
+func DiffStateVersions(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, from, to string) (string, error) {
+	if from == "" {
+		return "", fmt.Errorf("wrong request format. 'from' is required")
+	}
+	fromState, err := readVersion(ctx, store, stateParams, from)
+	if err != nil {
+		return "", fmt.Errorf("cannot read state version %s: %v", from, err)
+	}
+	toState, err := readVersion(ctx, store, stateParams, to)
+	if err != nil {
+		return "", fmt.Errorf("cannot read state version %s: %v", to, err)
+	}
+	return cmp.Diff(fromState, toState), nil
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
+
+	stateReq, err := common.DecodeBody[StateRequest](r)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+
+	stateParams := common.BlobObjParams{
+		StorageName:   stateStorageName,
+		ContainerName: stateContainerName,
+		BlobName:      stateBlobName,
+	}
+	if stateReq.Protocol != nil && *stateReq.Protocol == "nfs" {
+		stateParams.ContainerName = nfsStateContainerName
+		stateParams.BlobName = nfsStateBlobName
+
+		logger = logger.WithStrValue("protocol", "nfs")
+	}
+
+	var result interface{}
+	switch stateReq.Action {
+	case "list":
+		result, err = common.ListStateVersions(ctx, store, stateParams)
+	case "diff":
+		result, err = DiffStateVersions(ctx, store, stateParams, stateReq.From, stateReq.To)
+	case "restore":
+		if stateReq.Version == "" {
+			err = fmt.Errorf("wrong request format. 'version' is required")
+			break
+		}
+		_, err = common.RestoreStateVersion(ctx, store, stateParams, stateReq.Version)
+		result = fmt.Sprintf("State was restored to version %s successfully", stateReq.Version)
+	default:
+		err = fmt.Errorf("unsupported action %q, supported actions: list, diff, restore", stateReq.Action)
+	}
+
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+	common.WriteSuccessResponse(w, result)
+}
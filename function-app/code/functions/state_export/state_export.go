@@ -0,0 +1,105 @@
+package state_export
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/config"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+func ExportState(ctx context.Context, store common.StateStore, keyVaultUri string, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams, nfsScaleSetName string, nfsStateParams common.BlobObjParams) (signed common.SignedStateBundle, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	bundle := common.StateBundle{
+		SchemaVersion: common.StateSchemaVersion,
+		CreatedAt:     time.Now().UTC(),
+		ScaleSetName:  vmssParams.ScaleSetName,
+	}
+
+	bundle.State, err = common.ReadState(ctx, store, stateParams)
+	if err != nil {
+		err = fmt.Errorf("cannot read state: %v", err)
+		return
+	}
+
+	if nfsScaleSetName != "" {
+		nfsState, err2 := common.ReadState(ctx, store, nfsStateParams)
+		if err2 != nil {
+			err = fmt.Errorf("cannot read NFS state: %v", err2)
+			return
+		}
+		bundle.NfsScaleSetName = nfsScaleSetName
+		bundle.NfsState = &nfsState
+	}
+
+	vmssConfig, err := common.GetCurrentScaleSetConfiguration(ctx, vmssParams)
+	if err != nil {
+		err = fmt.Errorf("cannot get vmss configuration: %v", err)
+		return
+	}
+	if vmssConfig != nil {
+		bundle.VmssConfigHash = vmssConfig.ConfigHash
+	} else {
+		logger.Warn().Msgf("vmss %s is not found, exporting state without config hash", vmssParams.ScaleSetName)
+	}
+
+	key, err := common.GetStateBundleSigningKey(ctx, keyVaultUri)
+	if err != nil {
+		return
+	}
+	return common.SignStateBundle(bundle, key)
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	nfsScaleSetName := cfg.NfsVmssName
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	prefix := cfg.Prefix
+	clusterName := cfg.ClusterName
+	keyVaultUri := cfg.KeyVaultUri
+
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
+
+	stateParams := common.BlobObjParams{
+		StorageName:   stateStorageName,
+		ContainerName: stateContainerName,
+		BlobName:      stateBlobName,
+	}
+	nfsStateParams := common.BlobObjParams{
+		StorageName:   stateStorageName,
+		ContainerName: nfsStateContainerName,
+		BlobName:      nfsStateBlobName,
+	}
+	vmScaleSetName, err := common.GetBackendsScaleSetName(ctx, store, stateParams, prefix, clusterName)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+	vmssParams := &common.ScaleSetParams{
+		SubscriptionId:    subscriptionId,
+		ResourceGroupName: resourceGroupName,
+		ScaleSetName:      vmScaleSetName,
+		Flexible:          false,
+	}
+
+	signed, err := ExportState(ctx, store, keyVaultUri, vmssParams, stateParams, nfsScaleSetName, nfsStateParams)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+	common.WriteSuccessResponse(w, signed)
+}
@@ -0,0 +1,284 @@
+package state_import
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"weka-deployment/common"
+	"weka-deployment/config"
+
+	"github.com/weka/go-cloud-lib/logging"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+type ImportRequest struct {
+	// one of: bundle (default), reconstruct
+	Mode   string                    `json:"mode"`
+	Bundle *common.SignedStateBundle `json:"bundle"`
+	// validate only, without writing the state
+	DryRun bool `json:"dry_run"`
+	// write the state even if the validation failed
+	Force bool `json:"force"`
+}
+
+type ImportResponse struct {
+	Mode       string                 `json:"mode"`
+	Validation common.StateValidation `json:"validation"`
+	State      protocol.ClusterState  `json:"state"`
+	NfsState   *protocol.ClusterState `json:"nfs_state,omitempty"`
+	Written    bool                   `json:"written"`
+}
+
+type ImportParams struct {
+	KeyVaultUri          string
+	VmssParams           *common.ScaleSetParams
+	StateParams          common.BlobObjParams
+	NfsVmssParams        *common.ScaleSetParams
+	NfsStateParams       common.BlobObjParams
+	InitialClusterSize   int
+	ClusterizationTarget int
+	InitialNfsSize       int
+}
+
+func validateState(ctx context.Context, state protocol.ClusterState, vmssParams *common.ScaleSetParams, configHash string, validation *common.StateValidation) {
+	config, err := common.GetCurrentScaleSetConfiguration(ctx, vmssParams)
+	if err != nil {
+		validation.AddError("cannot get vmss %s: %v", vmssParams.ScaleSetName, err)
+		return
+	}
+	if config == nil {
+		if state.Clusterized || len(state.Instances) > 0 {
+			validation.AddError("vmss %s is not found but the state contains clusterization info", vmssParams.ScaleSetName)
+		}
+		return
+	}
+	if configHash != "" && config.ConfigHash != configHash {
+		validation.AddWarning("vmss %s config hash %s differs from the exported %s, the vmss will be updated", vmssParams.ScaleSetName, config.ConfigHash, configHash)
+	}
+
+	vms, err := common.GetScaleSetInstances(ctx, vmssParams)
+	if err != nil {
+		validation.AddError("cannot get vmss %s instances: %v", vmssParams.ScaleSetName, err)
+		return
+	}
+	common.ValidateStateAgainstInstances(state, vms, validation)
+}
+
+func importBundle(ctx context.Context, signed *common.SignedStateBundle, p ImportParams) (response ImportResponse, err error) {
+	if signed == nil {
+		err = fmt.Errorf("wrong request format. 'bundle' is required")
+		return
+	}
+	key, err := common.GetStateBundleSigningKey(ctx, p.KeyVaultUri)
+	if err != nil {
+		return
+	}
+	bundle, err := common.VerifyStateBundle(*signed, key)
+	if err != nil {
+		return
+	}
+
+	response.State = bundle.State
+	validation := &response.Validation
+	if bundle.ScaleSetName != p.VmssParams.ScaleSetName {
+		validation.AddError("bundle was exported for vmss %s, current vmss is %s", bundle.ScaleSetName, p.VmssParams.ScaleSetName)
+	}
+	validateState(ctx, bundle.State, p.VmssParams, bundle.VmssConfigHash, validation)
+
+	switch {
+	case bundle.NfsState != nil && p.NfsVmssParams == nil:
+		validation.AddError("bundle contains NFS state but NFS is not configured")
+	case bundle.NfsState != nil:
+		if bundle.NfsScaleSetName != p.NfsVmssParams.ScaleSetName {
+			validation.AddError("bundle was exported for NFS vmss %s, current NFS vmss is %s", bundle.NfsScaleSetName, p.NfsVmssParams.ScaleSetName)
+		}
+		validateState(ctx, *bundle.NfsState, p.NfsVmssParams, "", validation)
+		response.NfsState = bundle.NfsState
+	case p.NfsVmssParams != nil:
+		validation.AddWarning("bundle doesn't contain NFS state, NFS state is left unchanged")
+	}
+	return
+}
+
+func reconstructState(ctx context.Context, vmssParams *common.ScaleSetParams, initialSize, clusterizationTarget int, validation *common.StateValidation) (state *protocol.ClusterState, err error) {
+	scaleSet, err := common.GetScaleSetOrNil(ctx, vmssParams.SubscriptionId, vmssParams.ResourceGroupName, vmssParams.ScaleSetName)
+	if err != nil {
+		return
+	}
+	if scaleSet == nil {
+		validation.AddWarning("vmss %s is not found, nothing to reconstruct", vmssParams.ScaleSetName)
+		return
+	}
+
+	vms, err := common.GetScaleSetInstances(ctx, vmssParams)
+	if err != nil {
+		return
+	}
+	capacity := 0
+	if scaleSet.SKU != nil && scaleSet.SKU.Capacity != nil {
+		capacity = int(*scaleSet.SKU.Capacity)
+	}
+
+	reconstructed, warnings := common.ReconstructClusterState(vms, capacity, initialSize, clusterizationTarget)
+	for _, warning := range warnings {
+		validation.AddWarning("vmss %s: %s", vmssParams.ScaleSetName, warning)
+	}
+	return &reconstructed, nil
+}
+
+func reconstruct(ctx context.Context, p ImportParams) (response ImportResponse, err error) {
+	validation := &response.Validation
+
+	state, err := reconstructState(ctx, p.VmssParams, p.InitialClusterSize, p.ClusterizationTarget, validation)
+	if err != nil {
+		return
+	}
+	if state == nil {
+		validation.AddError("backend vmss doesn't exist, scale_up creates a new state and vmss by itself")
+		return
+	}
+	response.State = *state
+
+	if p.NfsVmssParams != nil {
+		response.NfsState, err = reconstructState(ctx, p.NfsVmssParams, p.InitialNfsSize, p.InitialNfsSize, validation)
+	}
+	return
+}
+
+func writeState(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, state protocol.ClusterState) (err error) {
+	if err = store.EnsureContainer(ctx, stateParams); err != nil {
+		return
+	}
+	lock, err := common.LockContainer(ctx, store, stateParams)
+	if err != nil {
+		return
+	}
+	defer common.UnlockContainer(ctx, lock)
+
+	return common.WriteState(ctx, store, stateParams, state)
+}
+
+func ImportState(ctx context.Context, store common.StateStore, request ImportRequest, p ImportParams) (response ImportResponse, err error) {
+	logger := logging.LoggerFromCtx(ctx)
+
+	switch request.Mode {
+	case "", "bundle":
+		response, err = importBundle(ctx, request.Bundle, p)
+		response.Mode = "bundle"
+	case "reconstruct":
+		response, err = reconstruct(ctx, p)
+		response.Mode = request.Mode
+	default:
+		err = fmt.Errorf("unsupported mode %q, supported modes: bundle, reconstruct", request.Mode)
+	}
+	if err != nil {
+		return
+	}
+
+	response.Validation.Valid = len(response.Validation.Errors) == 0
+	if response.Validation.Errors == nil {
+		response.Validation.Errors = []string{}
+	}
+	if response.Validation.Warnings == nil {
+		response.Validation.Warnings = []string{}
+	}
+
+	if request.DryRun {
+		return
+	}
+	if !response.Validation.Valid && !request.Force {
+		err = fmt.Errorf("state validation failed: %s", strings.Join(response.Validation.Errors, "; "))
+		return
+	}
+
+	logger.Info().Msgf("writing %s state (clusterized: %t, desired size: %d)", response.Mode, response.State.Clusterized, response.State.DesiredSize)
+	if err = writeState(ctx, store, p.StateParams, response.State); err != nil {
+		err = fmt.Errorf("cannot write state: %v", err)
+		return
+	}
+	if response.NfsState != nil {
+		if err = writeState(ctx, store, p.NfsStateParams, *response.NfsState); err != nil {
+			err = fmt.Errorf("cannot write NFS state: %v", err)
+			return
+		}
+	}
+	response.Written = true
+	return
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromCtx(r.Context())
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	nfsScaleSetName := cfg.NfsVmssName
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	prefix := cfg.Prefix
+	clusterName := cfg.ClusterName
+	keyVaultUri := cfg.KeyVaultUri
+	initialClusterSize := cfg.InitialClusterSize
+	clusterizationTarget := cfg.ClusterizationTarget
+	initialNfsSize := cfg.NfsProtocolGatewaysNum
+
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
+
+	importReq, err := common.DecodeBody[ImportRequest](r)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+
+	stateParams := common.BlobObjParams{
+		StorageName:   stateStorageName,
+		ContainerName: stateContainerName,
+		BlobName:      stateBlobName,
+	}
+	vmScaleSetName, err := common.GetBackendsScaleSetName(ctx, store, stateParams, prefix, clusterName)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+
+	p := ImportParams{
+		KeyVaultUri: keyVaultUri,
+		VmssParams: &common.ScaleSetParams{
+			SubscriptionId:    subscriptionId,
+			ResourceGroupName: resourceGroupName,
+			ScaleSetName:      vmScaleSetName,
+			Flexible:          false,
+		},
+		StateParams: stateParams,
+		NfsStateParams: common.BlobObjParams{
+			StorageName:   stateStorageName,
+			ContainerName: nfsStateContainerName,
+			BlobName:      nfsStateBlobName,
+		},
+		InitialClusterSize:   initialClusterSize,
+		ClusterizationTarget: clusterizationTarget,
+		InitialNfsSize:       initialNfsSize,
+	}
+	if nfsScaleSetName != "" {
+		p.NfsVmssParams = &common.ScaleSetParams{
+			SubscriptionId:    subscriptionId,
+			ResourceGroupName: resourceGroupName,
+			ScaleSetName:      nfsScaleSetName,
+			Flexible:          true,
+		}
+	}
+
+	response, err := ImportState(ctx, store, importReq, p)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+	common.WriteSuccessResponse(w, response)
+}
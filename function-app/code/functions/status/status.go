@@ -2,21 +2,15 @@ package status
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
-	"os"
 	"strings"
-	"time"
 
-	"github.com/weka/go-cloud-lib/connectors"
-	"github.com/weka/go-cloud-lib/lib/jrpc"
-	"github.com/weka/go-cloud-lib/lib/weka"
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
 
 	"weka-deployment/common"
+	"weka-deployment/config"
 )
 
 func itemInList(item string, list []string) bool {
@@ -98,11 +92,11 @@ func addSummary(ctx context.Context, state protocol.ClusterState, stateParams co
 	reports.Summary = summary
 }
 
-func GetReports(ctx context.Context, stateParams common.BlobObjParams, vmssParams *common.ScaleSetParams) (reports protocol.Reports, err error) {
+func GetReports(ctx context.Context, store common.StateStore, stateParams common.BlobObjParams, vmssParams *common.ScaleSetParams) (reports protocol.Reports, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msg("fetching cluster status...")
 
-	state, err := common.ReadState(ctx, stateParams)
+	state, err := common.ReadState(ctx, store, stateParams)
 	if err != nil {
 		return
 	}
@@ -122,11 +116,11 @@ func GetReports(ctx context.Context, stateParams common.BlobObjParams, vmssParam
 	return
 }
 
-func GetClusterStatus(ctx context.Context, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams, keyVaultUri string) (clusterStatus protocol.ClusterStatus, err error) {
+func GetClusterStatus(ctx context.Context, store common.StateStore, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams, keyVaultUri string) (clusterStatus protocol.ClusterStatus, err error) {
 	logger := logging.LoggerFromCtx(ctx)
 	logger.Info().Msg("fetching cluster status...")
 
-	state, err := common.ReadState(ctx, stateParams)
+	state, err := common.ReadState(ctx, store, stateParams)
 	if err != nil {
 		return
 	}
@@ -137,43 +131,8 @@ func GetClusterStatus(ctx context.Context, vmssParams *common.ScaleSetParams, st
 		return
 	}
 
-	credentials, err := common.GetWekaClusterCredentials(ctx, keyVaultUri)
-	if err != nil {
-		return
-	}
-
-	jrpcBuilder := func(ip string) *jrpc.BaseClient {
-		return connectors.NewJrpcClient(ctx, ip, weka.ManagementJrpcPort, credentials.Username, credentials.Password)
-	}
-
-	vmIps, err := common.GetVmsPrivateIps(ctx, vmssParams)
-	if err != nil {
-		return
-	}
-	ips := make([]string, 0, len(vmIps))
-	for _, ip := range vmIps {
-		ips = append(ips, ip)
-	}
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	r.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
-	logger.Info().Msgf("ips: %s", ips)
-	jpool := &jrpc.Pool{
-		Ips:     ips,
-		Clients: map[string]*jrpc.BaseClient{},
-		Active:  "",
-		Builder: jrpcBuilder,
-		Ctx:     ctx,
-	}
-
-	var rawWekaStatus json.RawMessage
-
-	err = jpool.Call(weka.JrpcStatus, struct{}{}, &rawWekaStatus)
-	if err != nil {
-		return
-	}
-
 	wekaStatus := protocol.WekaStatus{}
-	if err = json.Unmarshal(rawWekaStatus, &wekaStatus); err != nil {
+	if err = common.WekaClientFromCtx(ctx).Status(ctx, vmssParams, keyVaultUri, &wekaStatus); err != nil {
 		return
 	}
 	clusterStatus.WekaStatus = wekaStatus
@@ -181,7 +140,7 @@ func GetClusterStatus(ctx context.Context, vmssParams *common.ScaleSetParams, st
 	return
 }
 
-func GetRefreshStatus(ctx context.Context, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams, vmssConfigStr string, extended bool) (*common.VMSSStateVerbose, error) {
+func GetRefreshStatus(ctx context.Context, store common.StateStore, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams, vmssConfigStr string, extended bool) (*common.VMSSStateVerbose, error) {
 	vmssConfig, err := common.ReadVmssConfig(ctx, vmssConfigStr)
 	if err != nil {
 		return nil, err
@@ -211,7 +170,7 @@ func GetRefreshStatus(ctx context.Context, vmssParams *common.ScaleSetParams, st
 		result.CurrentConfig = currentConfig
 	}
 
-	state, err := common.ReadState(ctx, stateParams)
+	state, err := common.ReadState(ctx, store, stateParams)
 	if err != nil {
 		return nil, err
 	}
@@ -221,68 +180,65 @@ func GetRefreshStatus(ctx context.Context, vmssParams *common.ScaleSetParams, st
 	for _, update := range state.Updates {
 		result.UpdatesLog = append(result.UpdatesLog, update)
 	}
+
+	plans, err := common.GetVmssPlans(ctx, store, stateParams)
+	if err != nil {
+		return nil, err
+	}
+	result.PendingPlan = plans.Pending()
 	return result, nil
 }
 
+type StatusRequest struct {
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	// page through the reports archived out of the state, for "progress" type
+	ArchivePage *int `json:"archive_page"`
+	PageSize    int  `json:"page_size"`
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	keyVaultUri := os.Getenv("KEY_VAULT_URI")
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-	nfsScaleSetName := os.Getenv("NFS_VMSS_NAME")
-	vmssConfigStr := os.Getenv("VMSS_CONFIG")
+	cfg := config.FromCtx(r.Context())
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	prefix := cfg.Prefix
+	clusterName := cfg.ClusterName
+	keyVaultUri := cfg.KeyVaultUri
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	nfsScaleSetName := cfg.NfsVmssName
+	vmssConfigStr := cfg.VmssConfig
 
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	var invokeRequest common.InvokeRequest
-
-	var requestBody struct {
-		Type     string `json:"type"`
-		Protocol string `json:"protocol"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&invokeRequest); err != nil {
-		err = fmt.Errorf("cannot decode the request: %v", err)
-		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err := json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	requestBody, err := common.DecodeBody[StatusRequest](r)
 	if err != nil {
-		err = fmt.Errorf("cannot unmarshal the request data: %v", err)
 		logger.Error().Err(err).Send()
-		common.WriteErrorResponse(w, err)
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
 
-	if reqData["Body"] != nil {
-		if err := json.Unmarshal([]byte(reqData["Body"].(string)), &requestBody); err != nil {
-			err = fmt.Errorf("cannot unmarshal the request body: %v", err)
-			logger.Error().Err(err).Send()
-			common.WriteErrorResponse(w, err)
-			return
-		}
-	}
-
 	stateParams := common.BlobObjParams{
 		StorageName:   stateStorageName,
 		ContainerName: stateContainerName,
 		BlobName:      stateBlobName,
 	}
 
+	vmScaleSetName, err := common.GetBackendsScaleSetName(ctx, store, stateParams, prefix, clusterName)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
 	vmssParams := &common.ScaleSetParams{
 		SubscriptionId:    subscriptionId,
 		ResourceGroupName: resourceGroupName,
-		ScaleSetName:      common.GetVmScaleSetName(prefix, clusterName),
+		ScaleSetName:      vmScaleSetName,
 		Flexible:          false,
 	}
 
@@ -296,13 +252,25 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
 	var result interface{}
 	if requestBody.Type == "" || requestBody.Type == "status" {
-		result, err = GetClusterStatus(ctx, vmssParams, stateParams, keyVaultUri)
+		result, err = GetClusterStatus(ctx, store, vmssParams, stateParams, keyVaultUri)
+	} else if requestBody.Type == "progress" && requestBody.ArchivePage != nil {
+		result, err = common.GetArchivedReports(ctx, store, stateParams, *requestBody.ArchivePage, requestBody.PageSize)
 	} else if requestBody.Type == "progress" {
-		result, err = GetReports(ctx, stateParams, vmssParams)
+		result, err = GetReports(ctx, store, stateParams, vmssParams)
 	} else if requestBody.Type == "vmss" {
-		result, err = GetRefreshStatus(ctx, vmssParams, stateParams, vmssConfigStr, false)
+		result, err = GetRefreshStatus(ctx, store, vmssParams, stateParams, vmssConfigStr, false)
 	} else if requestBody.Type == "vmss-extended" {
-		result, err = GetRefreshStatus(ctx, vmssParams, stateParams, vmssConfigStr, true)
+		result, err = GetRefreshStatus(ctx, store, vmssParams, stateParams, vmssConfigStr, true)
+	} else if requestBody.Type == "operations" {
+		result, err = common.GetOperations(ctx, store, stateParams)
+	} else if requestBody.Type == "upgrade" {
+		result, err = common.GetRollingUpgrade(ctx, store, stateParams)
+	} else if requestBody.Type == "migration" {
+		result, err = common.GetSkuMigration(ctx, store, stateParams)
+	} else if requestBody.Type == "clusterization" {
+		result, err = common.GetClusterizationWatch(ctx, store, stateParams)
+	} else if requestBody.Type == "audit" {
+		result, err = common.GetAuditEntries(ctx, store, stateParams)
 	} else {
 		result = "Invalid status type"
 	}
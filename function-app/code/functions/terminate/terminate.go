@@ -2,13 +2,12 @@ package terminate
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"time"
 	"weka-deployment/common"
+	"weka-deployment/config"
 
 	"github.com/weka/go-cloud-lib/logging"
 	"github.com/weka/go-cloud-lib/protocol"
@@ -115,7 +114,7 @@ func terminateUnhealthyInstances(ctx context.Context, vmssParams *common.ScaleSe
 	return terminateErrors
 }
 
-func setDeletionProtection(ctx context.Context, allVms []*common.VMInfoSummary, excludeInstanceIds []string, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams) {
+func setDeletionProtection(ctx context.Context, store common.StateStore, allVms []*common.VMInfoSummary, excludeInstanceIds []string, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams) {
 	logger := logging.LoggerFromCtx(ctx)
 
 	// check deletion protection
@@ -143,16 +142,21 @@ func setDeletionProtection(ctx context.Context, allVms []*common.VMInfoSummary,
 	for _, vm := range vmsWithoutProtection {
 		logger.Info().Msgf("Setting deletion protection for VM %v", vm)
 		// do not retry, but report
-		common.RetrySetDeletionProtectionAndReport(ctx, vmssParams, stateParams, vm.InstanceId, vm.HostName, 0, time.Second)
+		common.RetrySetDeletionProtectionAndReport(ctx, store, vmssParams, stateParams, vm.InstanceId, vm.HostName, 0, time.Second)
 	}
 }
 
-func Terminate(ctx context.Context, scaleResponse protocol.ScaleResponse, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams) (response protocol.TerminatedInstancesResponse, err error) {
+func Terminate(ctx context.Context, store common.StateStore, scaleResponse protocol.ScaleResponse, vmssParams *common.ScaleSetParams, stateParams common.BlobObjParams) (response protocol.TerminatedInstancesResponse, err error) {
+	ctx = common.ContextWithOperationsState(ctx, stateParams)
 	logger := logging.LoggerFromCtx(ctx)
 	logger = logger.WithStrValue("vmss", vmssParams.ScaleSetName)
 	logger.Info().Msg("Running termination function...")
 
 	response.Version = protocol.Version
+	defer func() {
+		common.TerminatedInstances.Add(float64(len(response.Instances)), vmssParams.ScaleSetName)
+		common.TransientErrors.Add(float64(len(response.TransientErrors)), vmssParams.ScaleSetName)
+	}()
 
 	if scaleResponse.Version != protocol.Version {
 		err = errors.New("incompatible scale response version")
@@ -168,8 +172,6 @@ func Terminate(ctx context.Context, scaleResponse protocol.ScaleResponse, vmssPa
 		return
 	}
 
-	response.TransientErrors = scaleResponse.TransientErrors[0:len(scaleResponse.TransientErrors):len(scaleResponse.TransientErrors)]
-
 	// get VMs expanded list which will be used later
 	vms, err := common.GetScaleSetVmsExpandedView(ctx, vmssParams)
 	if err != nil {
@@ -191,7 +193,7 @@ func Terminate(ctx context.Context, scaleResponse protocol.ScaleResponse, vmssPa
 	// NOTE: we want to have deletion protection set for all instances (which are not selected for termination)
 	// in order to avoid races, this step is presented here, during "terminate" step
 	unprotectedVmIds := append(deltaInstanceIds, unhealthyInstanceIds...)
-	setDeletionProtection(ctx, vms, unprotectedVmIds, vmssParams, stateParams)
+	setDeletionProtection(ctx, store, vms, unprotectedVmIds, vmssParams, stateParams)
 
 	if len(deltaInstanceIds) == 0 {
 		logger.Info().Msgf("No delta instances ids")
@@ -223,45 +225,26 @@ func Terminate(ctx context.Context, scaleResponse protocol.ScaleResponse, vmssPa
 }
 
 func Handler(w http.ResponseWriter, r *http.Request) {
-	subscriptionId := os.Getenv("SUBSCRIPTION_ID")
-	resourceGroupName := os.Getenv("RESOURCE_GROUP_NAME")
-	prefix := os.Getenv("PREFIX")
-	clusterName := os.Getenv("CLUSTER_NAME")
-	stateContainerName := os.Getenv("STATE_CONTAINER_NAME")
-	stateStorageName := os.Getenv("STATE_STORAGE_NAME")
-	stateBlobName := os.Getenv("STATE_BLOB_NAME")
-	nfsStateContainerName := os.Getenv("NFS_STATE_CONTAINER_NAME")
-	nfsStateBlobName := os.Getenv("NFS_STATE_BLOB_NAME")
-	nfsScaleSetName := os.Getenv("NFS_VMSS_NAME")
+	cfg := config.FromCtx(r.Context())
+	subscriptionId := cfg.SubscriptionId
+	resourceGroupName := cfg.ResourceGroupName
+	prefix := cfg.Prefix
+	clusterName := cfg.ClusterName
+	stateContainerName := cfg.StateContainerName
+	stateStorageName := cfg.StateStorageName
+	stateBlobName := cfg.StateBlobName
+	nfsStateContainerName := cfg.NfsStateContainerName
+	nfsStateBlobName := cfg.NfsStateBlobName
+	nfsScaleSetName := cfg.NfsVmssName
 
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
 
-	vmScaleSetName := common.GetVmScaleSetName(prefix, clusterName)
-
-	var invokeRequest common.InvokeRequest
-
-	d := json.NewDecoder(r.Body)
-
-	if err := d.Decode(&invokeRequest); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-
-	if err := json.Unmarshal(invokeRequest.Data["req"], &reqData); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var scaleResponse protocol.ScaleResponse
-
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &scaleResponse); err != nil {
-		logger.Error().Msgf("Failed to parse scaleResponse: %s", reqData["Body"].(string))
-		common.WriteErrorResponse(w, err)
+	scaleResponse, err := common.DecodeBody[protocol.ScaleResponse](r)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
 
@@ -270,19 +253,37 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		ContainerName: stateContainerName,
 		BlobName:      stateBlobName,
 	}
-	vmssParams := &common.ScaleSetParams{
-		SubscriptionId:    subscriptionId,
-		ResourceGroupName: resourceGroupName,
-		ScaleSetName:      vmScaleSetName,
-		Flexible:          false,
-	}
-	terminateResponse, err := Terminate(ctx, scaleResponse, vmssParams, stateParams)
+	skuMigration, err := common.GetSkuMigration(ctx, store, stateParams)
 	if err != nil {
 		logger.Error().Err(err).Send()
 		common.WriteErrorResponse(w, err)
 		return
 	}
 
+	// the transient errors of the scale down are reported once, not per scale set
+	terminateResponse := protocol.TerminatedInstancesResponse{Version: protocol.Version, TransientErrors: scaleResponse.TransientErrors}
+	for _, vmScaleSetName := range skuMigration.ScaleSets(common.GetVmScaleSetName(prefix, clusterName)) {
+		if skuMigration.Phase == common.SkuMigrationDraining && vmScaleSetName == skuMigration.Source {
+			// the instances of the source scale set are removed by the sku migration
+			continue
+		}
+		vmssParams := &common.ScaleSetParams{
+			SubscriptionId:    subscriptionId,
+			ResourceGroupName: resourceGroupName,
+			ScaleSetName:      vmScaleSetName,
+			Flexible:          false,
+		}
+		vmssTerminateResponse, err := Terminate(ctx, store, scaleResponse, vmssParams, stateParams)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			common.WriteErrorResponse(w, err)
+			return
+		}
+		terminateResponse.Version = vmssTerminateResponse.Version
+		terminateResponse.Instances = append(terminateResponse.Instances, vmssTerminateResponse.Instances...)
+		terminateResponse.TransientErrors = append(terminateResponse.TransientErrors, vmssTerminateResponse.TransientErrors...)
+	}
+
 	// terminate NFS instances (if NFS is configured)
 	if nfsScaleSetName != "" {
 		nfsParams := common.BlobObjParams{
@@ -296,7 +297,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			ScaleSetName:      nfsScaleSetName,
 			Flexible:          true,
 		}
-		nfsTerminateResponse, err := Terminate(ctx, scaleResponse, nfsVmssParams, nfsParams)
+		nfsTerminateResponse, err := Terminate(ctx, store, scaleResponse, nfsVmssParams, nfsParams)
 		if err != nil {
 			logger.Error().Err(err).Send()
 			common.WriteErrorResponse(w, err)
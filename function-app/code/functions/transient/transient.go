@@ -1,7 +1,6 @@
 package transient
 
 import (
-	"encoding/json"
 	"net/http"
 	"weka-deployment/common"
 
@@ -11,32 +10,13 @@ import (
 
 func Handler(w http.ResponseWriter, r *http.Request) {
 	resData := make(map[string]interface{})
-	var invokeRequest common.InvokeRequest
-
 	ctx := r.Context()
 	logger := logging.LoggerFromCtx(ctx)
 
-	d := json.NewDecoder(r.Body)
-	err := d.Decode(&invokeRequest)
-	if err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var reqData map[string]interface{}
-	err = json.Unmarshal(invokeRequest.Data["req"], &reqData)
+	terminateResponse, err := common.DecodeBody[protocol.TerminatedInstancesResponse](r)
 	if err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
-		return
-	}
-
-	var terminateResponse protocol.TerminatedInstancesResponse
-
-	if err := json.Unmarshal([]byte(reqData["Body"].(string)), &terminateResponse); err != nil {
-		logger.Error().Msg("Bad request")
-		common.WriteErrorResponse(w, err)
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
 		return
 	}
 
@@ -0,0 +1,60 @@
+package upgrade
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/config"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// UpgradeRequest pauses or resumes the rolling upgrade of the backends scale set, the upgrade progress is
+// returned by the status function ("upgrade" type)
+type UpgradeRequest struct {
+	// pause or resume
+	Action string `json:"action" validate:"required"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromCtx(r.Context())
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
+
+	upgradeReq, err := common.DecodeBody[UpgradeRequest](r)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+	if upgradeReq.Action != "pause" && upgradeReq.Action != "resume" {
+		err = fmt.Errorf("%w: action must be pause or resume, got %q", common.ErrBadRequest, upgradeReq.Action)
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+
+	stateParams := common.BlobObjParams{
+		StorageName:   cfg.StateStorageName,
+		ContainerName: cfg.StateContainerName,
+		BlobName:      cfg.StateBlobName,
+	}
+	upgrade, err := common.UpdateRollingUpgrade(ctx, store, stateParams, func(upgrade *common.RollingUpgrade) error {
+		upgrade.Paused = upgradeReq.Action == "pause"
+		upgrade.PauseReason = ""
+		if !upgrade.Paused && upgrade.Phase == common.RollingUpgradeWaitingReplacement {
+			// give the replacement a new join timeout
+			upgrade.PhaseStartedAt = time.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+
+	logger.Info().Msgf("rolling upgrade %sd", upgradeReq.Action)
+	common.WriteSuccessResponse(w, upgrade)
+}
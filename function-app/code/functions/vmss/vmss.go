@@ -0,0 +1,98 @@
+package vmss
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/config"
+
+	"github.com/weka/go-cloud-lib/logging"
+)
+
+// VmssRequest lists the vmss config change plans, or approves or rejects the pending one. The plans are only
+// recorded when VMSS_UPDATE_APPROVAL_REQUIRED is set, scale_up applies a plan once it is approved.
+type VmssRequest struct {
+	// list, approve or reject
+	Action string `json:"action" validate:"required"`
+	// id of the pending plan, for approve and reject
+	Id     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	cfg := config.FromCtx(r.Context())
+	ctx := r.Context()
+	logger := logging.LoggerFromCtx(ctx)
+	store := common.StateStoreFromCtx(ctx)
+
+	vmssReq, err := common.DecodeBody[VmssRequest](r)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+	stateParams := common.BlobObjParams{
+		StorageName:   cfg.StateStorageName,
+		ContainerName: cfg.StateContainerName,
+		BlobName:      cfg.StateBlobName,
+	}
+
+	var status common.VmssPlanStatus
+	switch vmssReq.Action {
+	case "list":
+		plans, err := common.GetVmssPlans(ctx, store, stateParams)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			common.WriteErrorResponse(w, err)
+			return
+		}
+		common.WriteSuccessResponse(w, plans)
+		return
+	case "approve":
+		status = common.VmssPlanApproved
+	case "reject":
+		status = common.VmssPlanRejected
+	default:
+		err = fmt.Errorf("%w: action must be list, approve or reject, got %q", common.ErrBadRequest, vmssReq.Action)
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+	if vmssReq.Id == "" {
+		err = fmt.Errorf("%w: id is required to %s a plan", common.ErrBadRequest, vmssReq.Action)
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+
+	var plan common.VmssPlan
+	_, err = common.UpdateVmssPlans(ctx, store, stateParams, func(plans *common.VmssPlans) error {
+		pending := plans.Pending()
+		if pending == nil || pending.Id != vmssReq.Id {
+			return fmt.Errorf("%w: vmss plan %s is not pending", common.ErrBadRequest, vmssReq.Id)
+		}
+		now := time.Now()
+		pending.Status = status
+		pending.DecidedAt = &now
+		pending.Reason = vmssReq.Reason
+		plan = *pending
+		return nil
+	})
+	if errors.Is(err, common.ErrBadRequest) {
+		common.WriteBadRequestResponse(w, err)
+		return
+	}
+	if err != nil {
+		logger.Error().Err(err).Send()
+		common.WriteErrorResponse(w, err)
+		return
+	}
+
+	message := fmt.Sprintf("vmss plan %s was %s", plan.Id, plan.Status)
+	if plan.Reason != "" {
+		message = fmt.Sprintf("%s: %s", message, plan.Reason)
+	}
+	logger.Info().Msg(message)
+	common.ReportMsg(ctx, store, "vmss", stateParams, "progress", message)
+	common.WriteSuccessResponse(w, plan)
+}
@@ -1,47 +1,864 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 	"weka-deployment/common"
+	"weka-deployment/config"
+	"weka-deployment/functions/health"
+	"weka-deployment/functions/metrics"
+	"weka-deployment/functions/reset"
+	"weka-deployment/functions/scale_up"
+	"weka-deployment/functions/terminate"
+	"weka-deployment/functions/vmss"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v5"
+	"github.com/weka/go-cloud-lib/protocol"
+)
+
+const (
+	testSubscriptionId    = "00000000-0000-0000-0000-000000000000"
+	testResourceGroupName = "test-rg"
+	testScaleSetName      = "test-cluster-vmss"
 )
 
+// callFunction calls the function handler directly with a plain json request, as the local mode does
+func callFunction(t *testing.T, ctx context.Context, handler http.HandlerFunc, request any) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)).WithContext(ctx)
+	recorder := httptest.NewRecorder()
+	common.DirectCallMiddleware(handler)(recorder, req)
+	return recorder
+}
+
+// callScaleUp calls scale_up and checks that it responds with expected
+func callScaleUp(t *testing.T, ctx context.Context, expected string) {
+	t.Helper()
+	recorder := callFunction(t, ctx, scale_up.Handler, map[string]any{})
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), expected) {
+		t.Fatalf("expected scale_up response with %q, got %d %s", expected, recorder.Code, recorder.Body.String())
+	}
+}
+
+// testConfig is the config of the test deployment, its backends scale set is test-cluster-vmss
+func testConfig() *config.Config {
+	return &config.Config{
+		SubscriptionId:     testSubscriptionId,
+		ResourceGroupName:  testResourceGroupName,
+		Prefix:             "test",
+		ClusterName:        "cluster",
+		KeyVaultUri:        "https://test-cluster.vault.azure.net/",
+		StateStorageName:   "storage",
+		StateContainerName: "container",
+		StateBlobName:      "state",
+	}
+}
+
+func testStateParams(cfg *config.Config) common.BlobObjParams {
+	return common.BlobObjParams{StorageName: cfg.StateStorageName, ContainerName: cfg.StateContainerName, BlobName: cfg.StateBlobName}
+}
+
+// testVmssConfig is the VMSS_CONFIG of the backends scale set of the test deployment, changing the sku or the image
+// changes its config hash
+func testVmssConfig(t *testing.T, sku, image string) string {
+	t.Helper()
+	vmssConfig := common.VMSSConfig{
+		Name:               testScaleSetName,
+		Location:           "eastus",
+		ResourceGroupName:  testResourceGroupName,
+		SKU:                sku,
+		SourceImageID:      image,
+		Tags:               map[string]string{"weka_cluster": "cluster"},
+		UpgradeMode:        "Manual",
+		OrchestrationMode:  "Uniform",
+		Identity:           common.Identity{Type: "UserAssigned", IdentityIDs: []string{"identity"}},
+		AdminUsername:      "weka",
+		SshPublicKey:       "ssh-rsa key",
+		ComputerNamePrefix: "test-cluster-backend",
+		OSDisk:             common.OSDisk{Caching: "ReadWrite", StorageAccountType: "Premium_LRS"},
+		DataDisk:           common.DataDisk{Caching: "None", CreateOption: "Empty", DiskSizeGB: 100, StorageAccountType: "Premium_LRS"},
+		PrimaryNIC: common.PrimaryNIC{
+			Name:                   "test-cluster-backend-nic-0",
+			NetworkSecurityGroupID: "nsg",
+			IPConfigurations:       []common.IPConfiguration{{Primary: true, SubnetID: "subnet", PublicIPAddress: &common.PublicIPAddress{}}},
+		},
+	}
+	data, err := json.Marshal(vmssConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// newDeploymentTest returns the context of a test deployment which is not clusterized yet: its backends scale set
+// is created by the first scale_up from cfg.VmssConfig with InitialClusterSize instances
+func newDeploymentTest(t *testing.T, cfg *config.Config) (context.Context, *common.FakeCloudProvider, *common.FakeWekaClient, common.StateStore) {
+	t.Helper()
+	cfg.FunctionsBaseUrl = "http://localhost/api/"
+	cfg.VmBootstrapTokenTtl = 168 * time.Hour
+	cloud := common.NewFakeCloudProvider()
+	weka := common.NewFakeWekaClient()
+	store := common.NewMemoryStateStore()
+	ctx := common.ContextWithCloudProvider(config.ContextWithConfig(context.TODO(), cfg), cloud)
+	ctx = common.ContextWithWekaClient(common.ContextWithStateStore(ctx, store), weka)
+	_ = cloud.SetSecret(ctx, cfg.KeyVaultUri, common.VmTokenSigningKeySecret, "signing-key")
+	_ = cloud.SetSecret(ctx, cfg.KeyVaultUri, common.WekaDeploymentPasswordKey, "password")
+
+	if recorder := callFunction(t, ctx, scale_up.Handler, map[string]any{}); recorder.Code != http.StatusOK {
+		t.Fatalf("initial scale_up failed: %s", recorder.Body.String())
+	}
+	return ctx, cloud, weka, store
+}
+
+// newScaleUpTest returns the context of a clusterized test deployment
+func newScaleUpTest(t *testing.T, cfg *config.Config) (context.Context, *common.FakeCloudProvider, *common.FakeWekaClient, common.StateStore) {
+	t.Helper()
+	ctx, cloud, weka, store := newDeploymentTest(t, cfg)
+	_, err := common.UpdateState(ctx, store, testStateParams(cfg), func(state *protocol.ClusterState) error {
+		state.Clusterized = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed clusterizing state: %s", err)
+	}
+	return ctx, cloud, weka, store
+}
+
+// wekaStatus is a weka status with the given number of active backends
+func wekaStatus(activeBackends int, fullyProtected bool) map[string]any {
+	protectionState := []map[string]any{{"numFailures": 0, "percent": 100}}
+	if !fullyProtected {
+		protectionState = []map[string]any{{"numFailures": 0, "percent": 90}, {"numFailures": 1, "percent": 10}}
+	}
+	return map[string]any{
+		"io_status": "STARTED",
+		"hosts":     map[string]any{"backends": map[string]any{"active": activeBackends, "total": activeBackends}},
+		"rebuild":   map[string]any{"protectionState": protectionState},
+	}
+}
+
+func instanceIds(t *testing.T, cloud *common.FakeCloudProvider, vmScaleSetName string) string {
+	t.Helper()
+	instances, err := cloud.GetInstances(testSubscriptionId, testResourceGroupName, vmScaleSetName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, instance.InstanceId)
+	}
+	return strings.Join(ids, ",")
+}
+
 func Test_fetchPrivateIps(t *testing.T) {
-	subscriptionId := "d2f248b9-d054-477f-b7e8-413921532c2a"
-	resourceGroupName := "jassaf-rg"
-	vmScaleSetName := "jassaf-poc-vmss"
-	ctx := context.TODO()
+	cloud := common.NewFakeCloudProvider()
+	cloud.AddScaleSet(testSubscriptionId, testResourceGroupName, testScaleSetName, false, 7)
+	ctx := common.ContextWithCloudProvider(context.TODO(), cloud)
 
 	vmssParams := &common.ScaleSetParams{
-		SubscriptionId:    subscriptionId,
-		ResourceGroupName: resourceGroupName,
-		ScaleSetName:      vmScaleSetName,
+		SubscriptionId:    testSubscriptionId,
+		ResourceGroupName: testResourceGroupName,
+		ScaleSetName:      testScaleSetName,
 		Flexible:          false,
 	}
 
 	vmsPrivateIps, err := common.GetVmsPrivateIps(ctx, vmssParams)
 	if err != nil {
-		t.Logf("failed fetching private ips: %s", err)
-		return
+		t.Fatalf("failed fetching private ips: %s", err)
+	}
+
+	// the fake scale set hands out consecutive private ips to its instances
+	expected := map[string]string{
+		"test-cluster-vmss_0": "10.0.0.5",
+		"test-cluster-vmss_1": "10.0.0.6",
+		"test-cluster-vmss_2": "10.0.0.7",
+		"test-cluster-vmss_3": "10.0.0.8",
+		"test-cluster-vmss_4": "10.0.0.9",
+		"test-cluster-vmss_5": "10.0.0.10",
+		"test-cluster-vmss_6": "10.0.0.11",
+	}
+	if !reflect.DeepEqual(vmsPrivateIps, expected) {
+		t.Fatalf("expected private ips %v, got %v", expected, vmsPrivateIps)
+	}
+}
+
+func Test_terminate(t *testing.T) {
+	cloud := common.NewFakeCloudProvider()
+	cloud.AddScaleSet(testSubscriptionId, testResourceGroupName, testScaleSetName, false, 5)
+	ctx := common.ContextWithCloudProvider(context.TODO(), cloud)
+	store := common.NewMemoryStateStore()
+
+	stateParams := common.BlobObjParams{StorageName: "storage", ContainerName: "state", BlobName: "state"}
+	if _, err := common.EnsureStateIsCreated(ctx, store, stateParams, protocol.ClusterState{}); err != nil {
+		t.Fatalf("failed creating state: %s", err)
+	}
+	vmssParams := &common.ScaleSetParams{
+		SubscriptionId:    testSubscriptionId,
+		ResourceGroupName: testResourceGroupName,
+		ScaleSetName:      testScaleSetName,
+	}
+
+	instances, _ := cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
+	// instance 0 is stopped and unhealthy, instance 3 left the cluster long ago, instance 4 is new
+	_ = cloud.UpdateInstance(testSubscriptionId, testResourceGroupName, testScaleSetName, "0", func(instance *common.FakeInstance) {
+		instance.PowerState = "stopped"
+		instance.HealthState = "unhealthy"
+	})
+	_ = cloud.UpdateInstance(testSubscriptionId, testResourceGroupName, testScaleSetName, "3", func(instance *common.FakeInstance) {
+		instance.CreatedAt = time.Now().Add(-time.Hour)
+	})
+
+	scaleResponse := protocol.ScaleResponse{Version: protocol.Version}
+	for _, instance := range instances[:3] {
+		scaleResponse.Hosts = append(scaleResponse.Hosts, protocol.ScaleResponseHost{InstanceId: instance.InstanceId, PrivateIp: instance.PrivateIp})
+	}
+
+	response, err := terminate.Terminate(ctx, store, scaleResponse, vmssParams, stateParams)
+	if err != nil {
+		t.Fatalf("terminate failed: %s", err)
+	}
+	if len(response.Instances) != 1 || response.Instances[0].InstanceId != "3" {
+		t.Fatalf("expected only instance 3 to be terminated, got %+v", response.Instances)
+	}
+
+	remaining, _ := cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
+	var remainingIds []string
+	for _, instance := range remaining {
+		remainingIds = append(remainingIds, instance.InstanceId)
+		if instance.InstanceId != "4" && !instance.Protected {
+			t.Errorf("instance %s should be protected from deletion", instance.InstanceId)
+		}
+	}
+	if strings.Join(remainingIds, ",") != "1,2,4" {
+		t.Fatalf("unexpected remaining instances: %v", remainingIds)
+	}
+}
+
+func Test_terminateTransientErrors(t *testing.T) {
+	cfg := testConfig()
+	cloud := common.NewFakeCloudProvider()
+	cloud.AddScaleSet(testSubscriptionId, testResourceGroupName, testScaleSetName, false, 2)
+	store := common.NewMemoryStateStore()
+	ctx := common.ContextWithCloudProvider(config.ContextWithConfig(context.TODO(), cfg), cloud)
+	ctx = common.ContextWithStateStore(ctx, store)
+	if _, err := common.EnsureStateIsCreated(ctx, store, testStateParams(cfg), protocol.ClusterState{}); err != nil {
+		t.Fatalf("failed creating state: %s", err)
+	}
+
+	// both the source and target scale sets are terminated during a sku migration
+	cloud.AddScaleSet(testSubscriptionId, testResourceGroupName, testScaleSetName+"-v2", false, 2)
+	_, err := common.UpdateSkuMigration(ctx, store, testStateParams(cfg), func(migration *common.SkuMigration) error {
+		migration.Source, migration.Target, migration.Active = testScaleSetName, testScaleSetName+"-v2", testScaleSetName+"-v2"
+		migration.Phase = common.SkuMigrationJoining
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scaleResponse := protocol.ScaleResponse{Version: protocol.Version, TransientErrors: []string{"scale down error"}}
+	for _, name := range []string{testScaleSetName, testScaleSetName + "-v2"} {
+		instances, _ := cloud.GetInstances(testSubscriptionId, testResourceGroupName, name)
+		for _, instance := range instances {
+			scaleResponse.Hosts = append(scaleResponse.Hosts, protocol.ScaleResponseHost{InstanceId: instance.InstanceId, PrivateIp: instance.PrivateIp})
+		}
+	}
+	var response protocol.TerminatedInstancesResponse
+	if err := json.Unmarshal(callFunction(t, ctx, terminate.Handler, scaleResponse).Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
 	}
+	if strings.Join(response.TransientErrors, ",") != "scale down error" {
+		t.Fatalf("expected the scale down transient errors to be reported once, got %v", response.TransientErrors)
+	}
+}
 
-	t.Logf("ips map: %s", vmsPrivateIps)
+func Test_readiness(t *testing.T) {
+	cloud := common.NewFakeCloudProvider()
+	ctx := common.ContextWithCloudProvider(context.TODO(), cloud)
+	cfg := testConfig()
+	_ = cloud.SetSecret(ctx, cfg.KeyVaultUri, "weka-password", "password")
 
-	var ipsList []string
-	instances := []string{
-		"jassaf-poc-vmss_6",
-		"jassaf-poc-vmss_4",
-		"jassaf-poc-vmss_3",
-		"jassaf-poc-vmss_0",
-		"jassaf-poc-vmss_1",
-		"jassaf-poc-vmss_5",
+	readiness := health.CheckReadiness(ctx, cfg, common.NewMemoryStateStore())
+	if readiness.Ready {
+		t.Fatalf("expected not ready without the function key, got %+v", readiness)
+	}
+	for _, dependency := range readiness.Dependencies {
+		if dependency.Ok == (dependency.Name == "key_vault_function_key") {
+			t.Errorf("unexpected %s status %+v", dependency.Name, dependency)
+		}
 	}
 
+	_ = cloud.SetSecret(ctx, cfg.KeyVaultUri, "function-app-default-key", "key")
+	if readiness = health.CheckReadiness(ctx, cfg, common.NewMemoryStateStore()); !readiness.Ready {
+		t.Fatalf("expected ready, got %+v", readiness)
+	}
+}
+
+func Test_metrics(t *testing.T) {
+	cfg := testConfig()
+	cfg.WebsiteInstanceId = "worker-1"
+	cloud := common.NewFakeCloudProvider()
+	cloud.AddScaleSet(testSubscriptionId, testResourceGroupName, testScaleSetName, false, 4)
+	store := common.NewMemoryStateStore()
+	ctx := common.ContextWithCloudProvider(config.ContextWithConfig(context.TODO(), cfg), cloud)
+	ctx = common.ContextWithStateStore(ctx, store)
+
+	state := protocol.ClusterState{InitialSize: 6, DesiredSize: 6, ClusterizationTarget: 6, Instances: []protocol.Vm{{Name: "test-cluster-vmss_0:host-0"}}}
+	if _, err := common.EnsureStateIsCreated(ctx, store, testStateParams(cfg), state); err != nil {
+		t.Fatalf("failed creating state: %s", err)
+	}
+	common.TerminatedInstances.Add(2, "metrics-test-vmss")
+
+	recorder := callFunction(t, ctx, metrics.Handler, map[string]any{})
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`weka_vmss_desired_capacity{vmss="test-cluster-vmss"} 6`,
+		`weka_vmss_capacity{vmss="test-cluster-vmss"} 4`,
+		`weka_instances_ready_for_clusterization{vmss="test-cluster-vmss"} 1`,
+		`weka_clusterized{vmss="test-cluster-vmss"} 0`,
+		`weka_terminated_instances_total{vmss="metrics-test-vmss",instance="worker-1"} 2`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("missing %s in:\n%s", line, body)
+		}
+	}
+}
+
+func Test_rollingUpgrade(t *testing.T) {
+	cfg := testConfig()
+	cfg.InitialClusterSize = 3
+	cfg.RollingUpgradeJoinTimeout = time.Hour
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-1")
+	ctx, cloud, weka, store := newScaleUpTest(t, cfg)
+	stateParams := testStateParams(cfg)
+
+	rollingUpgrade := func() common.RollingUpgrade {
+		t.Helper()
+		upgrade, err := common.GetRollingUpgrade(ctx, store, stateParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return upgrade
+	}
+
+	// the new image updates the scale set model, the instances are replaced by the following invocations
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-2")
+	callScaleUp(t, ctx, "vmss update handled successfully")
+	instances, _ := cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
+
+	// the instance is picked once the data is fully protected, its weka host is deactivated first
+	weka.SetStatus(wekaStatus(3, false))
+	callScaleUp(t, ctx, "waiting for the cluster to be fully protected")
+	weka.SetStatus(wekaStatus(3, true))
+	callScaleUp(t, ctx, "waiting for weka to deactivate and remove the host of instance "+instances[0].Name)
+	if upgrade := rollingUpgrade(); upgrade.Phase != common.RollingUpgradeDeactivating || upgrade.InstanceId != "0" || upgrade.ActiveBackends != 3 {
+		t.Fatalf("expected instance 0 to be deactivated, got %+v", upgrade)
+	}
+	if !weka.Deactivating(instances[0].PrivateIp) || instanceIds(t, cloud, testScaleSetName) != "0,1,2" {
+		t.Fatalf("expected the host of instance 0 to be deactivated before its deletion")
+	}
+
+	// weka removed the host but the deletion fails, the deletion is resumed by the next invocation
+	for _, kind := range []common.OperationKind{common.OperationScaleSetVmsDelete, common.OperationScaleSetVmDelete} {
+		cloud.FailOperations(kind, errors.New("deletion failed"))
+	}
+	recorder := callFunction(t, ctx, scale_up.Handler, map[string]any{})
+	if upgrade := rollingUpgrade(); recorder.Code != http.StatusOK || upgrade.Phase != common.RollingUpgradeWaitingReplacement {
+		t.Fatalf("expected the host removal to be recorded, got %+v", upgrade)
+	}
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "0,1,2" {
+		t.Fatalf("expected instance 0 to be kept after the failed deletion, got %s", ids)
+	}
+	for _, kind := range []common.OperationKind{common.OperationScaleSetVmsDelete, common.OperationScaleSetVmDelete} {
+		cloud.FailOperations(kind, nil)
+	}
+	callScaleUp(t, ctx, "removed instance "+instances[0].Name)
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "1,2,3" {
+		t.Fatalf("expected instance 0 to be replaced by instance 3, got %s", ids)
+	}
+
+	// the replacement joins the cluster
+	weka.SetStatus(wekaStatus(2, true))
+	callScaleUp(t, ctx, "waiting for the replacement of "+instances[0].Name+" to join (2/3 active backends")
+	weka.SetStatus(wekaStatus(3, true))
+	callScaleUp(t, ctx, "instance "+instances[0].Name+" was replaced")
+
+	for i := 0; i < 10 && rollingUpgrade().Phase != common.RollingUpgradeCompleted; i++ {
+		callScaleUp(t, ctx, "")
+	}
+	upgrade := rollingUpgrade()
+	if upgrade.Phase != common.RollingUpgradeCompleted || len(upgrade.Replaced) != 3 || upgrade.Remaining != 0 {
+		t.Fatalf("expected the rolling upgrade to complete, got %+v", upgrade)
+	}
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "3,4,5" {
+		t.Fatalf("expected all the instances to be replaced, got %s", ids)
+	}
+}
+
+func Test_rollingUpgradeConfigChange(t *testing.T) {
+	cfg := testConfig()
+	cfg.InitialClusterSize = 3
+	cfg.RollingUpgradeJoinTimeout = time.Hour
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-1")
+	ctx, cloud, weka, store := newScaleUpTest(t, cfg)
+	stateParams := testStateParams(cfg)
+
+	rollingUpgrade := func() common.RollingUpgrade {
+		t.Helper()
+		upgrade, err := common.GetRollingUpgrade(ctx, store, stateParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return upgrade
+	}
+
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-2")
+	callScaleUp(t, ctx, "vmss update handled successfully")
+	instances, _ := cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
+	weka.SetStatus(wekaStatus(3, true))
+	callScaleUp(t, ctx, "waiting for weka to deactivate and remove the host of instance "+instances[0].Name)
+	previous := rollingUpgrade()
+
+	// the config changes while the host of instance 0 is deactivated, its replacement is carried over
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-3")
+	callScaleUp(t, ctx, "vmss update handled successfully")
+	callScaleUp(t, ctx, "removed instance "+instances[0].Name)
+	upgrade := rollingUpgrade()
+	if upgrade.To == previous.To || upgrade.Phase != common.RollingUpgradeWaitingReplacement || upgrade.InstanceId != "0" || upgrade.ActiveBackends != 3 {
+		t.Fatalf("expected the replacement of instance 0 to be carried over to the new upgrade, got %+v", upgrade)
+	}
+	state, err := common.ReadState(ctx, store, stateParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(state.Progress["vmss"], func(report string) bool {
+		return strings.Contains(report, "carrying over the replacement of "+instances[0].Name)
+	}) {
+		t.Fatalf("expected the carried over replacement to be reported, got %v", state.Progress["vmss"])
+	}
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "1,2,3" {
+		t.Fatalf("expected instance 0 to be replaced by instance 3, got %s", ids)
+	}
+	callScaleUp(t, ctx, "instance "+instances[0].Name+" was replaced")
+
+	for i := 0; i < 10 && rollingUpgrade().Phase != common.RollingUpgradeCompleted; i++ {
+		callScaleUp(t, ctx, "")
+	}
+	upgrade = rollingUpgrade()
+	if upgrade.Phase != common.RollingUpgradeCompleted || len(upgrade.Replaced) != 3 {
+		t.Fatalf("expected the rolling upgrade to complete, got %+v", upgrade)
+	}
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "3,4,5" {
+		t.Fatalf("expected all the instances to be replaced, got %s", ids)
+	}
+	instances, _ = cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
 	for _, instance := range instances {
-		ipsList = append(ipsList, vmsPrivateIps[instance])
+		if instance.Tags[common.ConfigHashTag] != upgrade.To {
+			t.Fatalf("expected instance %s to be created from the latest config, got %v", instance.Name, instance.Tags)
+		}
+	}
+}
+
+func Test_skuMigration(t *testing.T) {
+	cfg := testConfig()
+	cfg.InitialClusterSize = 2
+	cfg.ProtectionLevel = 2
+	cfg.SkuMigrationEnabled = true
+	cfg.SkuMigrationBatchSize = 3
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-1")
+	ctx, cloud, weka, store := newScaleUpTest(t, cfg)
+	stateParams := testStateParams(cfg)
+	target := testScaleSetName + "-v2"
+
+	skuMigration := func() common.SkuMigration {
+		t.Helper()
+		migration, err := common.GetSkuMigration(ctx, store, stateParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return migration
+	}
+
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L16s_v3", "image-1")
+	callScaleUp(t, ctx, "started sku migration to vmss "+target)
+
+	// creating
+	weka.SetStatus(wekaStatus(2, false))
+	callScaleUp(t, ctx, "waiting for the cluster to be fully protected before creating the target vmss")
+	weka.SetStatus(wekaStatus(2, true))
+	callScaleUp(t, ctx, "created target vmss "+target)
+	if migration := skuMigration(); migration.Phase != common.SkuMigrationJoining || migration.SourceBackends != 2 {
+		t.Fatalf("expected the migration to wait for the target instances, got %+v", migration)
+	}
+
+	// joining
+	callScaleUp(t, ctx, "waiting for the instances of "+target+" to join (2/4 active backends")
+	if ids := instanceIds(t, cloud, target); ids != "0,1" {
+		t.Fatalf("expected the target vmss to be scaled to the desired size, got %s", ids)
+	}
+	weka.SetStatus(wekaStatus(4, true))
+	callScaleUp(t, ctx, "it is the active vmss, draining "+testScaleSetName)
+
+	// draining: the batch is capped to PROTECTION_LEVEL - 1 instances, their hosts are deactivated first
+	callScaleUp(t, ctx, "waiting for weka to deactivate and remove the hosts of 1/1 instances of the batch")
+	source, _ := cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
+	if migration := skuMigration(); strings.Join(migration.Batch, ",") != "0" || len(migration.Deactivated) != 0 {
+		t.Fatalf("expected a batch of instance 0, got %+v", migration)
+	}
+	if !weka.Deactivating(source[0].PrivateIp) || instanceIds(t, cloud, testScaleSetName) != "0,1" {
+		t.Fatalf("expected the host of instance 0 to be deactivated before its deletion")
+	}
+
+	// weka removed the host but the deletion fails, the deletion is resumed by the next invocation
+	for _, kind := range []common.OperationKind{common.OperationScaleSetVmsDelete, common.OperationScaleSetVmDelete} {
+		cloud.FailOperations(kind, errors.New("deletion failed"))
+	}
+	if recorder := callFunction(t, ctx, scale_up.Handler, map[string]any{}); !strings.Contains(recorder.Body.String(), "cannot remove instances") {
+		t.Fatalf("expected the failed deletion to be reported, got %s", recorder.Body.String())
+	}
+	if migration := skuMigration(); strings.Join(migration.Deactivated, ",") != "0" || instanceIds(t, cloud, testScaleSetName) != "0,1" {
+		t.Fatalf("expected the host removal of instance 0 to be recorded, got %+v", migration)
+	}
+	for _, kind := range []common.OperationKind{common.OperationScaleSetVmsDelete, common.OperationScaleSetVmDelete} {
+		cloud.FailOperations(kind, nil)
+	}
+	callScaleUp(t, ctx, "removed instances ["+source[0].Name+"]")
+
+	callScaleUp(t, ctx, "waiting for weka to deactivate and remove the hosts of 1/1 instances of the batch")
+	callScaleUp(t, ctx, "removed instances ["+source[1].Name+"]")
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "" {
+		t.Fatalf("expected the source vmss to be drained, got %s", ids)
+	}
+
+	// retiring
+	callScaleUp(t, ctx, "vmss "+testScaleSetName+" is drained, retiring it")
+	callScaleUp(t, ctx, "deleting vmss "+testScaleSetName)
+	callScaleUp(t, ctx, "completed")
+	migration := skuMigration()
+	if migration.Phase != common.SkuMigrationCompleted || migration.Active != target || len(migration.Removed) != 2 {
+		t.Fatalf("expected the migration to complete, got %+v", migration)
+	}
+	if ids := instanceIds(t, cloud, target); ids != "0,1" {
+		t.Fatalf("expected the target instances to be kept, got %s", ids)
+	}
+}
+
+func Test_vmssUpdateApproval(t *testing.T) {
+	cfg := testConfig()
+	cfg.InitialClusterSize = 2
+	cfg.VmssUpdateApprovalRequired = true
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-1")
+	ctx, _, _, store := newScaleUpTest(t, cfg)
+	stateParams := testStateParams(cfg)
+
+	callVmss := func(request map[string]any, expectedCode int) {
+		t.Helper()
+		recorder := callFunction(t, ctx, vmss.Handler, request)
+		if recorder.Code != expectedCode {
+			t.Fatalf("expected vmss %v response code %d, got %d %s", request, expectedCode, recorder.Code, recorder.Body.String())
+		}
+	}
+	vmssPlans := func() common.VmssPlans {
+		t.Helper()
+		plans, err := common.GetVmssPlans(ctx, store, stateParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plans
+	}
+
+	// the change is recorded as a pending plan and not applied
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-2")
+	callScaleUp(t, ctx, "is pending")
+	plans := vmssPlans()
+	rejected := plans.Pending()
+	if rejected == nil || rejected.Risk != common.VmssPlanRiskMedium {
+		t.Fatalf("expected a pending plan replacing the instances, got %+v", vmssPlans())
+	}
+	callScaleUp(t, ctx, "vmss update to config "+rejected.Id+" is pending")
+
+	// only the pending plan can be decided
+	callVmss(map[string]any{"action": "approve", "id": "unknown"}, http.StatusBadRequest)
+	callVmss(map[string]any{"action": "reject"}, http.StatusBadRequest)
+	callVmss(map[string]any{"action": "reject", "id": rejected.Id, "reason": "wrong image"}, http.StatusOK)
+	callVmss(map[string]any{"action": "approve", "id": rejected.Id}, http.StatusBadRequest)
+	callScaleUp(t, ctx, "vmss update to config "+rejected.Id+" is rejected")
+
+	// a new change gets a new plan, it is applied once approved
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-3")
+	callScaleUp(t, ctx, "is pending")
+	plans = vmssPlans()
+	approved := plans.Pending()
+	if approved == nil || approved.Id == rejected.Id {
+		t.Fatalf("expected a new pending plan, got %+v", vmssPlans())
+	}
+	callVmss(map[string]any{"action": "approve", "id": approved.Id}, http.StatusOK)
+	callScaleUp(t, ctx, "vmss update handled successfully")
+	callScaleUp(t, ctx, "vmss is up to date")
+
+	plans = vmssPlans()
+	if len(plans.Plans) != 2 || plans.Plans[0].Status != common.VmssPlanRejected || plans.Plans[0].Reason != "wrong image" {
+		t.Fatalf("expected the first plan to be rejected, got %+v", plans)
+	}
+	if plans.Plans[1].Status != common.VmssPlanApplied || plans.Plans[1].AppliedAt == nil {
+		t.Fatalf("expected the approved plan to be applied, got %+v", plans.Plans[1])
+	}
+}
+
+func Test_bootstrapTokenRotation(t *testing.T) {
+	cfg := testConfig()
+	cfg.InitialClusterSize = 2
+	cfg.VmssUpdateApprovalRequired = true
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-1")
+	ctx, cloud, _, store := newScaleUpTest(t, cfg)
+
+	scaleSet := func() *armcompute.VirtualMachineScaleSet {
+		t.Helper()
+		scaleSet, err := cloud.GetScaleSet(ctx, testSubscriptionId, testResourceGroupName, testScaleSetName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return scaleSet
+	}
+	deployed := scaleSet()
+
+	// the config change is rejected, the scale set keeps the deployed config
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-2")
+	callScaleUp(t, ctx, "is pending")
+	plans, err := common.GetVmssPlans(ctx, store, testStateParams(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := plans.Pending()
+	recorder := callFunction(t, ctx, vmss.Handler, map[string]any{"action": "reject", "id": rejected.Id})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("failed rejecting the plan: %d %s", recorder.Code, recorder.Body.String())
 	}
-	ips := strings.Join(ipsList, ",")
-	t.Logf("ips: %s", ips)
+	callScaleUp(t, ctx, "vmss update to config "+rejected.Id+" is rejected")
 
+	// the bootstrap token gets past half of its lifetime
+	aged := *deployed
+	aged.Tags = maps.Clone(deployed.Tags)
+	expiresAt := time.Now().Add(cfg.VmBootstrapTokenTtl / 4).UTC().Format(time.RFC3339)
+	aged.Tags[common.BootstrapVmTokenExpiresAtTag] = &expiresAt
+	if _, err := cloud.CreateOrUpdateScaleSet(ctx, testSubscriptionId, testResourceGroupName, testScaleSetName, aged); err != nil {
+		t.Fatal(err)
+	}
+
+	callScaleUp(t, ctx, "vmss update to config "+rejected.Id+" is rejected; rotated the bootstrap token of vmss "+testScaleSetName)
+	rotated := scaleSet()
+	if *rotated.Tags[common.BootstrapVmTokenExpiresAtTag] == expiresAt || *rotated.Tags[common.ConfigHashTag] != *deployed.Tags[common.ConfigHashTag] {
+		t.Fatalf("expected the bootstrap token of the deployed config to be rotated, got tags %v", common.PtrMapToStrMap(rotated.Tags))
+	}
+	profile := rotated.Properties.VirtualMachineProfile
+	if *profile.StorageProfile.ImageReference.ID != "image-1" || *profile.UserData != *deployed.Properties.VirtualMachineProfile.UserData {
+		t.Fatalf("expected the rotation to keep the deployed config, got image %s", *profile.StorageProfile.ImageReference.ID)
+	}
+	callScaleUp(t, ctx, "vmss update to config "+rejected.Id+" is rejected; scaled up")
+}
+
+func Test_clusterizationWatchdog(t *testing.T) {
+	cfg := testConfig()
+	cfg.InitialClusterSize = 3
+	cfg.ClusterizationTimeout = time.Hour
+	cfg.ClusterizationMaxReelections = 1
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-1")
+	ctx, cloud, _, store := newDeploymentTest(t, cfg)
+	stateParams := testStateParams(cfg)
+
+	clusterizationWatch := func() common.ClusterizationWatch {
+		t.Helper()
+		watch, err := common.GetClusterizationWatch(ctx, store, stateParams)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return watch
+	}
+	setState := func(updateFn func(state *protocol.ClusterState)) {
+		t.Helper()
+		_, err := common.UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+			updateFn(state)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the last of the instances ready for clusterization is elected to clusterize
+	instances, _ := cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
+	setState(func(state *protocol.ClusterState) {
+		state.ClusterizationTarget = 3
+		state.Instances = nil
+		for _, instance := range instances {
+			state.Instances = append(state.Instances, protocol.Vm{Name: instance.Name + ":" + instance.ComputerName})
+		}
+	})
+	elected := instances[2].Name + ":" + instances[2].ComputerName
+	callScaleUp(t, ctx, "clusterization instance "+elected+" last reported")
+	if watch := clusterizationWatch(); watch.Instance != elected {
+		t.Fatalf("expected %s to be followed, got %+v", elected, watch)
+	}
+
+	// the instance stalls, it is kept in the state until it is terminated
+	_, err := common.UpdateClusterizationWatch(ctx, store, stateParams, func(watch *common.ClusterizationWatch) error {
+		watch.LastProgressAt = time.Now().Add(-2 * time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []common.OperationKind{common.OperationScaleSetVmsDelete, common.OperationScaleSetVmDelete} {
+		cloud.FailOperations(kind, errors.New("deletion failed"))
+	}
+	callScaleUp(t, ctx, "cannot replace clusterization instance "+elected)
+	state, err := common.ReadState(ctx, store, stateParams)
+	if err != nil || len(state.Instances) != 3 || len(clusterizationWatch().Reelections) != 0 {
+		t.Fatalf("expected the instance to be kept after the failed termination, got %+v", state.Instances)
+	}
+
+	// the next invocation retries the termination and removes the instance from the state, the scale set is
+	// scaled back to its size
+	for _, kind := range []common.OperationKind{common.OperationScaleSetVmsDelete, common.OperationScaleSetVmDelete} {
+		cloud.FailOperations(kind, nil)
+	}
+	callScaleUp(t, ctx, "replaced clusterization instance "+elected+" (no report for 2h")
+	state, err = common.ReadState(ctx, store, stateParams)
+	if err != nil || len(state.Instances) != 2 {
+		t.Fatalf("expected the instance to be removed from the state, got %+v", state.Instances)
+	}
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "0,1,3" {
+		t.Fatalf("expected instance 2 to be replaced by instance 3, got %s", ids)
+	}
+	watch := clusterizationWatch()
+	if len(watch.Reelections) != 1 || watch.Reelections[0].Instance != elected || watch.Instance != "" {
+		t.Fatalf("expected the reelection to be recorded, got %+v", watch)
+	}
+
+	// the next elected instance is gone, it is not replaced once the reelections are exhausted
+	setState(func(state *protocol.ClusterState) {
+		state.Instances = append(state.Instances, protocol.Vm{Name: testScaleSetName + "_9:gone"})
+	})
+	callScaleUp(t, ctx, "it is not replaced since 1 instances were already replaced")
+	if state, _ := common.ReadState(ctx, store, stateParams); len(state.Instances) != 3 {
+		t.Fatalf("expected the gone instance to be kept, got %+v", state.Instances)
+	}
+}
+
+func Test_reset(t *testing.T) {
+	cfg := testConfig()
+	cfg.InitialClusterSize = 2
+	cfg.VmssConfig = testVmssConfig(t, "Standard_L8s_v3", "image-1")
+	ctx, cloud, _, store := newScaleUpTest(t, cfg)
+	stateParams := testStateParams(cfg)
+
+	callReset := func(request map[string]any, expectedCode int) string {
+		t.Helper()
+		recorder := callFunction(t, ctx, reset.Handler, request)
+		if recorder.Code != expectedCode {
+			t.Fatalf("expected reset %v response code %d, got %d %s", request, expectedCode, recorder.Code, recorder.Body.String())
+		}
+		return recorder.Body.String()
+	}
+	instances, _ := cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
+	_, err := common.UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		for _, instance := range instances {
+			state.Instances = append(state.Instances, protocol.Vm{Name: instance.Name + ":" + instance.ComputerName})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a clusterized cluster is only reset with force, the refused request is audited
+	callReset(map[string]any{"mode": "hard", "reason": "retry"}, http.StatusBadRequest)
+	state, err := common.ReadState(ctx, store, stateParams)
+	if err != nil || !state.Clusterized || len(state.Instances) != 2 {
+		t.Fatalf("expected the state to be kept, got %+v", state)
+	}
+	entries, err := common.GetAuditEntries(ctx, store, stateParams)
+	if err != nil || len(entries) != 1 || entries[0].Action != "reset" || !strings.Contains(entries[0].Error, "set force") {
+		t.Fatalf("expected the refused reset to be audited, got %+v", entries)
+	}
+
+	// the state is kept when the scale set can't be deleted
+	cloud.FailOperations(common.OperationScaleSetDelete, errors.New("deletion failed"))
+	if body := callReset(map[string]any{"mode": "hard", "force": true}, http.StatusOK); !strings.Contains(body, "cannot delete scale set") {
+		t.Fatalf("expected the deletion to fail, got %s", body)
+	}
+	if state, _ := common.ReadState(ctx, store, stateParams); len(state.Instances) != 2 {
+		t.Fatalf("expected the instances to be kept after the failed deletion, got %+v", state.Instances)
+	}
+
+	// the hard reset deletes the scale set and clears the state, scale_up creates the scale set again
+	cloud.FailOperations(common.OperationScaleSetDelete, nil)
+	body := callReset(map[string]any{"mode": "hard", "force": true}, http.StatusOK)
+	if !strings.Contains(body, "hard reset removed 2 instances from the state") {
+		t.Fatalf("expected the instances to be removed, got %s", body)
+	}
+	if _, err := cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName); err == nil {
+		t.Fatalf("expected scale set %s to be deleted", testScaleSetName)
+	}
+	state, err = common.ReadState(ctx, store, stateParams)
+	if err != nil || state.Clusterized || len(state.Instances) != 0 {
+		t.Fatalf("expected the state to be reset, got %+v", state)
+	}
+	recorder := callFunction(t, ctx, scale_up.Handler, map[string]any{})
+	if !strings.Contains(recorder.Body.String(), "created initial vmss successfully") {
+		t.Fatalf("expected scale_up to create the scale set again, got %s", recorder.Body.String())
+	}
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "0,1" {
+		t.Fatalf("expected the initial instances, got %s", ids)
+	}
+
+	// the soft reset clears the instances and the reports of the state and keeps the scale set
+	instances, _ = cloud.GetInstances(testSubscriptionId, testResourceGroupName, testScaleSetName)
+	_, err = common.UpdateState(ctx, store, stateParams, func(state *protocol.ClusterState) error {
+		for _, instance := range instances {
+			state.Instances = append(state.Instances, protocol.Vm{Name: instance.Name + ":" + instance.ComputerName})
+			state.Progress[instance.Name] = []string{"joining"}
+			state.Errors[instance.Name] = []string{"clusterization failed"}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = callReset(map[string]any{"mode": "soft", "reason": "clusterization failed"}, http.StatusOK)
+	if !strings.Contains(body, "soft reset removed 2 instances from the state") {
+		t.Fatalf("expected the instances to be removed, got %s", body)
+	}
+	state, err = common.ReadState(ctx, store, stateParams)
+	if err != nil || len(state.Instances) != 0 || len(state.Errors) != 0 {
+		t.Fatalf("expected the instances and the errors to be cleared, got %+v", state)
+	}
+	// only the reset itself is reported
+	if _, ok := state.Progress["vmss"]; len(state.Progress) != 1 || !ok {
+		t.Fatalf("expected the progress reports to be cleared, got %v", state.Progress)
+	}
+	if ids := instanceIds(t, cloud, testScaleSetName); ids != "0,1" {
+		t.Fatalf("expected the soft reset to keep the scale set, got %s", ids)
+	}
+	entries, err = common.GetAuditEntries(ctx, store, stateParams)
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("expected every reset to be audited, got %+v", entries)
+	}
+	if soft := entries[0]; soft.Action != "reset" || soft.Reason != "clusterization failed" || soft.Details["mode"] != "soft" || soft.Error != "" {
+		t.Fatalf("expected the soft reset to be audited, got %+v", soft)
+	}
 }
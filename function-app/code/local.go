@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/weka/go-cloud-lib/protocol"
+
+	"weka-deployment/common"
+	"weka-deployment/config"
+)
+
+// localSecrets are the key vault secrets created by terraform
+var localSecrets = map[string]string{
+	"function-app-default-key":         "local",
+	"get-weka-io-token":                "local",
+	common.WekaAdminPasswordKey:        "local-admin-password",
+	common.WekaDeploymentPasswordKey:   "local-deployment-password",
+	common.VmTokenSigningKeySecret:     "local-vm-token-signing-key",
+	common.StateBundleSigningKeySecret: "local-state-bundle-signing-key",
+}
+
+// newLocalDependencies returns the dependencies of the local mode: the key vault and the scale sets are simulated
+// in memory, and the state is kept in stateDir (in memory when empty). The backends scale set and the states are
+// created like terraform does, so that /deploy, /clusterize and /report can be called right away.
+func newLocalDependencies(ctx context.Context, cfg *config.Config, stateDir string) (common.StateStore, common.CloudProvider, error) {
+	var stateStore common.StateStore = common.NewMemoryStateStore()
+	if stateDir != "" {
+		stateStore = common.NewFileStateStore(stateDir)
+	}
+
+	cloudProvider := common.NewFakeCloudProvider()
+	for name, value := range localSecrets {
+		if err := cloudProvider.SetSecret(ctx, cfg.KeyVaultUri, name, value); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	stateParams := common.BlobObjParams{
+		StorageName:   cfg.StateStorageName,
+		ContainerName: cfg.StateContainerName,
+		BlobName:      cfg.StateBlobName,
+	}
+	state, err := common.ReadStateOrCreateNew(ctx, stateStore, stateParams, protocol.ClusterState{
+		InitialSize:          cfg.InitialClusterSize,
+		DesiredSize:          cfg.InitialClusterSize,
+		ClusterizationTarget: cfg.ClusterizationTarget,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create local state: %v", err)
+	}
+	// the simulated instances are recreated on restart, with the size of the persisted state
+	vmScaleSetName := common.GetVmScaleSetName(cfg.Prefix, cfg.ClusterName)
+	cloudProvider.AddScaleSet(cfg.SubscriptionId, cfg.ResourceGroupName, vmScaleSetName, false, state.DesiredSize)
+
+	if cfg.NfsVmssName != "" {
+		cloudProvider.AddScaleSet(cfg.SubscriptionId, cfg.ResourceGroupName, cfg.NfsVmssName, true, cfg.NfsProtocolGatewaysNum)
+		nfsStateParams := common.BlobObjParams{
+			StorageName:   cfg.StateStorageName,
+			ContainerName: cfg.NfsStateContainerName,
+			BlobName:      cfg.NfsStateBlobName,
+		}
+		_, err = common.ReadStateOrCreateNew(ctx, stateStore, nfsStateParams, protocol.ClusterState{
+			InitialSize:          cfg.NfsProtocolGatewaysNum,
+			DesiredSize:          cfg.NfsProtocolGatewaysNum,
+			ClusterizationTarget: cfg.NfsProtocolGatewaysNum,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot create local NFS state: %v", err)
+		}
+	}
+
+	instances, _ := cloudProvider.GetInstances(cfg.SubscriptionId, cfg.ResourceGroupName, vmScaleSetName)
+	for _, instance := range instances {
+		logger.Info().Msgf("simulated backend %s (%s)", instance.Name, instance.PrivateIp)
+	}
+	return stateStore, cloudProvider, nil
+}
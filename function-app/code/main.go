@@ -1,28 +1,52 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"weka-deployment/common"
+	"weka-deployment/config"
 	"weka-deployment/functions/clusterize"
 	"weka-deployment/functions/clusterize_finalization"
 	"weka-deployment/functions/debug"
 	"weka-deployment/functions/deploy"
 	"weka-deployment/functions/fetch"
+	"weka-deployment/functions/health"
 	"weka-deployment/functions/join_finalization"
+	"weka-deployment/functions/metrics"
 	"weka-deployment/functions/protect"
 	"weka-deployment/functions/report"
+	"weka-deployment/functions/reset"
 	"weka-deployment/functions/resize"
 	"weka-deployment/functions/scale_down"
 	"weka-deployment/functions/scale_up"
+	"weka-deployment/functions/state"
+	"weka-deployment/functions/state_export"
+	"weka-deployment/functions/state_import"
 	"weka-deployment/functions/status"
 	"weka-deployment/functions/terminate"
 	"weka-deployment/functions/transient"
+	"weka-deployment/functions/upgrade"
+	"weka-deployment/functions/vmss"
 
 	"github.com/weka/go-cloud-lib/logging"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
+// shutdownTimeout bounds the completion of the running invocations and the export of the remaining spans on SIGTERM
+const shutdownTimeout = 10 * time.Second
+
 var (
 	logger *logging.Logger
+
+	local    = flag.Bool("local", false, "run without the functions host: the cloud and the key vault are simulated in memory and the generated scripts call this server")
+	stateDir = flag.String("state-dir", "", "directory of the state in local mode, the state is kept in memory when empty")
 )
 
 func init() {
@@ -34,21 +58,120 @@ func main() {
 	if !exists {
 		customHandlerPort = "8080"
 	}
+	flag.Parse()
+
+	var (
+		cfg           *config.Config
+		stateStore    common.StateStore
+		cloudProvider common.CloudProvider
+		err           error
+	)
+	if *local {
+		cfg, err = config.LoadLocal(fmt.Sprintf("http://localhost:%s/", customHandlerPort))
+		if err != nil {
+			logger.Fatal().Err(err).Msg("cannot start local server")
+		}
+		configureCommon(cfg)
+		stateStore, cloudProvider, err = newLocalDependencies(context.Background(), cfg, *stateDir)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("cannot start local server")
+		}
+	} else {
+		cfg, err = config.Load()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("cannot start function app")
+		}
+		configureCommon(cfg)
+		stateStore = common.NewBlobStateStore()
+		cloudProvider = common.NewAzureCloudProvider()
+	}
+	tracerProvider := setupTracing(cfg)
+
 	mux := http.NewServeMux()
-	mux.Handle("/clusterize", logging.LoggingMiddleware(clusterize.Handler))
-	mux.Handle("/clusterize_finalization", logging.LoggingMiddleware(clusterize_finalization.Handler))
-	mux.Handle("/status", logging.LoggingMiddleware(status.Handler))
-	mux.Handle("/debug", logging.LoggingMiddleware(debug.Handler))
-	mux.Handle("/scale_up", logging.LoggingMiddleware(scale_up.Handler))
-	mux.Handle("/fetch", logging.LoggingMiddleware(fetch.Handler))
-	mux.Handle("/deploy", logging.LoggingMiddleware(deploy.Handler))
-	mux.Handle("/join_finalization", logging.LoggingMiddleware(join_finalization.Handler))
-	mux.Handle("/scale_down", logging.LoggingMiddleware(scale_down.Handler))
-	mux.Handle("/terminate", logging.LoggingMiddleware(terminate.Handler))
-	mux.Handle("/transient", logging.LoggingMiddleware(transient.Handler))
-	mux.Handle("/resize", logging.LoggingMiddleware(resize.Handler))
-	mux.Handle("/report", logging.LoggingMiddleware(report.Handler))
-	mux.Handle("/protect", logging.LoggingMiddleware(protect.Handler))
-	logger.Info().Msgf("Go server Listening on: %v", customHandlerPort)
-	logger.Fatal().Err(http.ListenAndServe(":"+customHandlerPort, mux)).Send()
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, logging.LoggingMiddleware(common.InvocationMiddleware(common.TracingMiddleware(common.DirectCallMiddleware(common.StateStoreMiddleware(stateStore, common.CloudProviderMiddleware(cloudProvider, config.Middleware(cfg, common.VmAuthMiddleware(cfg.KeyVaultUri, handler)))))))))
+	}
+	handle("/clusterize", clusterize.Handler)
+	handle("/clusterize_finalization", clusterize_finalization.Handler)
+	handle("/status", status.Handler)
+	handle("/debug", debug.Handler)
+	handle("/scale_up", scale_up.Handler)
+	handle("/fetch", fetch.Handler)
+	handle("/deploy", deploy.Handler)
+	handle("/join_finalization", join_finalization.Handler)
+	handle("/scale_down", scale_down.Handler)
+	handle("/terminate", terminate.Handler)
+	handle("/transient", transient.Handler)
+	handle("/resize", resize.Handler)
+	handle("/upgrade", upgrade.Handler)
+	handle("/vmss", vmss.Handler)
+	handle("/reset", reset.Handler)
+	handle("/report", report.Handler)
+	handle("/protect", protect.Handler)
+	handle("/state", state.Handler)
+	handle("/state_export", state_export.Handler)
+	handle("/state_import", state_import.Handler)
+	handle("/metrics", metrics.Handler)
+	handle("/healthz", health.HealthzHandler)
+	handle("/readyz", health.ReadyzHandler)
+	server := &http.Server{Addr: ":" + customHandlerPort, Handler: mux}
+	go func() {
+		logger.Info().Msgf("Go server Listening on: %v", customHandlerPort)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal().Err(err).Send()
+		}
+	}()
+
+	// the functions host stops the worker with SIGTERM
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-signalCtx.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn().Err(err).Msg("failed waiting for the running invocations")
+	}
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logger.Warn().Err(err).Msg("failed exporting the remaining traces")
+		}
+	}
+}
+
+// configureCommon applies the tuning settings of the common package, before any state write or Azure client creation
+func configureCommon(cfg *config.Config) {
+	common.SetStateHistoryRetention(cfg.StateHistoryRetention)
+	common.SetReportsLimits(common.ReportsLimits{PerHost: cfg.ReportsPerHostLimit, Total: cfg.ReportsTotalLimit})
+	common.SetClientOptions(common.NewClientOptions(common.RetryPolicy{
+		MaxAttempts: cfg.AzureRetryMaxAttempts,
+		BaseDelay:   time.Duration(cfg.AzureRetryBaseDelayMs) * time.Millisecond,
+		MaxDelay:    time.Duration(cfg.AzureRetryMaxDelaySeconds) * time.Second,
+	}))
+}
+
+func setupTracing(cfg *config.Config) *sdktrace.TracerProvider {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch cfg.TracesExporter {
+	case "otlp":
+		exporter, err = common.NewOtlpTraceExporter(context.Background(), cfg.OtlpEndpoint, cfg.OtlpHeaders)
+	case "file":
+		exporter, err = common.NewFileTraceExporter(cfg.TracesFile)
+	default:
+		return nil
+	}
+	if err != nil {
+		logger.Error().Err(err).Msgf("cannot create the %s trace exporter, tracing is disabled", cfg.TracesExporter)
+		return nil
+	}
+	provider := common.SetupTracing(exporter, map[string]string{
+		"service.name":      "weka-function-app",
+		"service.namespace": cfg.Prefix + "-" + cfg.ClusterName,
+		"faas.instance":     cfg.FunctionAppName,
+	})
+	logger.Info().Msgf("exporting traces with the %s exporter", cfg.TracesExporter)
+	return provider
 }
@@ -151,6 +151,20 @@ locals {
     POST_CLUSTER_CREATION_SCRIPT   = var.script_post_cluster_creation
     PRE_START_IO_SCRIPT            = var.script_pre_start_io
     DOWN_BACKENDS_REMOVAL_TIMEOUT  = var.debug_down_backends_removal_timeout
+    STATE_HISTORY_RETENTION        = var.state_history_retention
+    REPORTS_PER_HOST_LIMIT         = var.state_reports_per_host_limit
+    REPORTS_TOTAL_LIMIT            = var.state_reports_total_limit
+    AZURE_RETRY_MAX_ATTEMPTS       = var.azure_retry_max_attempts
+    AZURE_RETRY_BASE_DELAY_MS      = var.azure_retry_base_delay
+    AZURE_RETRY_MAX_DELAY_SECONDS  = var.azure_retry_max_delay
+    VM_TOKEN_TTL                   = var.vm_token_ttl
+    VM_BOOTSTRAP_TOKEN_TTL         = var.vm_bootstrap_token_ttl
+    ROLLING_UPGRADE_JOIN_TIMEOUT   = var.rolling_upgrade_join_timeout
+    SKU_MIGRATION_ENABLED          = var.sku_migration_enabled
+    SKU_MIGRATION_BATCH_SIZE       = var.sku_migration_batch_size
+    VMSS_UPDATE_APPROVAL_REQUIRED  = var.vmss_update_approval_required
+    CLUSTERIZATION_TIMEOUT         = var.clusterization_timeout
+    CLUSTERIZATION_MAX_REELECTIONS = var.clusterization_max_reelections
 
     https_only               = true
     FUNCTION_APP_EDIT_MODE   = "readonly"
@@ -181,6 +195,11 @@ locals {
     # init script inputs
     APT_REPO_SERVER = var.apt_repo_server
     CGROUPS_MODE    = var.weka_cgroups_mode
+    # tracing
+    TRACES_EXPORTER             = var.function_app_traces_exporter
+    OTEL_EXPORTER_OTLP_ENDPOINT = var.function_app_otlp_endpoint
+    OTEL_EXPORTER_OTLP_HEADERS  = var.function_app_otlp_headers
+    TRACES_FILE                 = var.function_app_traces_file
   }
 
   secured_storage_account_app_settings = {
@@ -118,3 +118,38 @@ resource "azurerm_key_vault_secret" "weka_deployment_password" {
   }
   depends_on = [azurerm_key_vault.key_vault, azurerm_key_vault_access_policy.key_vault_access_policy]
 }
+
+resource "random_password" "state_bundle_signing_key" {
+  length  = 64
+  special = false
+}
+
+# the key is set by terraform, so that the bundles exported by another deployment sharing the key can be imported
+resource "azurerm_key_vault_secret" "state_bundle_signing_key" {
+  name         = "state-bundle-signing-key"
+  value        = var.state_bundle_signing_key != "" ? var.state_bundle_signing_key : random_password.state_bundle_signing_key.result
+  key_vault_id = azurerm_key_vault.key_vault.id
+  tags         = merge(var.tags_map, { "weka_cluster" : var.cluster_name })
+  lifecycle {
+    ignore_changes = [tags]
+  }
+  depends_on = [azurerm_key_vault.key_vault, azurerm_key_vault_access_policy.key_vault_access_policy]
+}
+
+resource "random_password" "vm_token_signing_key" {
+  length  = 64
+  special = false
+}
+
+# the function app only reads the key: the VM tokens signed with a key created concurrently by another invocation
+# would be rejected
+resource "azurerm_key_vault_secret" "vm_token_signing_key" {
+  name         = "vm-token-signing-key"
+  value        = random_password.vm_token_signing_key.result
+  key_vault_id = azurerm_key_vault.key_vault.id
+  tags         = merge(var.tags_map, { "weka_cluster" : var.cluster_name })
+  lifecycle {
+    ignore_changes = [tags]
+  }
+  depends_on = [azurerm_key_vault.key_vault, azurerm_key_vault_access_policy.key_vault_access_policy]
+}
@@ -141,7 +141,15 @@ output "cluster_helper_commands" {
     get_status            = <<EOT
 function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
 # for weka status pass "status" instead of "progress"
+# to page through the progress reports archived out of the state add "archive_page": 0 (newest first)
+# for pending and failed vmss operations pass "operations"
 curl --fail https://${local.function_app_name}.azurewebsites.net/api/status?code=$function_key -H "Content-Type:application/json" -d '{"type": "progress"}'
+EOT
+    export_state          = <<EOT
+function_key=$(az functionapp keys list --name ${local.function_app_name} --resource-group ${local.resource_group_name} --subscription ${var.subscription_id} --query functionKeys -o tsv)
+# to import the bundle POST '{"bundle": <exported result>}' to /api/state/import, add "dry_run": true to validate only
+# without a bundle, '{"mode": "reconstruct"}' rebuilds the state from the live vmss instances
+curl --fail https://${local.function_app_name}.azurewebsites.net/api/state/export?code=$function_key > state_bundle.json
 EOT
     get_password          = "az keyvault secret show --vault-name ${local.key_vault_name} --name ${azurerm_key_vault_secret.weka_password_secret.name} | jq .value"
     resize_cluster        = local.resize_helper_command
@@ -395,6 +395,132 @@ variable "function_app_log_level" {
   }
 }
 
+variable "state_history_retention" {
+  type        = number
+  default     = 50
+  description = "Number of cluster state versions kept by the function app for rollback. Set to 0 to disable the state history."
+
+  validation {
+    condition     = var.state_history_retention >= 0
+    error_message = "state_history_retention must be a non-negative number."
+  }
+}
+
+variable "state_bundle_signing_key" {
+  type        = string
+  default     = ""
+  sensitive   = true
+  description = "Key signing the state bundles exported by the function app. Set the same key on deployments which import each other's bundles, e.g. for disaster recovery. A random key is generated when empty."
+}
+
+variable "state_reports_per_host_limit" {
+  type        = number
+  default     = 50
+  description = "Number of progress, error and debug reports kept in the cluster state per host, older reports are archived. Set to 0 for no limit."
+}
+
+variable "state_reports_total_limit" {
+  type        = number
+  default     = 1000
+  description = "Number of progress, error and debug reports kept in the cluster state per report type, older reports are archived. Set to 0 for no limit."
+}
+
+variable "azure_retry_max_attempts" {
+  type        = number
+  default     = 5
+  description = "Number of attempts of an Azure API call failing with throttling or a transient error, including the first attempt."
+}
+
+variable "azure_retry_base_delay" {
+  type        = number
+  default     = 1000
+  description = "Base delay in milliseconds of the exponential backoff between attempts of a failing Azure API call."
+}
+
+variable "azure_retry_max_delay" {
+  type        = number
+  default     = 60
+  description = "Maximal delay in seconds between attempts of a failing Azure API call. Calls asked to retry after a longer delay fail instead of waiting."
+}
+
+variable "function_app_traces_exporter" {
+  type        = string
+  default     = "none"
+  description = "Exporter of the function app traces: none, otlp (OTLP/HTTP to function_app_otlp_endpoint) or file (json spans appended to function_app_traces_file)."
+
+  validation {
+    condition     = contains(["none", "otlp", "file"], var.function_app_traces_exporter)
+    error_message = "Allowed values for the traces exporter are none, otlp and file."
+  }
+}
+
+variable "function_app_otlp_endpoint" {
+  type        = string
+  default     = ""
+  description = "OTLP/HTTP collector endpoint of the function app traces, used by the otlp traces exporter."
+}
+
+variable "function_app_otlp_headers" {
+  type        = string
+  default     = ""
+  sensitive   = true
+  description = "Headers of the requests to the OTLP collector, as comma separated key=value pairs (e.g. an authorization header)."
+}
+
+variable "function_app_traces_file" {
+  type        = string
+  default     = ""
+  description = "File the function app appends its traces to, used by the file traces exporter."
+}
+
+variable "vm_token_ttl" {
+  type        = string
+  default     = "6h"
+  description = "Lifetime of the tokens the function app issues to the deploy and clusterize scripts of a VM. Valid time units are s, m, h."
+}
+
+variable "vm_bootstrap_token_ttl" {
+  type        = string
+  default     = "168h"
+  description = "Lifetime of the bootstrap token held by the backends scale set custom data, the function app rotates it after half of its lifetime. Valid time units are s, m, h."
+}
+
+variable "rolling_upgrade_join_timeout" {
+  type        = string
+  default     = "2h"
+  description = "Time the rolling upgrade waits for the replacement of a backend to join the cluster before pausing itself. Valid time units are s, m, h."
+}
+
+variable "sku_migration_enabled" {
+  type        = bool
+  default     = false
+  description = "Migrate the backends to a new scale set when instance_type changes, instead of refusing the change."
+}
+
+variable "sku_migration_batch_size" {
+  type        = number
+  default     = 1
+  description = "Number of backends removed at once from the previous scale set by a SKU migration, at most protection_level - 1."
+}
+
+variable "vmss_update_approval_required" {
+  type        = bool
+  default     = false
+  description = "Record backends scale set config changes as plans which are only applied once approved through the vmss function."
+}
+
+variable "clusterization_timeout" {
+  type        = string
+  default     = "45m"
+  description = "Time without report after which the instance running the clusterization is replaced, 0 disables the replacement. Valid time units are s, m, h."
+}
+
+variable "clusterization_max_reelections" {
+  type        = number
+  default     = 3
+  description = "Maximum number of instances running the clusterization which are replaced when they stall."
+}
+
 variable "function_app_storage_account_prefix" {
   type        = string
   description = "Weka storage account name prefix"
@@ -13,5 +13,9 @@ terraform {
       source  = "hashicorp/local"
       version = "~>2.4.0"
     }
+    random = {
+      source  = "hashicorp/random"
+      version = "~>3.6.0"
+    }
   }
 }